@@ -0,0 +1,127 @@
+package mqtt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+// Allocation budgets for the hot encoding and decoding paths. If a change
+// makes one of these fail, either fix the regression or raise the budget
+// deliberately.
+//
+// Decoding with the default config allocates everything that the caller
+// then owns: the message, its topic and its payload. Keeping the decoding
+// of a PUBLISH within 2 allocations takes a config that reuses them; see
+// TestReusingDecodeAllocationBudget.
+func TestAllocationBudgets(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items at random in race builds")
+	}
+	publish := &Publish{TopicName: "a/b", Payload: BytesPayload{1, 2, 3}}
+	pubAck := &PubAck{MessageId: 0x1234}
+
+	tests := []struct {
+		Comment string
+		Msg     Message
+		// MaxEncodeAllocs is the budget for encoding Msg to ioutil.Discard.
+		MaxEncodeAllocs float64
+		// MaxDecodeAllocs is the budget for decoding Msg from a bytes.Reader.
+		MaxDecodeAllocs float64
+	}{
+		{
+			Comment:         "QoS 0 PUBLISH message",
+			Msg:             publish,
+			MaxEncodeAllocs: 0,
+			// The Publish, the topic bytes and string, the payload reader, and
+			// the payload and its interface value.
+			MaxDecodeAllocs: 6,
+		},
+		{
+			Comment:         "PUBACK message",
+			Msg:             pubAck,
+			MaxEncodeAllocs: 0,
+			// The PubAck.
+			MaxDecodeAllocs: 1,
+		},
+	}
+
+	for _, test := range tests {
+		if allocs := testing.AllocsPerRun(100, func() {
+			test.Msg.Encode(ioutil.Discard)
+		}); allocs > test.MaxEncodeAllocs {
+			t.Errorf("%s: Encoding made %v allocations, budget is %v", test.Comment, allocs, test.MaxEncodeAllocs)
+		}
+
+		// Appending to a preallocated slice never allocates.
+		appender := test.Msg.(interface {
+			AppendTo(b []byte) ([]byte, error)
+		})
+		scratch := make([]byte, 0, 64)
+		if allocs := testing.AllocsPerRun(100, func() {
+			appender.AppendTo(scratch[:0])
+		}); allocs > 0 {
+			t.Errorf("%s: Appending made %v allocations, budget is 0", test.Comment, allocs)
+		}
+
+		buf := new(bytes.Buffer)
+		if _, err := test.Msg.Encode(buf); err != nil {
+			t.Fatalf("%s: Unexpected error during encoding: %v", test.Comment, err)
+		}
+		encoded := buf.Bytes()
+		r := bytes.NewReader(encoded)
+		if allocs := testing.AllocsPerRun(100, func() {
+			r.Reset(encoded)
+			DecodeOneMessage(r, nil)
+		}); allocs > test.MaxDecodeAllocs {
+			t.Errorf("%s: Decoding made %v allocations, budget is %v", test.Comment, allocs, test.MaxDecodeAllocs)
+		}
+	}
+}
+
+// Decoding strings as ByteStrings saves allocating the topic, as its bytes
+// and as a string.
+func TestByteStringAllocationBudget(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items at random in race builds")
+	}
+	buf := new(bytes.Buffer)
+	if _, err := (&Publish{TopicName: "a/b", Payload: BytesPayload{1, 2, 3}}).Encode(buf); err != nil {
+		t.Fatalf("Unexpected error encoding: %v", err)
+	}
+	encoded := buf.Bytes()
+	config := &ByteStringDecoderConfig{}
+	r := bytes.NewReader(encoded)
+	if allocs := testing.AllocsPerRun(100, func() {
+		r.Reset(encoded)
+		DecodeOneMessage(r, config)
+	}); allocs > 4 {
+		t.Errorf("Decoding made %v allocations, budget is 4", allocs)
+	}
+}
+
+// Decoding into a MessagePool, with strings as ByteStrings, reuses the
+// Publish, its payload and the buffer for its topic.
+func TestReusingDecodeAllocationBudget(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items at random in race builds")
+	}
+	buf := new(bytes.Buffer)
+	if _, err := (&Publish{TopicName: "a/b", Payload: BytesPayload{1, 2, 3}}).Encode(buf); err != nil {
+		t.Fatalf("Unexpected error encoding: %v", err)
+	}
+	encoded := buf.Bytes()
+	pool := new(MessagePool)
+	config := &ByteStringDecoderConfig{DecoderConfig: pool}
+	r := bytes.NewReader(encoded)
+
+	// The payload reader.
+	const budget = 1
+	if allocs := testing.AllocsPerRun(100, func() {
+		r.Reset(encoded)
+		msg, _ := DecodeOneMessage(r, config)
+		pool.Release(msg)
+	}); allocs > budget {
+		t.Errorf("Decoding made %v allocations, budget is %v", allocs, budget)
+	}
+}
@@ -0,0 +1,480 @@
+package mqtt
+
+import (
+	"bytes"
+)
+
+// The Size and AppendTo methods give the MQTT v3.1/v3.1.1 encoding of a
+// message, exactly as written by its Encode method, without going through
+// an io.Writer. A hot publishing path can reuse one slice to encode each
+// message with no heap allocations:
+//
+//	buf, err = msg.AppendTo(buf[:0])
+//	if err != nil {
+//	  // handle err
+//	}
+//	conn.Write(buf)
+//
+// MQTT v5 messages (a Connect with ProtocolVersion 5, and Auth) are
+// supported, but are encoded through a temporary buffer.
+
+// encodedSize returns the size of a message with a body of the given size.
+func encodedSize(bodySize int) int {
+	return 1 + RemainingLengthSize(int32(bodySize)) + bodySize
+}
+
+// appendHeader appends the fixed header of a message with a body of the
+// given size.
+func appendHeader(b []byte, hdr *Header, msgType MessageType, bodySize int) (_ []byte, err error) {
+	if msgType != MsgPublish {
+		// A PUBLISH is counted once its payload is appended too.
+		defer func() {
+			if err != nil {
+				countEncode(msgType, 0, err)
+			} else {
+				countEncode(msgType, encodedSize(bodySize), nil)
+			}
+		}()
+	}
+
+	if int64(bodySize) > MaxPayloadSize {
+		return b, ErrMessageTooLong
+	}
+	if !hdr.QosLevel.IsValid() {
+		return b, ErrBadQos
+	}
+	if !msgType.IsValid() && msgType != MsgAuth {
+		return b, ErrBadMessageType
+	}
+
+	b = append(b, hdr.byte1(msgType))
+	return appendLength(b, int32(bodySize)), nil
+}
+
+func appendLength(b []byte, length int32) []byte {
+	for {
+		digit := byte(length & 0x7f)
+		length >>= 7
+		if length > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if length == 0 {
+			return b
+		}
+	}
+}
+
+func appendUint16(b []byte, val uint16) []byte {
+	return append(b, byte(val>>8), byte(val))
+}
+
+// appendString appends val, preceded by its length. val must be no longer
+// than 65535 bytes (see stringsTooLong).
+func appendString(b []byte, val string) []byte {
+	b = appendUint16(b, uint16(len(val)))
+	return append(b, val...)
+}
+
+// appendStringOrBytes appends val, or bs if val is empty and bs is not nil.
+func appendStringOrBytes(b []byte, val string, bs ByteString) []byte {
+	if val == "" && bs != nil {
+		b = appendUint16(b, uint16(len(bs)))
+		return append(b, bs...)
+	}
+	return appendString(b, val)
+}
+
+// stringsTooLong returns true if any of strs is too long for its length to
+// be appended.
+func stringsTooLong(strs ...string) bool {
+	for _, s := range strs {
+		if len(s) > 0xffff {
+			return true
+		}
+	}
+	return false
+}
+
+// lenStringOrBytes returns the length of the string that
+// appendStringOrBytes appends.
+func lenStringOrBytes(val string, bs ByteString) int {
+	if val == "" {
+		return len(bs)
+	}
+	return len(val)
+}
+
+// appendEncoded appends msg as written by its Encode method.
+func appendEncoded(b []byte, msg Message) ([]byte, error) {
+	buf := bytes.NewBuffer(b)
+	_, err := msg.Encode(buf)
+	return buf.Bytes(), err
+}
+
+// sizeEncoded returns the number of bytes written by the Encode method of
+// msg, or 0 if it cannot be encoded.
+func sizeEncoded(msg Message) int {
+	b, err := appendEncoded(nil, msg)
+	if err != nil {
+		return 0
+	}
+	return len(b)
+}
+
+// appendWriter is an io.Writer that appends to a slice.
+type appendWriter struct {
+	b []byte
+}
+
+func (w *appendWriter) Write(p []byte) (int, error) {
+	w.b = append(w.b, p...)
+	return len(p), nil
+}
+
+func (msg *Connect) bodySize() int {
+	n := 2 + len(msg.ProtocolName) + 1 + 1 + 2 + 2 + lenStringOrBytes(msg.ClientId, msg.ClientIdBytes)
+	if msg.WillFlag {
+		n += 2 + len(msg.WillTopic) + 2 + len(msg.WillMessage)
+	}
+	if msg.UsernameFlag {
+		n += 2 + len(msg.Username)
+	}
+	if msg.PasswordFlag {
+		n += 2 + len(msg.Password)
+	}
+	return n
+}
+
+// Size returns the number of bytes that Encode writes for msg.
+func (msg *Connect) Size() int {
+	if msg.ProtocolVersion == uint8(ProtocolV5) {
+		return sizeEncoded(msg)
+	}
+	return encodedSize(msg.bodySize())
+}
+
+// AppendTo appends the encoding of msg to b.
+func (msg *Connect) AppendTo(b []byte) ([]byte, error) {
+	if msg.ProtocolVersion == uint8(ProtocolV5) {
+		return appendEncoded(b, msg)
+	}
+	if !msg.WillQos.IsValid() {
+		return b, ErrBadWillQos
+	}
+	if msg.PasswordFlag && !msg.UsernameFlag {
+		return b, ErrPasswordNoUser
+	}
+	if stringsTooLong(msg.ProtocolName) || lenStringOrBytes(msg.ClientId, msg.ClientIdBytes) > 0xffff ||
+		msg.WillFlag && stringsTooLong(msg.WillTopic, msg.WillMessage) ||
+		msg.UsernameFlag && stringsTooLong(msg.Username) ||
+		msg.PasswordFlag && stringsTooLong(msg.Password) {
+		return b, ErrStringTooLong
+	}
+
+	orig := b
+	b, err := appendHeader(b, &msg.Header, MsgConnect, msg.bodySize())
+	if err != nil {
+		return orig, err
+	}
+
+	flags := boolToByte(msg.UsernameFlag) << 7
+	flags |= boolToByte(msg.PasswordFlag) << 6
+	flags |= boolToByte(msg.WillRetain) << 5
+	flags |= byte(msg.WillQos) << 3
+	flags |= boolToByte(msg.WillFlag) << 2
+	flags |= boolToByte(msg.CleanSession) << 1
+
+	b = appendString(b, msg.ProtocolName)
+	b = append(b, msg.ProtocolVersion, flags)
+	b = appendUint16(b, msg.KeepAliveTimer)
+	b = appendStringOrBytes(b, msg.ClientId, msg.ClientIdBytes)
+	if msg.WillFlag {
+		b = appendString(b, msg.WillTopic)
+		b = appendString(b, msg.WillMessage)
+	}
+	if msg.UsernameFlag {
+		b = appendString(b, msg.Username)
+	}
+	if msg.PasswordFlag {
+		b = appendString(b, msg.Password)
+	}
+	return b, nil
+}
+
+// Size returns the number of bytes that Encode writes for msg.
+func (msg *ConnAck) Size() int {
+	return encodedSize(2)
+}
+
+// AppendTo appends the encoding of msg to b.
+func (msg *ConnAck) AppendTo(b []byte) ([]byte, error) {
+	orig := b
+	b, err := appendHeader(b, &msg.Header, MsgConnAck, 2)
+	if err != nil {
+		return orig, err
+	}
+	return append(b, boolToByte(msg.SessionPresent), byte(msg.ReturnCode)), nil
+}
+
+func (msg *Publish) bodySize() int {
+	n := 2 + lenStringOrBytes(msg.TopicName, msg.TopicBytes) + msg.Payload.Size()
+	if msg.Header.QosLevel.HasId() {
+		n += 2
+	}
+	return n
+}
+
+// Size returns the number of bytes that Encode writes for msg.
+func (msg *Publish) Size() int {
+	return encodedSize(msg.bodySize())
+}
+
+// AppendTo appends the encoding of msg to b. A BytesPayload is appended
+// directly, and other payloads are appended through their WritePayload
+// method.
+func (msg *Publish) AppendTo(b []byte) (out []byte, err error) {
+	orig := b
+	defer func() {
+		countEncode(MsgPublish, len(out)-len(orig), err)
+	}()
+
+	if lenStringOrBytes(msg.TopicName, msg.TopicBytes) > 0xffff {
+		return orig, ErrStringTooLong
+	}
+	b, err = appendHeader(b, &msg.Header, MsgPublish, msg.bodySize())
+	if err != nil {
+		return orig, err
+	}
+
+	b = appendStringOrBytes(b, msg.TopicName, msg.TopicBytes)
+	if msg.Header.QosLevel.HasId() {
+		b = appendUint16(b, msg.MessageId)
+	}
+
+	if payload, ok := msg.Payload.(BytesPayload); ok {
+		return append(b, payload...), nil
+	}
+	w := &appendWriter{b}
+	if _, err := msg.Payload.WritePayload(w); err != nil {
+		return orig, err
+	}
+	return w.b, nil
+}
+
+// Size returns the number of bytes that Encode writes for msg.
+func (msg *PubAck) Size() int {
+	return encodedSize(2)
+}
+
+// AppendTo appends the encoding of msg to b.
+func (msg *PubAck) AppendTo(b []byte) ([]byte, error) {
+	return appendAckCommon(b, &msg.Header, msg.MessageId, MsgPubAck)
+}
+
+// Size returns the number of bytes that Encode writes for msg.
+func (msg *PubRec) Size() int {
+	return encodedSize(2)
+}
+
+// AppendTo appends the encoding of msg to b.
+func (msg *PubRec) AppendTo(b []byte) ([]byte, error) {
+	return appendAckCommon(b, &msg.Header, msg.MessageId, MsgPubRec)
+}
+
+// Size returns the number of bytes that Encode writes for msg.
+func (msg *PubRel) Size() int {
+	return encodedSize(2)
+}
+
+// AppendTo appends the encoding of msg to b.
+func (msg *PubRel) AppendTo(b []byte) ([]byte, error) {
+	return appendAckCommon(b, &msg.Header, msg.MessageId, MsgPubRel)
+}
+
+// Size returns the number of bytes that Encode writes for msg.
+func (msg *PubComp) Size() int {
+	return encodedSize(2)
+}
+
+// AppendTo appends the encoding of msg to b.
+func (msg *PubComp) AppendTo(b []byte) ([]byte, error) {
+	return appendAckCommon(b, &msg.Header, msg.MessageId, MsgPubComp)
+}
+
+func (msg *Subscribe) bodySize() int {
+	n := 0
+	if msg.Header.QosLevel.HasId() {
+		n += 2
+	}
+	for _, topic := range msg.Topics {
+		n += 2 + len(topic.Topic) + 1
+	}
+	return n
+}
+
+// Size returns the number of bytes that Encode writes for msg.
+func (msg *Subscribe) Size() int {
+	return encodedSize(msg.bodySize())
+}
+
+// AppendTo appends the encoding of msg to b.
+func (msg *Subscribe) AppendTo(b []byte) ([]byte, error) {
+	if len(msg.Topics) == 0 {
+		return b, ErrNoTopics
+	}
+	for _, topic := range msg.Topics {
+		if stringsTooLong(topic.Topic) {
+			return b, ErrStringTooLong
+		}
+	}
+
+	orig := b
+	b, err := appendHeader(b, &msg.Header, MsgSubscribe, msg.bodySize())
+	if err != nil {
+		return orig, err
+	}
+	if msg.Header.QosLevel.HasId() {
+		b = appendUint16(b, msg.MessageId)
+	}
+	for _, topic := range msg.Topics {
+		b = appendString(b, topic.Topic)
+		b = append(b, byte(topic.Qos))
+	}
+	return b, nil
+}
+
+// Size returns the number of bytes that Encode writes for msg.
+func (msg *SubAck) Size() int {
+	return encodedSize(2 + len(msg.TopicsQos))
+}
+
+// AppendTo appends the encoding of msg to b.
+func (msg *SubAck) AppendTo(b []byte) ([]byte, error) {
+	orig := b
+	b, err := appendHeader(b, &msg.Header, MsgSubAck, 2+len(msg.TopicsQos))
+	if err != nil {
+		return orig, err
+	}
+	b = appendUint16(b, msg.MessageId)
+	for _, qos := range msg.TopicsQos {
+		b = append(b, byte(qos))
+	}
+	return b, nil
+}
+
+func (msg *Unsubscribe) bodySize() int {
+	n := 0
+	if msg.Header.QosLevel.HasId() {
+		n += 2
+	}
+	for _, topic := range msg.Topics {
+		n += 2 + len(topic)
+	}
+	return n
+}
+
+// Size returns the number of bytes that Encode writes for msg.
+func (msg *Unsubscribe) Size() int {
+	return encodedSize(msg.bodySize())
+}
+
+// AppendTo appends the encoding of msg to b.
+func (msg *Unsubscribe) AppendTo(b []byte) ([]byte, error) {
+	if len(msg.Topics) == 0 {
+		return b, ErrNoTopics
+	}
+	if stringsTooLong(msg.Topics...) {
+		return b, ErrStringTooLong
+	}
+
+	orig := b
+	b, err := appendHeader(b, &msg.Header, MsgUnsubscribe, msg.bodySize())
+	if err != nil {
+		return orig, err
+	}
+	if msg.Header.QosLevel.HasId() {
+		b = appendUint16(b, msg.MessageId)
+	}
+	for _, topic := range msg.Topics {
+		b = appendString(b, topic)
+	}
+	return b, nil
+}
+
+// Size returns the number of bytes that Encode writes for msg.
+func (msg *UnsubAck) Size() int {
+	return encodedSize(2)
+}
+
+// AppendTo appends the encoding of msg to b.
+func (msg *UnsubAck) AppendTo(b []byte) ([]byte, error) {
+	return appendAckCommon(b, &msg.Header, msg.MessageId, MsgUnsubAck)
+}
+
+// Size returns the number of bytes that Encode writes for msg.
+func (msg *PingReq) Size() int {
+	return encodedSize(0)
+}
+
+// AppendTo appends the encoding of msg to b.
+func (msg *PingReq) AppendTo(b []byte) ([]byte, error) {
+	return appendHeader(b, &msg.Header, MsgPingReq, 0)
+}
+
+// Size returns the number of bytes that Encode writes for msg.
+func (msg *PingResp) Size() int {
+	return encodedSize(0)
+}
+
+// AppendTo appends the encoding of msg to b.
+func (msg *PingResp) AppendTo(b []byte) ([]byte, error) {
+	return appendHeader(b, &msg.Header, MsgPingResp, 0)
+}
+
+// Size returns the number of bytes that Encode writes for msg.
+func (msg *Disconnect) Size() int {
+	return encodedSize(0)
+}
+
+// AppendTo appends the encoding of msg to b.
+func (msg *Disconnect) AppendTo(b []byte) ([]byte, error) {
+	return appendHeader(b, &msg.Header, MsgDisconnect, 0)
+}
+
+// Size returns the number of bytes that Encode writes for msg.
+func (msg *Auth) Size() int {
+	return sizeEncoded(msg)
+}
+
+// AppendTo appends the encoding of msg to b.
+func (msg *Auth) AppendTo(b []byte) ([]byte, error) {
+	return appendEncoded(b, msg)
+}
+
+// Size returns the number of bytes that Encode writes for msg.
+func (msg *RawMessage) Size() int {
+	return encodedSize(len(msg.Body))
+}
+
+// AppendTo appends the encoding of msg to b.
+func (msg *RawMessage) AppendTo(b []byte) ([]byte, error) {
+	msgType := MessageType(msg.HeaderByte >> 4)
+	if int64(len(msg.Body)) > MaxPayloadSize {
+		countEncode(msgType, 0, ErrMessageTooLong)
+		return b, ErrMessageTooLong
+	}
+	countEncode(msgType, encodedSize(len(msg.Body)), nil)
+	b = append(b, msg.HeaderByte)
+	b = appendLength(b, int32(len(msg.Body)))
+	return append(b, msg.Body...), nil
+}
+
+func appendAckCommon(b []byte, hdr *Header, messageId uint16, msgType MessageType) ([]byte, error) {
+	orig := b
+	b, err := appendHeader(b, hdr, msgType, 2)
+	if err != nil {
+		return orig, err
+	}
+	return appendUint16(b, messageId), nil
+}
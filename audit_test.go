@@ -0,0 +1,12 @@
+//go:build audit
+
+package mqtt_test
+
+// The audit build runs the property tests for far longer, to back the
+// guarantee that the decoder never panics on arbitrary input:
+//
+//	go test -tags audit
+func init() {
+	quickConfig.MaxCount = 1000000
+	roundTripIterations = 1000000
+}
@@ -0,0 +1,48 @@
+package mqtt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+var benchPublish = &Publish{
+	Header:    Header{QosLevel: QosAtLeastOnce},
+	TopicName: "sensors/temperature/1",
+	MessageId: 0x1234,
+	Payload:   BytesPayload(bytes.Repeat([]byte{1}, 256)),
+}
+
+func BenchmarkPublishEncode(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		benchPublish.Encode(ioutil.Discard)
+	}
+}
+
+func BenchmarkPublishAppendTo(b *testing.B) {
+	b.ReportAllocs()
+	buf := make([]byte, 0, benchPublish.Size())
+	for i := 0; i < b.N; i++ {
+		buf, _ = benchPublish.AppendTo(buf[:0])
+	}
+}
+
+func BenchmarkPublishDecode(b *testing.B) {
+	b.ReportAllocs()
+	encoded, _ := benchPublish.AppendTo(nil)
+	r := bytes.NewReader(encoded)
+	for i := 0; i < b.N; i++ {
+		r.Reset(encoded)
+		DecodeOneMessage(r, nil)
+	}
+}
+
+func BenchmarkPubAckAppendTo(b *testing.B) {
+	b.ReportAllocs()
+	msg := &PubAck{MessageId: 0x1234}
+	buf := make([]byte, 0, msg.Size())
+	for i := 0; i < b.N; i++ {
+		buf, _ = msg.AppendTo(buf[:0])
+	}
+}
@@ -0,0 +1,233 @@
+package mqtt
+
+// MaxClientIdLength is the longest client identifier allowed by MQTT v3.1.
+const MaxClientIdLength = 23
+
+// PublishBuilder constructs a Publish message, checking at Build time that
+// the message is valid. For example:
+//
+//	msg, err := mqtt.NewPublish("a/b").QoS(mqtt.QosAtLeastOnce).MessageId(1).Payload(data).Build()
+type PublishBuilder struct {
+	msg Publish
+}
+
+// NewPublish starts building a QoS 0 Publish message with an empty payload.
+func NewPublish(topic string) *PublishBuilder {
+	return &PublishBuilder{msg: Publish{TopicName: topic}}
+}
+
+// QoS sets the QoS level of the message.
+func (b *PublishBuilder) QoS(qos QosLevel) *PublishBuilder {
+	b.msg.QosLevel = qos
+	return b
+}
+
+// MessageId sets the message id, which is required for QoS levels above 0.
+func (b *PublishBuilder) MessageId(id uint16) *PublishBuilder {
+	b.msg.MessageId = id
+	return b
+}
+
+// Retain sets the retain flag.
+func (b *PublishBuilder) Retain() *PublishBuilder {
+	b.msg.Retain = true
+	return b
+}
+
+// Dup sets the DUP flag, marking the message as a redelivery.
+func (b *PublishBuilder) Dup() *PublishBuilder {
+	b.msg.DupFlag = true
+	return b
+}
+
+// Payload sets the payload to the given bytes.
+func (b *PublishBuilder) Payload(data []byte) *PublishBuilder {
+	b.msg.Payload = BytesPayload(data)
+	return b
+}
+
+// PayloadFrom sets the payload to p, e.g a *StreamedPayload.
+func (b *PublishBuilder) PayloadFrom(p Payload) *PublishBuilder {
+	b.msg.Payload = p
+	return b
+}
+
+// Build returns the message, or an error if it is invalid.
+func (b *PublishBuilder) Build() (*Publish, error) {
+	msg := b.msg
+	if err := ValidateTopicName(msg.TopicName); err != nil {
+		return nil, err
+	}
+	if !msg.QosLevel.IsValid() || msg.QosLevel == QosRejected {
+		return nil, ErrBadQos
+	}
+	if msg.QosLevel.HasId() && msg.MessageId == 0 {
+		return nil, ErrMissingMessageId
+	}
+	if msg.Payload == nil {
+		msg.Payload = BytesPayload{}
+	}
+	return &msg, nil
+}
+
+// SubscribeBuilder constructs a Subscribe message, checking at Build time
+// that the message is valid.
+type SubscribeBuilder struct {
+	msg Subscribe
+}
+
+// NewSubscribe starts building a Subscribe message with the given message id.
+func NewSubscribe(id uint16) *SubscribeBuilder {
+	return &SubscribeBuilder{msg: Subscribe{
+		Header:    Header{QosLevel: QosAtLeastOnce},
+		MessageId: id,
+	}}
+}
+
+// Topic adds a topic filter to subscribe to with the given maximum QoS.
+func (b *SubscribeBuilder) Topic(filter string, qos QosLevel) *SubscribeBuilder {
+	b.msg.Topics = append(b.msg.Topics, TopicQos{Topic: filter, Qos: qos})
+	return b
+}
+
+// Build returns the message, or an error if it is invalid.
+func (b *SubscribeBuilder) Build() (*Subscribe, error) {
+	msg := b.msg
+	if msg.MessageId == 0 {
+		return nil, ErrMissingMessageId
+	}
+	if len(msg.Topics) == 0 {
+		return nil, ErrNoTopics
+	}
+	for _, topic := range msg.Topics {
+		if err := ValidateTopicFilter(topic.Topic); err != nil {
+			return nil, err
+		}
+		if !topic.Qos.IsValid() || topic.Qos == QosRejected {
+			return nil, ErrBadQos
+		}
+	}
+	msg.Topics = append([]TopicQos(nil), msg.Topics...)
+	return &msg, nil
+}
+
+// UnsubscribeBuilder constructs an Unsubscribe message, checking at Build
+// time that the message is valid.
+type UnsubscribeBuilder struct {
+	msg Unsubscribe
+}
+
+// NewUnsubscribe starts building an Unsubscribe message with the given
+// message id.
+func NewUnsubscribe(id uint16) *UnsubscribeBuilder {
+	return &UnsubscribeBuilder{msg: Unsubscribe{
+		Header:    Header{QosLevel: QosAtLeastOnce},
+		MessageId: id,
+	}}
+}
+
+// Topic adds a topic filter to unsubscribe from.
+func (b *UnsubscribeBuilder) Topic(filter string) *UnsubscribeBuilder {
+	b.msg.Topics = append(b.msg.Topics, filter)
+	return b
+}
+
+// Build returns the message, or an error if it is invalid.
+func (b *UnsubscribeBuilder) Build() (*Unsubscribe, error) {
+	msg := b.msg
+	if msg.MessageId == 0 {
+		return nil, ErrMissingMessageId
+	}
+	if len(msg.Topics) == 0 {
+		return nil, ErrNoTopics
+	}
+	for _, topic := range msg.Topics {
+		if err := ValidateTopicFilter(topic); err != nil {
+			return nil, err
+		}
+	}
+	msg.Topics = append([]string(nil), msg.Topics...)
+	return &msg, nil
+}
+
+// ConnectBuilder constructs a Connect message, checking at Build time that
+// the message is valid.
+type ConnectBuilder struct {
+	msg     Connect
+	version ProtocolVersion
+}
+
+// NewConnect starts building an MQTT v3.1 Connect message for the given
+// client id.
+func NewConnect(clientId string) *ConnectBuilder {
+	return &ConnectBuilder{
+		msg:     Connect{ClientId: clientId},
+		version: ProtocolV31,
+	}
+}
+
+// Version sets the protocol version to connect with.
+func (b *ConnectBuilder) Version(version ProtocolVersion) *ConnectBuilder {
+	b.version = version
+	return b
+}
+
+// KeepAlive sets the keep alive timer, in seconds.
+func (b *ConnectBuilder) KeepAlive(seconds uint16) *ConnectBuilder {
+	b.msg.KeepAliveTimer = seconds
+	return b
+}
+
+// CleanSession sets the clean session flag.
+func (b *ConnectBuilder) CleanSession() *ConnectBuilder {
+	b.msg.CleanSession = true
+	return b
+}
+
+// Will sets the will message that the server publishes if the client
+// disconnects unexpectedly.
+func (b *ConnectBuilder) Will(topic, message string, qos QosLevel, retain bool) *ConnectBuilder {
+	b.msg.WillFlag = true
+	b.msg.WillTopic = topic
+	b.msg.WillMessage = message
+	b.msg.WillQos = qos
+	b.msg.WillRetain = retain
+	return b
+}
+
+// Username sets the user name to authenticate with.
+func (b *ConnectBuilder) Username(username string) *ConnectBuilder {
+	b.msg.UsernameFlag = true
+	b.msg.Username = username
+	return b
+}
+
+// Credentials sets the user name and password to authenticate with.
+func (b *ConnectBuilder) Credentials(username, password string) *ConnectBuilder {
+	b.Username(username)
+	b.msg.PasswordFlag = true
+	b.msg.Password = password
+	return b
+}
+
+// Build returns the message, or an error if it is invalid.
+func (b *ConnectBuilder) Build() (*Connect, error) {
+	msg := b.msg
+	if !b.version.IsValid() {
+		return nil, ErrBadProtocol
+	}
+	msg.ProtocolName = b.version.ProtocolName()
+	msg.ProtocolVersion = uint8(b.version)
+	if !b.version.AcceptsClientId(msg.ClientId, msg.CleanSession) {
+		return nil, ErrBadClientId
+	}
+	if msg.WillFlag {
+		if err := ValidateTopicName(msg.WillTopic); err != nil {
+			return nil, err
+		}
+		if !msg.WillQos.IsValid() || msg.WillQos == QosRejected {
+			return nil, ErrBadWillQos
+		}
+	}
+	return &msg, nil
+}
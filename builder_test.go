@@ -0,0 +1,180 @@
+package mqtt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBuilders(t *testing.T) {
+	tests := []struct {
+		Comment     string
+		Build       func() (Message, error)
+		Expected    Message
+		ExpectError bool
+	}{
+		{
+			Comment: "QoS 1 PUBLISH",
+			Build: func() (Message, error) {
+				return NewPublish("a/b").QoS(QosAtLeastOnce).MessageId(7).Retain().Payload([]byte{1}).Build()
+			},
+			Expected: &Publish{
+				Header:    Header{QosLevel: QosAtLeastOnce, Retain: true},
+				TopicName: "a/b",
+				MessageId: 7,
+				Payload:   BytesPayload{1},
+			},
+		},
+		{
+			Comment: "PUBLISH with no payload",
+			Build: func() (Message, error) {
+				return NewPublish("a/b").Build()
+			},
+			Expected: &Publish{TopicName: "a/b", Payload: BytesPayload{}},
+		},
+		{
+			Comment: "PUBLISH with QoS 1 and no MessageId",
+			Build: func() (Message, error) {
+				return NewPublish("a/b").QoS(QosAtLeastOnce).Build()
+			},
+			ExpectError: true,
+		},
+		{
+			Comment: "PUBLISH with empty topic",
+			Build: func() (Message, error) {
+				return NewPublish("").Build()
+			},
+			ExpectError: true,
+		},
+		{
+			Comment: "PUBLISH with wildcard topic",
+			Build: func() (Message, error) {
+				return NewPublish("a/+").Build()
+			},
+			ExpectError: true,
+		},
+		{
+			Comment: "PUBLISH with rejected QoS",
+			Build: func() (Message, error) {
+				return NewPublish("a/b").QoS(QosRejected).MessageId(1).Build()
+			},
+			ExpectError: true,
+		},
+		{
+			Comment: "SUBSCRIBE",
+			Build: func() (Message, error) {
+				return NewSubscribe(3).Topic("a/+", QosAtMostOnce).Topic("b/#", QosExactlyOnce).Build()
+			},
+			Expected: &Subscribe{
+				Header:    Header{QosLevel: QosAtLeastOnce},
+				MessageId: 3,
+				Topics: []TopicQos{
+					{Topic: "a/+", Qos: QosAtMostOnce},
+					{Topic: "b/#", Qos: QosExactlyOnce},
+				},
+			},
+		},
+		{
+			Comment: "SUBSCRIBE with no topics",
+			Build: func() (Message, error) {
+				return NewSubscribe(3).Build()
+			},
+			ExpectError: true,
+		},
+		{
+			Comment: "SUBSCRIBE with # before the last level",
+			Build: func() (Message, error) {
+				return NewSubscribe(3).Topic("a/#/b", QosAtMostOnce).Build()
+			},
+			ExpectError: true,
+		},
+		{
+			Comment: "SUBSCRIBE with partial level wildcard",
+			Build: func() (Message, error) {
+				return NewSubscribe(3).Topic("a/b+", QosAtMostOnce).Build()
+			},
+			ExpectError: true,
+		},
+		{
+			Comment: "UNSUBSCRIBE",
+			Build: func() (Message, error) {
+				return NewUnsubscribe(4).Topic("a/+").Build()
+			},
+			Expected: &Unsubscribe{
+				Header:    Header{QosLevel: QosAtLeastOnce},
+				MessageId: 4,
+				Topics:    []string{"a/+"},
+			},
+		},
+		{
+			Comment: "UNSUBSCRIBE with no MessageId",
+			Build: func() (Message, error) {
+				return NewUnsubscribe(0).Topic("a/+").Build()
+			},
+			ExpectError: true,
+		},
+		{
+			Comment: "CONNECT",
+			Build: func() (Message, error) {
+				return NewConnect("client").KeepAlive(10).CleanSession().
+					Will("will/topic", "bye", QosAtLeastOnce, true).
+					Credentials("name", "pwd").Build()
+			},
+			Expected: &Connect{
+				ProtocolName:    "MQIsdp",
+				ProtocolVersion: 3,
+				KeepAliveTimer:  10,
+				CleanSession:    true,
+				ClientId:        "client",
+				WillFlag:        true,
+				WillTopic:       "will/topic",
+				WillMessage:     "bye",
+				WillQos:         QosAtLeastOnce,
+				WillRetain:      true,
+				UsernameFlag:    true,
+				Username:        "name",
+				PasswordFlag:    true,
+				Password:        "pwd",
+			},
+		},
+		{
+			Comment: "CONNECT with client id that is too long",
+			Build: func() (Message, error) {
+				return NewConnect("012345678901234567890123").Build()
+			},
+			ExpectError: true,
+		},
+		{
+			Comment: "CONNECT with wildcard will topic",
+			Build: func() (Message, error) {
+				return NewConnect("client").Will("will/#", "bye", QosAtMostOnce, false).Build()
+			},
+			ExpectError: true,
+		},
+		{
+			Comment: "CONNECT for 3.1.1 with empty client id",
+			Build: func() (Message, error) {
+				return NewConnect("").Version(ProtocolV311).CleanSession().Build()
+			},
+			Expected: &Connect{
+				ProtocolName:    "MQTT",
+				ProtocolVersion: 4,
+				CleanSession:    true,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		msg, err := test.Build()
+		if test.ExpectError {
+			if err == nil {
+				t.Errorf("%s: Expected error, but got nil.", test.Comment)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Unexpected error: %v", test.Comment, err)
+		} else if !reflect.DeepEqual(test.Expected, msg) {
+			t.Errorf("%s:\n     got = %#v\nexpected = %#v", test.Comment, msg, test.Expected)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package mqtt
+
+import (
+	"io"
+)
+
+// ByteString is a string decoded as a view into a buffer that is reused
+// (see ByteStringConfig), rather than as a newly allocated string.
+type ByteString []byte
+
+// Copy returns a copy of b that does not share its buffer, so that it can
+// be kept after the next message is decoded.
+func (b ByteString) Copy() ByteString {
+	if b == nil {
+		return nil
+	}
+	return append(ByteString{}, b...)
+}
+
+// String returns a copy of b as a string.
+func (b ByteString) String() string {
+	return string(b)
+}
+
+// ByteStringConfig can optionally be implemented by a DecoderConfig to
+// decode the topic names of PUBLISH messages into Publish.TopicBytes, and
+// the client ids of CONNECT messages into Connect.ClientIdBytes, as views
+// into a buffer that it provides. TopicName and ClientId are left empty.
+// This saves allocating a string for each message, for servers that only
+// look at the topic to route a message.
+//
+// The views are only valid until the buffer is reused, so they must be
+// copied (see ByteString.Copy) to keep them any longer. Messages decoded
+// this way are encoded with TopicBytes and ClientIdBytes, as long as
+// TopicName and ClientId are empty, and are checked by Validate; other
+// functions of the package look only at TopicName and ClientId.
+type ByteStringConfig interface {
+	// ByteStringBuffer returns a buffer of n bytes to decode a string into,
+	// which may reuse the memory of the buffers it returned before.
+	ByteStringBuffer(n int) []byte
+}
+
+func isByteStringConfig(config DecoderConfig) bool {
+	_, ok := config.(ByteStringConfig)
+	return ok
+}
+
+// ByteStringDecoderConfig decodes strings as ByteStrings (see
+// ByteStringConfig) into a single buffer, which it reuses for each message.
+// A ByteString it decodes is valid until the next message is decoded, so
+// it must not be shared between connections that are decoded concurrently.
+type ByteStringDecoderConfig struct {
+	// DecoderConfig makes the payloads of Publish messages. nil indicates
+	// that the DefaultDecoderConfig should be used.
+	DecoderConfig DecoderConfig
+
+	buf []byte
+}
+
+func (c *ByteStringDecoderConfig) Unwrap() DecoderConfig {
+	return c.DecoderConfig
+}
+
+func (c *ByteStringDecoderConfig) MakePayload(msg *Publish, r io.Reader, n int) (Payload, error) {
+	if c.DecoderConfig == nil {
+		return DefaultDecoderConfig{}.MakePayload(msg, r, n)
+	}
+	return c.DecoderConfig.MakePayload(msg, r, n)
+}
+
+func (c *ByteStringDecoderConfig) ByteStringBuffer(n int) []byte {
+	if cap(c.buf) < n {
+		c.buf = make([]byte, n)
+	}
+	return c.buf[:n]
+}
@@ -0,0 +1,94 @@
+package mqtt
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestByteStringDecoderConfig(t *testing.T) {
+	var stream bytes.Buffer
+	codec := &Codec{Version: ProtocolV311}
+	msgs := []Message{
+		&Connect{ClientId: "client-1", CleanSession: true},
+		&Publish{TopicName: "a/b", Payload: BytesPayload{1}},
+		&Publish{TopicName: "c/d", Payload: BytesPayload{2}},
+	}
+	for _, msg := range msgs {
+		if _, err := codec.Encode(&stream, msg); err != nil {
+			t.Fatalf("Unexpected error encoding %T: %v", msg, err)
+		}
+	}
+	encoded := append([]byte(nil), stream.Bytes()...)
+
+	config := &ByteStringDecoderConfig{}
+	decoder := &Codec{Version: ProtocolV311, DecoderConfig: config}
+	var decoded []Message
+	for i := range msgs {
+		msg, err := decoder.Decode(&stream)
+		if err != nil {
+			t.Fatalf("Message %d: Unexpected error decoding: %v", i, err)
+		}
+		decoded = append(decoded, msg)
+	}
+
+	connect := decoded[0].(*Connect)
+	if connect.ClientId != "" || connect.ClientIdBytes == nil {
+		t.Errorf("Decoded client id %q, bytes %q", connect.ClientId, connect.ClientIdBytes)
+	}
+	first, second := decoded[1].(*Publish), decoded[2].(*Publish)
+	if first.TopicName != "" || second.TopicBytes.String() != "c/d" {
+		t.Errorf("Decoded topics %q and %q", first.TopicName, second.TopicBytes)
+	}
+	// The buffer is reused, so only a copy of a ByteString outlives the next
+	// message.
+	if first.TopicBytes.String() != "c/d" {
+		t.Errorf("First topic is %q, expected the buffer to have been reused", first.TopicBytes)
+	}
+	kept := second.TopicBytes.Copy()
+	config.ByteStringBuffer(3)[0] = 'x'
+	if kept.String() != "c/d" || second.TopicBytes.String() != "x/d" {
+		t.Errorf("Got copy %q and view %q", kept, second.TopicBytes)
+	}
+
+	// ByteStrings are encoded in place of empty strings.
+	var reencoded []byte
+	for i, msg := range []Message{
+		&Connect{ProtocolName: "MQTT", ProtocolVersion: 4, ClientIdBytes: ByteString("client-1"), CleanSession: true},
+		&Publish{TopicBytes: ByteString("a/b"), Payload: BytesPayload{1}},
+		&Publish{TopicBytes: ByteString("c/d"), Payload: BytesPayload{2}},
+	} {
+		var buf bytes.Buffer
+		if _, err := codec.Encode(&buf, msg); err != nil {
+			t.Fatalf("Message %d: Unexpected error encoding: %v", i, err)
+		}
+		appended, err := msg.(interface {
+			AppendTo(b []byte) ([]byte, error)
+		}).AppendTo(nil)
+		if err != nil || !bytes.Equal(appended, buf.Bytes()) {
+			t.Errorf("Message %d: Appended %x, %v; encoded %x", i, appended, err, buf.Bytes())
+		}
+		reencoded = append(reencoded, buf.Bytes()...)
+	}
+	if !bytes.Equal(reencoded, encoded) {
+		t.Errorf("Encoded %x, expected %x", reencoded, encoded)
+	}
+}
+
+func TestValidateByteStrings(t *testing.T) {
+	tests := []struct {
+		Comment  string
+		Msg      Message
+		Expected error
+	}{
+		{"Topic bytes", &Publish{TopicBytes: ByteString("a/b")}, nil},
+		{"Wildcard in topic bytes", &Publish{TopicBytes: ByteString("a/+")}, ErrWildcardTopic},
+		{"Invalid UTF-8 in topic bytes", &Publish{TopicBytes: ByteString{'a', 0xff}}, ErrBadString},
+		{"Client id bytes", &Connect{ClientIdBytes: ByteString("c")}, nil},
+		{"U+0000 in client id bytes", &Connect{ClientIdBytes: ByteString{'c', 0}}, ErrBadString},
+	}
+	for _, test := range tests {
+		if err := Validate(test.Msg); err != test.Expected {
+			t.Errorf("%s: Got %v, expected %v", test.Comment, err, test.Expected)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+)
+
+// ChecksumSize is the number of bytes that a ChecksummedPayload adds to the
+// payload that it wraps.
+const ChecksumSize = 4
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ChecksummedPayload wraps a payload with a CRC-32C (Castagnoli) checksum,
+// which is appended to it as 4 big-endian bytes. It is for links without
+// integrity checks of their own (e.g a serial line), where a corrupted
+// payload would otherwise be delivered. Decoding with a
+// ChecksumDecoderConfig verifies the checksum.
+type ChecksummedPayload struct {
+	Payload Payload
+}
+
+func (p *ChecksummedPayload) Size() int {
+	return p.Payload.Size() + ChecksumSize
+}
+
+func (p *ChecksummedPayload) WritePayload(w io.Writer) (int, error) {
+	cw := &crcWriter{w: w}
+	n, err := p.Payload.WritePayload(cw)
+	if err != nil {
+		return n, err
+	}
+	var sum [ChecksumSize]byte
+	binary.BigEndian.PutUint32(sum[:], cw.crc)
+	m, err := w.Write(sum[:])
+	return n + m, err
+}
+
+// ReadPayload reads the wrapped payload from r, then the checksum, which
+// must match. ErrBadChecksum is returned if it does not.
+func (p *ChecksummedPayload) ReadPayload(r io.Reader) error {
+	tr := &trailerReader{r: r}
+	if err := p.Payload.ReadPayload(tr); err != nil {
+		return err
+	}
+	// Any payload bytes that the wrapped payload did not read still count.
+	if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+		return err
+	}
+	if len(tr.held) != ChecksumSize {
+		return io.ErrUnexpectedEOF
+	}
+	if binary.BigEndian.Uint32(tr.held) != tr.crc {
+		return ErrBadChecksum
+	}
+	return nil
+}
+
+// ChecksumDecoderConfig decodes every Publish payload as a
+// *ChecksummedPayload, so that its checksum is verified. A payload that is
+// too short to hold a checksum, or whose checksum does not match, fails to
+// decode.
+type ChecksumDecoderConfig struct {
+	// DecoderConfig makes the payloads that are wrapped, and is passed the
+	// size of the payload without its checksum. nil indicates that the
+	// DefaultDecoderConfig should be used.
+	DecoderConfig DecoderConfig
+}
+
+func (c *ChecksumDecoderConfig) Unwrap() DecoderConfig {
+	return c.DecoderConfig
+}
+
+func (c *ChecksumDecoderConfig) MakePayload(msg *Publish, r io.Reader, n int) (Payload, error) {
+	if n < ChecksumSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	config := c.DecoderConfig
+	if config == nil {
+		config = DefaultDecoderConfig{}
+	}
+	payload, err := config.MakePayload(msg, r, n-ChecksumSize)
+	if err != nil {
+		return nil, err
+	}
+	return &ChecksummedPayload{Payload: payload}, nil
+}
+
+// crcWriter computes the CRC-32C of what is written through it.
+type crcWriter struct {
+	w   io.Writer
+	crc uint32
+}
+
+func (c *crcWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.crc = crc32.Update(c.crc, castagnoliTable, b[:n])
+	return n, err
+}
+
+// trailerReader reads r, holding back its last ChecksumSize bytes, which are
+// left in held at EOF. It computes the CRC-32C of the bytes that it returns.
+type trailerReader struct {
+	r    io.Reader
+	held []byte
+	eof  bool
+	crc  uint32
+	buf  [4096]byte
+}
+
+func (t *trailerReader) Read(p []byte) (int, error) {
+	for len(t.held) <= ChecksumSize {
+		if t.eof {
+			return 0, io.EOF
+		}
+		n, err := t.r.Read(t.buf[:])
+		t.held = append(t.held, t.buf[:n]...)
+		if err == io.EOF {
+			t.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, t.held[:len(t.held)-ChecksumSize])
+	t.crc = crc32.Update(t.crc, castagnoliTable, p[:n])
+	t.held = append(t.held[:0], t.held[n:]...)
+	return n, nil
+}
@@ -0,0 +1,78 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"testing"
+)
+
+func TestChecksummedPayload(t *testing.T) {
+	data := bytes.Repeat([]byte("payload"), 2000)
+	msg := &Publish{TopicName: "a", Payload: &ChecksummedPayload{Payload: BytesPayload(data)}}
+	buf := new(bytes.Buffer)
+	if _, err := msg.Encode(buf); err != nil {
+		t.Fatalf("Unexpected error during encoding: %v", err)
+	}
+	encoded := buf.Bytes()
+	if sum := binary.BigEndian.Uint32(encoded[len(encoded)-ChecksumSize:]); sum != crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)) {
+		t.Errorf("Checksum is %#x, expected the CRC-32C of the payload", sum)
+	}
+	if expected := msg.Payload.Size(); expected != len(data)+ChecksumSize {
+		t.Errorf("Size is %d, expected %d", expected, len(data)+ChecksumSize)
+	}
+
+	config := &ChecksumDecoderConfig{}
+	decoded, err := DecodeOneMessage(bytes.NewReader(encoded), config)
+	if err != nil {
+		t.Fatalf("Unexpected error during decoding: %v", err)
+	}
+	payload, ok := decoded.(*Publish).Payload.(*ChecksummedPayload)
+	if !ok {
+		t.Fatalf("Expected *ChecksummedPayload, got %T", decoded.(*Publish).Payload)
+	}
+	if !bytes.Equal(data, payload.Payload.(BytesPayload)) {
+		t.Errorf("Decoded payload differs")
+	}
+
+	// Corrupting the payload or the checksum is detected.
+	for _, i := range []int{10, len(encoded) - 1} {
+		corrupted := append([]byte(nil), encoded...)
+		corrupted[i] ^= 0x40
+		if _, err := DecodeOneMessage(bytes.NewReader(corrupted), config); !errors.Is(err, ErrBadChecksum) {
+			t.Errorf("Byte %d corrupted: got %v, expected ErrBadChecksum", i, err)
+		}
+	}
+
+	// A payload too short to hold a checksum.
+	buf.Reset()
+	(&Publish{TopicName: "a", Payload: BytesPayload{1, 2}}).Encode(buf)
+	if _, err := DecodeOneMessage(buf, config); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Short payload: got %v, expected io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestChecksumDecoderConfigKeepsConfig(t *testing.T) {
+	msg := &Publish{
+		Header:    Header{DupFlag: true},
+		TopicName: "a",
+		Payload:   &ChecksummedPayload{Payload: BytesPayload("data")},
+	}
+	buf := new(bytes.Buffer)
+	if _, err := msg.Encode(buf); err != nil {
+		t.Fatalf("Unexpected error during encoding: %v", err)
+	}
+	encoded := buf.Bytes()
+
+	config := &ChecksumDecoderConfig{DecoderConfig: StrictDecoderConfig{}}
+	if _, err := DecodeOneMessage(bytes.NewReader(encoded), config); !errors.Is(err, ErrBadDupFlag) {
+		t.Errorf("Got %v, expected ErrBadDupFlag", err)
+	}
+	config = &ChecksumDecoderConfig{DecoderConfig: &PacketLimitConfig{MaxPacketSize: len(encoded) - 1}}
+	var tooLarge *PacketTooLargeError
+	if _, err := DecodeOneMessage(bytes.NewReader(encoded), config); !errors.As(err, &tooLarge) {
+		t.Errorf("Got %v, expected a *PacketTooLargeError", err)
+	}
+}
@@ -0,0 +1,766 @@
+package mqtt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ClientOptions configures a Client.
+type ClientOptions struct {
+	// Version is the protocol version to connect with. The zero value means
+	// ProtocolV31.
+	Version ProtocolVersion
+
+	ClientId     string
+	CleanSession bool
+	// KeepAlive is sent in CONNECT, in seconds. When the Client has sent
+	// nothing else for that long, it sends PINGREQ, and closes the
+	// connection with ErrKeepaliveTimeout if the PINGRESP does not arrive
+	// within the same time. A v5 server may replace it in CONNACK. Zero
+	// turns the keep alive off.
+	KeepAlive uint16
+
+	// Username and Password are sent in CONNECT if not empty.
+	Username, Password string
+
+	// Will, if not nil, is the message that the server publishes if the
+	// client disconnects without sending DISCONNECT. Its Payload must be a
+	// BytesPayload.
+	Will *Publish
+
+	// OnMessage is called for each PUBLISH received from the server, in the
+	// order in which they arrive. QoS 1 and 2 messages are acknowledged after
+	// it returns. It must not block on calls to the Client that wait for a
+	// reply, as replies are read by the goroutine that calls it.
+	OnMessage func(msg *Publish)
+
+	// DecoderConfig is used to decode messages from the server. nil
+	// indicates that the DefaultDecoderConfig should be used.
+	DecoderConfig DecoderConfig
+
+	// SessionStore, if not nil, stores the session under ClientId. When
+	// connecting with CleanSession false, the stored session is resumed:
+	// messages that were in flight are sent again, and QoS 2 messages that
+	// were already received are not passed to OnMessage again. If the
+	// server has lost the session, the stored one is deleted, and its
+	// subscriptions are sent to the server again. When connecting with
+	// CleanSession true, the stored session is deleted.
+	SessionStore SessionStore
+}
+
+// ConnectRefusedError is returned by Client.Connect when the server refuses
+// the connection.
+type ConnectRefusedError struct {
+	ReturnCode ReturnCode
+}
+
+func (e *ConnectRefusedError) Error() string {
+	return fmt.Sprintf("mqtt: connection refused with return code %d", e.ReturnCode)
+}
+
+// DisconnectError is the reason that a Client's connection ended when an
+// MQTT v5 server sent DISCONNECT.
+type DisconnectError struct {
+	ReasonCode ReasonCode
+	Properties Properties
+}
+
+func (e *DisconnectError) Error() string {
+	if reason, ok := e.Properties.Get(PropReasonString); ok {
+		return fmt.Sprintf("mqtt: disconnected by the server with reason code %#02x: %v", uint8(e.ReasonCode), reason)
+	}
+	return fmt.Sprintf("mqtt: disconnected by the server with reason code %#02x", uint8(e.ReasonCode))
+}
+
+// Capabilities describes what a connection allows, as settled by CONNECT and
+// CONNACK. Servers before MQTT v5 cannot declare limits, so for them the
+// protocol's own limits apply.
+type Capabilities struct {
+	Version        ProtocolVersion
+	SessionPresent bool
+	// ClientId is the client id assigned by an MQTT v5 server, or else the
+	// one that the client connected with.
+	ClientId string
+	// KeepAlive is the keep alive in seconds that the server asked for, or
+	// else the one that the client connected with.
+	KeepAlive uint16
+
+	// MaximumQos is the highest QoS that the server accepts in PUBLISH.
+	MaximumQos QosLevel
+	// RetainAvailable is false if the server does not accept retained
+	// messages.
+	RetainAvailable bool
+	// WildcardSubAvailable, SubscriptionIdAvailable and SharedSubAvailable
+	// are false if the server does not support the feature.
+	WildcardSubAvailable, SubscriptionIdAvailable, SharedSubAvailable bool
+	// ReceiveMaximum is the number of QoS 1 and 2 messages that the server
+	// will handle at once.
+	ReceiveMaximum uint16
+	// TopicAliasMaximum is the highest topic alias that the server accepts,
+	// or 0 if it accepts none.
+	TopicAliasMaximum uint16
+	// MaxPacketSize is the size of the largest packet that the server
+	// accepts, or 0 if it only has the protocol's limit.
+	MaxPacketSize int
+
+	// MaxReceivePacketSize is the size of the largest PUBLISH that the
+	// client decodes, set by a DecoderConfig that implements
+	// PacketSizeLimiter, or 0 if there is no limit.
+	MaxReceivePacketSize int
+}
+
+// newCapabilities returns the Capabilities of a connection made with opts,
+// and accepted with ack.
+func newCapabilities(opts ClientOptions, ack *ConnAck) Capabilities {
+	caps := Capabilities{
+		Version:                 opts.Version,
+		SessionPresent:          ack.SessionPresent,
+		ClientId:                opts.ClientId,
+		KeepAlive:               opts.KeepAlive,
+		MaximumQos:              QosExactlyOnce,
+		RetainAvailable:         true,
+		WildcardSubAvailable:    true,
+		SubscriptionIdAvailable: opts.Version == ProtocolV5,
+		SharedSubAvailable:      opts.Version == ProtocolV5,
+		ReceiveMaximum:          0xffff,
+	}
+	caps.MaxReceivePacketSize = packetSizeLimit(opts.DecoderConfig, MsgPublish)
+
+	for _, prop := range ack.Properties {
+		switch value := prop.Value.(type) {
+		case uint8:
+			switch prop.Id {
+			case PropMaximumQos:
+				caps.MaximumQos = QosLevel(value)
+			case PropRetainAvailable:
+				caps.RetainAvailable = value != 0
+			case PropWildcardSubAvailable:
+				caps.WildcardSubAvailable = value != 0
+			case PropSubscriptionIdAvailable:
+				caps.SubscriptionIdAvailable = value != 0
+			case PropSharedSubAvailable:
+				caps.SharedSubAvailable = value != 0
+			}
+		case uint16:
+			switch prop.Id {
+			case PropServerKeepAlive:
+				caps.KeepAlive = value
+			case PropReceiveMaximum:
+				caps.ReceiveMaximum = value
+			case PropTopicAliasMaximum:
+				caps.TopicAliasMaximum = value
+			}
+		case uint32:
+			if prop.Id == PropMaximumPacketSize {
+				caps.MaxPacketSize = int(value)
+			}
+		case string:
+			if prop.Id == PropAssignedClientId {
+				caps.ClientId = value
+			}
+		}
+	}
+	return caps
+}
+
+// Client is an MQTT client on a single connection. It correlates replies
+// with requests, so that its methods return once the server has
+// acknowledged them, and handles the acknowledgement of messages that the
+// server publishes to it. Its methods may be called from several
+// goroutines.
+//
+// An MQTT v5 server that sends DISCONNECT ends the connection with a
+// *DisconnectError. MQTT v5 enhanced authentication is not supported: an
+// AUTH from the server ends the connection with ErrUnexpectedMessage.
+type Client struct {
+	conn      io.ReadWriteCloser
+	keepalive *Keepalive
+	codec     *Codec
+	opts      ClientOptions
+	store     SessionStore // nil unless the session is kept.
+
+	writeMu sync.Mutex
+
+	mu        sync.Mutex
+	connAck   chan *ConnAck
+	pending   map[pendingKey]chan Message
+	ids       MessageIdPool
+	caps      Capabilities
+	inbound   map[uint16]bool // QoS 2 message ids awaiting PUBREL.
+	started   bool
+	counted   bool // Whether the client is counted in DebugStats.OpenClients.
+	done      chan struct{}
+	err       error
+	closeOnce sync.Once
+}
+
+// pendingKey identifies a reply that a request is waiting for.
+type pendingKey struct {
+	msgType   MessageType
+	messageId uint16
+}
+
+// NewClient creates a Client that talks to a server over conn. Call Connect
+// before anything else.
+func NewClient(conn io.ReadWriteCloser, opts ClientOptions) *Client {
+	if opts.Version == 0 {
+		opts.Version = ProtocolV31
+	}
+	keepalive := NewKeepalive(conn, KeepaliveClient)
+	var store SessionStore
+	if !opts.CleanSession {
+		store = opts.SessionStore
+	}
+	return &Client{
+		store:     store,
+		conn:      keepalive,
+		keepalive: keepalive,
+		codec:     &Codec{Version: opts.Version, DecoderConfig: opts.DecoderConfig},
+		opts:      opts,
+		connAck:   make(chan *ConnAck, 1),
+		pending:   make(map[pendingKey]chan Message),
+		inbound:   make(map[uint16]bool),
+		done:      make(chan struct{}),
+	}
+}
+
+// Connect sends CONNECT, and waits for the server's CONNACK. A
+// *ConnectRefusedError is returned if the server refuses the connection.
+func (c *Client) Connect() (*ConnAck, error) {
+	msg := &Connect{
+		ProtocolName:    c.opts.Version.ProtocolName(),
+		ProtocolVersion: uint8(c.opts.Version),
+		ClientId:        c.opts.ClientId,
+		CleanSession:    c.opts.CleanSession,
+		KeepAliveTimer:  c.opts.KeepAlive,
+	}
+	if c.opts.Username != "" {
+		msg.UsernameFlag, msg.Username = true, c.opts.Username
+	}
+	if c.opts.Password != "" {
+		msg.PasswordFlag, msg.Password = true, c.opts.Password
+	}
+	if will := c.opts.Will; will != nil {
+		payload, ok := will.Payload.(BytesPayload)
+		if !ok {
+			return nil, fmt.Errorf("mqtt: will payload must be a BytesPayload, got %T", will.Payload)
+		}
+		msg.WillFlag = true
+		msg.WillTopic = will.TopicName
+		msg.WillMessage = string(payload)
+		msg.WillQos = will.QosLevel
+		msg.WillRetain = will.Retain
+	}
+
+	c.mu.Lock()
+	if c.started {
+		c.mu.Unlock()
+		return nil, ErrAlreadyConnected
+	}
+	c.started = true
+	c.counted = debugStart(&debugCounters.openClients)
+	c.mu.Unlock()
+
+	var session *Session
+	if c.opts.SessionStore != nil {
+		var err error
+		if c.opts.CleanSession {
+			err = c.opts.SessionStore.Delete(c.opts.ClientId)
+		} else {
+			session, err = c.opts.SessionStore.Get(c.opts.ClientId)
+		}
+		if err != nil {
+			c.close(err)
+			return nil, err
+		}
+	}
+
+	if err := c.send(msg); err != nil {
+		c.close(err)
+		return nil, err
+	}
+	go c.readLoop()
+
+	select {
+	case ack := <-c.connAck:
+		if ack.ReturnCode != RetCodeAccepted {
+			err := &ConnectRefusedError{ack.ReturnCode}
+			c.close(err)
+			return ack, err
+		}
+		c.mu.Lock()
+		c.caps = newCapabilities(c.opts, ack)
+		keepAlive := c.caps.KeepAlive
+		c.mu.Unlock()
+		c.keepalive.Start(time.Duration(keepAlive) * time.Second)
+		if session != nil {
+			if err := c.resume(session, ack.SessionPresent); err != nil {
+				c.close(err)
+				return ack, err
+			}
+		}
+		return ack, nil
+	case <-c.done:
+		return nil, c.Err()
+	}
+}
+
+// Publish publishes a message, and waits until the server has acknowledged
+// it according to its QoS: not at all for QoS 0, PUBACK for QoS 1, and
+// PUBCOMP for QoS 2.
+func (c *Client) Publish(topic string, payload []byte, qos QosLevel, retain bool) error {
+	msg := &Publish{
+		Header:    Header{QosLevel: qos, Retain: retain},
+		TopicName: topic,
+		Payload:   BytesPayload(payload),
+	}
+
+	switch qos {
+	case QosAtMostOnce:
+		return c.send(msg)
+	case QosAtLeastOnce:
+		_, err := c.request(msg, &msg.MessageId, MsgPubAck)
+		return err
+	case QosExactlyOnce:
+		// The PUBCOMP is expected from the start, to keep the message id in
+		// use between PUBREC and PUBREL.
+		if _, err := c.request(msg, &msg.MessageId, MsgPubRec, MsgPubComp); err != nil {
+			c.forget(pendingKey{MsgPubComp, msg.MessageId})
+			return err
+		}
+		rel := &PubRel{Header: Header{QosLevel: QosAtLeastOnce}, MessageId: msg.MessageId}
+		_, err := c.wait(rel, pendingKey{MsgPubComp, msg.MessageId})
+		return err
+	}
+	return ErrBadQos
+}
+
+// Subscribe subscribes to topics, and returns the QoS granted for each of
+// them by the server, which is QosRejected for topics that were refused.
+func (c *Client) Subscribe(topics ...TopicQos) ([]QosLevel, error) {
+	msg := &Subscribe{
+		Header: Header{QosLevel: QosAtLeastOnce},
+		Topics: topics,
+	}
+	reply, err := c.request(msg, &msg.MessageId, MsgSubAck)
+	if err != nil {
+		return nil, err
+	}
+	granted := reply.(*SubAck).TopicsQos
+	if c.store != nil {
+		for i, qos := range granted {
+			if i >= len(topics) || qos == QosRejected {
+				continue
+			}
+			sub := TopicQos{Topic: topics[i].Topic, Qos: qos}
+			if err := c.store.PutSubscription(c.opts.ClientId, sub); err != nil {
+				return granted, err
+			}
+		}
+	}
+	return granted, nil
+}
+
+// Unsubscribe unsubscribes from topics, and waits for the server's UNSUBACK.
+func (c *Client) Unsubscribe(topics ...string) error {
+	msg := &Unsubscribe{
+		Header: Header{QosLevel: QosAtLeastOnce},
+		Topics: topics,
+	}
+	if _, err := c.request(msg, &msg.MessageId, MsgUnsubAck); err != nil {
+		return err
+	}
+	if c.store != nil {
+		for _, topic := range topics {
+			if err := c.store.DeleteSubscription(c.opts.ClientId, topic); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Disconnect sends DISCONNECT and closes the connection.
+func (c *Client) Disconnect() error {
+	err := c.send(&Disconnect{})
+	c.close(ErrClientClosed)
+	return err
+}
+
+// ResetSession ends the client's session, on the server and in its
+// SessionStore, and returns a new Client connected with an empty session
+// that is kept (CleanSession false). As a v3 server only ends a session
+// when a client connects with CleanSession true, it disconnects, connects
+// with CleanSession true and disconnects again, then connects with
+// CleanSession false, each time over a new connection from dial. Messages
+// in flight on this client are dropped, and it cannot be used afterwards.
+func (c *Client) ResetSession(dial func() (io.ReadWriteCloser, error)) (*Client, *ConnAck, error) {
+	c.Disconnect()
+	c.mu.Lock()
+	c.ids.reset()
+	c.pending = make(map[pendingKey]chan Message)
+	c.inbound = make(map[uint16]bool)
+	c.mu.Unlock()
+
+	opts := c.opts
+	opts.CleanSession = true
+	conn, err := dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	clean := NewClient(conn, opts)
+	if ack, err := clean.Connect(); err != nil {
+		return nil, ack, err
+	}
+	if err := clean.Disconnect(); err != nil {
+		return nil, nil, err
+	}
+
+	opts.CleanSession = false
+	if conn, err = dial(); err != nil {
+		return nil, nil, err
+	}
+	client := NewClient(conn, opts)
+	ack, err := client.Connect()
+	if err != nil {
+		return nil, ack, err
+	}
+	return client, ack, nil
+}
+
+// Capabilities returns what the connection allows, once Connect has
+// succeeded. Before then, it returns the zero Capabilities.
+func (c *Client) Capabilities() Capabilities {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.caps
+}
+
+// Done returns a channel that is closed when the connection ends.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the reason that the connection ended, or nil if it has not.
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// send encodes msg on the connection. A message that cannot be encoded is
+// refused without harming the connection, which is only closed if writing
+// to it fails.
+func (c *Client) send(msg Message) error {
+	select {
+	case <-c.done:
+		return c.Err()
+	default:
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if _, err := c.codec.Encode(buf, msg); err != nil {
+		return err
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		c.close(err)
+		return err
+	}
+	return nil
+}
+
+// request sends msg with a new message id, which it stores in messageId,
+// and waits for the first of replyTypes. Replies of the other types are
+// expected later, and must be waited for or forgotten by the caller. The id
+// is released once the last of replyTypes is forgotten.
+func (c *Client) request(msg Message, messageId *uint16, replyTypes ...MessageType) (Message, error) {
+	id, err := c.ids.Allocate(replyTypes[len(replyTypes)-1])
+	if err != nil {
+		return nil, err
+	}
+	*messageId = id
+	if err := c.storeSent(msg, id); err != nil {
+		c.ids.Release(id)
+		return nil, err
+	}
+	c.mu.Lock()
+	for _, replyType := range replyTypes {
+		c.pending[pendingKey{replyType, id}] = make(chan Message, 1)
+	}
+	c.mu.Unlock()
+	return c.wait(msg, pendingKey{replyTypes[0], id})
+}
+
+// storeSent records a message that is about to be sent with a new id in
+// the session, if it is kept.
+func (c *Client) storeSent(msg Message, id uint16) error {
+	if c.store == nil {
+		return nil
+	}
+	if _, ok := msg.(*Publish); ok {
+		if err := c.store.PutMessage(c.opts.ClientId, msg); err != nil {
+			return err
+		}
+	}
+	next := id + 1
+	if next == 0 {
+		next = 1
+	}
+	return c.store.PutNextMessageId(c.opts.ClientId, next)
+}
+
+// resume restores a stored session once the server has accepted the
+// connection, and sends the messages that were in flight again. If the
+// server has no session (which v3.1 servers cannot say), the stored
+// session is deleted instead, and its subscriptions are made again.
+func (c *Client) resume(session *Session, present bool) error {
+	if !present && conformance[c.opts.Version].sessionPresent {
+		if err := c.store.Delete(c.opts.ClientId); err != nil {
+			return err
+		}
+		return c.resubscribe(session.Subscriptions)
+	}
+	c.ids.SetNext(session.NextMessageId)
+	c.mu.Lock()
+	for id := range session.Received {
+		c.inbound[id] = true
+	}
+	c.mu.Unlock()
+
+	var ids []int
+	for id, msg := range session.Outbound {
+		done := MsgPubComp
+		if pub, ok := msg.(*Publish); ok {
+			pub.DupFlag = true
+			if pub.QosLevel == QosAtLeastOnce {
+				done = MsgPubAck
+			}
+		}
+		if c.ids.Reserve(id, done) {
+			ids = append(ids, int(id))
+		}
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		if err := c.send(session.Outbound[uint16(id)]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resubscribe subscribes again to the subscriptions of a session that the
+// server has lost, in order of topic filter.
+func (c *Client) resubscribe(subs map[string]QosLevel) error {
+	if len(subs) == 0 {
+		return nil
+	}
+	filters := make([]string, 0, len(subs))
+	for filter := range subs {
+		filters = append(filters, filter)
+	}
+	sort.Strings(filters)
+	topics := make([]TopicQos, len(filters))
+	for i, filter := range filters {
+		topics[i] = TopicQos{Topic: filter, Qos: subs[filter]}
+	}
+	_, err := c.Subscribe(topics...)
+	return err
+}
+
+// wait sends msg, then waits for the reply registered under key.
+func (c *Client) wait(msg Message, key pendingKey) (Message, error) {
+	c.mu.Lock()
+	ch := c.pending[key]
+	c.mu.Unlock()
+	defer c.forget(key)
+
+	if err := c.send(msg); err != nil {
+		return nil, err
+	}
+	select {
+	case reply := <-ch:
+		return reply, nil
+	case <-c.done:
+		return nil, c.Err()
+	}
+}
+
+// forget stops expecting the reply registered under key, releasing its
+// message id if it was the last reply expected.
+func (c *Client) forget(key pendingKey) {
+	c.mu.Lock()
+	delete(c.pending, key)
+	c.mu.Unlock()
+	c.ids.complete(key.msgType, key.messageId)
+}
+
+// readLoop reads messages from the server until the connection ends.
+func (c *Client) readLoop() {
+	r := bufio.NewReader(c.conn)
+	for {
+		msg, err := c.codec.Decode(r)
+		if err != nil {
+			c.close(err)
+			return
+		}
+		if err := c.handle(msg); err != nil {
+			c.close(err)
+			return
+		}
+	}
+}
+
+// handle deals with one message from the server.
+func (c *Client) handle(msg Message) error {
+	switch msg := msg.(type) {
+	case *ConnAck:
+		select {
+		case c.connAck <- msg:
+		default:
+			return ErrUnexpectedMessage
+		}
+	case *PubAck:
+		return c.complete(MsgPubAck, msg.MessageId, msg)
+	case *PubRec:
+		return c.pubRec(msg)
+	case *PubComp:
+		return c.complete(MsgPubComp, msg.MessageId, msg)
+	case *SubAck:
+		c.deliver(MsgSubAck, msg.MessageId, msg)
+	case *UnsubAck:
+		c.deliver(MsgUnsubAck, msg.MessageId, msg)
+	case *Publish:
+		return c.receive(msg)
+	case *PubRel:
+		c.mu.Lock()
+		delete(c.inbound, msg.MessageId)
+		c.mu.Unlock()
+		if c.store != nil {
+			if err := c.store.DeleteReceived(c.opts.ClientId, msg.MessageId); err != nil {
+				return err
+			}
+		}
+		return c.send(&PubComp{MessageId: msg.MessageId})
+	case *PingResp:
+	case *Disconnect:
+		// Only MQTT v5 servers send DISCONNECT.
+		if c.opts.Version != ProtocolV5 {
+			return ErrUnexpectedMessage
+		}
+		return &DisconnectError{msg.ReasonCode, msg.Properties}
+	default:
+		return ErrUnexpectedMessage
+	}
+	return nil
+}
+
+// deliver passes a reply to the request waiting for it, and returns true
+// if there is one. Replies that no request is waiting for are dropped.
+func (c *Client) deliver(msgType MessageType, id uint16, msg Message) bool {
+	c.mu.Lock()
+	ch, ok := c.pending[pendingKey{msgType, id}]
+	c.mu.Unlock()
+	if ok {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+	return ok
+}
+
+// complete passes a PUBACK or PUBCOMP to the request waiting for it, or
+// completes a resumed message that no request is waiting for, and removes
+// the message from the session.
+func (c *Client) complete(msgType MessageType, id uint16, msg Message) error {
+	if !c.deliver(msgType, id, msg) && !c.ids.complete(msgType, id) {
+		return nil
+	}
+	if c.store != nil {
+		return c.store.DeleteMessage(c.opts.ClientId, id)
+	}
+	return nil
+}
+
+// pubRec moves a QoS 2 message in flight on to its PUBREL, which is stored
+// in the session in place of the message. The Publish waiting for the
+// PUBREC sends the PUBREL itself; for a resumed message, it is sent here.
+func (c *Client) pubRec(msg *PubRec) error {
+	if !c.ids.InFlight(msg.MessageId) {
+		return nil
+	}
+	rel := &PubRel{Header: Header{QosLevel: QosAtLeastOnce}, MessageId: msg.MessageId}
+	if c.store != nil {
+		if err := c.store.PutMessage(c.opts.ClientId, rel); err != nil {
+			return err
+		}
+	}
+	if c.deliver(MsgPubRec, msg.MessageId, msg) {
+		return nil
+	}
+	return c.send(rel)
+}
+
+// receive passes a PUBLISH from the server to OnMessage, and acknowledges
+// it. A QoS 2 message is only passed on once, however many times the server
+// sends it before its PUBREL.
+func (c *Client) receive(msg *Publish) error {
+	switch msg.QosLevel {
+	case QosAtMostOnce:
+		c.onMessage(msg)
+		return nil
+	case QosAtLeastOnce:
+		c.onMessage(msg)
+		return c.send(&PubAck{MessageId: msg.MessageId})
+	case QosExactlyOnce:
+		c.mu.Lock()
+		seen := c.inbound[msg.MessageId]
+		c.inbound[msg.MessageId] = true
+		c.mu.Unlock()
+		if !seen {
+			if c.store != nil {
+				if err := c.store.PutReceived(c.opts.ClientId, msg.MessageId); err != nil {
+					return err
+				}
+			}
+			c.onMessage(msg)
+		}
+		return c.send(&PubRec{MessageId: msg.MessageId})
+	}
+	return ErrBadQos
+}
+
+func (c *Client) onMessage(msg *Publish) {
+	if c.opts.OnMessage != nil {
+		c.opts.OnMessage(msg)
+	}
+}
+
+// close ends the connection, recording err as the reason if it is the
+// first.
+func (c *Client) close(err error) {
+	c.closeOnce.Do(func() {
+		if kerr := c.keepalive.Err(); kerr != nil {
+			// The keep alive closing the connection is why it failed.
+			err = kerr
+		}
+		c.mu.Lock()
+		c.err = err
+		counted := c.counted
+		c.mu.Unlock()
+		if counted {
+			debugEnd(&debugCounters.openClients)
+		}
+		close(c.done)
+		c.conn.Close()
+	})
+}
@@ -0,0 +1,510 @@
+package mqtt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeServer answers a client's requests on conn, and sends what it
+// receives to got.
+func fakeServer(conn net.Conn, connAck *ConnAck, got chan<- Message) {
+	defer close(got)
+	defer conn.Close()
+	codec := &Codec{Version: ProtocolV311}
+	r := bufio.NewReader(conn)
+	for {
+		msg, err := codec.Decode(r)
+		if err != nil {
+			return
+		}
+		got <- msg
+
+		var reply Message
+		switch msg := msg.(type) {
+		case *Connect:
+			reply = connAck
+		case *Publish:
+			switch msg.QosLevel {
+			case QosAtLeastOnce:
+				reply = &PubAck{MessageId: msg.MessageId}
+			case QosExactlyOnce:
+				reply = &PubRec{MessageId: msg.MessageId}
+			}
+		case *PubRel:
+			reply = &PubComp{MessageId: msg.MessageId}
+		case *Subscribe:
+			qos := make([]QosLevel, len(msg.Topics))
+			for i, topic := range msg.Topics {
+				qos[i] = topic.Qos
+			}
+			reply = &SubAck{MessageId: msg.MessageId, TopicsQos: qos}
+		case *Unsubscribe:
+			reply = &UnsubAck{MessageId: msg.MessageId}
+		case *PingReq:
+			reply = &PingResp{}
+		}
+		if reply != nil {
+			if _, err := codec.Encode(conn, reply); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	local, remote := net.Pipe()
+	got := make(chan Message, 100)
+	go fakeServer(remote, &ConnAck{}, got)
+
+	received := make(chan *Publish, 1)
+	client := NewClient(local, ClientOptions{
+		Version:      ProtocolV311,
+		ClientId:     "c",
+		CleanSession: true,
+		OnMessage:    func(msg *Publish) { received <- msg },
+	})
+
+	if _, err := client.Connect(); err != nil {
+		t.Fatalf("Unexpected error connecting: %v", err)
+	}
+	for _, qos := range []QosLevel{QosAtMostOnce, QosAtLeastOnce, QosExactlyOnce} {
+		if err := client.Publish("a/b", []byte{1, 2}, qos, false); err != nil {
+			t.Errorf("QoS %d: Unexpected error publishing: %v", qos, err)
+		}
+	}
+	granted, err := client.Subscribe(TopicQos{Topic: "a/#", Qos: QosAtLeastOnce})
+	if err != nil {
+		t.Errorf("Unexpected error subscribing: %v", err)
+	} else if !reflect.DeepEqual([]QosLevel{QosAtLeastOnce}, granted) {
+		t.Errorf("Granted %v", granted)
+	}
+	if err := client.Unsubscribe("a/#"); err != nil {
+		t.Errorf("Unexpected error unsubscribing: %v", err)
+	}
+	if _, err := client.Subscribe(); err == nil {
+		t.Errorf("Expected error subscribing to no topics, but got nil.")
+	}
+
+	// A QoS 1 message from the server is passed on, and acknowledged.
+	if _, err := (&Codec{Version: ProtocolV311}).Encode(remote, &Publish{
+		Header:    Header{QosLevel: QosAtLeastOnce},
+		TopicName: "x",
+		MessageId: 9,
+		Payload:   BytesPayload{3},
+	}); err != nil {
+		t.Fatalf("Unexpected error sending PUBLISH: %v", err)
+	}
+	if msg := <-received; msg.TopicName != "x" {
+		t.Errorf("Received %#v", msg)
+	}
+
+	var types []string
+	for msg := range got {
+		types = append(types, reflect.TypeOf(msg).Elem().Name())
+		if _, ok := msg.(*PubAck); ok {
+			break
+		}
+	}
+
+	if err := client.Disconnect(); err != nil {
+		t.Errorf("Unexpected error disconnecting: %v", err)
+	}
+	<-client.Done()
+
+	for msg := range got {
+		types = append(types, reflect.TypeOf(msg).Elem().Name())
+	}
+	expected := []string{
+		"Connect", "Publish", "Publish", "Publish", "PubRel",
+		"Subscribe", "Unsubscribe", "PubAck", "Disconnect",
+	}
+	if !reflect.DeepEqual(expected, types) {
+		t.Errorf("Server got %v, expected %v", types, expected)
+	}
+}
+
+func TestClientConnectRefused(t *testing.T) {
+	local, remote := net.Pipe()
+	got := make(chan Message, 10)
+	go fakeServer(remote, &ConnAck{ReturnCode: RetCodeNotAuthorized}, got)
+
+	client := NewClient(local, ClientOptions{Version: ProtocolV311, ClientId: "c"})
+	_, err := client.Connect()
+	if refused, ok := err.(*ConnectRefusedError); !ok || refused.ReturnCode != RetCodeNotAuthorized {
+		t.Errorf("Expected *ConnectRefusedError, got %v", err)
+	}
+	if err := client.Publish("a", nil, QosAtMostOnce, false); err == nil {
+		t.Errorf("Expected error publishing after refusal, but got nil.")
+	}
+}
+
+// A CONNECT that cannot be encoded closes the client.
+func TestClientConnectEncodeError(t *testing.T) {
+	EnableDebugStats(true)
+	defer EnableDebugStats(false)
+	base := DebugSnapshot()
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	client := NewClient(local, ClientOptions{
+		Version:  ProtocolV311,
+		ClientId: "c",
+		Will:     &Publish{Header: Header{QosLevel: 3}, TopicName: "w", Payload: BytesPayload{}},
+	})
+	if _, err := client.Connect(); err != ErrBadWillQos {
+		t.Errorf("Got %v, expected ErrBadWillQos", err)
+	}
+	select {
+	case <-client.Done():
+	default:
+		t.Errorf("Client was not closed")
+	}
+	if diff := DebugSnapshot().Sub(base); diff.OpenClients != 0 {
+		t.Errorf("%d clients are counted as open", diff.OpenClients)
+	}
+}
+
+func TestClientSession(t *testing.T) {
+	local, remote := net.Pipe()
+	go fakeServer(remote, &ConnAck{}, make(chan Message, 100))
+
+	store := &MemorySessionStore{}
+	client := NewClient(local, ClientOptions{Version: ProtocolV311, ClientId: "c", SessionStore: store})
+	if _, err := client.Connect(); err != nil {
+		t.Fatalf("Unexpected error connecting: %v", err)
+	}
+	defer client.Disconnect()
+
+	for _, qos := range []QosLevel{QosAtLeastOnce, QosExactlyOnce} {
+		if err := client.Publish("a/b", []byte{1}, qos, false); err != nil {
+			t.Fatalf("QoS %d: Unexpected error publishing: %v", qos, err)
+		}
+	}
+	if _, err := client.Subscribe(TopicQos{Topic: "a/#", Qos: QosAtLeastOnce}, TopicQos{Topic: "b", Qos: QosAtMostOnce}); err != nil {
+		t.Fatalf("Unexpected error subscribing: %v", err)
+	}
+	if err := client.Unsubscribe("b"); err != nil {
+		t.Fatalf("Unexpected error unsubscribing: %v", err)
+	}
+
+	session, err := store.Get("c")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := &Session{
+		Outbound:      map[uint16]Message{},
+		Received:      map[uint16]bool{},
+		Subscriptions: map[string]QosLevel{"a/#": QosAtLeastOnce},
+		NextMessageId: 5,
+	}
+	if !reflect.DeepEqual(session, expected) {
+		t.Errorf("\n     got = %+v\nexpected = %+v", session, expected)
+	}
+}
+
+func TestClientSessionResume(t *testing.T) {
+	store := &MemorySessionStore{}
+	store.PutMessage("c", &Publish{Header: Header{QosLevel: QosAtLeastOnce}, TopicName: "a", MessageId: 1, Payload: BytesPayload{1}})
+	store.PutMessage("c", &PubRel{Header: Header{QosLevel: QosAtLeastOnce}, MessageId: 5})
+	store.PutMessage("c", &Publish{Header: Header{QosLevel: QosExactlyOnce}, TopicName: "b", MessageId: 6, Payload: BytesPayload{2}})
+	store.PutNextMessageId("c", 7)
+
+	local, remote := net.Pipe()
+	got := make(chan Message, 100)
+	go fakeServer(remote, &ConnAck{SessionPresent: true}, got)
+	client := NewClient(local, ClientOptions{Version: ProtocolV311, ClientId: "c", SessionStore: store})
+	if _, err := client.Connect(); err != nil {
+		t.Fatalf("Unexpected error connecting: %v", err)
+	}
+
+	// The messages in flight are sent again, and completed.
+	var sent []string
+	for len(sent) < 5 {
+		msg := <-got
+		switch msg := msg.(type) {
+		case *Publish:
+			if !msg.DupFlag {
+				t.Errorf("PUBLISH %d was sent again without DUP", msg.MessageId)
+			}
+			sent = append(sent, fmt.Sprintf("Publish %d", msg.MessageId))
+		case *PubRel:
+			sent = append(sent, fmt.Sprintf("PubRel %d", msg.MessageId))
+		default:
+			sent = append(sent, reflect.TypeOf(msg).Elem().Name())
+		}
+	}
+	expected := []string{"Connect", "Publish 1", "PubRel 5", "Publish 6", "PubRel 6"}
+	if !reflect.DeepEqual(sent, expected) {
+		t.Errorf("Server got %v, expected %v", sent, expected)
+	}
+
+	// New messages carry on from the stored message id.
+	if err := client.Publish("c", nil, QosAtLeastOnce, false); err != nil {
+		t.Fatalf("Unexpected error publishing: %v", err)
+	}
+	if msg := (<-got).(*Publish); msg.MessageId != 7 {
+		t.Errorf("Published with id %d, expected 7", msg.MessageId)
+	}
+	client.Disconnect()
+	for range got {
+	}
+	if session, _ := store.Get("c"); len(session.Outbound) != 0 {
+		t.Errorf("Messages still in flight: %+v", session.Outbound)
+	}
+
+	// A server without the session ends it.
+	local, remote = net.Pipe()
+	go fakeServer(remote, &ConnAck{}, make(chan Message, 100))
+	client = NewClient(local, ClientOptions{Version: ProtocolV311, ClientId: "c", SessionStore: store})
+	if _, err := client.Connect(); err != nil {
+		t.Fatalf("Unexpected error connecting: %v", err)
+	}
+	client.Disconnect()
+	if session, _ := store.Get("c"); session != nil {
+		t.Errorf("Stored session was kept: %+v", session)
+	}
+}
+
+func TestClientSessionResubscribes(t *testing.T) {
+	store := &MemorySessionStore{}
+	store.PutSubscription("c", TopicQos{Topic: "b", Qos: QosExactlyOnce})
+	store.PutSubscription("c", TopicQos{Topic: "a/#", Qos: QosAtLeastOnce})
+	store.PutMessage("c", &Publish{Header: Header{QosLevel: QosAtLeastOnce}, TopicName: "a", MessageId: 1, Payload: BytesPayload{1}})
+
+	// The server has lost the session, so the subscriptions are made again.
+	local, remote := net.Pipe()
+	got := make(chan Message, 100)
+	go fakeServer(remote, &ConnAck{}, got)
+	client := NewClient(local, ClientOptions{Version: ProtocolV311, ClientId: "c", SessionStore: store})
+	if _, err := client.Connect(); err != nil {
+		t.Fatalf("Unexpected error connecting: %v", err)
+	}
+	client.Disconnect()
+
+	var subscribed []TopicQos
+	for msg := range got {
+		switch msg := msg.(type) {
+		case *Subscribe:
+			subscribed = append(subscribed, msg.Topics...)
+		case *Publish:
+			t.Errorf("PUBLISH %d of the lost session was sent again", msg.MessageId)
+		}
+	}
+	expected := []TopicQos{{Topic: "a/#", Qos: QosAtLeastOnce}, {Topic: "b", Qos: QosExactlyOnce}}
+	if !reflect.DeepEqual(subscribed, expected) {
+		t.Errorf("Server got subscriptions %+v, expected %+v", subscribed, expected)
+	}
+	session, _ := store.Get("c")
+	if session == nil || len(session.Outbound) != 0 || !reflect.DeepEqual(session.Subscriptions, map[string]QosLevel{"a/#": QosAtLeastOnce, "b": QosExactlyOnce}) {
+		t.Errorf("Got session %+v", session)
+	}
+}
+
+func TestClientResetSession(t *testing.T) {
+	store := &MemorySessionStore{}
+	store.PutSubscription("c", TopicQos{Topic: "a/#", Qos: QosAtLeastOnce})
+	store.PutReceived("c", 9)
+	store.PutNextMessageId("c", 7)
+
+	local, remote := net.Pipe()
+	go fakeServer(remote, &ConnAck{SessionPresent: true}, make(chan Message, 100))
+	opts := ClientOptions{Version: ProtocolV311, ClientId: "c", SessionStore: store}
+	client := NewClient(local, opts)
+	if _, err := client.Connect(); err != nil {
+		t.Fatalf("Unexpected error connecting: %v", err)
+	}
+
+	var servers []chan Message
+	dial := func() (io.ReadWriteCloser, error) {
+		local, remote := net.Pipe()
+		got := make(chan Message, 100)
+		servers = append(servers, got)
+		go fakeServer(remote, &ConnAck{}, got)
+		return local, nil
+	}
+	reset, _, err := client.ResetSession(dial)
+	if err != nil {
+		t.Fatalf("Unexpected error resetting the session: %v", err)
+	}
+	defer reset.Disconnect()
+
+	// The session is ended by connecting with CleanSession true, then kept
+	// again by connecting with CleanSession false.
+	if len(servers) != 2 {
+		t.Fatalf("Dialled %d connections, expected 2", len(servers))
+	}
+	for i, clean := range []bool{true, false} {
+		if msg, ok := (<-servers[i]).(*Connect); !ok || msg.CleanSession != clean {
+			t.Errorf("Connection %d: Got %+v, expected CONNECT with CleanSession %v", i, msg, clean)
+		}
+	}
+	if session, _ := store.Get("c"); session != nil {
+		t.Errorf("Stored session was kept: %+v", session)
+	}
+	client.mu.Lock()
+	inbound := len(client.inbound)
+	client.mu.Unlock()
+	if inbound != 0 || client.ids.Len() != 0 {
+		t.Errorf("Old client kept %d received and %d sent messages in flight", inbound, client.ids.Len())
+	}
+	if err := client.Err(); err != ErrClientClosed {
+		t.Errorf("Old client ended with %v, expected ErrClientClosed", err)
+	}
+
+	// The new client starts the session afresh.
+	if err := reset.Publish("a", nil, QosAtLeastOnce, false); err != nil {
+		t.Fatalf("Unexpected error publishing: %v", err)
+	}
+	if msg := (<-servers[1]).(*Publish); msg.MessageId != 1 {
+		t.Errorf("Published with id %d, expected 1", msg.MessageId)
+	}
+}
+
+func TestClientKeepAlive(t *testing.T) {
+	local, remote := net.Pipe()
+	got := make(chan Message, 10)
+	go fakeServer(remote, &ConnAck{}, got)
+
+	client := NewClient(local, ClientOptions{Version: ProtocolV311, ClientId: "c", KeepAlive: 1})
+	if _, err := client.Connect(); err != nil {
+		t.Fatalf("Unexpected error connecting: %v", err)
+	}
+	defer client.Disconnect()
+	<-got // CONNECT
+
+	select {
+	case msg := <-got:
+		if _, ok := msg.(*PingReq); !ok {
+			t.Errorf("Server received %T, expected *PingReq", msg)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("No PINGREQ was sent while idle")
+	}
+	select {
+	case <-client.Done():
+		t.Errorf("Connection ended after PINGRESP: %v", client.Err())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestClientCapabilities(t *testing.T) {
+	local, remote := net.Pipe()
+	go fakeServer(remote, &ConnAck{SessionPresent: true}, make(chan Message, 10))
+
+	client := NewClient(local, ClientOptions{
+		Version:       ProtocolV311,
+		ClientId:      "c",
+		KeepAlive:     30,
+		DecoderConfig: &PacketLimitConfig{MaxPacketSize: 1024},
+	})
+	if caps := client.Capabilities(); caps != (Capabilities{}) {
+		t.Errorf("Got %+v before connecting", caps)
+	}
+	if _, err := client.Connect(); err != nil {
+		t.Fatalf("Unexpected error connecting: %v", err)
+	}
+	defer client.Disconnect()
+
+	expected := Capabilities{
+		Version:              ProtocolV311,
+		SessionPresent:       true,
+		ClientId:             "c",
+		KeepAlive:            30,
+		MaximumQos:           QosExactlyOnce,
+		RetainAvailable:      true,
+		WildcardSubAvailable: true,
+		ReceiveMaximum:       0xffff,
+		MaxReceivePacketSize: 1024,
+	}
+	if caps := client.Capabilities(); caps != expected {
+		t.Errorf("\n     got = %+v\nexpected = %+v", caps, expected)
+	}
+}
+
+func TestClientCapabilitiesV5(t *testing.T) {
+	local, remote := net.Pipe()
+	go func() {
+		defer remote.Close()
+		codec := &Codec{Version: ProtocolV5}
+		if _, err := codec.Decode(remote); err != nil {
+			return
+		}
+		codec.Encode(remote, &ConnAck{Properties: Properties{
+			{PropAssignedClientId, "assigned"},
+			{PropServerKeepAlive, uint16(10)},
+			{PropMaximumQos, uint8(1)},
+			{PropRetainAvailable, uint8(0)},
+			{PropSharedSubAvailable, uint8(0)},
+			{PropReceiveMaximum, uint16(20)},
+			{PropTopicAliasMaximum, uint16(5)},
+			{PropMaximumPacketSize, uint32(4096)},
+		}})
+		codec.Decode(remote)
+	}()
+
+	client := NewClient(local, ClientOptions{Version: ProtocolV5, CleanSession: true, KeepAlive: 60})
+	if _, err := client.Connect(); err != nil {
+		t.Fatalf("Unexpected error connecting: %v", err)
+	}
+	defer client.Disconnect()
+
+	expected := Capabilities{
+		Version:                 ProtocolV5,
+		ClientId:                "assigned",
+		KeepAlive:               10,
+		MaximumQos:              QosAtLeastOnce,
+		WildcardSubAvailable:    true,
+		SubscriptionIdAvailable: true,
+		ReceiveMaximum:          20,
+		TopicAliasMaximum:       5,
+		MaxPacketSize:           4096,
+	}
+	if caps := client.Capabilities(); caps != expected {
+		t.Errorf("\n     got = %+v\nexpected = %+v", caps, expected)
+	}
+}
+
+func TestClientDisconnectedV5(t *testing.T) {
+	local, remote := net.Pipe()
+	go func() {
+		defer remote.Close()
+		codec := &Codec{Version: ProtocolV5}
+		if _, err := codec.Decode(remote); err != nil {
+			return
+		}
+		codec.Encode(remote, &ConnAck{})
+		// Wait for the client to publish, so that it has seen the CONNACK.
+		if _, err := codec.Decode(remote); err != nil {
+			return
+		}
+		codec.Encode(remote, &Disconnect{
+			ReasonCode: ReasonServerShuttingDown,
+			Properties: Properties{{PropReasonString, "maintenance"}},
+		})
+	}()
+
+	client := NewClient(local, ClientOptions{Version: ProtocolV5, CleanSession: true})
+	if _, err := client.Connect(); err != nil {
+		t.Fatalf("Unexpected error connecting: %v", err)
+	}
+	if err := client.Publish("a", nil, QosAtMostOnce, false); err != nil {
+		t.Fatalf("Unexpected error publishing: %v", err)
+	}
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("Client was not closed by DISCONNECT")
+	}
+	expected := &DisconnectError{
+		ReasonCode: ReasonServerShuttingDown,
+		Properties: Properties{{PropReasonString, "maintenance"}},
+	}
+	if err := client.Err(); !reflect.DeepEqual(err, expected) {
+		t.Errorf("Got %v, expected %v", err, expected)
+	}
+}
@@ -0,0 +1,324 @@
+package mqtt
+
+import (
+	"fmt"
+	"io"
+)
+
+// ProtocolVersion is the protocol level sent in a CONNECT message.
+type ProtocolVersion uint8
+
+const (
+	// ProtocolV31 is MQTT v3.1, which uses the protocol name "MQIsdp".
+	ProtocolV31 = ProtocolVersion(3)
+	// ProtocolV311 is MQTT v3.1.1, which uses the protocol name "MQTT".
+	ProtocolV311 = ProtocolVersion(4)
+	// ProtocolV5 is MQTT v5.0, which adds properties and reason codes to most
+	// messages, and the AUTH message.
+	ProtocolV5 = ProtocolVersion(5)
+)
+
+// versionRules describes what differs between protocol versions, as far as
+// encoding and decoding is concerned.
+type versionRules struct {
+	// protocolName is sent in CONNECT along with the version.
+	protocolName string
+	// subAckFailure is true if SUBACK can use QosRejected to refuse a topic.
+	subAckFailure bool
+	// maxClientIdLength is the longest client id that servers must accept,
+	// or zero if there is no such limit.
+	maxClientIdLength int
+	// emptyClientId is true if a client can connect with an empty client id,
+	// as long as it asks for a clean session.
+	emptyClientId bool
+	// sessionPresent is true if CONNACK can set the session present flag.
+	sessionPresent bool
+	// headerFlags is true if the fixed header flags of messages other than
+	// PUBLISH must have their specified values (see headerFlagsValid).
+	headerFlags bool
+	// v5 is true if messages have the MQTT v5 properties and reason codes.
+	v5 bool
+}
+
+var conformance = map[ProtocolVersion]versionRules{
+	ProtocolV31: {
+		protocolName:      "MQIsdp",
+		subAckFailure:     false,
+		maxClientIdLength: MaxClientIdLength,
+		emptyClientId:     false,
+		sessionPresent:    false,
+		headerFlags:       false,
+		v5:                false,
+	},
+	ProtocolV311: {
+		protocolName:      "MQTT",
+		subAckFailure:     true,
+		maxClientIdLength: 0,
+		emptyClientId:     true,
+		sessionPresent:    true,
+		headerFlags:       true,
+		v5:                false,
+	},
+	ProtocolV5: {
+		protocolName:      "MQTT",
+		subAckFailure:     true,
+		maxClientIdLength: 0,
+		emptyClientId:     true,
+		sessionPresent:    true,
+		headerFlags:       true,
+		v5:                true,
+	},
+}
+
+// IsValid returns true if the ProtocolVersion is one that this package
+// supports.
+func (v ProtocolVersion) IsValid() bool {
+	_, ok := conformance[v]
+	return ok
+}
+
+// ProtocolName returns the protocol name sent in CONNECT for this version, or
+// "" if the version is invalid.
+func (v ProtocolVersion) ProtocolName() string {
+	return conformance[v].protocolName
+}
+
+// AcceptsClientId returns true if the version allows a client to connect
+// with the given client id and clean session flag. A server should refuse
+// other client ids with RetCodeIdentifierRejected. In 3.1 the client id must
+// be 1 to 23 bytes long. In 3.1.1 it may be longer, and may be empty if the
+// client asks for a clean session, in which case the server assigns one.
+func (v ProtocolVersion) AcceptsClientId(clientId string, cleanSession bool) bool {
+	rules, ok := conformance[v]
+	if !ok {
+		return false
+	}
+	if clientId == "" {
+		return rules.emptyClientId && cleanSession
+	}
+	return rules.maxClientIdLength == 0 || len(clientId) <= rules.maxClientIdLength
+}
+
+func (v ProtocolVersion) String() string {
+	switch v {
+	case ProtocolV31:
+		return "3.1"
+	case ProtocolV311:
+		return "3.1.1"
+	case ProtocolV5:
+		return "5.0"
+	}
+	return fmt.Sprintf("ProtocolVersion(%d)", uint8(v))
+}
+
+// ConnectVersion returns the protocol version requested by a CONNECT
+// message. A server can use it to choose the Codec for the rest of the
+// connection, and should refuse the connection with
+// RetCodeUnacceptableProtocolVersion if it returns an error.
+func ConnectVersion(msg *Connect) (ProtocolVersion, error) {
+	v := ProtocolVersion(msg.ProtocolVersion)
+	if !v.IsValid() || msg.ProtocolName != v.ProtocolName() {
+		return 0, ErrBadProtocol
+	}
+	return v, nil
+}
+
+// Codec encodes and decodes messages for one protocol version, applying the
+// rules that differ between versions. It is intended to be chosen once per
+// connection, rather than per message.
+type Codec struct {
+	// Version is the protocol version spoken on the connection.
+	Version ProtocolVersion
+
+	// DecoderConfig is passed to DecodeOneMessage. nil indicates that the
+	// DefaultDecoderConfig should be used.
+	DecoderConfig DecoderConfig
+
+	// Strict refuses to encode or decode messages that break the rules of
+	// the protocol, decoding as if DecoderConfig implemented StrictConfig,
+	// and checking messages with Validate. It also
+	// refuses CONNECT messages with client ids that the version does not
+	// accept (see ProtocolVersion.AcceptsClientId).
+	Strict bool
+}
+
+// NewCodec returns a Codec for the given version. An error is returned if
+// the version is not supported.
+func NewCodec(version ProtocolVersion, config DecoderConfig) (*Codec, error) {
+	if !version.IsValid() {
+		return nil, ErrBadProtocol
+	}
+	return &Codec{Version: version, DecoderConfig: config}, nil
+}
+
+// Encode writes msg to w. A Connect message with no ProtocolName or
+// ProtocolVersion set is sent with those of the codec's version; msg itself
+// is not modified.
+func (c *Codec) Encode(w io.Writer, msg Message) (int, error) {
+	if connect, ok := msg.(*Connect); ok && connect.ProtocolName == "" && connect.ProtocolVersion == 0 {
+		filled := *connect
+		filled.ProtocolName = c.Version.ProtocolName()
+		filled.ProtocolVersion = uint8(c.Version)
+		msg = &filled
+	}
+	if err := c.conform(msg); err != nil {
+		return 0, err
+	}
+	if c.Strict {
+		if err := c.validate(msg); err != nil {
+			return 0, err
+		}
+	}
+	if encoder, ok := msg.(v5Encoder); ok && conformance[c.Version].v5 {
+		return encoder.encodeV5(w)
+	}
+	return msg.Encode(w)
+}
+
+// Decode reads one message from r, and checks that it is valid for the
+// codec's version.
+func (c *Codec) Decode(r io.Reader) (Message, error) {
+	config := c.DecoderConfig
+	if c.Strict {
+		config = &strictConfig{config}
+	}
+	msg, err := decodeOneMessage(r, config, conformance[c.Version].v5)
+	if err != nil {
+		return msg, err
+	}
+	if c.Strict {
+		if err := c.validate(msg); err != nil {
+			return msg, err
+		}
+	}
+	return msg, c.conform(msg)
+}
+
+// strictConfig makes the DecoderConfig that it wraps strict, for a strict
+// Codec.
+type strictConfig struct {
+	DecoderConfig DecoderConfig
+}
+
+func (c *strictConfig) Unwrap() DecoderConfig {
+	return c.DecoderConfig
+}
+
+func (c *strictConfig) MakePayload(msg *Publish, r io.Reader, n int) (Payload, error) {
+	if c.DecoderConfig == nil {
+		return DefaultDecoderConfig{}.MakePayload(msg, r, n)
+	}
+	return c.DecoderConfig.MakePayload(msg, r, n)
+}
+
+func (c *strictConfig) Strict() bool {
+	return true
+}
+
+// conform checks msg against the rules for the codec's version.
+func (c *Codec) conform(msg Message) error {
+	rules, ok := conformance[c.Version]
+	if !ok {
+		return ErrBadProtocol
+	}
+
+	if rules.headerFlags && !headerFlagsValid(msg) {
+		return ErrReservedBits
+	}
+
+	if !rules.v5 && hasV5Fields(msg) {
+		return ErrUnsupported
+	}
+
+	switch msg := msg.(type) {
+	case *Connect:
+		if v, err := ConnectVersion(msg); err != nil || v != c.Version {
+			return ErrBadProtocol
+		}
+	case *ConnAck:
+		if msg.SessionPresent && !rules.sessionPresent {
+			return ErrUnsupported
+		}
+	case *Auth:
+		if !rules.v5 {
+			return ErrUnsupported
+		}
+	case *SubAck:
+		if !rules.subAckFailure {
+			for _, qos := range msg.TopicsQos {
+				if qos == QosRejected {
+					return ErrUnsupported
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// validate checks msg against the rules enforced by strict encoding and
+// decoding, including those that depend on the codec's version.
+func (c *Codec) validate(msg Message) error {
+	if connect, ok := msg.(*Connect); ok && !c.Version.AcceptsClientId(connect.ClientId, connect.CleanSession) {
+		return ErrBadClientId
+	}
+	return Validate(msg)
+}
+
+// headerFlagsValid returns true if the fixed header flags of msg have the
+// values required by MQTT v3.1.1: PUBREL, SUBSCRIBE and UNSUBSCRIBE must be
+// sent with QoS 1 and no other flags, PUBLISH must not use QoS 3, and all
+// other messages must have no flags set.
+func headerFlagsValid(msg Message) bool {
+	h, ok := msg.(interface {
+		header() *Header
+	})
+	if !ok {
+		return true
+	}
+	hdr := h.header()
+
+	switch msg.(type) {
+	case *Publish:
+		return hdr.QosLevel <= QosExactlyOnce
+	case *PubRel, *Subscribe, *Unsubscribe:
+		return !hdr.DupFlag && !hdr.Retain && hdr.QosLevel == QosAtLeastOnce
+	}
+	return !hdr.DupFlag && !hdr.Retain && hdr.QosLevel == QosAtMostOnce
+}
+
+// hasV5Fields returns true if msg sets any fields that only MQTT v5 can
+// encode.
+func hasV5Fields(msg Message) bool {
+	switch msg := msg.(type) {
+	case *Connect:
+		return len(msg.Properties) > 0 || len(msg.WillProperties) > 0
+	case *ConnAck:
+		return len(msg.Properties) > 0
+	case *Publish:
+		return len(msg.Properties) > 0
+	case *PubAck:
+		return msg.ReasonCode != ReasonSuccess || len(msg.Properties) > 0
+	case *PubRec:
+		return msg.ReasonCode != ReasonSuccess || len(msg.Properties) > 0
+	case *PubRel:
+		return msg.ReasonCode != ReasonSuccess || len(msg.Properties) > 0
+	case *PubComp:
+		return msg.ReasonCode != ReasonSuccess || len(msg.Properties) > 0
+	case *Subscribe:
+		for _, topic := range msg.Topics {
+			if topic.NoLocal || topic.RetainAsPublished || topic.RetainHandling != 0 {
+				return true
+			}
+		}
+		return len(msg.Properties) > 0
+	case *SubAck:
+		return len(msg.Properties) > 0
+	case *Unsubscribe:
+		return len(msg.Properties) > 0
+	case *UnsubAck:
+		return len(msg.ReasonCodes) > 0 || len(msg.Properties) > 0
+	case *Disconnect:
+		return msg.ReasonCode != ReasonSuccess || len(msg.Properties) > 0
+	}
+	return false
+}
@@ -0,0 +1,192 @@
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCodec(t *testing.T) {
+	tests := []struct {
+		Comment     string
+		Version     ProtocolVersion
+		Msg         Message
+		Expected    Message
+		ExpectError bool
+	}{
+		{
+			Comment:  "CONNECT gets the 3.1 protocol name and version",
+			Version:  ProtocolV31,
+			Msg:      &Connect{ClientId: "c"},
+			Expected: &Connect{ProtocolName: "MQIsdp", ProtocolVersion: 3, ClientId: "c"},
+		},
+		{
+			Comment:  "CONNECT gets the 3.1.1 protocol name and version",
+			Version:  ProtocolV311,
+			Msg:      &Connect{ClientId: "c"},
+			Expected: &Connect{ProtocolName: "MQTT", ProtocolVersion: 4, ClientId: "c"},
+		},
+		{
+			Comment:     "CONNECT for another version",
+			Version:     ProtocolV311,
+			Msg:         &Connect{ProtocolName: "MQIsdp", ProtocolVersion: 3, ClientId: "c"},
+			ExpectError: true,
+		},
+		{
+			Comment:     "CONNECT with mismatched protocol name",
+			Version:     ProtocolV311,
+			Msg:         &Connect{ProtocolName: "MQIsdp", ProtocolVersion: 4, ClientId: "c"},
+			ExpectError: true,
+		},
+		{
+			Comment:     "SUBACK failure return code in 3.1",
+			Version:     ProtocolV31,
+			Msg:         &SubAck{MessageId: 1, TopicsQos: []QosLevel{QosRejected}},
+			ExpectError: true,
+		},
+		{
+			Comment:  "SUBACK failure return code in 3.1.1",
+			Version:  ProtocolV311,
+			Msg:      &SubAck{MessageId: 1, TopicsQos: []QosLevel{QosRejected}},
+			Expected: &SubAck{MessageId: 1, TopicsQos: []QosLevel{QosRejected}},
+		},
+		{
+			Comment:     "CONNACK session present in 3.1",
+			Version:     ProtocolV31,
+			Msg:         &ConnAck{SessionPresent: true},
+			ExpectError: true,
+		},
+		{
+			Comment:  "CONNACK session present in 3.1.1",
+			Version:  ProtocolV311,
+			Msg:      &ConnAck{SessionPresent: true},
+			Expected: &ConnAck{SessionPresent: true},
+		},
+		{
+			Comment: "SUBSCRIBE with QoS 1 header in 3.1.1",
+			Version: ProtocolV311,
+			Msg: &Subscribe{
+				Header:    Header{QosLevel: QosAtLeastOnce},
+				MessageId: 1,
+				Topics:    []TopicQos{{Topic: "a", Qos: QosAtMostOnce}},
+			},
+			Expected: &Subscribe{
+				Header:    Header{QosLevel: QosAtLeastOnce},
+				MessageId: 1,
+				Topics:    []TopicQos{{Topic: "a", Qos: QosAtMostOnce}},
+			},
+		},
+		{
+			Comment: "SUBSCRIBE without QoS 1 header in 3.1.1",
+			Version: ProtocolV311,
+			Msg: &Subscribe{
+				Topics: []TopicQos{{Topic: "a", Qos: QosAtMostOnce}},
+			},
+			ExpectError: true,
+		},
+		{
+			Comment:     "PINGREQ with flags in 3.1.1",
+			Version:     ProtocolV311,
+			Msg:         &PingReq{Header: Header{Retain: true}},
+			ExpectError: true,
+		},
+		{
+			Comment:  "PINGREQ with flags in 3.1",
+			Version:  ProtocolV31,
+			Msg:      &PingReq{Header: Header{Retain: true}},
+			Expected: &PingReq{Header: Header{Retain: true}},
+		},
+	}
+
+	for _, test := range tests {
+		codec, err := NewCodec(test.Version, nil)
+		if err != nil {
+			t.Fatalf("%s: Unexpected error creating codec: %v", test.Comment, err)
+		}
+
+		// Test encoding.
+		buf := new(bytes.Buffer)
+		_, err = codec.Encode(buf, test.Msg)
+		if test.ExpectError {
+			if err == nil {
+				t.Errorf("%s: Expected error during encoding, but got nil.", test.Comment)
+			}
+
+			// Test decoding, bypassing the codec to encode.
+			buf.Reset()
+			if _, err := test.Msg.Encode(buf); err != nil {
+				t.Fatalf("%s: Unexpected error during encoding: %v", test.Comment, err)
+			}
+			if _, err := codec.Decode(buf); err == nil {
+				t.Errorf("%s: Expected error during decoding, but got nil.", test.Comment)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Unexpected error during encoding: %v", test.Comment, err)
+			continue
+		}
+
+		// Test decoding.
+		if msg, err := codec.Decode(buf); err != nil {
+			t.Errorf("%s: Unexpected error during decoding: %v", test.Comment, err)
+		} else if !reflect.DeepEqual(test.Expected, msg) {
+			t.Errorf("%s:\n     got = %#v\nexpected = %#v", test.Comment, msg, test.Expected)
+		}
+	}
+
+	strictTests := []struct {
+		Version     ProtocolVersion
+		Msg         Message
+		ExpectError bool
+	}{
+		{ProtocolV31, &Publish{TopicName: "a/+", Payload: BytesPayload{}}, true},
+		{ProtocolV31, &Connect{ClientId: "c", WillFlag: true, WillTopic: "a/#"}, true},
+		{ProtocolV31, &Connect{ClientId: "", CleanSession: true}, true},
+		{ProtocolV31, &Connect{ClientId: "012345678901234567890123"}, true},
+		{ProtocolV311, &Connect{ClientId: "", CleanSession: false}, true},
+		{ProtocolV311, &Connect{ClientId: "", CleanSession: true}, false},
+		{ProtocolV311, &Connect{ClientId: "012345678901234567890123"}, false},
+	}
+	for _, test := range strictTests {
+		strictCodec := &Codec{Version: test.Version, Strict: true}
+		_, err := strictCodec.Encode(new(bytes.Buffer), test.Msg)
+		if test.ExpectError && err == nil {
+			t.Errorf("%v %#v: Expected error during strict encoding, but got nil.", test.Version, test.Msg)
+		} else if !test.ExpectError && err != nil {
+			t.Errorf("%v %#v: Unexpected error during strict encoding: %v", test.Version, test.Msg, err)
+		}
+
+		nonStrictCodec := &Codec{Version: test.Version}
+		if _, err := nonStrictCodec.Encode(new(bytes.Buffer), test.Msg); err != nil {
+			t.Errorf("%v %#v: Unexpected error during non-strict encoding: %v", test.Version, test.Msg, err)
+		}
+	}
+
+	// A strict codec decodes strictly, refusing reserved bits that only the
+	// decoder sees.
+	strictDecodeTests := []struct {
+		Comment string
+		Version ProtocolVersion
+		Encoded []byte
+	}{
+		{"CONNECT with reserved flag", ProtocolV311, []byte{0x10, 0x0d, 0x00, 0x04, 'M', 'Q', 'T', 'T', 0x04, 0x03, 0x00, 0x00, 0x00, 0x01, 'c'}},
+		{"CONNACK with reserved flags", ProtocolV311, []byte{0x20, 0x02, 0x02, 0x00}},
+		{"MQTT v5 CONNACK with reserved flags", ProtocolV5, []byte{0x20, 0x03, 0x02, 0x00, 0x00}},
+		{"MQTT v5 SUBSCRIBE with reserved option bits", ProtocolV5, []byte{0x82, 0x07, 0x00, 0x01, 0x00, 0x00, 0x01, 'a', 0xc0}},
+	}
+	for _, test := range strictDecodeTests {
+		if _, err := (&Codec{Version: test.Version}).Decode(bytes.NewReader(test.Encoded)); err != nil {
+			t.Errorf("%s: Unexpected error during non-strict decoding: %v", test.Comment, err)
+		}
+		strictCodec := &Codec{Version: test.Version, DecoderConfig: new(MessagePool), Strict: true}
+		if _, err := strictCodec.Decode(bytes.NewReader(test.Encoded)); !errors.Is(err, ErrReservedBits) {
+			t.Errorf("%s: Got %v during strict decoding, expected ErrReservedBits", test.Comment, err)
+		}
+	}
+
+	if _, err := NewCodec(ProtocolVersion(6), nil); err == nil {
+		t.Errorf("Expected error creating codec for unsupported version, but got nil.")
+	}
+}
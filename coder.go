@@ -0,0 +1,61 @@
+package mqtt
+
+import (
+	"bufio"
+	"io"
+)
+
+// DefaultBufferSize is the size of the buffers used by Encoder and Decoder.
+const DefaultBufferSize = 4096
+
+// Encoder writes messages to a connection through a buffer, so that each
+// message (including a BytesPayload) is sent with a single write.
+type Encoder struct {
+	w *bufio.Writer
+}
+
+// NewEncoder creates an Encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{bufio.NewWriterSize(w, DefaultBufferSize)}
+}
+
+// Encode writes msg, and flushes it to the underlying writer.
+func (e *Encoder) Encode(msg Message) error {
+	if _, err := msg.Encode(e.w); err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
+
+// Decoder reads messages from a connection through a buffer. Unlike
+// DecodeOneMessage on an unbuffered connection, the many small reads made
+// while decoding (e.g a byte at a time for the remaining length) do not
+// each become a system call.
+type Decoder struct {
+	r      *bufio.Reader
+	config DecoderConfig
+}
+
+// NewDecoder creates a Decoder that reads from r. config is passed to
+// DecodeOneMessage, and may be nil.
+func NewDecoder(r io.Reader, config DecoderConfig) *Decoder {
+	return &Decoder{bufio.NewReaderSize(r, DefaultBufferSize), config}
+}
+
+// Decode reads the next message.
+func (d *Decoder) Decode() (Message, error) {
+	return DecodeOneMessage(d.r, d.config)
+}
+
+// Buffered returns the number of bytes that have been read from the
+// connection but not yet decoded.
+func (d *Decoder) Buffered() int {
+	return d.r.Buffered()
+}
+
+// Resync discards bytes until the Decoder appears to be positioned at the
+// start of a message, as for the Resync function. Like Decode, it expects
+// MQTT v3.1 or v3.1.1 messages.
+func (d *Decoder) Resync(maxSkip int) (int, error) {
+	return Resync(d.r, ProtocolV311, maxSkip)
+}
@@ -0,0 +1,64 @@
+package mqtt
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// countingWriter counts calls to Write.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+// countingReader counts calls to Read.
+type countingReader struct {
+	r     *bytes.Reader
+	reads int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	r.reads++
+	return r.r.Read(p)
+}
+
+func TestEncoderDecoder(t *testing.T) {
+	msgs := []Message{
+		&Publish{Header: Header{QosLevel: QosAtLeastOnce}, TopicName: "a/b", MessageId: 1, Payload: BytesPayload{1, 2, 3}},
+		&PubAck{MessageId: 1},
+		&PingReq{},
+	}
+
+	w := new(countingWriter)
+	enc := NewEncoder(w)
+	for _, msg := range msgs {
+		if err := enc.Encode(msg); err != nil {
+			t.Fatalf("Unexpected error during encoding: %v", err)
+		}
+	}
+	if w.writes != len(msgs) {
+		t.Errorf("Encoder made %d writes for %d messages", w.writes, len(msgs))
+	}
+
+	r := &countingReader{r: bytes.NewReader(w.Bytes())}
+	dec := NewDecoder(r, nil)
+	for _, expected := range msgs {
+		if msg, err := dec.Decode(); err != nil {
+			t.Errorf("Unexpected error during decoding: %v", err)
+		} else if !reflect.DeepEqual(expected, msg) {
+			t.Errorf("\n     got = %#v\nexpected = %#v", msg, expected)
+		}
+	}
+	if r.reads > 2 {
+		t.Errorf("Decoder made %d reads", r.reads)
+	}
+	if dec.Buffered() != 0 {
+		t.Errorf("%d bytes left buffered", dec.Buffered())
+	}
+}
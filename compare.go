@@ -0,0 +1,111 @@
+package mqtt
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+)
+
+// Comparer compares messages by their content. Unlike reflect.DeepEqual, it
+// ignores the DUP flag (which only says whether a message is a resend) and
+// Metadata (which is never encoded), treats nil and empty slices as equal, and
+// compares BytesPayload values by their bytes. The zero value is ready to use.
+type Comparer struct {
+	// IgnoreMessageId also ignores MessageId fields, e.g for deduplicating
+	// messages that were resent under a different id.
+	IgnoreMessageId bool
+}
+
+// Equal reports whether a and b are the same type of message with the same
+// content.
+func (c Comparer) Equal(a, b Message) bool {
+	return len(c.Diff(a, b)) == 0
+}
+
+// Diff returns a description of each difference between a and b, or nil if
+// they are equal. Each difference is reported as a field path followed by
+// the two values, e.g:
+//
+//	Topics[1].Qos: 1 != 2
+func (c Comparer) Diff(a, b Message) []string {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if !va.IsValid() || !vb.IsValid() || va.Type() != vb.Type() {
+		if !va.IsValid() && !vb.IsValid() {
+			return nil
+		}
+		return []string{fmt.Sprintf("type: %T != %T", a, b)}
+	}
+	if va.Kind() == reflect.Ptr {
+		if va.IsNil() || vb.IsNil() {
+			if va.IsNil() && vb.IsNil() {
+				return nil
+			}
+			return []string{fmt.Sprintf("value: %v != %v", a, b)}
+		}
+		va, vb = va.Elem(), vb.Elem()
+	}
+
+	var diffs []string
+	c.diffValues("", va, vb, &diffs)
+	return diffs
+}
+
+var bytesPayloadType = reflect.TypeOf(BytesPayload(nil))
+
+func (c Comparer) diffValues(path string, a, b reflect.Value, diffs *[]string) {
+	if a.Kind() == reflect.Interface {
+		if a.IsNil() || b.IsNil() || a.Elem().Type() != b.Elem().Type() {
+			if !a.IsNil() || !b.IsNil() {
+				*diffs = append(*diffs, fmt.Sprintf("%s: %#v != %#v", path, a.Interface(), b.Interface()))
+			}
+			return
+		}
+		a, b = a.Elem(), b.Elem()
+	}
+
+	switch {
+	case a.Type() == bytesPayloadType:
+		if !bytes.Equal(a.Bytes(), b.Bytes()) {
+			*diffs = append(*diffs, fmt.Sprintf("%s: %v != %v", path, a.Bytes(), b.Bytes()))
+		}
+
+	case a.Kind() == reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			field := a.Type().Field(i)
+			if field.Name == "DupFlag" || field.Name == "Metadata" || (c.IgnoreMessageId && field.Name == "MessageId") {
+				continue
+			}
+			fieldPath := field.Name
+			if path != "" {
+				fieldPath = path + "." + field.Name
+			}
+			c.diffValues(fieldPath, a.Field(i), b.Field(i), diffs)
+		}
+
+	case a.Kind() == reflect.Slice:
+		if a.Len() != b.Len() {
+			*diffs = append(*diffs, fmt.Sprintf("%s: length %d != %d", path, a.Len(), b.Len()))
+			return
+		}
+		for i := 0; i < a.Len(); i++ {
+			c.diffValues(fmt.Sprintf("%s[%d]", path, i), a.Index(i), b.Index(i), diffs)
+		}
+
+	default:
+		if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+			*diffs = append(*diffs, fmt.Sprintf("%s: %#v != %#v", path, a.Interface(), b.Interface()))
+		}
+	}
+}
+
+// Equal reports whether a and b have the same content, as compared by the
+// zero Comparer.
+func Equal(a, b Message) bool {
+	return Comparer{}.Equal(a, b)
+}
+
+// Diff describes the differences between a and b, as compared by the zero
+// Comparer.
+func Diff(a, b Message) []string {
+	return Comparer{}.Diff(a, b)
+}
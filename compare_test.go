@@ -0,0 +1,112 @@
+package mqtt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		Comment  string
+		Comparer Comparer
+		A, B     Message
+		Expected []string
+	}{
+		{
+			Comment:  "Identical",
+			A:        &PubAck{MessageId: 1},
+			B:        &PubAck{MessageId: 1},
+			Expected: nil,
+		},
+		{
+			Comment:  "Different types",
+			A:        &PubAck{MessageId: 1},
+			B:        &PubRec{MessageId: 1},
+			Expected: []string{"type: *mqtt.PubAck != *mqtt.PubRec"},
+		},
+		{
+			Comment: "DUP flag is ignored",
+			A: &Publish{
+				Header:    Header{DupFlag: true, QosLevel: QosAtLeastOnce},
+				TopicName: "a/b",
+				MessageId: 1,
+				Payload:   BytesPayload{1, 2},
+			},
+			B: &Publish{
+				Header:    Header{QosLevel: QosAtLeastOnce},
+				TopicName: "a/b",
+				MessageId: 1,
+				Payload:   BytesPayload{1, 2},
+			},
+			Expected: nil,
+		},
+		{
+			Comment: "Field differences",
+			A: &Publish{
+				Header:    Header{QosLevel: QosAtLeastOnce},
+				TopicName: "a/b",
+				MessageId: 1,
+				Payload:   BytesPayload{1, 2},
+			},
+			B: &Publish{
+				Header:    Header{QosLevel: QosExactlyOnce},
+				TopicName: "a/c",
+				MessageId: 2,
+				Payload:   BytesPayload{1, 3},
+			},
+			Expected: []string{
+				"Header.QosLevel: 0x1 != 0x2",
+				`TopicName: "a/b" != "a/c"`,
+				"MessageId: 0x1 != 0x2",
+				"Payload: [1 2] != [1 3]",
+			},
+		},
+		{
+			Comment:  "Metadata is ignored",
+			A:        &PubAck{Header: Header{Metadata: &Metadata{"a": 1}}, MessageId: 1},
+			B:        &PubAck{MessageId: 1},
+			Expected: nil,
+		},
+		{
+			Comment:  "MessageId is optionally ignored",
+			Comparer: Comparer{IgnoreMessageId: true},
+			A:        &PubAck{MessageId: 1},
+			B:        &PubAck{MessageId: 2},
+			Expected: nil,
+		},
+		{
+			Comment:  "Nil and empty slices are equal",
+			A:        &Unsubscribe{Topics: nil},
+			B:        &Unsubscribe{Topics: []string{}},
+			Expected: nil,
+		},
+		{
+			Comment: "Slice element differences",
+			A: &Subscribe{Topics: []TopicQos{
+				{Topic: "a/b", Qos: QosAtLeastOnce},
+				{Topic: "c/d", Qos: QosAtLeastOnce},
+			}},
+			B: &Subscribe{Topics: []TopicQos{
+				{Topic: "a/b", Qos: QosAtLeastOnce},
+				{Topic: "c/d", Qos: QosExactlyOnce},
+			}},
+			Expected: []string{"Topics[1].Qos: 0x1 != 0x2"},
+		},
+		{
+			Comment:  "Slice length differences",
+			A:        &SubAck{TopicsQos: []QosLevel{QosAtMostOnce}},
+			B:        &SubAck{TopicsQos: []QosLevel{}},
+			Expected: []string{"TopicsQos: length 1 != 0"},
+		},
+	}
+
+	for _, test := range tests {
+		diffs := test.Comparer.Diff(test.A, test.B)
+		if !reflect.DeepEqual(test.Expected, diffs) {
+			t.Errorf("%s: Diff got %q, expected %q", test.Comment, diffs, test.Expected)
+		}
+		if equal := test.Comparer.Equal(test.A, test.B); equal != (test.Expected == nil) {
+			t.Errorf("%s: Equal got %t", test.Comment, equal)
+		}
+	}
+}
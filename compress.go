@@ -0,0 +1,432 @@
+package mqtt
+
+import (
+	"bytes"
+	"compress/flate"
+	"container/heap"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+)
+
+// MaxDictionarySize is the largest useful dictionary, as DEFLATE cannot
+// refer further back than 32KB.
+const MaxDictionarySize = 32 << 10
+
+// DefaultMaxDecompressedRatio and DefaultMinDecompressedSize limit the
+// size of decompressed payloads when Dictionaries.MaxSize is zero, to the
+// ratio times the compressed size, or the minimum size if that is larger.
+// Without a limit, a small packet could decompress into gigabytes.
+const (
+	DefaultMaxDecompressedRatio = 64
+	DefaultMinDecompressedSize  = 64 << 10
+)
+
+const (
+	// dictionaryKmer is the length of the substrings whose frequency across
+	// samples decides what goes in a dictionary.
+	dictionaryKmer = 6
+	// dictionarySegment is the length of the pieces of samples that a
+	// dictionary is made of.
+	dictionarySegment = 16
+	// defaultMaxSamples is the number of samples a DictionaryTrainer keeps
+	// for each family, if not set.
+	defaultMaxSamples = 1000
+)
+
+// Dictionary is a preset dictionary for DEFLATE compression of payloads.
+// DEFLATE is used rather than zstd, as the package depends only on the
+// standard library, which has no zstd. Small payloads that repeat the same
+// structure, such as JSON telemetry, compress far better with a dictionary
+// trained from samples of them than alone.
+//
+// To distribute a dictionary, publish Data (e.g as a retained message), and
+// have receivers pass it to NewDictionary and add it to their Dictionaries.
+type Dictionary struct {
+	// Id identifies the dictionary in compressed payloads. It is the CRC-32C
+	// of Data, except that 0 (which means no dictionary) becomes 1.
+	Id   uint32
+	Data []byte
+
+	writers sync.Pool
+}
+
+// NewDictionary creates a Dictionary from data, which is at most
+// MaxDictionarySize bytes; DEFLATE ignores any more before that.
+func NewDictionary(data []byte) *Dictionary {
+	if len(data) > MaxDictionarySize {
+		data = data[len(data)-MaxDictionarySize:]
+	}
+	id := crc32.Checksum(data, castagnoliTable)
+	if id == 0 {
+		id = 1
+	}
+	return &Dictionary{Id: id, Data: data}
+}
+
+// TrainDictionary builds a dictionary of up to size bytes (or
+// MaxDictionarySize if size is 0) from samples of payloads. It is made of
+// the pieces of the samples that contain the most substrings which recur
+// across samples, with the most valuable last, where DEFLATE refers to them
+// most cheaply. nil is returned if the samples have nothing in common.
+func TrainDictionary(samples [][]byte, size int) *Dictionary {
+	if size <= 0 || size > MaxDictionarySize {
+		size = MaxDictionarySize
+	}
+
+	// Count the samples that each k-mer appears in. Those that appear in a
+	// single sample are no use for compressing others.
+	freq := make(map[string]int)
+	for _, sample := range samples {
+		seen := make(map[string]bool)
+		for i := 0; i+dictionaryKmer <= len(sample); i++ {
+			kmer := string(sample[i : i+dictionaryKmer])
+			if !seen[kmer] {
+				seen[kmer] = true
+				freq[kmer]++
+			}
+		}
+	}
+	covered := make(map[string]bool)
+	score := func(segment []byte) int {
+		total := 0
+		for i := 0; i+dictionaryKmer <= len(segment); i++ {
+			kmer := string(segment[i : i+dictionaryKmer])
+			if n := freq[kmer]; n > 1 && !covered[kmer] {
+				total += n
+			}
+		}
+		return total
+	}
+
+	candidates := &segmentHeap{}
+	for _, sample := range samples {
+		for i := 0; i+dictionarySegment <= len(sample); i++ {
+			segment := sample[i : i+dictionarySegment]
+			if s := score(segment); s > 0 {
+				candidates.segments = append(candidates.segments, scoredSegment{segment, s})
+			}
+		}
+	}
+	heap.Init(candidates)
+
+	// Take the best segment each time, rescoring it first, as the segments
+	// already taken cover some of its k-mers.
+	var chosen [][]byte
+	for candidates.Len() > 0 && (len(chosen)+1)*dictionarySegment <= size {
+		best := heap.Pop(candidates).(scoredSegment)
+		best.score = score(best.segment)
+		if best.score == 0 {
+			continue
+		}
+		if candidates.Len() > 0 && best.score < candidates.segments[0].score {
+			heap.Push(candidates, best)
+			continue
+		}
+		chosen = append(chosen, best.segment)
+		for i := 0; i+dictionaryKmer <= len(best.segment); i++ {
+			covered[string(best.segment[i:i+dictionaryKmer])] = true
+		}
+	}
+	if len(chosen) == 0 {
+		return nil
+	}
+
+	data := make([]byte, 0, len(chosen)*dictionarySegment)
+	for i := len(chosen) - 1; i >= 0; i-- {
+		data = append(data, chosen[i]...)
+	}
+	return NewDictionary(data)
+}
+
+type scoredSegment struct {
+	segment []byte
+	score   int
+}
+
+// segmentHeap is a max-heap of segments by score.
+type segmentHeap struct {
+	segments []scoredSegment
+}
+
+func (h *segmentHeap) Len() int           { return len(h.segments) }
+func (h *segmentHeap) Less(i, j int) bool { return h.segments[i].score > h.segments[j].score }
+func (h *segmentHeap) Swap(i, j int)      { h.segments[i], h.segments[j] = h.segments[j], h.segments[i] }
+func (h *segmentHeap) Push(x interface{}) { h.segments = append(h.segments, x.(scoredSegment)) }
+
+func (h *segmentHeap) Pop() interface{} {
+	last := h.segments[len(h.segments)-1]
+	h.segments = h.segments[:len(h.segments)-1]
+	return last
+}
+
+// DictionaryTrainer samples payloads by topic family (a topic filter), and
+// trains a dictionary for each family.
+type DictionaryTrainer struct {
+	// Size is the size of the dictionaries to train. Zero means
+	// MaxDictionarySize.
+	Size int
+	// MaxSamples is the number of payloads kept for each family, which are
+	// a random selection of those sampled. Zero means 1000.
+	MaxSamples int
+
+	mu       sync.Mutex
+	families []*trainingFamily
+}
+
+type trainingFamily struct {
+	filter  *TopicFilter
+	samples [][]byte
+	seen    int
+}
+
+// AddFamily adds a family of topics that share a dictionary. An error is
+// returned if filter is not a valid topic filter.
+func (t *DictionaryTrainer) AddFamily(filter string) error {
+	f, err := NewTopicFilter(filter)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.families = append(t.families, &trainingFamily{filter: f})
+	t.mu.Unlock()
+	return nil
+}
+
+// Sample offers a payload published to topic for training. It is copied
+// into the first family (in the order they were added) that matches topic,
+// and false is returned if none does.
+func (t *DictionaryTrainer) Sample(topic string, payload []byte) bool {
+	max := t.MaxSamples
+	if max <= 0 {
+		max = defaultMaxSamples
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, f := range t.families {
+		if !f.filter.Matches(topic) {
+			continue
+		}
+		// Keep a uniform random selection of the payloads seen.
+		f.seen++
+		sample := append([]byte(nil), payload...)
+		if len(f.samples) < max {
+			f.samples = append(f.samples, sample)
+		} else if i := rand.Intn(f.seen); i < max {
+			f.samples[i] = sample
+		}
+		return true
+	}
+	return false
+}
+
+// Train trains a dictionary for each family from its samples, and returns
+// them. Families whose samples have nothing in common get no dictionary.
+func (t *DictionaryTrainer) Train() *Dictionaries {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	dicts := &Dictionaries{}
+	for _, f := range t.families {
+		if dict := TrainDictionary(f.samples, t.Size); dict != nil {
+			dicts.add(f.filter, dict)
+		}
+	}
+	return dicts
+}
+
+// Dictionaries holds the dictionaries of topic families, for compressing
+// payloads, and every dictionary added by id, for decompressing them. It is
+// a DecoderConfig that decodes every Publish payload as a
+// *CompressedPayload. It is safe for concurrent use, and the zero value has
+// no dictionaries.
+type Dictionaries struct {
+	// MaxSize limits the size of a decompressed payload, beyond which
+	// decoding fails with ErrMessageTooLong. Zero means the default limit,
+	// which depends on the compressed size (see DefaultMaxDecompressedRatio).
+	MaxSize int
+
+	mu       sync.RWMutex
+	families []familyDictionary
+	byId     map[uint32]*Dictionary
+}
+
+type familyDictionary struct {
+	filter *TopicFilter
+	dict   *Dictionary
+}
+
+// Add sets the dictionary of the family of topics that match filter,
+// replacing any that it had. Replaced dictionaries are kept for
+// decompressing payloads that were compressed with them. An error is
+// returned if filter is not a valid topic filter.
+func (d *Dictionaries) Add(filter string, dict *Dictionary) error {
+	f, err := NewTopicFilter(filter)
+	if err != nil {
+		return err
+	}
+	d.add(f, dict)
+	return nil
+}
+
+func (d *Dictionaries) add(filter *TopicFilter, dict *Dictionary) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.byId == nil {
+		d.byId = make(map[uint32]*Dictionary)
+	}
+	d.byId[dict.Id] = dict
+	for i := range d.families {
+		if d.families[i].filter.String() == filter.String() {
+			d.families[i].dict = dict
+			return
+		}
+	}
+	d.families = append(d.families, familyDictionary{filter, dict})
+}
+
+// ForTopic returns the dictionary of the first family (in the order they
+// were added) that matches topic, or nil if none does.
+func (d *Dictionaries) ForTopic(topic string) *Dictionary {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, f := range d.families {
+		if f.filter.Matches(topic) {
+			return f.dict
+		}
+	}
+	return nil
+}
+
+// Get returns the dictionary with id, or nil if it has not been added.
+func (d *Dictionaries) Get(id uint32) *Dictionary {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.byId[id]
+}
+
+// Compress compresses data for publishing to topic, with the dictionary of
+// its family if it has one.
+func (d *Dictionaries) Compress(topic string, data []byte) (*CompressedPayload, error) {
+	return NewCompressedPayload(d.ForTopic(topic), data)
+}
+
+func (d *Dictionaries) MakePayload(msg *Publish, r io.Reader, n int) (Payload, error) {
+	return &CompressedPayload{dicts: d, n: n}, nil
+}
+
+// CompressedPayload is a payload compressed with DEFLATE. It is encoded as
+// the 4 byte big-endian id of the dictionary it was compressed with (or 0
+// for none), then the compressed data. Decoding with a Dictionaries as the
+// DecoderConfig decompresses it.
+type CompressedPayload struct {
+	// Dictionary is the dictionary that the payload is compressed with, or
+	// nil for none.
+	Dictionary *Dictionary
+	// Data is the uncompressed payload.
+	Data []byte
+
+	encoded []byte
+	dicts   *Dictionaries
+	n       int
+}
+
+// NewCompressedPayload compresses data with dict, which may be nil.
+func NewCompressedPayload(dict *Dictionary, data []byte) (*CompressedPayload, error) {
+	var buf bytes.Buffer
+	var id uint32
+	if dict != nil {
+		id = dict.Id
+	}
+	binary.Write(&buf, binary.BigEndian, id)
+
+	w, err := dict.writer(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	dict.putWriter(w)
+	return &CompressedPayload{Dictionary: dict, Data: data, encoded: buf.Bytes()}, nil
+}
+
+func (p *CompressedPayload) Size() int {
+	return len(p.encoded)
+}
+
+func (p *CompressedPayload) WritePayload(w io.Writer) (int, error) {
+	return w.Write(p.encoded)
+}
+
+// ReadPayload reads the payload, and decompresses it into Data.
+// ErrUnknownDictionary is returned if it was compressed with a dictionary
+// that has not been added to the Dictionaries.
+func (p *CompressedPayload) ReadPayload(r io.Reader) error {
+	encoded := make([]byte, p.n)
+	if _, err := io.ReadFull(r, encoded); err != nil {
+		return err
+	}
+	if len(encoded) < 4 {
+		return io.ErrUnexpectedEOF
+	}
+	p.encoded = encoded
+
+	var dictData []byte
+	if id := binary.BigEndian.Uint32(encoded); id != 0 {
+		if p.Dictionary = p.dicts.Get(id); p.Dictionary == nil {
+			return ErrUnknownDictionary
+		}
+		dictData = p.Dictionary.Data
+	}
+	maxSize := p.dicts.MaxSize
+	if maxSize == 0 {
+		maxSize = DefaultMaxDecompressedRatio * p.n
+		if maxSize < DefaultMinDecompressedSize {
+			maxSize = DefaultMinDecompressedSize
+		}
+	}
+	fr := flate.NewReaderDict(bytes.NewReader(encoded[4:]), dictData)
+	data, err := ioutil.ReadAll(io.LimitReader(fr, int64(maxSize)+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxSize {
+		return ErrMessageTooLong
+	}
+	p.Data = data
+	return nil
+}
+
+// plainWriters holds DEFLATE writers without a dictionary.
+var plainWriters sync.Pool
+
+// writer returns a DEFLATE writer to w, with the dictionary if it is not
+// nil. Writers are reused, as they are expensive to create.
+func (d *Dictionary) writer(w io.Writer) (*flate.Writer, error) {
+	pool := &plainWriters
+	if d != nil {
+		pool = &d.writers
+	}
+	if fw, ok := pool.Get().(*flate.Writer); ok {
+		fw.Reset(w)
+		return fw, nil
+	}
+	if d == nil {
+		return flate.NewWriter(w, flate.BestCompression)
+	}
+	return flate.NewWriterDict(w, flate.BestCompression, d.Data)
+}
+
+func (d *Dictionary) putWriter(fw *flate.Writer) {
+	if d == nil {
+		plainWriters.Put(fw)
+	} else {
+		d.writers.Put(fw)
+	}
+}
@@ -0,0 +1,149 @@
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// telemetry returns a small JSON payload like those that devices publish.
+func telemetry(i int) []byte {
+	return []byte(fmt.Sprintf(`{"device":"sensor-%03d","temperature":%d.%d,"humidity":%d,"battery":%d,"status":"ok"}`,
+		i%50, 15+i%10, i%7, 40+i%20, 100-i%30))
+}
+
+func TestTrainDictionary(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 200; i++ {
+		samples = append(samples, telemetry(i))
+	}
+	dict := TrainDictionary(samples, 1024)
+	if dict == nil {
+		t.Fatalf("No dictionary was trained")
+	}
+	if len(dict.Data) > 1024 {
+		t.Errorf("Dictionary is %d bytes, expected at most 1024", len(dict.Data))
+	}
+	if !bytes.Contains(dict.Data, []byte(`"temperature":`)) {
+		t.Errorf("Dictionary %q lacks a common key", dict.Data)
+	}
+
+	payload := telemetry(1234)
+	plain, err := NewCompressedPayload(nil, payload)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	trained, err := NewCompressedPayload(dict, payload)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if trained.Size() >= plain.Size()*2/3 {
+		t.Errorf("Compressed to %d bytes with the dictionary, %d without; expected a bigger win", trained.Size(), plain.Size())
+	}
+
+	if dict := TrainDictionary([][]byte{[]byte("abcdefghijklmnopqrstuvwxyz")}, 0); dict != nil {
+		t.Errorf("Trained %q from a single sample", dict.Data)
+	}
+}
+
+func TestDictionaryTrainer(t *testing.T) {
+	trainer := &DictionaryTrainer{MaxSamples: 50}
+	for _, filter := range []string{"sensors/+/telemetry", "logs/#"} {
+		if err := trainer.AddFamily(filter); err != nil {
+			t.Fatalf("Unexpected error adding %q: %v", filter, err)
+		}
+	}
+	if err := trainer.AddFamily("bad/#/filter"); err == nil {
+		t.Errorf("Added an invalid filter")
+	}
+	for i := 0; i < 200; i++ {
+		if !trainer.Sample(fmt.Sprintf("sensors/%d/telemetry", i), telemetry(i)) {
+			t.Fatalf("Telemetry sample was not taken")
+		}
+		trainer.Sample("logs/app", []byte(fmt.Sprintf("level=info msg=\"request served\" id=%d", i)))
+	}
+	if trainer.Sample("other", []byte("x")) {
+		t.Errorf("Sample taken for a topic in no family")
+	}
+
+	dicts := trainer.Train()
+	sensors, logs := dicts.ForTopic("sensors/7/telemetry"), dicts.ForTopic("logs/app")
+	if sensors == nil || logs == nil || sensors == logs {
+		t.Fatalf("Got dictionaries %p and %p, expected one for each family", sensors, logs)
+	}
+	if dicts.ForTopic("other") != nil {
+		t.Errorf("Got a dictionary for a topic in no family")
+	}
+
+	// Payloads compressed with the dictionaries decode with them, whatever
+	// topic they arrive on.
+	codec := &Codec{Version: ProtocolV311, DecoderConfig: dicts}
+	for _, topic := range []string{"sensors/7/telemetry", "logs/app", "other"} {
+		data := []byte(topic + " payload")
+		payload, err := dicts.Compress(topic, data)
+		if err != nil {
+			t.Fatalf("%s: Unexpected error compressing: %v", topic, err)
+		}
+		var buf bytes.Buffer
+		if _, err := codec.Encode(&buf, &Publish{TopicName: topic, Payload: payload}); err != nil {
+			t.Fatalf("%s: Unexpected error encoding: %v", topic, err)
+		}
+		msg, err := codec.Decode(&buf)
+		if err != nil {
+			t.Fatalf("%s: Unexpected error decoding: %v", topic, err)
+		}
+		got := msg.(*Publish).Payload.(*CompressedPayload)
+		if !bytes.Equal(got.Data, data) || got.Dictionary != payload.Dictionary {
+			t.Errorf("%s: Decoded %q with %p, expected %q with %p", topic, got.Data, got.Dictionary, data, payload.Dictionary)
+		}
+	}
+}
+
+func TestCompressedPayloadErrors(t *testing.T) {
+	dict := NewDictionary([]byte(`{"temperature":`))
+	payload, err := NewCompressedPayload(dict, bytes.Repeat([]byte(`{"temperature":20}`), 10))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var buf bytes.Buffer
+	codec := &Codec{Version: ProtocolV311}
+	if _, err := codec.Encode(&buf, &Publish{TopicName: "a", Payload: payload}); err != nil {
+		t.Fatalf("Unexpected error encoding: %v", err)
+	}
+	encoded := buf.Bytes()
+
+	limited := &Dictionaries{MaxSize: 100}
+	if err := limited.Add("a", dict); err != nil {
+		t.Fatalf("Unexpected error adding: %v", err)
+	}
+	tests := []struct {
+		Comment  string
+		Dicts    *Dictionaries
+		Expected error
+	}{
+		{"Unknown dictionary", &Dictionaries{}, ErrUnknownDictionary},
+		{"Payload too large", limited, ErrMessageTooLong},
+	}
+	for _, test := range tests {
+		codec := &Codec{Version: ProtocolV311, DecoderConfig: test.Dicts}
+		if _, err := codec.Decode(bytes.NewReader(encoded)); !errors.Is(err, test.Expected) {
+			t.Errorf("%s: Got %v, expected %v", test.Comment, err, test.Expected)
+		}
+	}
+
+	// Without a MaxSize, a payload that expands far beyond its compressed
+	// size is refused.
+	bomb, err := NewCompressedPayload(nil, make([]byte, 10<<20))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	buf.Reset()
+	if _, err := codec.Encode(&buf, &Publish{TopicName: "a", Payload: bomb}); err != nil {
+		t.Fatalf("Unexpected error encoding: %v", err)
+	}
+	codec = &Codec{Version: ProtocolV311, DecoderConfig: &Dictionaries{}}
+	if _, err := codec.Decode(&buf); !errors.Is(err, ErrMessageTooLong) {
+		t.Errorf("Got %v decoding %d bytes that decompress to 10MiB, expected ErrMessageTooLong", err, bomb.Size())
+	}
+}
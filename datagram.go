@@ -0,0 +1,42 @@
+package mqtt
+
+import (
+	"bytes"
+)
+
+// DecodeDatagram decodes a single message from frame, for transports that
+// carry exactly one packet per frame (e.g a WebSocket message, or a UDP
+// datagram). Unlike DecodeOneMessage, it returns an error if the packet does
+// not fill the whole frame, rather than leaving trailing bytes unread.
+func DecodeDatagram(frame []byte, config DecoderConfig) (Message, error) {
+	return decodeDatagram(frame, bytes.NewReader(frame), config)
+}
+
+// decodeDatagram implements DecodeDatagram, reading frame with r.
+func decodeDatagram(frame []byte, r *bytes.Reader, config DecoderConfig) (Message, error) {
+	size, err := packetSize(frame)
+	if err != nil {
+		return nil, err
+	}
+	if size != len(frame) {
+		return nil, ErrFrameSize
+	}
+
+	msg, err := DecodeOneMessage(r, config)
+	if err != nil {
+		return nil, err
+	}
+	if r.Len() != 0 {
+		return nil, ErrFrameSize
+	}
+	return msg, nil
+}
+
+// EncodeDatagram encodes msg into a new frame holding only that packet.
+func EncodeDatagram(msg Message) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if _, err := msg.Encode(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
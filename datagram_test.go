@@ -0,0 +1,32 @@
+package mqtt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDatagram(t *testing.T) {
+	expected := &PubAck{MessageId: 0x1234}
+	frame, err := EncodeDatagram(expected)
+	if err != nil {
+		t.Fatalf("Unexpected error during encoding: %v", err)
+	}
+	if msg, err := DecodeDatagram(frame, nil); err != nil {
+		t.Errorf("Unexpected error during decoding: %v", err)
+	} else if !reflect.DeepEqual(expected, msg) {
+		t.Errorf("\n     got = %#v\nexpected = %#v", msg, expected)
+	}
+
+	badFrames := [][]byte{
+		{},                                   // Empty.
+		{0x40, 0x02, 0x12},                   // Truncated.
+		{0x40, 0x02, 0x12, 0x34, 0x00},       // Trailing byte.
+		{0x40, 0x02, 0x12, 0x34, 0xc0, 0x00}, // Trailing packet.
+		{0x40, 0xff, 0xff, 0xff, 0xff, 0x01}, // Bad length encoding.
+	}
+	for _, frame := range badFrames {
+		if _, err := DecodeDatagram(frame, nil); err == nil {
+			t.Errorf("%#v: Expected error, but got nil.", frame)
+		}
+	}
+}
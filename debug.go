@@ -0,0 +1,238 @@
+package mqtt
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// debugEnabled is non-zero while the counters are enabled.
+var debugEnabled int32
+
+// debugCounters holds the counters behind DebugSnapshot. They are only
+// changed atomically. Every field is 64 bits, so they are all aligned for
+// atomic access on 32-bit platforms.
+var debugCounters struct {
+	decoded      [16]uint64
+	decodeErrors uint64
+	bytesDecoded uint64
+	encoded      [16]uint64
+	encodeErrors uint64
+	bytesEncoded uint64
+
+	poolGets     uint64
+	poolMisses   uint64
+	poolReleases uint64
+	buffersInUse int64
+
+	openClients       int64
+	runningKeepalives int64
+	storedSessions    int64
+}
+
+// DebugStats is a snapshot of the counters that the package keeps across
+// all of its codecs, pools, clients and stores, to help find leaks in
+// tests (see mqtttest.RunLeakChecked) and long running processes. The
+// counters are off unless enabled with EnableDebugStats. Its String method
+// describes every counter, and it can be marshalled to JSON, e.g for a
+// debugging endpoint.
+type DebugStats struct {
+	// Decoded counts the messages decoded by DecodeOneMessage (and so by
+	// Codec, Client, etc), by type name (e.g "PUBLISH"), DecodeErrors the
+	// packets that failed to decode, and BytesDecoded the bytes read by
+	// decoding, whether it succeeded or not.
+	Decoded      map[string]uint64
+	DecodeErrors uint64
+	BytesDecoded uint64
+	// Encoded counts the messages encoded by their Encode and AppendTo
+	// methods (and so by Codec, Client, etc), by type name, EncodeErrors
+	// those that failed, and BytesEncoded the bytes encoded. A message
+	// decoded from the encoding of another is counted the same way by each.
+	Encoded      map[string]uint64
+	EncodeErrors uint64
+	BytesEncoded uint64
+
+	// PoolGets counts the messages handed out by MessagePools to decode
+	// into, PoolMisses those of them that were newly allocated, and
+	// PoolReleases the messages released back.
+	PoolGets     uint64
+	PoolMisses   uint64
+	PoolReleases uint64
+	// BuffersInUse is the number of encoding buffers taken from the
+	// package's buffer pool and not yet returned.
+	BuffersInUse int64
+
+	// OpenClients is the number of Clients that have started to connect
+	// and whose connections have not ended.
+	OpenClients int64
+	// RunningKeepalives is the number of Keepalives that have been started
+	// and not stopped.
+	RunningKeepalives int64
+	// StoredSessions is the number of sessions that MemorySessionStores and
+	// FileSessionStores have created and not deleted, including those of
+	// stores that are no longer used.
+	StoredSessions int64
+}
+
+// EnableDebugStats turns the counters behind DebugSnapshot on or off. They
+// are off by default, so that encoding and decoding do not contend on them.
+// Enable them before starting anything that they count, e.g in TestMain:
+// the messages in a pool, encoding buffers and sessions are only counted
+// right if they are counted both when they are taken and when they are
+// given back. Clients and Keepalives that were started while the counters
+// were off are never counted.
+func EnableDebugStats(enable bool) {
+	var enabled int32
+	if enable {
+		enabled = 1
+	}
+	atomic.StoreInt32(&debugEnabled, enabled)
+}
+
+// debugging returns whether the counters are enabled.
+func debugging() bool {
+	return atomic.LoadInt32(&debugEnabled) != 0
+}
+
+// debugCount adds one to counter, if the counters are enabled.
+func debugCount(counter *uint64) {
+	if debugging() {
+		atomic.AddUint64(counter, 1)
+	}
+}
+
+// debugGauge adds delta to gauge, if the counters are enabled.
+func debugGauge(gauge *int64, delta int64) {
+	if debugging() {
+		atomic.AddInt64(gauge, delta)
+	}
+}
+
+// debugStart adds one to gauge if the counters are enabled, and returns
+// whether it did, so that debugEnd is only called for what was counted.
+func debugStart(gauge *int64) bool {
+	if debugging() {
+		atomic.AddInt64(gauge, 1)
+		return true
+	}
+	return false
+}
+
+// debugEnd subtracts one from gauge, for something counted by debugStart.
+func debugEnd(gauge *int64) {
+	atomic.AddInt64(gauge, -1)
+}
+
+// DebugSnapshot returns the current values of the package's counters.
+func DebugSnapshot() *DebugStats {
+	c := &debugCounters
+	s := &DebugStats{
+		Decoded:      make(map[string]uint64),
+		DecodeErrors: atomic.LoadUint64(&c.decodeErrors),
+		BytesDecoded: atomic.LoadUint64(&c.bytesDecoded),
+		Encoded:      make(map[string]uint64),
+		EncodeErrors: atomic.LoadUint64(&c.encodeErrors),
+		BytesEncoded: atomic.LoadUint64(&c.bytesEncoded),
+
+		PoolGets:     atomic.LoadUint64(&c.poolGets),
+		PoolMisses:   atomic.LoadUint64(&c.poolMisses),
+		PoolReleases: atomic.LoadUint64(&c.poolReleases),
+		BuffersInUse: atomic.LoadInt64(&c.buffersInUse),
+
+		OpenClients:       atomic.LoadInt64(&c.openClients),
+		RunningKeepalives: atomic.LoadInt64(&c.runningKeepalives),
+		StoredSessions:    atomic.LoadInt64(&c.storedSessions),
+	}
+	for i := range c.decoded {
+		if n := atomic.LoadUint64(&c.decoded[i]); n != 0 {
+			s.Decoded[MessageType(i).String()] = n
+		}
+		if n := atomic.LoadUint64(&c.encoded[i]); n != 0 {
+			s.Encoded[MessageType(i).String()] = n
+		}
+	}
+	return s
+}
+
+// Sub returns the change in each counter since base, an earlier snapshot.
+func (s *DebugStats) Sub(base *DebugStats) *DebugStats {
+	diff := *s
+	diff.Decoded = subCounts(s.Decoded, base.Decoded)
+	diff.DecodeErrors -= base.DecodeErrors
+	diff.BytesDecoded -= base.BytesDecoded
+	diff.Encoded = subCounts(s.Encoded, base.Encoded)
+	diff.EncodeErrors -= base.EncodeErrors
+	diff.BytesEncoded -= base.BytesEncoded
+	diff.PoolGets -= base.PoolGets
+	diff.PoolMisses -= base.PoolMisses
+	diff.PoolReleases -= base.PoolReleases
+	diff.BuffersInUse -= base.BuffersInUse
+	diff.OpenClients -= base.OpenClients
+	diff.RunningKeepalives -= base.RunningKeepalives
+	diff.StoredSessions -= base.StoredSessions
+	return &diff
+}
+
+func subCounts(counts, base map[string]uint64) map[string]uint64 {
+	diff := make(map[string]uint64)
+	for name, n := range counts {
+		if n -= base[name]; n != 0 {
+			diff[name] = n
+		}
+	}
+	return diff
+}
+
+// String returns each counter on a line of its own, with counts by
+// message type in alphabetical order of the type.
+func (s *DebugStats) String() string {
+	var b strings.Builder
+	v := reflect.ValueOf(s).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name, field := v.Type().Field(i).Name, v.Field(i)
+		if counts, ok := field.Interface().(map[string]uint64); ok {
+			types := make([]string, 0, len(counts))
+			for msgType := range counts {
+				types = append(types, msgType)
+			}
+			sort.Strings(types)
+			for _, msgType := range types {
+				fmt.Fprintf(&b, "%s[%s] %d\n", name, msgType, counts[msgType])
+			}
+			continue
+		}
+		fmt.Fprintf(&b, "%s %v\n", name, field.Interface())
+	}
+	return b.String()
+}
+
+// countDecode counts the outcome of decoding a message of msgType, after
+// reading n bytes. A clean EOF between messages is not counted.
+func countDecode(msgType MessageType, n int64, err error) {
+	if !debugging() || err == io.EOF && n == 0 {
+		return
+	}
+	atomic.AddUint64(&debugCounters.bytesDecoded, uint64(n))
+	if err != nil {
+		atomic.AddUint64(&debugCounters.decodeErrors, 1)
+		return
+	}
+	atomic.AddUint64(&debugCounters.decoded[msgType&0x0f], 1)
+}
+
+// countEncode counts the outcome of encoding a message of msgType in n
+// bytes.
+func countEncode(msgType MessageType, n int, err error) {
+	if !debugging() {
+		return
+	}
+	atomic.AddUint64(&debugCounters.bytesEncoded, uint64(n))
+	if err != nil {
+		atomic.AddUint64(&debugCounters.encodeErrors, 1)
+		return
+	}
+	atomic.AddUint64(&debugCounters.encoded[msgType&0x0f], 1)
+}
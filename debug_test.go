@@ -0,0 +1,109 @@
+package mqtt
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDebugSnapshot(t *testing.T) {
+	EnableDebugStats(true)
+	defer EnableDebugStats(false)
+	base := DebugSnapshot()
+	codec := &Codec{Version: ProtocolV311}
+	var buf bytes.Buffer
+	n, err := codec.Encode(&buf, &Publish{TopicName: "a/b", Payload: BytesPayload("x")})
+	if err != nil {
+		t.Fatalf("Unexpected error encoding: %v", err)
+	}
+	if _, err := codec.Encode(&buf, &PingReq{}); err != nil {
+		t.Fatalf("Unexpected error encoding: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := codec.Decode(&buf); err != nil {
+			t.Fatalf("Unexpected error decoding: %v", err)
+		}
+	}
+	codec.Decode(bytes.NewReader([]byte{0x00, 0x00}))
+	codec.Decode(&buf)
+
+	store := &MemorySessionStore{}
+	store.PutNextMessageId("c", 1)
+
+	diff := DebugSnapshot().Sub(base)
+	if diff.Encoded["PUBLISH"] != 1 || diff.Encoded["PINGREQ"] != 1 || diff.BytesEncoded != uint64(n+2) {
+		t.Errorf("Encoded %v in %d bytes", diff.Encoded, diff.BytesEncoded)
+	}
+	if diff.Decoded["PUBLISH"] != 1 || diff.Decoded["PINGREQ"] != 1 || diff.DecodeErrors != 1 {
+		t.Errorf("Decoded %v with %d errors", diff.Decoded, diff.DecodeErrors)
+	}
+	if diff.BytesDecoded != uint64(n+2+2) {
+		t.Errorf("Decoded %d bytes, expected %d", diff.BytesDecoded, n+2+2)
+	}
+	if diff.StoredSessions != 1 {
+		t.Errorf("Stored %d sessions, expected 1", diff.StoredSessions)
+	}
+	store.Delete("c")
+	if diff := DebugSnapshot().Sub(base); diff.StoredSessions != 0 {
+		t.Errorf("Stored %d sessions after deleting, expected 0", diff.StoredSessions)
+	}
+
+	s := diff.String()
+	for _, line := range []string{"Encoded[PINGREQ] 1\n", "DecodeErrors 1\n", "StoredSessions 1\n", "OpenClients 0\n"} {
+		if !strings.Contains(s, line) {
+			t.Errorf("String lacks %q:\n%s", line, s)
+		}
+	}
+}
+
+// Every message is counted the same way when it is encoded, by any means,
+// as when it is decoded.
+func TestDebugStatsReconcile(t *testing.T) {
+	EnableDebugStats(true)
+	defer EnableDebugStats(false)
+
+	msgs := []Message{
+		&Connect{ProtocolName: "MQTT", ProtocolVersion: 4, ClientId: "c", CleanSession: true},
+		&Publish{Header: Header{QosLevel: QosAtLeastOnce}, TopicName: "a/b", MessageId: 1, Payload: BytesPayload("x")},
+		&PubAck{MessageId: 1},
+		&Subscribe{Header: Header{QosLevel: QosAtLeastOnce}, MessageId: 2, Topics: []TopicQos{{Topic: "a/#"}}},
+		&PingReq{},
+		&Disconnect{},
+		&RawMessage{HeaderByte: 0xf0, Body: []byte{1}},
+	}
+	config := reservedPolicyDecoderConfig{Policy: PassReserved}
+	for _, encode := range []string{"Encode", "AppendTo"} {
+		before := DebugSnapshot()
+		var buf bytes.Buffer
+		for _, msg := range msgs {
+			var err error
+			if encode == "Encode" {
+				_, err = msg.Encode(&buf)
+			} else {
+				var b []byte
+				b, err = msg.(interface {
+					AppendTo(b []byte) ([]byte, error)
+				}).AppendTo(nil)
+				buf.Write(b)
+			}
+			if err != nil {
+				t.Fatalf("%s: Unexpected error encoding %T: %v", encode, msg, err)
+			}
+		}
+		encoded := DebugSnapshot().Sub(before)
+		for range msgs {
+			if _, err := DecodeOneMessage(&buf, config); err != nil {
+				t.Fatalf("%s: Unexpected error decoding: %v", encode, err)
+			}
+		}
+		decoded := DebugSnapshot().Sub(before)
+
+		if len(encoded.Encoded) != len(msgs) || !reflect.DeepEqual(encoded.Encoded, decoded.Decoded) {
+			t.Errorf("%s: Encoded %v, decoded %v", encode, encoded.Encoded, decoded.Decoded)
+		}
+		if encoded.BytesEncoded != decoded.BytesDecoded {
+			t.Errorf("%s: Encoded %d bytes, decoded %d", encode, encoded.BytesEncoded, decoded.BytesDecoded)
+		}
+	}
+}
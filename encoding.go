@@ -3,41 +3,86 @@ package mqtt
 import (
 	"bytes"
 	"io"
+	"sync"
 )
 
+// maxPooledBufferSize is the capacity above which encoding buffers are left
+// for the garbage collector rather than being returned to bufferPool.
+const maxPooledBufferSize = 64 * 1024
+
+// bufferPool holds buffers for encoding messages into.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	debugGauge(&debugCounters.buffersInUse, 1)
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	debugGauge(&debugCounters.buffersInUse, -1)
+	if buf.Cap() <= maxPooledBufferSize {
+		bufferPool.Put(buf)
+	}
+}
+
+// readByte reads a single byte from r. It avoids allocating when r is an
+// io.ByteReader (such as a *bufio.Reader).
+func readByte(r io.Reader) (byte, error) {
+	if br, ok := r.(io.ByteReader); ok {
+		return br.ReadByte()
+	}
+
+	var b [1]byte
+	_, err := io.ReadFull(r, b[:])
+	return b[0], err
+}
+
 func getUint8(r io.Reader, packetRemaining *int32) uint8 {
 	if *packetRemaining < 1 {
-		raiseError(dataExceedsPacketError)
+		raiseError(ErrDataExceedsPacket)
 	}
 
-	var b [1]byte
-	if _, err := io.ReadFull(r, b[:]); err != nil {
+	b, err := readByte(r)
+	if err != nil {
 		raiseError(err)
 	}
 	*packetRemaining--
 
-	return b[0]
+	return b
 }
 
 func getUint16(r io.Reader, packetRemaining *int32) uint16 {
 	if *packetRemaining < 2 {
-		raiseError(dataExceedsPacketError)
+		raiseError(ErrDataExceedsPacket)
 	}
 
-	var b [2]byte
-	if _, err := io.ReadFull(r, b[:]); err != nil {
+	b0, err := readByte(r)
+	if err != nil {
+		raiseError(err)
+	}
+	b1, err := readByte(r)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
 		raiseError(err)
 	}
 	*packetRemaining -= 2
 
-	return uint16(b[0])<<8 | uint16(b[1])
+	return uint16(b0)<<8 | uint16(b1)
 }
 
 func getString(r io.Reader, packetRemaining *int32) string {
 	strLen := int(getUint16(r, packetRemaining))
 
 	if int(*packetRemaining) < strLen {
-		raiseError(dataExceedsPacketError)
+		raiseError(ErrDataExceedsPacket)
 	}
 
 	b := make([]byte, strLen)
@@ -49,6 +94,28 @@ func getString(r io.Reader, packetRemaining *int32) string {
 	return string(b)
 }
 
+// getStringOrBytes reads a string, which is returned as a ByteString if
+// config is a ByteStringConfig, and as a string otherwise.
+func getStringOrBytes(r io.Reader, packetRemaining *int32, config DecoderConfig) (string, ByteString) {
+	bsc, ok := findConfig(config, isByteStringConfig).(ByteStringConfig)
+	if !ok {
+		return getString(r, packetRemaining), nil
+	}
+	strLen := int(getUint16(r, packetRemaining))
+
+	if int(*packetRemaining) < strLen {
+		raiseError(ErrDataExceedsPacket)
+	}
+
+	b := bsc.ByteStringBuffer(strLen)
+	if _, err := io.ReadFull(r, b); err != nil {
+		raiseError(err)
+	}
+	*packetRemaining -= int32(strLen)
+
+	return "", ByteString(b)
+}
+
 func setUint8(val uint8, buf *bytes.Buffer) {
 	buf.WriteByte(byte(val))
 }
@@ -58,12 +125,30 @@ func setUint16(val uint16, buf *bytes.Buffer) {
 	buf.WriteByte(byte(val & 0x00ff))
 }
 
+// setString writes val, preceded by its length. It raises ErrStringTooLong
+// if val is too long for its length to be written.
 func setString(val string, buf *bytes.Buffer) {
+	if len(val) > 0xffff {
+		raiseError(ErrStringTooLong)
+	}
 	length := uint16(len(val))
 	setUint16(length, buf)
 	buf.WriteString(val)
 }
 
+// setStringOrBytes writes val, or b if val is empty and b is not nil.
+func setStringOrBytes(val string, b ByteString, buf *bytes.Buffer) {
+	if val == "" && b != nil {
+		if len(b) > 0xffff {
+			raiseError(ErrStringTooLong)
+		}
+		setUint16(uint16(len(b)), buf)
+		buf.Write(b)
+		return
+	}
+	setString(val, buf)
+}
+
 func boolToByte(val bool) byte {
 	if val {
 		return byte(1)
@@ -73,14 +158,13 @@ func boolToByte(val bool) byte {
 
 func decodeLength(r io.Reader) int32 {
 	var v int32
-	var buf [1]byte
 	var shift uint
 	for i := 0; i < 4; i++ {
-		if _, err := io.ReadFull(r, buf[:]); err != nil {
+		b, err := readByte(r)
+		if err != nil {
 			raiseError(err)
 		}
 
-		b := buf[0]
 		v |= int32(b&0x7f) << shift
 
 		if b&0x80 == 0 {
@@ -89,7 +173,7 @@ func decodeLength(r io.Reader) int32 {
 		shift += 7
 	}
 
-	raiseError(badLengthEncodingError)
+	raiseError(ErrBadLengthEncoding)
 	panic("unreachable")
 }
 
@@ -107,3 +191,49 @@ func encodeLength(length int32, buf *bytes.Buffer) {
 		buf.WriteByte(byte(digit))
 	}
 }
+
+// MaxRemainingLength is the largest value that the remaining length field of
+// a message can hold (256MiB - 1B).
+const MaxRemainingLength = (1 << (4 * 7)) - 1
+
+// EncodeRemainingLength writes length to w in the variable length encoding
+// used for the remaining length field of a message. An error is returned if
+// length is negative or greater than MaxRemainingLength.
+func EncodeRemainingLength(w io.Writer, length int32) (int, error) {
+	if length < 0 || length > MaxRemainingLength {
+		return 0, ErrBadLength
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	encodeLength(length, buf)
+	return w.Write(buf.Bytes())
+}
+
+// DecodeRemainingLength reads a remaining length field from r. An error is
+// returned if the field is longer than 4 bytes.
+func DecodeRemainingLength(r io.Reader) (length int32, err error) {
+	defer func() {
+		err = recoverError(err, recover())
+	}()
+
+	return decodeLength(r), nil
+}
+
+// RemainingLengthSize returns the number of bytes that EncodeRemainingLength
+// writes for length, or 0 if length cannot be encoded.
+func RemainingLengthSize(length int32) int {
+	switch {
+	case length < 0:
+		return 0
+	case length < 1<<7:
+		return 1
+	case length < 1<<14:
+		return 2
+	case length < 1<<21:
+		return 3
+	case length <= MaxRemainingLength:
+		return 4
+	}
+	return 0
+}
@@ -0,0 +1,379 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Operations recorded in a FileSessionStore log.
+const (
+	opDelete = iota + 1
+	opPutMessage
+	opDeleteMessage
+	opPutReceived
+	opDeleteReceived
+	opPutSubscription
+	opDeleteSubscription
+	opPutNextMessageId
+)
+
+// errBadRecord is returned for a record of a FileSessionStore log that
+// passes its checksum, but cannot be applied.
+var errBadRecord = errors.New("mqtt: session log record is invalid")
+
+// sessionCodec encodes the messages in a FileSessionStore log. It is v5,
+// so that the properties of v5 messages are kept.
+var sessionCodec = &Codec{Version: ProtocolV5}
+
+// maxRecordSize is the size of the largest record that a FileSessionStore
+// writes: the op, a client id, and the largest message. A record claiming
+// to be longer is garbage, as its length is not covered by its checksum.
+const maxRecordSize = 1 + 2 + 65535 + 5 + MaxRemainingLength
+
+// minCompactSize is the size below which a FileSessionStore log is not
+// compacted as it grows. It is a variable for tests.
+var minCompactSize int64 = 1 << 20
+
+// FileSessionStore is a SessionStore that keeps sessions in a file, so that
+// they survive the process restarting, or the machine losing power. The
+// sessions are also held in memory, so Get does not read the file.
+//
+// The file is a log to which each change is appended, and synced to disk
+// before the change takes effect. Each record is a 4 byte big-endian
+// length, the CRC-32C of the record's data, then the data. A record that
+// was only partly written when power was lost fails its checksum, or claims
+// to be longer than the rest of the file, and it and anything after it are
+// discarded when the file is opened, as they are after a record that cannot
+// be applied.
+//
+// The log is compacted when it is opened, and as it grows: each time it
+// has doubled in size since it was last compacted, once it is over 1MiB.
+//
+// A *Publish is stored with its payload, which is written to the file, so
+// it must be able to be written more than once (e.g a BytesPayload), and
+// it is read back as a BytesPayload.
+type FileSessionStore struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	closed bool
+	mem    MemorySessionStore
+
+	// size is the size of the log, and compacted its size when it was last
+	// compacted.
+	size, compacted int64
+}
+
+// OpenFileSessionStore opens the store in the file at path, creating it if
+// it does not exist. The log is compacted as it is opened, so that it only
+// holds the sessions as they are.
+func OpenFileSessionStore(path string) (*FileSessionStore, error) {
+	s := &FileSessionStore{path: path}
+	f, err := os.Open(path)
+	if err == nil {
+		var info os.FileInfo
+		if info, err = f.Stat(); err == nil {
+			err = s.replay(f, info.Size())
+		}
+		f.Close()
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// replay applies the records in r, which holds size bytes, to the sessions
+// in memory, up to the end of r or the first record that was not completely
+// written or cannot be applied.
+func (s *FileSessionStore) replay(r io.Reader, size int64) error {
+	br := bufio.NewReader(r)
+	var hdr [8]byte
+	for {
+		if _, err := io.ReadFull(br, hdr[:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		size -= int64(len(hdr))
+		n := int64(binary.BigEndian.Uint32(hdr[:4]))
+		if n > size || n > maxRecordSize {
+			return nil
+		}
+		size -= n
+		data := make([]byte, n)
+		if _, err := io.ReadFull(br, data); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if crc32.Checksum(data, castagnoliTable) != binary.BigEndian.Uint32(hdr[4:]) {
+			return nil
+		}
+		rec, err := parseRecord(data)
+		if err != nil {
+			return nil
+		}
+		if err := s.apply(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// sessionRecord is the data of one record of a FileSessionStore log.
+type sessionRecord struct {
+	op       byte
+	clientId string
+	id       uint16
+	msg      Message
+	sub      TopicQos
+}
+
+// parseRecord decodes the data of one record, and checks that it can be
+// applied.
+func parseRecord(data []byte) (rec sessionRecord, err error) {
+	if len(data) < 3 {
+		return rec, errBadRecord
+	}
+	rec.op = data[0]
+	n := int(binary.BigEndian.Uint16(data[1:]))
+	if len(data) < 3+n {
+		return rec, errBadRecord
+	}
+	rec.clientId = string(data[3 : 3+n])
+	args := data[3+n:]
+
+	switch rec.op {
+	case opDelete:
+	case opPutMessage:
+		if rec.msg, err = sessionCodec.Decode(bytes.NewReader(args)); err != nil {
+			return rec, err
+		}
+		if _, err := sessionMessageId(rec.msg); err != nil {
+			return rec, err
+		}
+	case opDeleteMessage, opPutReceived, opDeleteReceived, opPutNextMessageId:
+		if len(args) != 2 {
+			return rec, errBadRecord
+		}
+		rec.id = binary.BigEndian.Uint16(args)
+	case opPutSubscription:
+		if len(args) < 1 {
+			return rec, errBadRecord
+		}
+		rec.sub = TopicQos{Topic: string(args[1:]), Qos: QosLevel(args[0])}
+	case opDeleteSubscription:
+		rec.sub.Topic = string(args)
+	default:
+		return rec, errBadRecord
+	}
+	return rec, nil
+}
+
+// apply applies one record to the sessions in memory.
+func (s *FileSessionStore) apply(rec sessionRecord) error {
+	switch rec.op {
+	case opDelete:
+		return s.mem.Delete(rec.clientId)
+	case opPutMessage:
+		return s.mem.PutMessage(rec.clientId, rec.msg)
+	case opDeleteMessage:
+		return s.mem.DeleteMessage(rec.clientId, rec.id)
+	case opPutReceived:
+		return s.mem.PutReceived(rec.clientId, rec.id)
+	case opDeleteReceived:
+		return s.mem.DeleteReceived(rec.clientId, rec.id)
+	case opPutSubscription:
+		return s.mem.PutSubscription(rec.clientId, rec.sub)
+	case opDeleteSubscription:
+		return s.mem.DeleteSubscription(rec.clientId, rec.sub.Topic)
+	case opPutNextMessageId:
+		return s.mem.PutNextMessageId(rec.clientId, rec.id)
+	}
+	return errBadRecord
+}
+
+// appendRecord appends a record of op for clientId with args to b.
+func appendRecord(b []byte, op byte, clientId string, args []byte) []byte {
+	start := len(b)
+	b = append(b, 0, 0, 0, 0, 0, 0, 0, 0, op)
+	b = appendString(b, clientId)
+	b = append(b, args...)
+	data := b[start+8:]
+	binary.BigEndian.PutUint32(b[start:], uint32(len(data)))
+	binary.BigEndian.PutUint32(b[start+4:], crc32.Checksum(data, castagnoliTable))
+	return b
+}
+
+// log appends a record to the file and syncs it, then applies it to the
+// sessions in memory, compacting the log if it has grown enough. The record
+// is checked before it is written, so that the log only holds records that
+// can be replayed.
+func (s *FileSessionStore) log(op byte, clientId string, args []byte) error {
+	if len(clientId) > 0xffff {
+		return ErrStringTooLong
+	}
+	record := appendRecord(nil, op, clientId, args)
+	rec, err := parseRecord(record[8:])
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return os.ErrClosed
+	}
+	if _, err := s.file.Write(record); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.size += int64(len(record))
+	if err := s.apply(rec); err != nil {
+		return err
+	}
+	if s.size >= minCompactSize && s.size >= 2*s.compacted {
+		// The change is stored either way, and a compaction that fails
+		// leaves the log as it was, to be compacted after a later change.
+		s.compact()
+	}
+	return nil
+}
+
+func (s *FileSessionStore) Get(clientId string) (*Session, error) {
+	return s.mem.Get(clientId)
+}
+
+func (s *FileSessionStore) Delete(clientId string) error {
+	return s.log(opDelete, clientId, nil)
+}
+
+func (s *FileSessionStore) PutMessage(clientId string, msg Message) error {
+	if _, err := sessionMessageId(msg); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if _, err := sessionCodec.Encode(&buf, msg); err != nil {
+		return err
+	}
+	return s.log(opPutMessage, clientId, buf.Bytes())
+}
+
+func (s *FileSessionStore) DeleteMessage(clientId string, messageId uint16) error {
+	return s.log(opDeleteMessage, clientId, appendUint16(nil, messageId))
+}
+
+func (s *FileSessionStore) PutReceived(clientId string, messageId uint16) error {
+	return s.log(opPutReceived, clientId, appendUint16(nil, messageId))
+}
+
+func (s *FileSessionStore) DeleteReceived(clientId string, messageId uint16) error {
+	return s.log(opDeleteReceived, clientId, appendUint16(nil, messageId))
+}
+
+func (s *FileSessionStore) PutSubscription(clientId string, sub TopicQos) error {
+	return s.log(opPutSubscription, clientId, append([]byte{byte(sub.Qos)}, sub.Topic...))
+}
+
+func (s *FileSessionStore) DeleteSubscription(clientId string, filter string) error {
+	return s.log(opDeleteSubscription, clientId, []byte(filter))
+}
+
+func (s *FileSessionStore) PutNextMessageId(clientId string, id uint16) error {
+	return s.log(opPutNextMessageId, clientId, appendUint16(nil, id))
+}
+
+// Compact rewrites the log to hold only the sessions as they are, dropping
+// the records of changes that have been undone. It replaces the file
+// atomically, so a crash while compacting loses nothing.
+func (s *FileSessionStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compact()
+}
+
+// compact implements Compact, with s.mu held.
+func (s *FileSessionStore) compact() error {
+	if s.closed {
+		return os.ErrClosed
+	}
+
+	var b []byte
+	s.mem.mu.Lock()
+	for clientId, session := range s.mem.sessions {
+		for _, msg := range session.Outbound {
+			var buf bytes.Buffer
+			if _, err := sessionCodec.Encode(&buf, msg); err != nil {
+				s.mem.mu.Unlock()
+				return err
+			}
+			b = appendRecord(b, opPutMessage, clientId, buf.Bytes())
+		}
+		for id := range session.Received {
+			b = appendRecord(b, opPutReceived, clientId, appendUint16(nil, id))
+		}
+		for filter, qos := range session.Subscriptions {
+			b = appendRecord(b, opPutSubscription, clientId, append([]byte{byte(qos)}, filter...))
+		}
+		b = appendRecord(b, opPutNextMessageId, clientId, appendUint16(nil, session.NextMessageId))
+	}
+	s.mem.mu.Unlock()
+
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	// The old file is closed first, as an open file cannot be replaced on
+	// some systems.
+	if s.file != nil {
+		s.file.Close()
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		f.Close()
+		s.file, _ = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0)
+		return err
+	}
+	// Sync the directory, so that the rename survives a loss of power.
+	if dir, err := os.Open(filepath.Dir(s.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	s.file = f
+	s.size, s.compacted = int64(len(b)), int64(len(b))
+	return nil
+}
+
+// Close closes the file. The store cannot be changed afterwards.
+func (s *FileSessionStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
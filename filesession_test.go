@@ -0,0 +1,167 @@
+package mqtt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFileSessionStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqtt-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sessions")
+
+	store, err := OpenFileSessionStore(path)
+	if err != nil {
+		t.Fatalf("Unexpected error opening: %v", err)
+	}
+	pub := &Publish{
+		Header:    Header{QosLevel: QosAtLeastOnce, DupFlag: true},
+		TopicName: "a/b",
+		MessageId: 1,
+		Payload:   BytesPayload("hello"),
+	}
+	steps := []error{
+		store.PutMessage("c", pub),
+		store.PutMessage("c", &Publish{Header: Header{QosLevel: QosExactlyOnce}, TopicName: "x", MessageId: 2, Payload: BytesPayload{}}),
+		store.PutMessage("c", &PubRel{Header: Header{QosLevel: QosAtLeastOnce}, MessageId: 2}),
+		store.PutMessage("c", &Publish{Header: Header{QosLevel: QosAtLeastOnce}, TopicName: "y", MessageId: 3, Payload: BytesPayload{}}),
+		store.DeleteMessage("c", 3),
+		store.PutReceived("c", 7),
+		store.PutReceived("c", 8),
+		store.DeleteReceived("c", 8),
+		store.PutSubscription("c", TopicQos{Topic: "a/#", Qos: QosExactlyOnce}),
+		store.PutSubscription("c", TopicQos{Topic: "b", Qos: QosAtLeastOnce}),
+		store.DeleteSubscription("c", "b"),
+		store.PutNextMessageId("c", 4),
+		store.PutNextMessageId("gone", 9),
+		store.Delete("gone"),
+	}
+	for i, err := range steps {
+		if err != nil {
+			t.Fatalf("Step %d: Unexpected error: %v", i, err)
+		}
+	}
+	if err := store.PutMessage("c", &Publish{TopicName: "qos0"}); err != ErrNotInFlight {
+		t.Errorf("Storing a QoS 0 PUBLISH: got %v, expected ErrNotInFlight", err)
+	}
+	expected, err := store.Get("c")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(expected.Outbound[1], pub) || len(expected.Outbound) != 2 {
+		t.Errorf("Got outbound messages %+v", expected.Outbound)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Unexpected error closing: %v", err)
+	}
+
+	// The sessions are read back, however the file was written: as a log of
+	// changes, compacted, with a record cut short by a loss of power, with
+	// garbage claiming to be a 4GiB record, and with a record that passes
+	// its checksum but cannot be applied.
+	for _, test := range []string{"log", "compacted", "torn", "garbage", "invalid"} {
+		var tail []byte
+		switch test {
+		case "torn":
+			tail = appendRecord(nil, opPutReceived, "c", appendUint16(nil, 99))[:10]
+		case "garbage":
+			tail = []byte{0xff, 0xff, 0xff, 0xf0, 0x12, 0x34, 0x56, 0x78, 0x9a}
+		case "invalid":
+			tail = appendRecord(nil, 0xff, "c", nil)
+		}
+		if tail != nil {
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write(tail)
+			f.Close()
+		}
+		store, err := OpenFileSessionStore(path)
+		if err != nil {
+			t.Fatalf("%s: Unexpected error reopening: %v", test, err)
+		}
+		session, _ := store.Get("c")
+		if !reflect.DeepEqual(session, expected) {
+			t.Errorf("%s:\n     got = %+v\nexpected = %+v", test, session, expected)
+		}
+		if gone, _ := store.Get("gone"); gone != nil {
+			t.Errorf("%s: Deleted session came back: %+v", test, gone)
+		}
+		store.Close()
+	}
+
+	if err := store.PutReceived("c", 1); err == nil {
+		t.Errorf("Changed a closed store")
+	}
+}
+
+func TestFileSessionStoreRefusesBadRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqtt-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sessions")
+
+	store, err := OpenFileSessionStore(path)
+	if err != nil {
+		t.Fatalf("Unexpected error opening: %v", err)
+	}
+	if err := store.PutNextMessageId(strings.Repeat("c", 0x10000), 5); err != ErrStringTooLong {
+		t.Errorf("Storing a session with a long client id: got %v, expected ErrStringTooLong", err)
+	}
+	if err := store.PutNextMessageId("c", 5); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	store.Close()
+
+	// The refused change was not written, so the store can still be opened.
+	store, err = OpenFileSessionStore(path)
+	if err != nil {
+		t.Fatalf("Unexpected error reopening: %v", err)
+	}
+	defer store.Close()
+	if session, _ := store.Get("c"); session == nil || session.NextMessageId != 5 {
+		t.Errorf("Got session %+v", session)
+	}
+}
+
+func TestFileSessionStoreCompactsAsItGrows(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqtt-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sessions")
+	defer func(size int64) { minCompactSize = size }(minCompactSize)
+	minCompactSize = 1000
+
+	store, err := OpenFileSessionStore(path)
+	if err != nil {
+		t.Fatalf("Unexpected error opening: %v", err)
+	}
+	defer store.Close()
+	for i := 0; i < 1000; i++ {
+		if err := store.PutNextMessageId("c", uint16(i)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() >= 2*minCompactSize {
+		t.Errorf("Log is %d bytes after 1000 changes to one session, expected it to be compacted", info.Size())
+	}
+	if session, _ := store.Get("c"); session == nil || session.NextMessageId != 999 {
+		t.Errorf("Got session %+v", session)
+	}
+}
@@ -0,0 +1,269 @@
+package mqtt
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// KeepaliveRole is the side of a connection that a Keepalive is on, which
+// decides what it does when the connection is idle.
+type KeepaliveRole uint8
+
+const (
+	// KeepaliveClient sends PINGREQ when nothing has been written for the
+	// keep alive interval, and closes the connection if the PINGRESP does not
+	// arrive in time.
+	KeepaliveClient KeepaliveRole = iota
+	// KeepaliveServer closes the connection when nothing has been read for
+	// one and a half times the keep alive interval.
+	KeepaliveServer
+)
+
+// pingReqPacket is an encoded PINGREQ.
+var pingReqPacket = []byte{byte(MsgPingReq) << 4, 0}
+
+// Keepalive wraps a connection, and enforces the keep alive negotiated by
+// CONNECT (and a v5 CONNACK) on it. Messages must be read and written
+// through the Keepalive, so that it can see the traffic; PINGREQ is only
+// written between whole packets. It may be read from and written to by
+// different goroutines.
+//
+// Once the Keepalive has closed the connection, reads and writes return
+// ErrKeepaliveTimeout.
+type Keepalive struct {
+	// PingTimeout is how long a client waits for PINGRESP after sending
+	// PINGREQ. Zero means the keep alive interval.
+	PingTimeout time.Duration
+
+	conn io.ReadWriteCloser
+	role KeepaliveRole
+
+	writeMu   sync.Mutex
+	lastWrite time.Time
+	written   frameScanner
+
+	mu        sync.Mutex
+	interval  time.Duration
+	started   bool
+	lastRead  time.Time
+	read      frameScanner
+	pingSent  time.Time // Zero when no PINGRESP is outstanding.
+	err       error
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewKeepalive creates a Keepalive for conn, on the given side of the
+// connection. Call Start once the keep alive interval is known.
+func NewKeepalive(conn io.ReadWriteCloser, role KeepaliveRole) *Keepalive {
+	return &Keepalive{conn: conn, role: role, stop: make(chan struct{})}
+}
+
+// Start starts enforcing interval, which is usually the KeepAliveTimer of
+// CONNECT in seconds. An interval of zero leaves the keep alive off, as the
+// protocol requires. Calls after the first are ignored.
+func (k *Keepalive) Start(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	// writeMu is taken before mu, as it is when checking the keep alive.
+	k.writeMu.Lock()
+	defer k.writeMu.Unlock()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.started {
+		return
+	}
+	k.started = true
+	k.interval = interval
+	k.lastRead = time.Now()
+	k.lastWrite = k.lastRead
+	go k.run(debugStart(&debugCounters.runningKeepalives))
+}
+
+func (k *Keepalive) Read(p []byte) (int, error) {
+	n, err := k.conn.Read(p)
+	if n > 0 {
+		k.mu.Lock()
+		k.lastRead = time.Now()
+		k.read.scan(p[:n], k.received)
+		k.mu.Unlock()
+	}
+	return n, k.reason(err)
+}
+
+func (k *Keepalive) Write(p []byte) (int, error) {
+	k.writeMu.Lock()
+	defer k.writeMu.Unlock()
+	n, err := k.conn.Write(p)
+	if n > 0 {
+		k.lastWrite = time.Now()
+		k.written.scan(p[:n], nil)
+	}
+	return n, k.reason(err)
+}
+
+// Close stops the keep alive, and closes the connection.
+func (k *Keepalive) Close() error {
+	k.closeOnce.Do(func() { close(k.stop) })
+	return k.conn.Close()
+}
+
+// Err returns ErrKeepaliveTimeout if the Keepalive has closed the
+// connection, and nil otherwise.
+func (k *Keepalive) Err() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.err
+}
+
+// reason replaces err with ErrKeepaliveTimeout if the Keepalive closed the
+// connection, which is why reading or writing failed.
+func (k *Keepalive) reason(err error) error {
+	if err == nil {
+		return nil
+	}
+	if kerr := k.Err(); kerr != nil {
+		return kerr
+	}
+	return err
+}
+
+// received is called with the type of each message read.
+func (k *Keepalive) received(msgType MessageType) {
+	if msgType == MsgPingResp {
+		k.pingSent = time.Time{}
+	}
+}
+
+// run checks the connection each time a deadline may have passed, until
+// the Keepalive is closed or times out. counted is whether the Keepalive
+// was counted as running.
+func (k *Keepalive) run(counted bool) {
+	if counted {
+		defer debugEnd(&debugCounters.runningKeepalives)
+	}
+	timer := time.NewTimer(k.interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-k.stop:
+			return
+		}
+		next, err := k.check(time.Now())
+		if err != nil {
+			k.mu.Lock()
+			k.err = err
+			k.mu.Unlock()
+			k.Close()
+			return
+		}
+		timer.Reset(next)
+	}
+}
+
+// check enforces the keep alive at now, and returns how long until it
+// should next be called.
+func (k *Keepalive) check(now time.Time) (time.Duration, error) {
+	k.mu.Lock()
+	lastRead, pingSent := k.lastRead, k.pingSent
+	k.mu.Unlock()
+
+	if k.role == KeepaliveServer {
+		deadline := lastRead.Add(k.interval * 3 / 2)
+		if !now.Before(deadline) {
+			return 0, ErrKeepaliveTimeout
+		}
+		return deadline.Sub(now), nil
+	}
+
+	timeout := k.PingTimeout
+	if timeout <= 0 {
+		timeout = k.interval
+	}
+	if !pingSent.IsZero() {
+		deadline := pingSent.Add(timeout)
+		if !now.Before(deadline) {
+			return 0, ErrKeepaliveTimeout
+		}
+		return deadline.Sub(now), nil
+	}
+
+	k.writeMu.Lock()
+	defer k.writeMu.Unlock()
+	deadline := k.lastWrite.Add(k.interval)
+	if now.Before(deadline) {
+		return deadline.Sub(now), nil
+	}
+	if !k.written.atBoundary() {
+		// A packet is part written, so try again once it may be complete.
+		return k.interval, nil
+	}
+	// The ping is outstanding before it is written, as the PINGRESP may be
+	// read before the write returns.
+	k.mu.Lock()
+	k.pingSent = now
+	k.mu.Unlock()
+	if _, err := k.conn.Write(pingReqPacket); err != nil {
+		// The connection has failed, which its reader will find out.
+		return 0, err
+	}
+	k.lastWrite = now
+	return timeout, nil
+}
+
+// frameScanner follows the packet boundaries in a stream of MQTT packets,
+// without decoding them.
+type frameScanner struct {
+	state      uint8 // One of the scan constants.
+	msgType    MessageType
+	remaining  int
+	multiplier int
+}
+
+const (
+	scanType = iota
+	scanLength
+	scanBody
+)
+
+// atBoundary returns true if the bytes scanned so far are whole packets.
+func (s *frameScanner) atBoundary() bool {
+	return s.state == scanType
+}
+
+// scan follows the packets in b, calling complete (if not nil) with the
+// type of each packet that ends in it.
+func (s *frameScanner) scan(b []byte, complete func(MessageType)) {
+	for len(b) > 0 {
+		switch s.state {
+		case scanType:
+			s.msgType = MessageType(b[0] >> 4)
+			s.remaining, s.multiplier = 0, 1
+			s.state = scanLength
+			b = b[1:]
+		case scanLength:
+			s.remaining += int(b[0]&0x7f) * s.multiplier
+			s.multiplier *= 0x80
+			if b[0]&0x80 == 0 {
+				s.state = scanBody
+			}
+			b = b[1:]
+		case scanBody:
+			n := s.remaining
+			if n > len(b) {
+				n = len(b)
+			}
+			s.remaining -= n
+			b = b[n:]
+		}
+		if s.state == scanBody && s.remaining == 0 {
+			if complete != nil {
+				complete(s.msgType)
+			}
+			s.state = scanType
+		}
+	}
+}
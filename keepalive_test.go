@@ -0,0 +1,131 @@
+package mqtt
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestKeepaliveClient(t *testing.T) {
+	local, remote := net.Pipe()
+	ka := NewKeepalive(local, KeepaliveClient)
+	ka.Start(20 * time.Millisecond)
+	defer ka.Close()
+
+	codec := &Codec{Version: ProtocolV311}
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		msg, err := codec.Decode(remote)
+		if err != nil {
+			t.Fatalf("Ping %d: Unexpected error: %v", i, err)
+		}
+		if _, ok := msg.(*PingReq); !ok {
+			t.Fatalf("Ping %d: Got %T, expected *PingReq", i, msg)
+		}
+		if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+			t.Errorf("Ping %d: Sent after %v, expected the line to be idle first", i, elapsed)
+		}
+		// Reading the PINGRESP completes the ping.
+		go codec.Encode(remote, &PingResp{})
+		if _, err := codec.Decode(ka); err != nil {
+			t.Fatalf("Ping %d: Unexpected error reading PINGRESP: %v", i, err)
+		}
+	}
+
+	// A ping without a PINGRESP closes the connection.
+	if _, err := codec.Decode(remote); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := ka.Read(make([]byte, 1)); err != ErrKeepaliveTimeout {
+		t.Errorf("Got %v, expected ErrKeepaliveTimeout", err)
+	}
+}
+
+func TestKeepaliveServer(t *testing.T) {
+	local, remote := net.Pipe()
+	ka := NewKeepalive(local, KeepaliveServer)
+	ka.Start(20 * time.Millisecond)
+	defer ka.Close()
+
+	// Traffic from the client keeps the connection open past the timeout.
+	go func() {
+		for i := 0; i < 6; i++ {
+			time.Sleep(10 * time.Millisecond)
+			remote.Write(pingReqPacket)
+		}
+	}()
+	buf := make([]byte, 2)
+	for i := 0; i < 6; i++ {
+		if _, err := io.ReadFull(ka, buf); err != nil {
+			t.Fatalf("Read %d: Unexpected error: %v", i, err)
+		}
+	}
+
+	start := time.Now()
+	if _, err := ka.Read(buf); err != ErrKeepaliveTimeout {
+		t.Errorf("Got %v, expected ErrKeepaliveTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("Closed after %v idle, expected 1.5 times the keep alive", elapsed)
+	}
+}
+
+func TestKeepaliveDisabled(t *testing.T) {
+	local, remote := net.Pipe()
+	ka := NewKeepalive(local, KeepaliveServer)
+	ka.Start(0)
+	defer ka.Close()
+
+	time.Sleep(20 * time.Millisecond)
+	go remote.Write(pingReqPacket)
+	if _, err := io.ReadFull(ka, make([]byte, 2)); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestFrameScanner(t *testing.T) {
+	var stream bytes.Buffer
+	codec := &Codec{Version: ProtocolV311}
+	msgs := []Message{
+		&PingReq{},
+		&Publish{TopicName: "a/b", Payload: BytesPayload(make([]byte, 200))},
+		&PubAck{MessageId: 1},
+		&Disconnect{},
+	}
+	for _, msg := range msgs {
+		if _, err := codec.Encode(&stream, msg); err != nil {
+			t.Fatalf("Unexpected error encoding %T: %v", msg, err)
+		}
+	}
+
+	// Scan the stream in awkward pieces, which split the remaining length.
+	var s frameScanner
+	var got []MessageType
+	b := stream.Bytes()
+	for len(b) > 0 {
+		n := 3
+		if n > len(b) {
+			n = len(b)
+		}
+		s.scan(b[:n], func(msgType MessageType) { got = append(got, msgType) })
+		b = b[n:]
+	}
+	expected := []MessageType{MsgPingReq, MsgPublish, MsgPubAck, MsgDisconnect}
+	if len(got) != len(expected) {
+		t.Fatalf("Got %v, expected %v", got, expected)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Errorf("Packet %d: Got %v, expected %v", i, got[i], expected[i])
+		}
+	}
+	if !s.atBoundary() {
+		t.Errorf("Not at a boundary after whole packets")
+	}
+	s.scan(pingReqPacket[:1], nil)
+	if s.atBoundary() {
+		t.Errorf("At a boundary in the middle of a packet")
+	}
+}
@@ -0,0 +1,71 @@
+package mqtt
+
+import (
+	"bytes"
+	"io"
+)
+
+// appender is implemented by messages with an AppendTo method.
+type appender interface {
+	Size() int
+	AppendTo(b []byte) ([]byte, error)
+}
+
+// Marshal returns the encoding of msg, for transports that send packets
+// that are already framed (e.g a WebSocket message, or a queue entry).
+func Marshal(msg Message) ([]byte, error) {
+	if a, ok := msg.(appender); ok {
+		return a.AppendTo(make([]byte, 0, a.Size()))
+	}
+	return EncodeDatagram(msg)
+}
+
+// Unmarshal decodes the single message held in b, with the
+// DefaultDecoderConfig. It is an error for b to hold anything more than
+// the message. The message does not refer to b once Unmarshal returns.
+func Unmarshal(b []byte) (Message, error) {
+	return DecodeDatagram(b, nil)
+}
+
+// UnmarshalNoCopy is like Unmarshal, but the BytesPayload of a decoded
+// Publish aliases b rather than being copied from it. b must not be
+// modified while the message is in use. The payload's capacity is limited
+// to its length, so appending to it does not overwrite the rest of b.
+func UnmarshalNoCopy(b []byte) (Message, error) {
+	r := bytes.NewReader(b)
+	msg, err := decodeDatagram(b, r, &aliasConfig{frame: b, r: r})
+	if err != nil {
+		return nil, err
+	}
+	if msg, ok := msg.(*Publish); ok {
+		if p, ok := msg.Payload.(*aliasPayload); ok {
+			msg.Payload = p.BytesPayload
+		}
+	}
+	return msg, nil
+}
+
+// aliasConfig makes payloads that alias frame, which is being read by r.
+type aliasConfig struct {
+	frame []byte
+	r     *bytes.Reader
+}
+
+func (c *aliasConfig) MakePayload(msg *Publish, r io.Reader, n int) (Payload, error) {
+	offset := len(c.frame) - c.r.Len()
+	if offset+n > len(c.frame) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return &aliasPayload{c.frame[offset : offset+n : offset+n], c.r}, nil
+}
+
+// aliasPayload already holds its data, so reading it only skips over it.
+type aliasPayload struct {
+	BytesPayload
+	r *bytes.Reader
+}
+
+func (p *aliasPayload) ReadPayload(r io.Reader) error {
+	_, err := p.r.Seek(int64(len(p.BytesPayload)), io.SeekCurrent)
+	return err
+}
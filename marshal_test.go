@@ -0,0 +1,77 @@
+package mqtt
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestMarshal(t *testing.T) {
+	msgs := []Message{
+		&Connect{ProtocolName: "MQIsdp", ProtocolVersion: 3, ClientId: "c"},
+		&Publish{
+			Header:    Header{QosLevel: QosAtLeastOnce},
+			TopicName: "a/b",
+			MessageId: 1,
+			Payload:   BytesPayload{1, 2, 3},
+		},
+		&PubAck{MessageId: 0x1234},
+		&Subscribe{Header: Header{QosLevel: QosAtLeastOnce}, MessageId: 2, Topics: []TopicQos{{Topic: "a/#"}}},
+		&Disconnect{},
+		&RawMessage{HeaderByte: 0xf0, Body: []byte{1}},
+	}
+	for _, expected := range msgs {
+		b, err := Marshal(expected)
+		if err != nil {
+			t.Errorf("%T: Unexpected error during marshalling: %v", expected, err)
+			continue
+		}
+		encoded := new(bytes.Buffer)
+		expected.Encode(encoded)
+		if !bytes.Equal(encoded.Bytes(), b) {
+			t.Errorf("%T: Marshal gave % x, Encode gave % x", expected, b, encoded.Bytes())
+		}
+		if _, ok := expected.(*RawMessage); ok {
+			continue
+		}
+		for _, unmarshal := range []func([]byte) (Message, error){Unmarshal, UnmarshalNoCopy} {
+			if msg, err := unmarshal(b); err != nil {
+				t.Errorf("%T: Unexpected error during unmarshalling: %v", expected, err)
+			} else if !reflect.DeepEqual(expected, msg) {
+				t.Errorf("%T:\n     got = %#v\nexpected = %#v", expected, msg, expected)
+			}
+		}
+	}
+
+	if _, err := Unmarshal([]byte{0x40, 0x02, 0x12, 0x34, 0x00}); err == nil {
+		t.Errorf("Expected error unmarshalling trailing byte, but got nil.")
+	}
+}
+
+func TestUnmarshalNoCopy(t *testing.T) {
+	b, err := Marshal(&Publish{TopicName: "a", Payload: BytesPayload{1, 2, 3}})
+	if err != nil {
+		t.Fatalf("Unexpected error during marshalling: %v", err)
+	}
+
+	copied, err := Unmarshal(b)
+	if err != nil {
+		t.Fatalf("Unexpected error during unmarshalling: %v", err)
+	}
+	aliased, err := UnmarshalNoCopy(b)
+	if err != nil {
+		t.Fatalf("Unexpected error during unmarshalling: %v", err)
+	}
+
+	b[len(b)-1] = 9
+	if payload := copied.(*Publish).Payload.(BytesPayload); payload[2] != 3 {
+		t.Errorf("Unmarshal payload changed with its input: %v", payload)
+	}
+	payload := aliased.(*Publish).Payload.(BytesPayload)
+	if payload[2] != 9 {
+		t.Errorf("UnmarshalNoCopy payload does not alias its input: %v", payload)
+	}
+	if cap(payload) != len(payload) {
+		t.Errorf("UnmarshalNoCopy payload has capacity %d, expected %d", cap(payload), len(payload))
+	}
+}
@@ -2,12 +2,13 @@ package mqtt
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 )
 
 const (
 	// Maximum payload size in bytes (256MiB - 1B).
-	MaxPayloadSize = (1 << (4 * 7)) - 1
+	MaxPayloadSize = MaxRemainingLength
 )
 
 // Header contains the common attributes of all messages. Some attributes are
@@ -15,10 +16,48 @@ const (
 type Header struct {
 	DupFlag, Retain bool
 	QosLevel        QosLevel
+
+	// Metadata holds in-process annotations on the message (see Annotate).
+	// It is a pointer, so that messages can still be compared with ==.
+	Metadata *Metadata
+}
+
+// Metadata holds in-process annotations on a message, such as when it was
+// received, who sent it, or a trace id, for middleware to pass along to
+// handlers. It is never encoded, in any protocol version; to pass
+// annotations to an MQTT v5 peer, add them to the message's Properties as
+// user properties.
+type Metadata map[string]interface{}
+
+// Annotatable is implemented by messages that can carry Metadata. All the
+// message types in this package implement it through their Header.
+type Annotatable interface {
+	// Annotations returns the message's metadata, which may be nil.
+	Annotations() Metadata
+
+	// Annotate sets key to value in the message's metadata.
+	Annotate(key string, value interface{})
+}
+
+func (hdr *Header) Annotations() Metadata {
+	if hdr.Metadata == nil {
+		return nil
+	}
+	return *hdr.Metadata
+}
+
+// Annotate sets key to value in the message's metadata. A copy of the
+// message made since the metadata was created shares it.
+func (hdr *Header) Annotate(key string, value interface{}) {
+	if hdr.Metadata == nil {
+		hdr.Metadata = &Metadata{}
+	}
+	(*hdr.Metadata)[key] = value
 }
 
 func (hdr *Header) Encode(w io.Writer, msgType MessageType, remainingLength int32) (int, error) {
-	buf := new(bytes.Buffer)
+	buf := getBuffer()
+	defer putBuffer(buf)
 	err := hdr.encodeInto(buf, msgType, remainingLength)
 	if err != nil {
 		return 0, err
@@ -28,19 +67,29 @@ func (hdr *Header) Encode(w io.Writer, msgType MessageType, remainingLength int3
 
 func (hdr *Header) encodeInto(buf *bytes.Buffer, msgType MessageType, remainingLength int32) error {
 	if !hdr.QosLevel.IsValid() {
-		return badQosError
+		return ErrBadQos
 	}
-	if !msgType.IsValid() {
-		return badMsgTypeError
+	if !msgType.IsValid() && msgType != MsgAuth {
+		return ErrBadMessageType
 	}
 
+	buf.WriteByte(hdr.byte1(msgType))
+	encodeLength(remainingLength, buf)
+	return nil
+}
+
+// header gives access to the Header embedded in a message.
+func (hdr *Header) header() *Header {
+	return hdr
+}
+
+// byte1 returns the first byte of the fixed header.
+func (hdr *Header) byte1(msgType MessageType) byte {
 	val := byte(msgType) << 4
 	val |= (boolToByte(hdr.DupFlag) << 3)
 	val |= byte(hdr.QosLevel) << 1
 	val |= boolToByte(hdr.Retain)
-	buf.WriteByte(val)
-	encodeLength(remainingLength, buf)
-	return nil
+	return val
 }
 
 func (hdr *Header) Decode(r io.Reader) (msgType MessageType, remainingLength int32, err error) {
@@ -48,13 +97,11 @@ func (hdr *Header) Decode(r io.Reader) (msgType MessageType, remainingLength int
 		err = recoverError(err, recover())
 	}()
 
-	var buf [1]byte
-
-	if _, err = io.ReadFull(r, buf[:]); err != nil {
+	var byte1 byte
+	if byte1, err = readByte(r); err != nil {
 		return
 	}
 
-	byte1 := buf[0]
 	msgType = MessageType(byte1 & 0xF0 >> 4)
 
 	*hdr = Header{
@@ -99,6 +146,10 @@ const (
 	msgTypeFirstInvalid
 )
 
+// MsgAuth is the MQTT v5 AUTH message type. It is a reserved type in
+// earlier versions, and so is only decoded by a Codec for ProtocolV5.
+const MsgAuth = MessageType(15)
+
 type MessageType uint8
 
 // IsValid returns true if the MessageType value is valid.
@@ -106,15 +157,49 @@ func (mt MessageType) IsValid() bool {
 	return mt >= MsgConnect && mt < msgTypeFirstInvalid
 }
 
-func writeMessage(w io.Writer, msgType MessageType, hdr *Header, payloadBuf *bytes.Buffer, extraLength int32) (int, error) {
+var messageTypeNames = [...]string{
+	MsgConnect:     "CONNECT",
+	MsgConnAck:     "CONNACK",
+	MsgPublish:     "PUBLISH",
+	MsgPubAck:      "PUBACK",
+	MsgPubRec:      "PUBREC",
+	MsgPubRel:      "PUBREL",
+	MsgPubComp:     "PUBCOMP",
+	MsgSubscribe:   "SUBSCRIBE",
+	MsgSubAck:      "SUBACK",
+	MsgUnsubscribe: "UNSUBSCRIBE",
+	MsgUnsubAck:    "UNSUBACK",
+	MsgPingReq:     "PINGREQ",
+	MsgPingResp:    "PINGRESP",
+	MsgDisconnect:  "DISCONNECT",
+	MsgAuth:        "AUTH",
+}
+
+// String returns the name of the message type as written in the MQTT
+// specification, e.g "PUBLISH".
+func (mt MessageType) String() string {
+	if int(mt) < len(messageTypeNames) && messageTypeNames[mt] != "" {
+		return messageTypeNames[mt]
+	}
+	return fmt.Sprintf("MessageType(%d)", uint8(mt))
+}
+
+func writeMessage(w io.Writer, msgType MessageType, hdr *Header, payloadBuf *bytes.Buffer, extraLength int32) (n int, err error) {
+	if msgType != MsgPublish {
+		// A PUBLISH is counted once its payload is written too.
+		defer func() {
+			countEncode(msgType, n, err)
+		}()
+	}
+
 	totalPayloadLength := int64(len(payloadBuf.Bytes())) + int64(extraLength)
 	if totalPayloadLength > MaxPayloadSize {
-		return 0, msgTooLongError
+		return 0, ErrMessageTooLong
 	}
 
-	buf := new(bytes.Buffer)
-	err := hdr.encodeInto(buf, msgType, int32(totalPayloadLength))
-	if err != nil {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := hdr.encodeInto(buf, msgType, int32(totalPayloadLength)); err != nil {
 		return 0, err
 	}
 
@@ -134,17 +219,33 @@ type Connect struct {
 	WillQos                    QosLevel
 	KeepAliveTimer             uint16
 	ClientId                   string
+	ClientIdBytes              ByteString // In place of ClientId; see ByteStringConfig.
 	WillTopic, WillMessage     string
 	UsernameFlag, PasswordFlag bool
 	Username, Password         string
+
+	// Properties and WillProperties are only sent for MQTT v5, i.e when
+	// ProtocolVersion is 5.
+	Properties, WillProperties Properties
 }
 
-func (msg *Connect) Encode(w io.Writer) (int, error) {
+func (msg *Connect) Encode(w io.Writer) (n int, err error) {
+	defer func() {
+		err = recoverError(err, recover())
+	}()
+
+	if msg.ProtocolVersion == uint8(ProtocolV5) {
+		return msg.encodeV5(w)
+	}
 	if !msg.WillQos.IsValid() {
-		return 0, badWillQosError
+		return 0, ErrBadWillQos
+	}
+	if msg.PasswordFlag && !msg.UsernameFlag {
+		return 0, ErrPasswordNoUser
 	}
 
-	buf := new(bytes.Buffer)
+	buf := getBuffer()
+	defer putBuffer(buf)
 
 	flags := boolToByte(msg.UsernameFlag) << 7
 	flags |= boolToByte(msg.PasswordFlag) << 6
@@ -157,7 +258,7 @@ func (msg *Connect) Encode(w io.Writer) (int, error) {
 	setUint8(msg.ProtocolVersion, buf)
 	buf.WriteByte(flags)
 	setUint16(msg.KeepAliveTimer, buf)
-	setString(msg.ClientId, buf)
+	setStringOrBytes(msg.ClientId, msg.ClientIdBytes, buf)
 	if msg.WillFlag {
 		setString(msg.WillTopic, buf)
 		setString(msg.WillMessage, buf)
@@ -182,10 +283,18 @@ func (msg *Connect) Decode(r io.Reader, hdr Header, packetRemaining int32, confi
 	protocolName := getString(r, &packetRemaining)
 	protocolVersion := getUint8(r, &packetRemaining)
 	flags := getUint8(r, &packetRemaining)
+	if flags&0x01 != 0 && isStrict(config) {
+		return ErrReservedBits
+	}
 	keepAliveTimer := getUint16(r, &packetRemaining)
-	clientId := getString(r, &packetRemaining)
+	var properties Properties
+	if protocolVersion == uint8(ProtocolV5) {
+		properties = getProperties(r, &packetRemaining)
+	}
+	clientId, clientIdBytes := getStringOrBytes(r, &packetRemaining, config)
 
 	*msg = Connect{
+		Header:          hdr,
 		ProtocolName:    protocolName,
 		ProtocolVersion: protocolVersion,
 		UsernameFlag:    flags&0x80 > 0,
@@ -196,9 +305,14 @@ func (msg *Connect) Decode(r io.Reader, hdr Header, packetRemaining int32, confi
 		CleanSession:    flags&0x02 > 0,
 		KeepAliveTimer:  keepAliveTimer,
 		ClientId:        clientId,
+		ClientIdBytes:   clientIdBytes,
+		Properties:      properties,
 	}
 
 	if msg.WillFlag {
+		if protocolVersion == uint8(ProtocolV5) {
+			msg.WillProperties = getProperties(r, &packetRemaining)
+		}
 		msg.WillTopic = getString(r, &packetRemaining)
 		msg.WillMessage = getString(r, &packetRemaining)
 	}
@@ -210,7 +324,7 @@ func (msg *Connect) Decode(r io.Reader, hdr Header, packetRemaining int32, confi
 	}
 
 	if packetRemaining != 0 {
-		return msgTooLongError
+		return ErrMessageTooLong
 	}
 
 	return nil
@@ -219,13 +333,20 @@ func (msg *Connect) Decode(r io.Reader, hdr Header, packetRemaining int32, confi
 // ConnAck represents an MQTT CONNACK message.
 type ConnAck struct {
 	Header
+	// SessionPresent is set by a MQTT v3.1.1 server if it has kept session
+	// state from a previous connection. It must be false for MQTT v3.1.
+	SessionPresent bool
+	// ReturnCode holds a ReasonCode for MQTT v5.
 	ReturnCode ReturnCode
+	Properties Properties // MQTT v5 only.
 }
 
 func (msg *ConnAck) Encode(w io.Writer) (int, error) {
-	buf := new(bytes.Buffer)
+	buf := getBuffer()
+	defer putBuffer(buf)
 
-	buf.WriteByte(byte(0)) // Reserved byte.
+	// Acknowledge flags, which are reserved in MQTT v3.1.
+	setUint8(boolToByte(msg.SessionPresent), buf)
 	setUint8(uint8(msg.ReturnCode), buf)
 
 	return writeMessage(w, MsgConnAck, &msg.Header, buf, 0)
@@ -238,14 +359,18 @@ func (msg *ConnAck) Decode(r io.Reader, hdr Header, packetRemaining int32, confi
 
 	msg.Header = hdr
 
-	getUint8(r, &packetRemaining) // Skip reserved byte.
+	flags := getUint8(r, &packetRemaining)
+	if flags&0xfe != 0 && isStrict(config) {
+		return ErrReservedBits
+	}
+	msg.SessionPresent = flags&0x01 > 0
 	msg.ReturnCode = ReturnCode(getUint8(r, &packetRemaining))
 	if !msg.ReturnCode.IsValid() {
-		return badReturnCodeError
+		return ErrBadReturnCode
 	}
 
 	if packetRemaining != 0 {
-		return msgTooLongError
+		return ErrMessageTooLong
 	}
 
 	return nil
@@ -254,20 +379,32 @@ func (msg *ConnAck) Decode(r io.Reader, hdr Header, packetRemaining int32, confi
 // Publish represents an MQTT PUBLISH message.
 type Publish struct {
 	Header
-	TopicName string
-	MessageId uint16
-	Payload   Payload
+	TopicName  string
+	TopicBytes ByteString // In place of TopicName; see ByteStringConfig.
+	MessageId  uint16
+	Payload    Payload
+	Properties Properties // MQTT v5 only.
 }
 
-func (msg *Publish) Encode(w io.Writer) (int, error) {
-	buf := new(bytes.Buffer)
+func (msg *Publish) Encode(w io.Writer) (n int, err error) {
+	defer func() {
+		err = recoverError(err, recover())
+		countEncode(MsgPublish, n, err)
+	}()
+
+	if err := checkEncodable(msg.Payload); err != nil {
+		return 0, err
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
 
-	setString(msg.TopicName, buf)
+	setStringOrBytes(msg.TopicName, msg.TopicBytes, buf)
 	if msg.Header.QosLevel.HasId() {
 		setUint16(msg.MessageId, buf)
 	}
 
-	n, err := writeMessage(w, MsgPublish, &msg.Header, buf, int32(msg.Payload.Size()))
+	n, err = writeMessage(w, MsgPublish, &msg.Header, buf, int32(msg.Payload.Size()))
 
 	if err != nil {
 		return 0, err
@@ -275,7 +412,7 @@ func (msg *Publish) Encode(w io.Writer) (int, error) {
 
 	p, err := msg.Payload.WritePayload(w)
 
-	return (n + p), nil
+	return (n + p), err
 }
 
 func (msg *Publish) Decode(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) (err error) {
@@ -285,7 +422,7 @@ func (msg *Publish) Decode(r io.Reader, hdr Header, packetRemaining int32, confi
 
 	msg.Header = hdr
 
-	msg.TopicName = getString(r, &packetRemaining)
+	msg.TopicName, msg.TopicBytes = getStringOrBytes(r, &packetRemaining, config)
 	if msg.Header.QosLevel.HasId() {
 		msg.MessageId = getUint16(r, &packetRemaining)
 	}
@@ -302,7 +439,9 @@ func (msg *Publish) Decode(r io.Reader, hdr Header, packetRemaining int32, confi
 // PubAck represents an MQTT PUBACK message.
 type PubAck struct {
 	Header
-	MessageId uint16
+	MessageId  uint16
+	ReasonCode ReasonCode // MQTT v5 only.
+	Properties Properties // MQTT v5 only.
 }
 
 func (msg *PubAck) Encode(w io.Writer) (int, error) {
@@ -317,7 +456,9 @@ func (msg *PubAck) Decode(r io.Reader, hdr Header, packetRemaining int32, config
 // PubRec represents an MQTT PUBREC message.
 type PubRec struct {
 	Header
-	MessageId uint16
+	MessageId  uint16
+	ReasonCode ReasonCode // MQTT v5 only.
+	Properties Properties // MQTT v5 only.
 }
 
 func (msg *PubRec) Encode(w io.Writer) (int, error) {
@@ -332,7 +473,9 @@ func (msg *PubRec) Decode(r io.Reader, hdr Header, packetRemaining int32, config
 // PubRel represents an MQTT PUBREL message.
 type PubRel struct {
 	Header
-	MessageId uint16
+	MessageId  uint16
+	ReasonCode ReasonCode // MQTT v5 only.
+	Properties Properties // MQTT v5 only.
 }
 
 func (msg *PubRel) Encode(w io.Writer) (int, error) {
@@ -347,7 +490,9 @@ func (msg *PubRel) Decode(r io.Reader, hdr Header, packetRemaining int32, config
 // PubComp represents an MQTT PUBCOMP message.
 type PubComp struct {
 	Header
-	MessageId uint16
+	MessageId  uint16
+	ReasonCode ReasonCode // MQTT v5 only.
+	Properties Properties // MQTT v5 only.
 }
 
 func (msg *PubComp) Encode(w io.Writer) (int, error) {
@@ -362,17 +507,32 @@ func (msg *PubComp) Decode(r io.Reader, hdr Header, packetRemaining int32, confi
 // Subscribe represents an MQTT SUBSCRIBE message.
 type Subscribe struct {
 	Header
-	MessageId uint16
-	Topics    []TopicQos
+	MessageId  uint16
+	Topics     []TopicQos
+	Properties Properties // MQTT v5 only.
 }
 
 type TopicQos struct {
 	Topic string
 	Qos   QosLevel
+
+	// Subscription options, which are MQTT v5 only.
+	NoLocal           bool
+	RetainAsPublished bool
+	RetainHandling    uint8
 }
 
-func (msg *Subscribe) Encode(w io.Writer) (int, error) {
-	buf := new(bytes.Buffer)
+func (msg *Subscribe) Encode(w io.Writer) (n int, err error) {
+	defer func() {
+		err = recoverError(err, recover())
+	}()
+
+	if len(msg.Topics) == 0 {
+		return 0, ErrNoTopics
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
 	if msg.Header.QosLevel.HasId() {
 		setUint16(msg.MessageId, buf)
 	}
@@ -410,11 +570,14 @@ func (msg *Subscribe) Decode(r io.Reader, hdr Header, packetRemaining int32, con
 type SubAck struct {
 	Header
 	MessageId uint16
-	TopicsQos []QosLevel
+	// TopicsQos holds a ReasonCode for each topic for MQTT v5.
+	TopicsQos  []QosLevel
+	Properties Properties // MQTT v5 only.
 }
 
 func (msg *SubAck) Encode(w io.Writer) (int, error) {
-	buf := new(bytes.Buffer)
+	buf := getBuffer()
+	defer putBuffer(buf)
 	setUint16(msg.MessageId, buf)
 	for i := 0; i < len(msg.TopicsQos); i += 1 {
 		setUint8(uint8(msg.TopicsQos[i]), buf)
@@ -444,12 +607,22 @@ func (msg *SubAck) Decode(r io.Reader, hdr Header, packetRemaining int32, config
 // Unsubscribe represents an MQTT UNSUBSCRIBE message.
 type Unsubscribe struct {
 	Header
-	MessageId uint16
-	Topics    []string
+	MessageId  uint16
+	Topics     []string
+	Properties Properties // MQTT v5 only.
 }
 
-func (msg *Unsubscribe) Encode(w io.Writer) (int, error) {
-	buf := new(bytes.Buffer)
+func (msg *Unsubscribe) Encode(w io.Writer) (n int, err error) {
+	defer func() {
+		err = recoverError(err, recover())
+	}()
+
+	if len(msg.Topics) == 0 {
+		return 0, ErrNoTopics
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
 	if msg.Header.QosLevel.HasId() {
 		setUint16(msg.MessageId, buf)
 	}
@@ -482,7 +655,9 @@ func (msg *Unsubscribe) Decode(r io.Reader, hdr Header, packetRemaining int32, c
 // UnsubAck represents an MQTT UNSUBACK message.
 type UnsubAck struct {
 	Header
-	MessageId uint16
+	MessageId   uint16
+	ReasonCodes []ReasonCode // MQTT v5 only.
+	Properties  Properties   // MQTT v5 only.
 }
 
 func (msg *UnsubAck) Encode(w io.Writer) (int, error) {
@@ -500,12 +675,13 @@ type PingReq struct {
 }
 
 func (msg *PingReq) Encode(w io.Writer) (int, error) {
-	return msg.Header.Encode(w, MsgPingReq, 0)
+	return encodeEmpty(w, &msg.Header, MsgPingReq)
 }
 
 func (msg *PingReq) Decode(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) error {
+	msg.Header = hdr
 	if packetRemaining != 0 {
-		return msgTooLongError
+		return ErrMessageTooLong
 	}
 	return nil
 }
@@ -516,12 +692,13 @@ type PingResp struct {
 }
 
 func (msg *PingResp) Encode(w io.Writer) (int, error) {
-	return msg.Header.Encode(w, MsgPingResp, 0)
+	return encodeEmpty(w, &msg.Header, MsgPingResp)
 }
 
 func (msg *PingResp) Decode(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) error {
+	msg.Header = hdr
 	if packetRemaining != 0 {
-		return msgTooLongError
+		return ErrMessageTooLong
 	}
 	return nil
 }
@@ -529,21 +706,67 @@ func (msg *PingResp) Decode(r io.Reader, hdr Header, packetRemaining int32, conf
 // Disconnect represents an MQTT DISCONNECT message.
 type Disconnect struct {
 	Header
+	ReasonCode ReasonCode // MQTT v5 only.
+	Properties Properties // MQTT v5 only.
 }
 
 func (msg *Disconnect) Encode(w io.Writer) (int, error) {
-	return msg.Header.Encode(w, MsgDisconnect, 0)
+	return encodeEmpty(w, &msg.Header, MsgDisconnect)
 }
 
 func (msg *Disconnect) Decode(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) error {
+	msg.Header = hdr
 	if packetRemaining != 0 {
-		return msgTooLongError
+		return ErrMessageTooLong
 	}
 	return nil
 }
 
+// RawMessage is a message that is passed through without being interpreted,
+// such as a message of a reserved type (see PassReserved).
+type RawMessage struct {
+	// HeaderByte is the first byte of the message, holding its type and flags.
+	HeaderByte byte
+	// Body is the rest of the message, after the remaining length.
+	Body []byte
+}
+
+func (msg *RawMessage) Encode(w io.Writer) (n int, err error) {
+	defer func() {
+		countEncode(MessageType(msg.HeaderByte>>4), n, err)
+	}()
+
+	if int64(len(msg.Body)) > MaxPayloadSize {
+		return 0, ErrMessageTooLong
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	buf.WriteByte(msg.HeaderByte)
+	encodeLength(int32(len(msg.Body)), buf)
+	buf.Write(msg.Body)
+
+	return w.Write(buf.Bytes())
+}
+
+// Decode reads the message body. HeaderByte must already be set, as it cannot
+// be recovered from hdr for reserved message types.
+func (msg *RawMessage) Decode(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) error {
+	msg.Body = make([]byte, packetRemaining)
+	_, err := io.ReadFull(r, msg.Body)
+	return err
+}
+
+// encodeEmpty writes a message of msgType that has no body.
+func encodeEmpty(w io.Writer, hdr *Header, msgType MessageType) (int, error) {
+	n, err := hdr.Encode(w, msgType, 0)
+	countEncode(msgType, n, err)
+	return n, err
+}
+
 func encodeAckCommon(w io.Writer, hdr *Header, messageId uint16, msgType MessageType) (int, error) {
-	buf := new(bytes.Buffer)
+	buf := getBuffer()
+	defer putBuffer(buf)
 	setUint16(messageId, buf)
 	return writeMessage(w, msgType, hdr, buf, 0)
 }
@@ -556,7 +779,7 @@ func decodeAckCommon(r io.Reader, packetRemaining int32, messageId *uint16, conf
 	*messageId = getUint16(r, &packetRemaining)
 
 	if packetRemaining != 0 {
-		return msgTooLongError
+		return ErrMessageTooLong
 	}
 
 	return nil
@@ -0,0 +1,25 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package mqtt
+
+import (
+	"io"
+	"os"
+)
+
+// mmapRegion reads n bytes of f from offset into memory, on platforms
+// without mmap.
+func mmapRegion(f *os.File, offset int64, n int) (data, mapped []byte, err error) {
+	data = make([]byte, n)
+	if _, err := f.ReadAt(data, offset); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, nil, err
+	}
+	return data, nil, nil
+}
+
+func munmap(mapped []byte) error {
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package mqtt
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapRegion maps n bytes of f from offset read-only, returning the region
+// and the whole mapping, which starts at the page boundary before offset.
+func mmapRegion(f *os.File, offset int64, n int) (data, mapped []byte, err error) {
+	start := offset &^ int64(os.Getpagesize()-1)
+	mapped, err = syscall.Mmap(int(f.Fd()), start, int(offset-start)+n, syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, &os.PathError{Op: "mmap", Path: f.Name(), Err: err}
+	}
+	return mapped[offset-start:], mapped, nil
+}
+
+func munmap(mapped []byte) error {
+	return syscall.Munmap(mapped)
+}
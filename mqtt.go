@@ -1,8 +1,31 @@
-// Implementation of MQTT V3.1 encoding and decoding.
+// Implementation of MQTT encoding and decoding, for MQTT v3.1 (ProtocolV31),
+// v3.1.1 (ProtocolV311) and v5.0 (ProtocolV5).
 //
-// See http://public.dhe.ibm.com/software/dw/webservices/ws-mqtt/mqtt-v3r1.html
-// for the MQTT protocol specification. This package does not implement the
-// semantics of MQTT, but purely the encoding and decoding of its messages.
+// See the protocol specifications:
+//
+//	v3.1:   http://public.dhe.ibm.com/software/dw/webservices/ws-mqtt/mqtt-v3r1.html
+//	v3.1.1: http://docs.oasis-open.org/mqtt/mqtt/v3.1.1/mqtt-v3.1.1.html
+//	v5.0:   https://docs.oasis-open.org/mqtt/mqtt/v5.0/mqtt-v5.0.html
+//
+// At its core, the package encodes and decodes messages, as described
+// below. DecodeOneMessage and the Encode methods speak v3.1 and v3.1.1; a
+// Codec applies the rules of one version, including v5, to a connection.
+//
+// On top of that, it implements some of the semantics of MQTT, for those
+// who want them:
+//
+// * Client is a client on a single connection, which correlates replies
+// with requests, acknowledges messages published to it, and keeps its
+// session in a SessionStore (MemorySessionStore or FileSessionStore) when
+// connecting with CleanSession false.
+//
+// * Keepalive enforces the keep alive on a connection, for a client (which
+// sends PINGREQ when idle) or a server (which drops clients that go quiet).
+//
+// * SubscriptionTree stores subscribers by topic filter, and finds those
+// whose filters match a topic name, for a server routing PUBLISH messages.
+//
+// * MessageIdPool hands out the message ids of messages in flight.
 //
 // Decoding Messages:
 //
@@ -10,39 +33,39 @@
 // will return a Message value. The function can be implemented using the public
 // API of this package if more control is required. For example:
 //
-//   for {
-//     msg, err := mqtt.DecodeOneMessage(conn, nil)
-//     if err != nil {
-//       // handle err
-//     }
-//     switch msg := msg.(type) {
-//     case *Connect:
-//       // ...
-//     case *Publish:
-//       // ...
-//       // etc.
-//     }
-//   }
+//	for {
+//	  msg, err := mqtt.DecodeOneMessage(conn, nil)
+//	  if err != nil {
+//	    // handle err
+//	  }
+//	  switch msg := msg.(type) {
+//	  case *Connect:
+//	    // ...
+//	  case *Publish:
+//	    // ...
+//	    // etc.
+//	  }
+//	}
 //
 // Encoding Messages:
 //
 // Create a message value, and use its Encode method to write it to an
 // io.Writer. For example:
 //
-//   someData := []byte{1, 2, 3}
-//   msg := &Publish{
-//     Header: {
-//       DupFlag: false,
-//       QosLevel: QosAtLeastOnce,
-//       Retain: false,
-//     },
-//     TopicName: "a/b",
-//     MessageId: 10,
-//     Payload: BytesPayload(someData),
-//   }
-//   if err := msg.Encode(conn); err != nil {
-//     // handle err
-//   }
+//	someData := []byte{1, 2, 3}
+//	msg := &Publish{
+//	  Header: {
+//	    DupFlag: false,
+//	    QosLevel: QosAtLeastOnce,
+//	    Retain: false,
+//	  },
+//	  TopicName: "a/b",
+//	  MessageId: 10,
+//	  Payload: BytesPayload(someData),
+//	}
+//	if err := msg.Encode(conn); err != nil {
+//	  // handle err
+//	}
 //
 // Advanced PUBLISH payload handling:
 //
@@ -73,17 +96,52 @@ package mqtt
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
 )
 
+// Errors returned by this package. Errors from decoding a message are
+// wrapped in a *DecodeError, so test for them with errors.Is.
 var (
-	badMsgTypeError        = errors.New("mqtt: message type is invalid")
-	badQosError            = errors.New("mqtt: QoS is invalid")
-	badWillQosError        = errors.New("mqtt: will QoS is invalid")
-	badLengthEncodingError = errors.New("mqtt: remaining length field exceeded maximum of 4 bytes")
-	badReturnCodeError     = errors.New("mqtt: is invalid")
-	dataExceedsPacketError = errors.New("mqtt: data exceeds packet length")
-	msgTooLongError        = errors.New("mqtt: message is too long")
+	ErrAlreadyConnected  = errors.New("mqtt: client has already connected")
+	ErrBadChecksum       = errors.New("mqtt: payload checksum does not match")
+	ErrBadClientId       = errors.New("mqtt: client id is not allowed")
+	ErrBadDupFlag        = errors.New("mqtt: DUP flag is set on a QoS 0 PUBLISH")
+	ErrBadFrame          = errors.New("mqtt: SLIP frame is badly escaped")
+	ErrBadLength         = errors.New("mqtt: remaining length is out of range")
+	ErrBadLengthEncoding = errors.New("mqtt: remaining length field exceeded maximum of 4 bytes")
+	ErrBadMessageType    = errors.New("mqtt: message type is invalid")
+	ErrBadProperty       = errors.New("mqtt: property is invalid")
+	ErrBadProtocol       = errors.New("mqtt: protocol name or version is invalid")
+	ErrBadQos            = errors.New("mqtt: QoS is invalid")
+	ErrBadReturnCode     = errors.New("mqtt: return code is invalid")
+	ErrBadString         = errors.New("mqtt: string is not valid UTF-8 or contains U+0000")
+	ErrBadTopicFilter    = errors.New("mqtt: topic filter is invalid")
+	ErrBadWillQos        = errors.New("mqtt: will QoS is invalid")
+	ErrClientClosed      = errors.New("mqtt: client connection is closed")
+	ErrDataExceedsPacket = errors.New("mqtt: data exceeds packet length")
+	ErrDiscardedPayload  = errors.New("mqtt: cannot encode a discarded payload")
+	ErrEmptyTopic        = errors.New("mqtt: topic is empty")
+	ErrEncodeOnlyPayload = errors.New("mqtt: payload can only be encoded")
+	ErrFrameSize         = errors.New("mqtt: packet length does not match frame length")
+	ErrKeepaliveTimeout  = errors.New("mqtt: keep alive timed out")
+	ErrMessageTooLong    = errors.New("mqtt: message is too long")
+	ErrMissingMessageId  = errors.New("mqtt: message id must be non-zero")
+	ErrNoMessageId       = errors.New("mqtt: no message id is free")
+	ErrNoTopics          = errors.New("mqtt: message has no topics")
+	ErrNotInFlight       = errors.New("mqtt: message is not a QoS 1 or 2 PUBLISH or a PUBREL")
+	ErrPasswordNoUser    = errors.New("mqtt: password flag is set without username flag")
+	ErrReservedBits      = errors.New("mqtt: reserved flag bits are invalid")
+	ErrResyncLimit       = errors.New("mqtt: no message header found within resync limit")
+	ErrStringTooLong     = errors.New("mqtt: string is longer than 65535 bytes")
+	ErrUnexpectedMessage = errors.New("mqtt: unexpected message from server")
+	ErrUnknownDictionary = errors.New("mqtt: payload dictionary is unknown")
+	ErrUnsupported       = errors.New("mqtt: not supported by the protocol version")
+	ErrWildcardTopic     = errors.New("mqtt: topic name contains a wildcard")
 )
 
 const (
@@ -130,12 +188,90 @@ type DecoderConfig interface {
 	MakePayload(msg *Publish, r io.Reader, n int) (Payload, error)
 }
 
+// WrappingConfig is implemented by a DecoderConfig that wraps another, such
+// as PayloadLimitConfig, so that the optional interfaces of the one it wraps
+// (StrictConfig, PacketSizeLimiter, MessageFactory, etc) still apply. Each
+// optional interface is looked for on the outermost DecoderConfig first,
+// then on each that it wraps in turn.
+type WrappingConfig interface {
+	// Unwrap returns the DecoderConfig that is wrapped, or nil.
+	Unwrap() DecoderConfig
+}
+
+// unwrapConfig returns the DecoderConfig that config wraps, or nil if it
+// does not wrap one.
+func unwrapConfig(config DecoderConfig) DecoderConfig {
+	if wrapper, ok := config.(WrappingConfig); ok {
+		return wrapper.Unwrap()
+	}
+	return nil
+}
+
+// findConfig returns the first of config and the DecoderConfigs that it
+// wraps for which is returns true, or nil if there is none.
+func findConfig(config DecoderConfig, is func(DecoderConfig) bool) DecoderConfig {
+	for ; config != nil; config = unwrapConfig(config) {
+		if is(config) {
+			return config
+		}
+	}
+	return nil
+}
+
+func isMalformedPacketHandler(config DecoderConfig) bool {
+	_, ok := config.(MalformedPacketHandler)
+	return ok
+}
+
+func isReceiveTimer(config DecoderConfig) bool {
+	_, ok := config.(ReceiveTimer)
+	return ok
+}
+
+func isMessageFactory(config DecoderConfig) bool {
+	_, ok := config.(MessageFactory)
+	return ok
+}
+
+func isReservedTypeHandler(config DecoderConfig) bool {
+	_, ok := config.(ReservedTypeHandler)
+	return ok
+}
+
 type DefaultDecoderConfig struct{}
 
 func (c DefaultDecoderConfig) MakePayload(msg *Publish, r io.Reader, n int) (Payload, error) {
 	return make(BytesPayload, n), nil
 }
 
+// StrictConfig can optionally be implemented by a DecoderConfig to enable
+// strict decoding. Strict decoding refuses messages that can be decoded but
+// break the rules of the protocol, such as a SUBSCRIBE with no topics or a
+// PUBLISH to a wildcard topic. A server might use it to drop misbehaving
+// clients.
+type StrictConfig interface {
+	Strict() bool
+}
+
+// StrictDecoderConfig is the DefaultDecoderConfig, with strict decoding.
+type StrictDecoderConfig struct {
+	DefaultDecoderConfig
+}
+
+func (c StrictDecoderConfig) Strict() bool {
+	return true
+}
+
+func isStrict(config DecoderConfig) bool {
+	strict, ok := findConfig(config, isStrictConfig).(StrictConfig)
+	return ok && strict.Strict()
+}
+
+func isStrictConfig(config DecoderConfig) bool {
+	_, ok := config.(StrictConfig)
+	return ok
+}
+
 // ValueConfig always returns the given Payload when MakePayload is called.
 type ValueConfig struct {
 	Payload Payload
@@ -145,32 +281,429 @@ func (c *ValueConfig) MakePayload(msg *Publish, r io.Reader, n int) (Payload, er
 	return c.Payload, nil
 }
 
+// PayloadLimitConfig discards Publish payloads larger than MaxPayloadSize
+// rather than reading them into memory, so that one oversized message does
+// not have to end an otherwise healthy connection. Discarded payloads are
+// decoded as a *DiscardedPayload.
+type PayloadLimitConfig struct {
+	// DecoderConfig makes payloads that are within the limit. nil indicates
+	// that the DefaultDecoderConfig should be used.
+	DecoderConfig DecoderConfig
+
+	// MaxPayloadSize is the largest payload, in bytes, that is passed on to
+	// DecoderConfig. Zero means no limit.
+	MaxPayloadSize int
+
+	// OnDiscard, if not nil, is called for each Publish message whose payload
+	// is about to be discarded. n is the size of the payload.
+	OnDiscard func(msg *Publish, n int)
+}
+
+func (c *PayloadLimitConfig) Unwrap() DecoderConfig {
+	return c.DecoderConfig
+}
+
+func (c *PayloadLimitConfig) MakePayload(msg *Publish, r io.Reader, n int) (Payload, error) {
+	if c.MaxPayloadSize > 0 && n > c.MaxPayloadSize {
+		if c.OnDiscard != nil {
+			c.OnDiscard(msg, n)
+		}
+		return new(DiscardedPayload), nil
+	}
+	if c.DecoderConfig == nil {
+		return DefaultDecoderConfig{}.MakePayload(msg, r, n)
+	}
+	return c.DecoderConfig.MakePayload(msg, r, n)
+}
+
+// MetadataReceivedAt is the Metadata key under which DecodeOneMessage records
+// the time.Time that a message was received, if the DecoderConfig implements
+// ReceiveTimer.
+const MetadataReceivedAt = "mqtt.received-at"
+
+// ReceiveTimer can optionally be implemented by a DecoderConfig to have
+// DecodeOneMessage record when each message is received.
+type ReceiveTimer interface {
+	// Now returns the current time. It is called as soon as the fixed header of
+	// a message has been read, and so is not skewed by time spent waiting in a
+	// handler. Returning time.Now() gives a time with both wall clock and
+	// monotonic readings, so that time.Since measures latency correctly even
+	// if the wall clock is changed.
+	Now() time.Time
+}
+
+// ReceiveTimeConfig is the DefaultDecoderConfig, recording receive times.
+type ReceiveTimeConfig struct {
+	DefaultDecoderConfig
+}
+
+func (c ReceiveTimeConfig) Now() time.Time {
+	return time.Now()
+}
+
+// ReceivedAt returns the receive time recorded on msg by DecodeOneMessage,
+// and whether there was one.
+func ReceivedAt(msg Message) (time.Time, bool) {
+	if a, ok := msg.(Annotatable); ok {
+		t, ok := a.Annotations()[MetadataReceivedAt].(time.Time)
+		return t, ok
+	}
+	return time.Time{}, false
+}
+
+// ReservedTypePolicy says how DecodeOneMessage handles messages with the
+// reserved message types 0 and 15.
+type ReservedTypePolicy int
+
+const (
+	// DropReserved returns a *ReservedTypeError without reading the rest of
+	// the message. The connection can no longer be decoded from, and should
+	// be dropped. This is the default.
+	DropReserved = ReservedTypePolicy(iota)
+	// SkipReserved reads and discards the rest of the message, and returns a
+	// *ReservedTypeError. The connection can still be decoded from.
+	SkipReserved
+	// PassReserved decodes the message as a *RawMessage, e.g for a proxy to
+	// forward as is.
+	PassReserved
+)
+
+// ReservedTypeHandler can optionally be implemented by a DecoderConfig to
+// choose a ReservedTypePolicy other than DropReserved.
+type ReservedTypeHandler interface {
+	ReservedTypes() ReservedTypePolicy
+}
+
+// ReservedTypeError is returned by DecodeOneMessage for messages with a
+// reserved message type.
+type ReservedTypeError struct {
+	// HeaderByte is the first byte of the message, holding its type and flags.
+	HeaderByte byte
+	// RemainingLength is the length of the rest of the message.
+	RemainingLength int32
+	// Skipped is true if the rest of the message was read and discarded.
+	Skipped bool
+}
+
+func (e *ReservedTypeError) Error() string {
+	return fmt.Sprintf("mqtt: reserved message type %d (header byte %#02x)", e.HeaderByte>>4, e.HeaderByte)
+}
+
+// PacketSizeLimiter can optionally be implemented by a DecoderConfig to
+// refuse packets larger than a limit, before any memory is allocated for
+// them. The remaining length of a packet is chosen by its sender, and can be
+// up to 256MiB, so a server should set a limit for untrusted clients.
+type PacketSizeLimiter interface {
+	// PacketSizeLimit returns the size of the largest packet of msgType that
+	// will be decoded, in bytes including the fixed header. 0 means that
+	// there is no limit.
+	PacketSizeLimit(msgType MessageType) int
+}
+
+// PacketTooLargeError is returned when decoding a packet larger than the
+// limit set by a PacketSizeLimiter. The rest of the packet is not read, so
+// the connection can no longer be decoded from, and should be dropped.
+type PacketTooLargeError struct {
+	MsgType MessageType
+	// Size is the size of the packet, including its fixed header.
+	Size int
+	// Limit is the size of the largest packet of MsgType that is allowed.
+	Limit int
+}
+
+func (e *PacketTooLargeError) Error() string {
+	return fmt.Sprintf("mqtt: packet of type %d is %d bytes, larger than the limit of %d", e.MsgType, e.Size, e.Limit)
+}
+
+// PacketLimitConfig is the DefaultDecoderConfig, with packet size limits.
+type PacketLimitConfig struct {
+	DefaultDecoderConfig
+
+	// MaxPacketSize is the size of the largest packet, including its fixed
+	// header. 0 means that there is no limit.
+	MaxPacketSize int
+
+	// TypeLimits overrides MaxPacketSize for the message types in it, e.g
+	// with the ControlPacketLimits.
+	TypeLimits map[MessageType]int
+}
+
+func (c *PacketLimitConfig) PacketSizeLimit(msgType MessageType) int {
+	if limit, ok := c.TypeLimits[msgType]; ok {
+		return limit
+	}
+	return c.MaxPacketSize
+}
+
+// ControlPacketLimits returns limits for the control packets that are
+// always small in MQTT v3.1 and v3.1.1, for use as
+// PacketLimitConfig.TypeLimits. They are too small for MQTT v5, whose
+// acknowledgements may carry properties.
+func ControlPacketLimits() map[MessageType]int {
+	return map[MessageType]int{
+		MsgConnAck:    4,
+		MsgPubAck:     4,
+		MsgPubRec:     4,
+		MsgPubRel:     4,
+		MsgPubComp:    4,
+		MsgUnsubAck:   4,
+		MsgPingReq:    2,
+		MsgPingResp:   2,
+		MsgDisconnect: 2,
+	}
+}
+
+// checkPacketSize returns a *PacketTooLargeError if a packet of msgType and
+// size is over the limit set by config.
+func checkPacketSize(config DecoderConfig, msgType MessageType, size int) error {
+	if limit := packetSizeLimit(config, msgType); limit > 0 && size > limit {
+		return &PacketTooLargeError{msgType, size, limit}
+	}
+	return nil
+}
+
+// packetSizeLimit returns the limit that config sets on the size of packets
+// of msgType, or 0 if there is none.
+func packetSizeLimit(config DecoderConfig, msgType MessageType) int {
+	if limiter, ok := findConfig(config, isPacketSizeLimiter).(PacketSizeLimiter); ok {
+		return limiter.PacketSizeLimit(msgType)
+	}
+	return 0
+}
+
+func isPacketSizeLimiter(config DecoderConfig) bool {
+	_, ok := config.(PacketSizeLimiter)
+	return ok
+}
+
+// DecodeError is returned by DecodeOneMessage when a message fails to
+// decode. It wraps the underlying error (e.g ErrDataExceedsPacket, or
+// io.ErrUnexpectedEOF), which errors.Is and errors.As see through.
+type DecodeError struct {
+	// MsgType is the type of the message, or 0 if the fixed header could not
+	// be read.
+	MsgType MessageType
+	// Offset is the number of bytes of the packet, counting from the start of
+	// its fixed header, that had been read when decoding failed.
+	Offset int64
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	if e.MsgType == 0 {
+		return fmt.Sprintf("mqtt: decoding fixed header at byte %d: %s", e.Offset, strings.TrimPrefix(e.Err.Error(), "mqtt: "))
+	}
+	return fmt.Sprintf("mqtt: decoding %v at byte %d: %s", e.MsgType, e.Offset, strings.TrimPrefix(e.Err.Error(), "mqtt: "))
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// offsetReader counts the bytes read through it, for DecodeError.Offset.
+type offsetReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *offsetReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *offsetReader) ReadByte() (byte, error) {
+	b, err := readByte(c.r)
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// offsetReaders recycles offsetReaders, as one passed on as an io.Reader
+// always escapes to the heap, and allocating one for every message would
+// add an allocation to every decode.
+var offsetReaders = sync.Pool{New: func() interface{} { return new(offsetReader) }}
+
+// releaseOffsetReader returns c to offsetReaders after decoding msg, unless
+// msg may still read through it: the payload of a Publish may keep its
+// reader, and read it after decoding returns (see Payload.ReadPayload), but
+// a BytesPayload never does.
+func releaseOffsetReader(c *offsetReader, msg Message) {
+	if publish, ok := msg.(*Publish); ok {
+		if _, ok := publish.Payload.(BytesPayload); !ok {
+			return
+		}
+	}
+	c.r = nil
+	offsetReaders.Put(c)
+}
+
+// MaxCapturedPacketSize is the maximum number of bytes of a malformed packet
+// that are passed to MalformedPacketHandler.OnMalformedPacket.
+const MaxCapturedPacketSize = 4096
+
+// MalformedPacketHandler can optionally be implemented by a DecoderConfig to
+// be told about packets that fail to decode.
+type MalformedPacketHandler interface {
+	// OnMalformedPacket is called by DecodeOneMessage when decoding fails. raw
+	// holds the bytes read from the connection for the failed message (at
+	// most MaxCapturedPacketSize of them), and err is the error that
+	// DecodeOneMessage is about to return. raw must not be retained after the
+	// call returns.
+	OnMalformedPacket(raw []byte, err error)
+}
+
+// captureReader records up to MaxCapturedPacketSize bytes read through it.
+type captureReader struct {
+	r   io.Reader
+	buf []byte
+}
+
+func (c *captureReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if room := MaxCapturedPacketSize - len(c.buf); room > 0 {
+		if room > n {
+			room = n
+		}
+		c.buf = append(c.buf, p[:room]...)
+	}
+	return n, err
+}
+
 // DecodeOneMessage decodes one message from r. config provides specifics on
 // how to decode messages, nil indicates that the DefaultDecoderConfig should
 // be used.
 func DecodeOneMessage(r io.Reader, config DecoderConfig) (msg Message, err error) {
+	return decodeOneMessage(r, config, false)
+}
+
+// decodeOneMessage implements DecodeOneMessage. If v5 is true, messages are
+// decoded as MQTT v5, and AUTH is not a reserved type.
+func decodeOneMessage(r io.Reader, config DecoderConfig, v5 bool) (msg Message, err error) {
+	if config == nil {
+		config = DefaultDecoderConfig{}
+	}
+
+	if handler, ok := findConfig(config, isMalformedPacketHandler).(MalformedPacketHandler); ok {
+		capture := &captureReader{r: r}
+		r = capture
+		defer func() {
+			// A clean EOF between messages is not a malformed packet.
+			if err != nil && len(capture.buf) > 0 {
+				handler.OnMalformedPacket(capture.buf, err)
+			}
+		}()
+	}
+
+	counter := offsetReaders.Get().(*offsetReader)
+	counter.r, counter.n = r, 0
+	r = counter
 	var hdr Header
 	var msgType MessageType
+	defer func() {
+		err = wrapDecodeError(err, msgType, counter.n)
+		countDecode(msgType, counter.n, err)
+		releaseOffsetReader(counter, msg)
+	}()
+
 	var packetRemaining int32
 	msgType, packetRemaining, err = hdr.Decode(r)
 	if err != nil {
 		return
 	}
+	size := 1 + RemainingLengthSize(packetRemaining) + int(packetRemaining)
+	if err = checkPacketSize(config, msgType, size); err != nil {
+		return
+	}
 
-	msg, err = NewMessage(msgType)
+	var receivedAt time.Time
+	timer, recordTime := findConfig(config, isReceiveTimer).(ReceiveTimer)
+	if recordTime {
+		receivedAt = timer.Now()
+	}
+
+	factory, hasFactory := findConfig(config, isMessageFactory).(MessageFactory)
+	switch {
+	case v5 && msgType == MsgAuth:
+		msg = new(Auth)
+	case hasFactory:
+		msg, err = factory.NewMessage(msgType)
+		if err == ErrBadMessageType && !msgType.IsValid() {
+			// Leave the reserved type to the ReservedTypePolicy.
+			msg, err = nil, nil
+		}
+		if err != nil {
+			return
+		}
+	case msgType.IsValid():
+		if msg, err = NewMessage(msgType); err != nil {
+			return
+		}
+	}
+
+	if msg == nil {
+		policy := DropReserved
+		if handler, ok := findConfig(config, isReservedTypeHandler).(ReservedTypeHandler); ok {
+			policy = handler.ReservedTypes()
+		}
+		headerByte := hdr.byte1(msgType)
+		switch policy {
+		case SkipReserved:
+			if _, err = io.CopyN(ioutil.Discard, r, int64(packetRemaining)); err != nil {
+				return
+			}
+			return nil, &ReservedTypeError{headerByte, packetRemaining, true}
+		case PassReserved:
+			msg = &RawMessage{HeaderByte: headerByte}
+		default:
+			return nil, &ReservedTypeError{headerByte, packetRemaining, false}
+		}
+	}
+
+	if decoder, ok := msg.(v5Decoder); ok && v5 {
+		err = decoder.decodeV5(r, hdr, packetRemaining, config)
+	} else {
+		err = msg.Decode(r, hdr, packetRemaining, config)
+	}
 	if err != nil {
 		return
 	}
 
-	if config == nil {
-		config = DefaultDecoderConfig{}
+	if isStrict(config) {
+		if err = Validate(msg); err != nil {
+			return
+		}
+	}
+
+	if a, ok := msg.(Annotatable); ok && recordTime {
+		a.Annotate(MetadataReceivedAt, receivedAt)
 	}
 
-	return msg, msg.Decode(r, hdr, packetRemaining, config)
+	return
+}
+
+// wrapDecodeError wraps err, from decoding a message of msgType after offset
+// bytes had been read, in a *DecodeError. A clean EOF before a message, and
+// errors that already describe the packet, are returned as they are.
+func wrapDecodeError(err error, msgType MessageType, offset int64) error {
+	switch err.(type) {
+	case nil, *DecodeError, *PacketTooLargeError, *ReservedTypeError:
+		return err
+	}
+	if err == io.EOF {
+		if offset == 0 {
+			return err
+		}
+		err = io.ErrUnexpectedEOF
+	}
+	return &DecodeError{MsgType: msgType, Offset: offset, Err: err}
 }
 
 // NewMessage creates an instance of a Message value for the given message
-// type. An error is returned if msgType is invalid.
+// type. An error is returned if msgType is invalid. MsgAuth is invalid here,
+// as type 15 is reserved before MQTT v5; a v5 Codec creates AUTH messages
+// itself.
 func NewMessage(msgType MessageType) (msg Message, err error) {
 	switch msgType {
 	case MsgConnect:
@@ -202,7 +735,7 @@ func NewMessage(msgType MessageType) (msg Message, err error) {
 	case MsgDisconnect:
 		msg = new(Disconnect)
 	default:
-		return nil, badMsgTypeError
+		return nil, ErrBadMessageType
 	}
 
 	return
@@ -1,10 +1,14 @@
 package mqtt
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"io"
+	"io/ioutil"
 	"reflect"
 	"testing"
+	"time"
 
 	gbt "github.com/huin/gobinarytest"
 )
@@ -206,8 +210,8 @@ func TestEncodeDecode(t *testing.T) {
 				},
 				MessageId: 0x4321,
 				Topics: []TopicQos{
-					{"a/b", QosAtLeastOnce},
-					{"c/d", QosExactlyOnce},
+					{Topic: "a/b", Qos: QosAtLeastOnce},
+					{Topic: "c/d", Qos: QosExactlyOnce},
 				},
 			},
 			Expected: gbt.InOrder{
@@ -357,6 +361,30 @@ func TestErrorEncode(t *testing.T) {
 				Payload:   fakeSizePayload(0x7fffffff),
 			},
 		},
+		{
+			Comment: "CONNECT message with password but no username.",
+			Msg: &Connect{
+				ProtocolName:    "MQIsdp",
+				ProtocolVersion: 3,
+				ClientId:        "c",
+				PasswordFlag:    true,
+				Password:        "pwd",
+			},
+		},
+		{
+			Comment: "SUBSCRIBE message with no topics.",
+			Msg: &Subscribe{
+				Header:    Header{QosLevel: QosAtLeastOnce},
+				MessageId: 0x1234,
+			},
+		},
+		{
+			Comment: "UNSUBSCRIBE message with no topics.",
+			Msg: &Unsubscribe{
+				Header:    Header{QosLevel: QosAtLeastOnce},
+				MessageId: 0x1234,
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -410,6 +438,777 @@ func TestErrorDecode(t *testing.T) {
 	}
 }
 
+type capturingDecoderConfig struct {
+	DefaultDecoderConfig
+	Raw []byte
+	Err error
+}
+
+func (c *capturingDecoderConfig) OnMalformedPacket(raw []byte, err error) {
+	c.Raw = append([]byte(nil), raw...)
+	c.Err = err
+}
+
+func TestMalformedPacketHandler(t *testing.T) {
+	tests := []struct {
+		Comment  string
+		Encoded  gbt.Matcher
+		Expected []byte
+	}{
+		{
+			Comment:  "Immediate EOF is not reported",
+			Encoded:  gbt.Literal{},
+			Expected: nil,
+		},
+		{
+			Comment: "PUBACK message with too short a length",
+			Encoded: gbt.InOrder{
+				gbt.Named{"Header byte", gbt.Literal{0x40}},
+				gbt.Named{"Remaining length", gbt.Literal{1}},
+
+				gbt.Named{"Truncated MessageId", gbt.Literal{0x12}},
+			},
+			// The MessageId is never read, as the length already rules it out.
+			Expected: []byte{0x40, 0x01},
+		},
+		{
+			Comment: "Invalid message type",
+			Encoded: gbt.InOrder{
+				gbt.Named{"Header byte", gbt.Literal{0xf0}},
+				gbt.Named{"Remaining length", gbt.Literal{0}},
+			},
+			Expected: []byte{0xf0, 0x00},
+		},
+	}
+
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		test.Encoded.Write(buf)
+
+		config := new(capturingDecoderConfig)
+		_, err := DecodeOneMessage(buf, config)
+		if err == nil {
+			t.Errorf("%s: Expected error during decoding, but got nil.", test.Comment)
+			continue
+		}
+		if !bytes.Equal(test.Expected, config.Raw) {
+			t.Errorf("%s: Captured %#v, expected %#v", test.Comment, config.Raw, test.Expected)
+		}
+		if test.Expected != nil && config.Err != err {
+			t.Errorf("%s: Handler got error %v, DecodeOneMessage returned %v", test.Comment, config.Err, err)
+		}
+	}
+}
+
+func TestPayloadLimitConfig(t *testing.T) {
+	buf := new(bytes.Buffer)
+	for _, msg := range []Message{
+		&Publish{TopicName: "big", Payload: BytesPayload{1, 2, 3, 4}},
+		&Publish{TopicName: "small", Payload: BytesPayload{1, 2}},
+	} {
+		if _, err := msg.Encode(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var discarded []string
+	config := &PayloadLimitConfig{
+		MaxPayloadSize: 2,
+		OnDiscard: func(msg *Publish, n int) {
+			discarded = append(discarded, msg.TopicName)
+		},
+	}
+
+	expected := []Message{
+		&Publish{TopicName: "big", Payload: &DiscardedPayload{N: 4}},
+		&Publish{TopicName: "small", Payload: BytesPayload{1, 2}},
+	}
+	for _, expectedMsg := range expected {
+		if msg, err := DecodeOneMessage(buf, config); err != nil {
+			t.Errorf("Unexpected error during decoding: %v", err)
+		} else if !reflect.DeepEqual(expectedMsg, msg) {
+			t.Errorf("     got = %#v\nexpected = %#v", msg, expectedMsg)
+		}
+	}
+
+	if !reflect.DeepEqual([]string{"big"}, discarded) {
+		t.Errorf("OnDiscard called for %v, expected [big]", discarded)
+	}
+
+	for _, version := range []ProtocolVersion{ProtocolV311, ProtocolV5} {
+		out := new(bytes.Buffer)
+		codec := &Codec{Version: version}
+		if _, err := codec.Encode(out, expected[0]); err != ErrDiscardedPayload {
+			t.Errorf("%v: Got error %v encoding a discarded payload, expected ErrDiscardedPayload", version, err)
+		}
+		if out.Len() != 0 {
+			t.Errorf("%v: Wrote % x for a discarded payload, expected nothing", version, out.Bytes())
+		}
+	}
+
+	// A zero MaxPayloadSize means no limit.
+	if _, err := expected[1].Encode(buf); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := DecodeOneMessage(buf, &PayloadLimitConfig{}); err != nil {
+		t.Errorf("Unexpected error during decoding: %v", err)
+	} else if !reflect.DeepEqual(expected[1], msg) {
+		t.Errorf("     got = %#v\nexpected = %#v", msg, expected[1])
+	}
+}
+
+func TestPacketLimitConfig(t *testing.T) {
+	config := &PacketLimitConfig{MaxPacketSize: 10, TypeLimits: ControlPacketLimits()}
+	tests := []struct {
+		Comment  string
+		Encoded  []byte
+		Expected *PacketTooLargeError
+	}{
+		{"PUBACK", []byte{0x40, 0x02, 0x00, 0x01}, nil},
+		{"PUBACK over control limit", []byte{0x40, 0x03, 0x00, 0x01, 0x00}, &PacketTooLargeError{MsgPubAck, 5, 4}},
+		{"PINGREQ over control limit", []byte{0xc0, 0x01, 0x00}, &PacketTooLargeError{MsgPingReq, 3, 2}},
+		{"PUBLISH at limit", []byte{0x30, 0x08, 0x00, 0x01, 'a', 1, 2, 3, 4, 5}, nil},
+		{"PUBLISH over limit", []byte{0x30, 0x09, 0x00, 0x01, 'a', 1, 2, 3, 4, 5, 6}, &PacketTooLargeError{MsgPublish, 11, 10}},
+		// Refused before the claimed 256MiB body is read.
+		{"PUBLISH with huge length", []byte{0x30, 0xff, 0xff, 0xff, 0x7f}, &PacketTooLargeError{MsgPublish, 268435460, 10}},
+	}
+
+	for _, test := range tests {
+		_, err := DecodeOneMessage(bytes.NewBuffer(test.Encoded), config)
+		if test.Expected == nil {
+			if err != nil {
+				t.Errorf("%s: Unexpected error during decoding: %v", test.Comment, err)
+			}
+		} else if !reflect.DeepEqual(test.Expected, err) {
+			t.Errorf("%s: got error %v, expected %v", test.Comment, err, test.Expected)
+		}
+	}
+}
+
+// wrappedConfigs wrap a DecoderConfig in each of the package's
+// DecoderConfigs that wrap another.
+var wrappedConfigs = []struct {
+	Name string
+	Wrap func(DecoderConfig) DecoderConfig
+}{
+	{"PayloadLimitConfig", func(c DecoderConfig) DecoderConfig {
+		return &PayloadLimitConfig{DecoderConfig: c, MaxPayloadSize: 100}
+	}},
+	{"ByteStringDecoderConfig", func(c DecoderConfig) DecoderConfig {
+		return &ByteStringDecoderConfig{DecoderConfig: c}
+	}},
+}
+
+func TestWrappedConfigs(t *testing.T) {
+	dupQos0 := []byte{0x38, 0x03, 0x00, 0x01, 'a'}
+	large := []byte{0x30, 0x08, 0x00, 0x01, 'a', 1, 2, 3, 4, 5}
+
+	for _, wrapped := range wrappedConfigs {
+		if _, err := DecodeOneMessage(bytes.NewReader(dupQos0), wrapped.Wrap(StrictDecoderConfig{})); !errors.Is(err, ErrBadDupFlag) {
+			t.Errorf("%s: Got %v for a QoS 0 PUBLISH with DUP set, expected ErrBadDupFlag", wrapped.Name, err)
+		}
+
+		var tooLarge *PacketTooLargeError
+		if _, err := DecodeOneMessage(bytes.NewReader(large), wrapped.Wrap(&PacketLimitConfig{MaxPacketSize: 8})); !errors.As(err, &tooLarge) {
+			t.Errorf("%s: Got %v for a PUBLISH over the limit, expected a *PacketTooLargeError", wrapped.Name, err)
+		}
+
+		if msg, err := DecodeOneMessage(bytes.NewReader(large), wrapped.Wrap(ReceiveTimeConfig{})); err != nil {
+			t.Errorf("%s: Unexpected error: %v", wrapped.Name, err)
+		} else if _, ok := ReceivedAt(msg); !ok {
+			t.Errorf("%s: No receive time was recorded", wrapped.Name)
+		}
+	}
+}
+
+// lazyPayload keeps its reader, to read the payload after decoding.
+type lazyPayload struct {
+	r io.Reader
+}
+
+func (p *lazyPayload) Size() int                             { return 0 }
+func (p *lazyPayload) WritePayload(w io.Writer) (int, error) { return 0, nil }
+func (p *lazyPayload) ReadPayload(r io.Reader) error         { p.r = r; return nil }
+func (p *lazyPayload) MakePayload(msg *Publish, r io.Reader, n int) (Payload, error) {
+	return p, nil
+}
+
+// A payload may read its reader after DecodeOneMessage returns, so the
+// reader must not be reused to decode other messages in the meantime.
+func TestDecodeLazyPayload(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if _, err := (&Publish{TopicName: "a", Payload: BytesPayload("lazy")}).Encode(buf); err != nil {
+		t.Fatal(err)
+	}
+	payload := new(lazyPayload)
+	if _, err := DecodeOneMessage(buf, payload); err != nil {
+		t.Fatalf("Unexpected error during decoding: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := DecodeOneMessage(bytes.NewReader([]byte{0x40, 0x02, 0x00, 0x01}), nil); err != nil {
+			t.Fatalf("Unexpected error during decoding: %v", err)
+		}
+	}
+	if data, err := ioutil.ReadAll(payload.r); err != nil || string(data) != "lazy" {
+		t.Errorf("Read %q, %v from the payload, expected \"lazy\"", data, err)
+	}
+}
+
+func TestResync(t *testing.T) {
+	tests := []struct {
+		Comment         string
+		Version         ProtocolVersion
+		Encoded         gbt.Matcher
+		MaxSkip         int
+		ExpectedSkipped int
+		ExpectError     bool
+	}{
+		{
+			Comment: "Already at a message",
+			Version: ProtocolV311,
+			Encoded: gbt.InOrder{
+				gbt.Named{"Header byte", gbt.Literal{0x40}},
+				gbt.Named{"Remaining length", gbt.Literal{2}},
+				gbt.Named{"MessageId", gbt.Literal{0x12, 0x34}},
+			},
+			MaxSkip:         10,
+			ExpectedSkipped: 0,
+		},
+		{
+			Comment: "Garbage before PUBACK",
+			Version: ProtocolV311,
+			Encoded: gbt.InOrder{
+				gbt.Named{"Invalid message type", gbt.Literal{0x00}},
+				gbt.Named{"PUBACK with wrong length", gbt.Literal{0x40, 0x03}},
+				gbt.Named{"PUBLISH with QoS 3", gbt.Literal{0x36, 0x05}},
+				gbt.Named{"Bad length encoding", gbt.Literal{0x30, 0xff, 0xff, 0xff, 0xff}},
+
+				gbt.Named{"Header byte", gbt.Literal{0x40}},
+				gbt.Named{"Remaining length", gbt.Literal{2}},
+				gbt.Named{"MessageId", gbt.Literal{0x12, 0x34}},
+			},
+			MaxSkip:         20,
+			ExpectedSkipped: 10,
+		},
+		{
+			Comment: "Garbage exceeds MaxSkip",
+			Version: ProtocolV311,
+			Encoded: gbt.InOrder{
+				gbt.Named{"Garbage", gbt.Literal{0x00, 0x00, 0x00}},
+
+				gbt.Named{"Header byte", gbt.Literal{0x40}},
+				gbt.Named{"Remaining length", gbt.Literal{2}},
+				gbt.Named{"MessageId", gbt.Literal{0x12, 0x34}},
+			},
+			MaxSkip:         2,
+			ExpectedSkipped: 2,
+			ExpectError:     true,
+		},
+		{
+			Comment: "AUTH is reserved before MQTT v5",
+			Version: ProtocolV311,
+			Encoded: gbt.InOrder{
+				gbt.Named{"AUTH", gbt.Literal{0xf0, 0x00}},
+
+				gbt.Named{"Header byte", gbt.Literal{0x40}},
+				gbt.Named{"Remaining length", gbt.Literal{2}},
+				gbt.Named{"MessageId", gbt.Literal{0x12, 0x34}},
+			},
+			MaxSkip:         10,
+			ExpectedSkipped: 2,
+		},
+		{
+			Comment: "MQTT v5 lengths",
+			Version: ProtocolV5,
+			Encoded: gbt.InOrder{
+				gbt.Named{"Invalid message type", gbt.Literal{0x00}},
+				gbt.Named{"CONNACK without properties", gbt.Literal{0x20, 0x02}},
+				gbt.Named{"SUBACK without reason codes", gbt.Literal{0x90, 0x03}},
+
+				gbt.Named{"Header byte", gbt.Literal{0x40}},
+				gbt.Named{"Remaining length", gbt.Literal{2}},
+				gbt.Named{"MessageId", gbt.Literal{0x12, 0x34}},
+			},
+			MaxSkip:         10,
+			ExpectedSkipped: 5,
+		},
+		{
+			Comment: "MQTT v5 PUBACK with a reason code",
+			Version: ProtocolV5,
+			Encoded: gbt.InOrder{
+				gbt.Named{"Header byte", gbt.Literal{0x40}},
+				gbt.Named{"Remaining length", gbt.Literal{3}},
+				gbt.Named{"MessageId", gbt.Literal{0x12, 0x34}},
+				gbt.Named{"Reason code", gbt.Literal{0x00}},
+			},
+			MaxSkip:         10,
+			ExpectedSkipped: 0,
+		},
+		{
+			Comment: "Unsupported version",
+			Version: ProtocolVersion(6),
+			Encoded: gbt.InOrder{
+				gbt.Named{"Header byte", gbt.Literal{0x40}},
+				gbt.Named{"Remaining length", gbt.Literal{2}},
+				gbt.Named{"MessageId", gbt.Literal{0x12, 0x34}},
+			},
+			MaxSkip:         10,
+			ExpectedSkipped: 0,
+			ExpectError:     true,
+		},
+	}
+
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		test.Encoded.Write(buf)
+		r := bufio.NewReader(buf)
+
+		skipped, err := Resync(r, test.Version, test.MaxSkip)
+		if skipped != test.ExpectedSkipped {
+			t.Errorf("%s: Skipped %d bytes, expected %d", test.Comment, skipped, test.ExpectedSkipped)
+		}
+		if test.ExpectError {
+			if err == nil {
+				t.Errorf("%s: Expected error, but got nil.", test.Comment)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Unexpected error: %v", test.Comment, err)
+		} else if msg, err := (&Codec{Version: test.Version}).Decode(r); err != nil {
+			t.Errorf("%s: Unexpected error during decoding: %v", test.Comment, err)
+		} else if !reflect.DeepEqual(&PubAck{MessageId: 0x1234}, msg) {
+			t.Errorf("%s: Decoded %#v", test.Comment, msg)
+		}
+	}
+}
+
+func TestMetadataIsNotEncoded(t *testing.T) {
+	msg := &PubAck{MessageId: 0x1234}
+	var annotatable Annotatable = msg
+	annotatable.Annotate("trace-id", "abc")
+	if got := msg.Annotations()["trace-id"]; got != "abc" {
+		t.Errorf("Got trace-id %v, expected abc", got)
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := msg.Encode(buf); err != nil {
+		t.Fatalf("Unexpected error during encoding: %v", err)
+	}
+	if err := gbt.Matches(gbt.Literal{0x40, 0x02, 0x12, 0x34}, buf.Bytes()); err != nil {
+		t.Errorf("Unexpected encoding output: %v", err)
+	}
+
+	if decodedMsg, err := DecodeOneMessage(buf, nil); err != nil {
+		t.Errorf("Unexpected error during decoding: %v", err)
+	} else if md := decodedMsg.(Annotatable).Annotations(); md != nil {
+		t.Errorf("Decoded message has metadata %v", md)
+	}
+
+	// Headers, and messages made only of a header, can still be compared
+	// with ==, with or without metadata.
+	ping := &PingReq{}
+	if *ping != (PingReq{}) {
+		t.Errorf("Equal messages compare as unequal")
+	}
+	ping.Annotate("trace-id", "abc")
+	if *ping == (PingReq{}) || ping.Header != ping.Header {
+		t.Errorf("Annotated message does not compare as expected")
+	}
+}
+
+type fixedTimeDecoderConfig struct {
+	DefaultDecoderConfig
+	Time time.Time
+}
+
+func (c fixedTimeDecoderConfig) Now() time.Time {
+	return c.Time
+}
+
+func TestReceiveTimer(t *testing.T) {
+	receivedAt := time.Date(2013, 1, 2, 3, 4, 5, 6, time.UTC)
+	config := fixedTimeDecoderConfig{Time: receivedAt}
+
+	for _, msg := range []Message{&PubAck{MessageId: 0x1234}, &Connect{}, &PingReq{}} {
+		buf := new(bytes.Buffer)
+		if _, err := msg.Encode(buf); err != nil {
+			t.Fatalf("%T: Unexpected error during encoding: %v", msg, err)
+		}
+
+		decodedMsg, err := DecodeOneMessage(buf, config)
+		if err != nil {
+			t.Fatalf("%T: Unexpected error during decoding: %v", msg, err)
+		}
+		if got, ok := ReceivedAt(decodedMsg); !ok || !got.Equal(receivedAt) {
+			t.Errorf("%T: ReceivedAt got %v, %t, expected %v", msg, got, ok, receivedAt)
+		}
+	}
+
+	if _, ok := ReceivedAt(&PubAck{}); ok {
+		t.Errorf("ReceivedAt reported a time for a message that was not decoded")
+	}
+}
+
+type reservedPolicyDecoderConfig struct {
+	DefaultDecoderConfig
+	Policy ReservedTypePolicy
+}
+
+func (c reservedPolicyDecoderConfig) ReservedTypes() ReservedTypePolicy {
+	return c.Policy
+}
+
+func TestDecodeError(t *testing.T) {
+	tests := []struct {
+		Comment  string
+		Encoded  gbt.Matcher
+		Expected *DecodeError
+	}{
+		{
+			Comment: "Truncated PUBACK",
+			Encoded: gbt.InOrder{
+				gbt.Named{"Header byte", gbt.Literal{0x40}},
+				gbt.Named{"Remaining length", gbt.Literal{2}},
+				gbt.Named{"Half a message id", gbt.Literal{0x12}},
+			},
+			Expected: &DecodeError{MsgPubAck, 3, io.ErrUnexpectedEOF},
+		},
+		{
+			Comment: "CONNACK with bad return code",
+			Encoded: gbt.InOrder{
+				gbt.Named{"Header byte", gbt.Literal{0x20}},
+				gbt.Named{"Remaining length", gbt.Literal{2}},
+				gbt.Named{"Acknowledge flags", gbt.Literal{0x00}},
+				gbt.Named{"Return code", gbt.Literal{0x09}},
+			},
+			Expected: &DecodeError{MsgConnAck, 4, ErrBadReturnCode},
+		},
+		{
+			Comment: "SUBACK with length too short for message id",
+			Encoded: gbt.InOrder{
+				gbt.Named{"Header byte", gbt.Literal{0x90}},
+				gbt.Named{"Remaining length", gbt.Literal{1}},
+				gbt.Named{"Body", gbt.Literal{0x12}},
+			},
+			Expected: &DecodeError{MsgSubAck, 2, ErrDataExceedsPacket},
+		},
+		{
+			Comment: "Remaining length over 4 bytes",
+			Encoded: gbt.InOrder{
+				gbt.Named{"Header byte", gbt.Literal{0x30}},
+				gbt.Named{"Remaining length", gbt.Literal{0xff, 0xff, 0xff, 0xff}},
+			},
+			Expected: &DecodeError{MsgPublish, 5, ErrBadLengthEncoding},
+		},
+	}
+
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		test.Encoded.Write(buf)
+
+		_, err := DecodeOneMessage(buf, nil)
+		var decodeErr *DecodeError
+		if !errors.As(err, &decodeErr) {
+			t.Errorf("%s: Got %#v, expected a *DecodeError", test.Comment, err)
+		} else if !reflect.DeepEqual(test.Expected, decodeErr) {
+			t.Errorf("%s: Got error %#v, expected %#v", test.Comment, decodeErr, test.Expected)
+		} else if !errors.Is(err, test.Expected.Err) {
+			t.Errorf("%s: errors.Is(%v, %v) is false", test.Comment, err, test.Expected.Err)
+		}
+	}
+
+	// A clean EOF between messages is not wrapped.
+	if _, err := DecodeOneMessage(new(bytes.Buffer), nil); err != io.EOF {
+		t.Errorf("Got %v at EOF, expected io.EOF", err)
+	}
+
+	err := &DecodeError{MsgPubAck, 3, io.ErrUnexpectedEOF}
+	if expected := "mqtt: decoding PUBACK at byte 3: unexpected EOF"; err.Error() != expected {
+		t.Errorf("Got message %q, expected %q", err.Error(), expected)
+	}
+}
+
+// Every defined message type can be created by NewMessage, and round-trips
+// through encoding and decoding.
+func TestNewMessageRoundTrip(t *testing.T) {
+	samples := map[MessageType]Message{
+		MsgConnect:     &Connect{ProtocolName: "MQTT", ProtocolVersion: 4, ClientId: "c", CleanSession: true},
+		MsgConnAck:     &ConnAck{ReturnCode: RetCodeNotAuthorized},
+		MsgPublish:     &Publish{Header: Header{QosLevel: QosAtLeastOnce}, TopicName: "a/b", MessageId: 1, Payload: BytesPayload{1}},
+		MsgPubAck:      &PubAck{MessageId: 1},
+		MsgPubRec:      &PubRec{MessageId: 1},
+		MsgPubRel:      &PubRel{Header: Header{QosLevel: QosAtLeastOnce}, MessageId: 1},
+		MsgPubComp:     &PubComp{MessageId: 1},
+		MsgSubscribe:   &Subscribe{Header: Header{QosLevel: QosAtLeastOnce}, MessageId: 1, Topics: []TopicQos{{Topic: "a/#", Qos: QosExactlyOnce}}},
+		MsgSubAck:      &SubAck{MessageId: 1, TopicsQos: []QosLevel{QosExactlyOnce}},
+		MsgUnsubscribe: &Unsubscribe{Header: Header{QosLevel: QosAtLeastOnce}, MessageId: 1, Topics: []string{"a/#"}},
+		MsgUnsubAck:    &UnsubAck{MessageId: 1},
+		MsgPingReq:     &PingReq{},
+		MsgPingResp:    &PingResp{},
+		MsgDisconnect:  &Disconnect{},
+	}
+
+	for msgType := MessageType(0); msgType < 16; msgType++ {
+		msg, err := NewMessage(msgType)
+		sample, defined := samples[msgType]
+		if !defined {
+			if err == nil {
+				t.Errorf("%v: Expected error for reserved type, got %T", msgType, msg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: Unexpected error: %v", msgType, err)
+			continue
+		}
+		if reflect.TypeOf(msg) != reflect.TypeOf(sample) {
+			t.Errorf("%v: NewMessage gave %T, expected %T", msgType, msg, sample)
+		}
+
+		codec := &Codec{Version: ProtocolV311}
+		buf := new(bytes.Buffer)
+		if _, err := codec.Encode(buf, sample); err != nil {
+			t.Errorf("%v: Unexpected error during encoding: %v", msgType, err)
+		} else if decoded, err := codec.Decode(buf); err != nil {
+			t.Errorf("%v: Unexpected error during decoding: %v", msgType, err)
+		} else if !reflect.DeepEqual(sample, decoded) {
+			t.Errorf("%v:\n     got = %#v\nexpected = %#v", msgType, decoded, sample)
+		}
+	}
+}
+
+// extensionFactory plugs in RawMessage for reserved type 15.
+type extensionFactory struct {
+	DefaultDecoderConfig
+}
+
+func (extensionFactory) NewMessage(msgType MessageType) (Message, error) {
+	if msgType == 15 {
+		return &RawMessage{HeaderByte: 0xf0}, nil
+	}
+	return NewMessage(msgType)
+}
+
+func TestMessageFactoryReservedType(t *testing.T) {
+	encoded := []byte{0xf0, 0x01, 0xab, 0x00, 0x00}
+	r := bytes.NewReader(encoded)
+
+	if msg, err := DecodeOneMessage(r, extensionFactory{}); err != nil {
+		t.Errorf("Unexpected error decoding type 15: %v", err)
+	} else if expected := (&RawMessage{HeaderByte: 0xf0, Body: []byte{0xab}}); !reflect.DeepEqual(expected, msg) {
+		t.Errorf("\n     got = %#v\nexpected = %#v", msg, expected)
+	}
+	// Type 0 is left to the ReservedTypePolicy.
+	if _, err := DecodeOneMessage(r, extensionFactory{}); err == nil {
+		t.Errorf("Expected error decoding type 0, but got nil.")
+	} else if _, ok := err.(*ReservedTypeError); !ok {
+		t.Errorf("Got %#v, expected a *ReservedTypeError", err)
+	}
+}
+
+// A MessageFactory that falls back to NewMessage leaves type 15 to the
+// ReservedTypePolicy before MQTT v5, and AUTH is still decoded in v5.
+func TestMessagePoolReservedType(t *testing.T) {
+	pool := new(MessagePool)
+	_, err := DecodeOneMessage(bytes.NewReader([]byte{0xf0, 0x00}), pool)
+	if _, ok := err.(*ReservedTypeError); !ok {
+		t.Errorf("Got %#v, expected a *ReservedTypeError", err)
+	}
+
+	codec := &Codec{Version: ProtocolV5, DecoderConfig: pool}
+	if msg, err := codec.Decode(bytes.NewReader([]byte{0xf0, 0x00})); err != nil {
+		t.Errorf("Unexpected error decoding AUTH: %v", err)
+	} else if _, ok := msg.(*Auth); !ok {
+		t.Errorf("Got %T, expected *Auth", msg)
+	}
+}
+
+func TestReservedTypePolicy(t *testing.T) {
+	encoded := gbt.InOrder{
+		gbt.Named{"Reserved type 15 header byte", gbt.Literal{0xf3}},
+		gbt.Named{"Remaining length", gbt.Literal{2}},
+		gbt.Named{"Body", gbt.Literal{0xab, 0xcd}},
+
+		gbt.Named{"PUBACK message", gbt.Literal{0x40, 0x02, 0x12, 0x34}},
+	}
+
+	tests := []struct {
+		Comment       string
+		Policy        ReservedTypePolicy
+		ExpectedMsg   Message
+		ExpectedError *ReservedTypeError
+	}{
+		{
+			Comment:       "DropReserved",
+			Policy:        DropReserved,
+			ExpectedError: &ReservedTypeError{HeaderByte: 0xf3, RemainingLength: 2},
+		},
+		{
+			Comment:       "SkipReserved",
+			Policy:        SkipReserved,
+			ExpectedError: &ReservedTypeError{HeaderByte: 0xf3, RemainingLength: 2, Skipped: true},
+		},
+		{
+			Comment:     "PassReserved",
+			Policy:      PassReserved,
+			ExpectedMsg: &RawMessage{HeaderByte: 0xf3, Body: []byte{0xab, 0xcd}},
+		},
+	}
+
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		encoded.Write(buf)
+		config := reservedPolicyDecoderConfig{Policy: test.Policy}
+
+		msg, err := DecodeOneMessage(buf, config)
+		if test.ExpectedError != nil {
+			if !reflect.DeepEqual(test.ExpectedError, err) {
+				t.Errorf("%s: Got error %#v, expected %#v", test.Comment, err, test.ExpectedError)
+			}
+		} else if err != nil {
+			t.Errorf("%s: Unexpected error during decoding: %v", test.Comment, err)
+		} else if !reflect.DeepEqual(test.ExpectedMsg, msg) {
+			t.Errorf("%s:\n     got = %#v\nexpected = %#v", test.Comment, msg, test.ExpectedMsg)
+		} else {
+			reencoded := new(bytes.Buffer)
+			if _, err := msg.Encode(reencoded); err != nil {
+				t.Errorf("%s: Unexpected error during encoding: %v", test.Comment, err)
+			} else if err := gbt.Matches(encoded[:3], reencoded.Bytes()); err != nil {
+				t.Errorf("%s: Unexpected encoding output: %v", test.Comment, err)
+			}
+		}
+
+		if test.Policy == DropReserved {
+			continue
+		}
+		if msg, err := DecodeOneMessage(buf, config); err != nil {
+			t.Errorf("%s: Unexpected error decoding following message: %v", test.Comment, err)
+		} else if !reflect.DeepEqual(&PubAck{MessageId: 0x1234}, msg) {
+			t.Errorf("%s: Decoded following message as %#v", test.Comment, msg)
+		}
+	}
+}
+
+// Messages that decode normally, but are refused by strict decoding.
+func TestStrictDecode(t *testing.T) {
+	tests := []struct {
+		Comment  string
+		Expected gbt.Matcher
+	}{
+		{
+			Comment: "SUBSCRIBE message with no topics",
+			Expected: gbt.InOrder{
+				gbt.Named{"Header byte", gbt.Literal{0x82}},
+				gbt.Named{"Remaining length", gbt.Literal{2}},
+				gbt.Named{"MessageId", gbt.Literal{0x12, 0x34}},
+			},
+		},
+		{
+			Comment: "UNSUBSCRIBE message with no topics",
+			Expected: gbt.InOrder{
+				gbt.Named{"Header byte", gbt.Literal{0xa2}},
+				gbt.Named{"Remaining length", gbt.Literal{2}},
+				gbt.Named{"MessageId", gbt.Literal{0x12, 0x34}},
+			},
+		},
+		{
+			Comment: "PUBLISH message with wildcard topic",
+			Expected: gbt.InOrder{
+				gbt.Named{"Header byte", gbt.Literal{0x30}},
+				gbt.Named{"Remaining length", gbt.Literal{5}},
+				gbt.Named{"Topic", gbt.Literal{0x00, 0x03, 'a', '/', '#'}},
+			},
+		},
+		{
+			Comment: "CONNECT message with password but no username",
+			Expected: gbt.InOrder{
+				gbt.Named{"Header byte", gbt.Literal{0x10}},
+				gbt.Named{"Remaining length", gbt.Literal{12 + 3 + 5}},
+				gbt.Named{"Protocol name", gbt.InOrder{gbt.Literal{0x00, 0x06}, gbt.Literal("MQIsdp")}},
+				gbt.Named{"Protocol version", gbt.Literal{0x03}},
+				gbt.Named{"Connect flags", gbt.Literal{0x40}},
+				gbt.Named{"Keep alive timer", gbt.Literal{0x00, 0x0a}},
+				gbt.Named{"Client identifier", gbt.Literal{0x00, 0x01, 'c'}},
+				gbt.Named{"Password", gbt.Literal{0x00, 0x03, 'p', 'w', 'd'}},
+			},
+		},
+		{
+			Comment: "PUBLISH message with QoS 3",
+			Expected: gbt.InOrder{
+				gbt.Named{"Header byte", gbt.Literal{0x36}},
+				gbt.Named{"Remaining length", gbt.Literal{3}},
+				gbt.Named{"Topic", gbt.Literal{0x00, 0x01, 'a'}},
+			},
+		},
+		{
+			Comment: "QoS 0 PUBLISH message with DUP",
+			Expected: gbt.InOrder{
+				gbt.Named{"Header byte", gbt.Literal{0x38}},
+				gbt.Named{"Remaining length", gbt.Literal{3}},
+				gbt.Named{"Topic", gbt.Literal{0x00, 0x01, 'a'}},
+			},
+		},
+		{
+			Comment: "PUBREL message with QoS 0",
+			Expected: gbt.InOrder{
+				gbt.Named{"Header byte", gbt.Literal{0x60}},
+				gbt.Named{"Remaining length", gbt.Literal{2}},
+				gbt.Named{"MessageId", gbt.Literal{0x12, 0x34}},
+			},
+		},
+		{
+			Comment: "SUBSCRIBE message with retain flag",
+			Expected: gbt.InOrder{
+				gbt.Named{"Header byte", gbt.Literal{0x83}},
+				gbt.Named{"Remaining length", gbt.Literal{6}},
+				gbt.Named{"MessageId", gbt.Literal{0x12, 0x34}},
+				gbt.Named{"Topic", gbt.Literal{0x00, 0x01, 'a'}},
+				gbt.Named{"Requested QoS", gbt.Literal{0x01}},
+			},
+		},
+		{
+			Comment: "CONNECT message with reserved flag",
+			Expected: gbt.InOrder{
+				gbt.Named{"Header byte", gbt.Literal{0x10}},
+				gbt.Named{"Remaining length", gbt.Literal{12 + 3}},
+				gbt.Named{"Protocol name", gbt.InOrder{gbt.Literal{0x00, 0x06}, gbt.Literal("MQIsdp")}},
+				gbt.Named{"Protocol version", gbt.Literal{0x03}},
+				gbt.Named{"Connect flags", gbt.Literal{0x03}},
+				gbt.Named{"Keep alive timer", gbt.Literal{0x00, 0x0a}},
+				gbt.Named{"Client identifier", gbt.Literal{0x00, 0x01, 'c'}},
+			},
+		},
+		{
+			Comment: "CONNECT message with wildcard will topic",
+			Expected: gbt.InOrder{
+				gbt.Named{"Header byte", gbt.Literal{0x10}},
+				gbt.Named{"Remaining length", gbt.Literal{12 + 3 + 5 + 2}},
+				gbt.Named{"Protocol name", gbt.InOrder{gbt.Literal{0x00, 0x06}, gbt.Literal("MQIsdp")}},
+				gbt.Named{"Protocol version", gbt.Literal{0x03}},
+				gbt.Named{"Connect flags", gbt.Literal{0x04}},
+				gbt.Named{"Keep alive timer", gbt.Literal{0x00, 0x0a}},
+				gbt.Named{"Client identifier", gbt.Literal{0x00, 0x01, 'c'}},
+				gbt.Named{"Will topic", gbt.Literal{0x00, 0x03, 'a', '/', '+'}},
+				gbt.Named{"Will message", gbt.Literal{0x00, 0x00}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		test.Expected.Write(buf)
+		encoded := buf.Bytes()
+
+		if _, err := DecodeOneMessage(bytes.NewReader(encoded), nil); err != nil {
+			t.Errorf("%s: Unexpected error during non-strict decoding: %v", test.Comment, err)
+		}
+		if _, err := DecodeOneMessage(bytes.NewReader(encoded), StrictDecoderConfig{}); err == nil {
+			t.Errorf("%s: Expected error during strict decoding, but got nil.", test.Comment)
+		}
+	}
+}
+
 func TestLengthEncodeDecode(t *testing.T) {
 	tests := []struct {
 		Value   int32
@@ -451,6 +1250,57 @@ func TestLengthEncodeDecode(t *testing.T) {
 	}
 }
 
+func TestRemainingLengthPublic(t *testing.T) {
+	tests := []struct {
+		Value   int32
+		Encoded []byte
+		Size    int
+	}{
+		{0, []byte{0x00}, 1},
+		{127, []byte{0x7f}, 1},
+		{128, []byte{0x80, 0x01}, 2},
+		{16383, []byte{0xff, 0x7f}, 2},
+		{16384, []byte{0x80, 0x80, 0x01}, 3},
+		{2097151, []byte{0xff, 0xff, 0x7f}, 3},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}, 4},
+		{MaxRemainingLength, []byte{0xff, 0xff, 0xff, 0x7f}, 4},
+	}
+
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		if n, err := EncodeRemainingLength(buf, test.Value); err != nil {
+			t.Errorf("Encoding %d: Unexpected error: %v", test.Value, err)
+		} else if n != test.Size || !bytes.Equal(test.Encoded, buf.Bytes()) {
+			t.Errorf("Encoding %d: got %d bytes %x, expected %x", test.Value, n, buf.Bytes(), test.Encoded)
+		}
+
+		if length, err := DecodeRemainingLength(bytes.NewReader(test.Encoded)); err != nil {
+			t.Errorf("Decoding %x: Unexpected error: %v", test.Encoded, err)
+		} else if length != test.Value {
+			t.Errorf("Decoding %x: got %d, expected %d", test.Encoded, length, test.Value)
+		}
+
+		if size := RemainingLengthSize(test.Value); size != test.Size {
+			t.Errorf("RemainingLengthSize(%d): got %d, expected %d", test.Value, size, test.Size)
+		}
+	}
+
+	for _, value := range []int32{-1, MaxRemainingLength + 1} {
+		if _, err := EncodeRemainingLength(new(bytes.Buffer), value); err == nil {
+			t.Errorf("Encoding %d: Expected error, but got nil.", value)
+		}
+		if size := RemainingLengthSize(value); size != 0 {
+			t.Errorf("RemainingLengthSize(%d): got %d, expected 0", value, size)
+		}
+	}
+
+	for _, encoded := range [][]byte{{}, {0x80}, {0x80, 0x80, 0x80, 0x80, 0x01}} {
+		if _, err := DecodeRemainingLength(bytes.NewReader(encoded)); err == nil {
+			t.Errorf("Decoding %x: Expected error, but got nil.", encoded)
+		}
+	}
+}
+
 type SeqBytePayload struct {
 	N int
 	T *testing.T
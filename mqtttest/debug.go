@@ -0,0 +1,63 @@
+package mqtttest
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/wolfeidau/mqtt"
+)
+
+// CheckLeaks compares the mqtt package's counters (see mqtt.DebugSnapshot)
+// with base, taken earlier, and returns an error naming the Clients,
+// Keepalives and encoding buffers opened since that are still open. As
+// connections end in goroutines of their own, it waits up to wait for them
+// to close before giving up. The counters must have been enabled with
+// mqtt.EnableDebugStats before base was taken.
+func CheckLeaks(base *mqtt.DebugStats, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	for {
+		diff := mqtt.DebugSnapshot().Sub(base)
+		var leaks []string
+		if diff.OpenClients > 0 {
+			leaks = append(leaks, fmt.Sprintf("%d clients", diff.OpenClients))
+		}
+		if diff.RunningKeepalives > 0 {
+			leaks = append(leaks, fmt.Sprintf("%d keepalives", diff.RunningKeepalives))
+		}
+		if diff.BuffersInUse > 0 {
+			leaks = append(leaks, fmt.Sprintf("%d buffers", diff.BuffersInUse))
+		}
+		if len(leaks) == 0 {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("mqtttest: leaked %s", strings.Join(leaks, ", "))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// RunLeakChecked enables the mqtt package's counters, runs the tests of m,
+// and then checks that they leaked nothing, for use in TestMain:
+//
+//	func TestMain(m *testing.M) {
+//		os.Exit(mqtttest.RunLeakChecked(m))
+//	}
+//
+// If the tests pass but leak, it prints what leaked and how each counter
+// changed over the run to stderr, and returns 1.
+func RunLeakChecked(m interface{ Run() int }) int {
+	mqtt.EnableDebugStats(true)
+	base := mqtt.DebugSnapshot()
+	code := m.Run()
+	if code != 0 {
+		return code
+	}
+	if err := CheckLeaks(base, time.Second); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n%s", err, mqtt.DebugSnapshot().Sub(base))
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,33 @@
+package mqtttest_test
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wolfeidau/mqtt"
+	"github.com/wolfeidau/mqtt/mqtttest"
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(mqtttest.RunLeakChecked(m))
+}
+
+func TestCheckLeaks(t *testing.T) {
+	base := mqtt.DebugSnapshot()
+	local, remote := net.Pipe()
+	defer remote.Close()
+	keepalive := mqtt.NewKeepalive(local, mqtt.KeepaliveServer)
+	keepalive.Start(time.Minute)
+
+	err := mqtttest.CheckLeaks(base, 0)
+	if err == nil || !strings.Contains(err.Error(), "1 keepalives") {
+		t.Errorf("Got %v, expected a leaked keepalive", err)
+	}
+	keepalive.Close()
+	if err := mqtttest.CheckLeaks(base, time.Second); err != nil {
+		t.Errorf("Unexpected error after closing: %v", err)
+	}
+}
@@ -0,0 +1,375 @@
+// Package mqtttest provides utilities for testing code that uses the mqtt
+// package.
+package mqtttest
+
+import (
+	"math/rand"
+
+	"github.com/wolfeidau/mqtt"
+)
+
+// messageTypes lists every message type that RandomMessage generates.
+var messageTypes = []mqtt.MessageType{
+	mqtt.MsgConnect,
+	mqtt.MsgConnAck,
+	mqtt.MsgPublish,
+	mqtt.MsgPubAck,
+	mqtt.MsgPubRec,
+	mqtt.MsgPubRel,
+	mqtt.MsgPubComp,
+	mqtt.MsgSubscribe,
+	mqtt.MsgSubAck,
+	mqtt.MsgUnsubscribe,
+	mqtt.MsgUnsubAck,
+	mqtt.MsgPingReq,
+	mqtt.MsgPingResp,
+	mqtt.MsgDisconnect,
+}
+
+// messageTypesV5 lists every message type that RandomMessageV5 generates.
+var messageTypesV5 = append(messageTypes[:len(messageTypes):len(messageTypes)], mqtt.MsgAuth)
+
+// RandomMessage returns a random MQTT v3.1.1 message of a random type. The
+// message passes mqtt.Validate, and is in the form that decoding its
+// encoding produces, so that:
+//
+//	msg := mqtttest.RandomMessage(r)
+//	msg.Encode(buf)
+//	decoded, _ := mqtt.DecodeOneMessage(buf, nil)
+//	reflect.DeepEqual(msg, decoded) // true
+//
+// Field values are biased towards edge cases, such as empty strings, zero and
+// maximum MessageIds, and sizes either side of the remaining length encoding
+// boundaries.
+func RandomMessage(r *rand.Rand) mqtt.Message {
+	return RandomMessageOfType(r, messageTypes[r.Intn(len(messageTypes))])
+}
+
+// RandomMessageV5 is like RandomMessage, but returns an MQTT v5 message,
+// which may be an AUTH message and may have properties, reason codes and
+// subscription options. Decoding its encoding with a strict v5 Codec
+// produces an equal message:
+//
+//	codec := &mqtt.Codec{Version: mqtt.ProtocolV5, Strict: true}
+//	codec.Encode(buf, msg)
+//	decoded, _ := codec.Decode(buf)
+//	reflect.DeepEqual(msg, decoded) // true
+func RandomMessageV5(r *rand.Rand) mqtt.Message {
+	return RandomMessageOfTypeV5(r, messageTypesV5[r.Intn(len(messageTypesV5))])
+}
+
+// RandomMessageOfType is like RandomMessage, but for a given message type. It
+// panics if msgType is invalid for MQTT v3.1.1.
+func RandomMessageOfType(r *rand.Rand, msgType mqtt.MessageType) mqtt.Message {
+	return randomMessage(r, msgType, false)
+}
+
+// RandomMessageOfTypeV5 is like RandomMessageV5, but for a given message
+// type. It panics if msgType is invalid.
+func RandomMessageOfTypeV5(r *rand.Rand, msgType mqtt.MessageType) mqtt.Message {
+	return randomMessage(r, msgType, true)
+}
+
+func randomMessage(r *rand.Rand, msgType mqtt.MessageType, v5 bool) mqtt.Message {
+	// PUBREL, SUBSCRIBE and UNSUBSCRIBE must be sent with QoS 1, and all
+	// other messages but PUBLISH with no flags set.
+	qos1 := mqtt.Header{QosLevel: mqtt.QosAtLeastOnce}
+
+	switch msgType {
+	case mqtt.MsgConnect:
+		msg := &mqtt.Connect{
+			ProtocolName:    mqtt.ProtocolV311.ProtocolName(),
+			ProtocolVersion: uint8(mqtt.ProtocolV311),
+			WillFlag:        randomBool(r),
+			CleanSession:    randomBool(r),
+			KeepAliveTimer:  RandomUint16(r),
+			ClientId:        RandomString(r),
+			UsernameFlag:    randomBool(r),
+		}
+		if v5 {
+			msg.ProtocolVersion = uint8(mqtt.ProtocolV5)
+			msg.Properties = randomProperties(r)
+		}
+		// An empty client id can only be given along with a clean session.
+		if msg.ClientId == "" {
+			msg.CleanSession = true
+		}
+		// Before MQTT v5, a password can only be given along with a username.
+		msg.PasswordFlag = (msg.UsernameFlag || v5) && randomBool(r)
+		if msg.WillFlag {
+			msg.WillRetain = randomBool(r)
+			msg.WillQos = RandomQos(r)
+			msg.WillTopic = randomTopic(r)
+			msg.WillMessage = RandomString(r)
+			if v5 {
+				msg.WillProperties = randomProperties(r)
+			}
+		}
+		if msg.UsernameFlag {
+			msg.Username = RandomString(r)
+		}
+		if msg.PasswordFlag {
+			msg.Password = RandomString(r)
+		}
+		return msg
+	case mqtt.MsgConnAck:
+		msg := &mqtt.ConnAck{
+			ReturnCode: mqtt.ReturnCode(r.Intn(int(mqtt.RetCodeNotAuthorized) + 1)),
+		}
+		if v5 {
+			msg.ReturnCode = mqtt.ReturnCode(randomReason(r, mqtt.ReasonSuccess,
+				mqtt.ReasonUnspecifiedError, mqtt.ReasonClientIdNotValid, mqtt.ReasonNotAuthorized))
+			msg.Properties = randomProperties(r)
+		}
+		// A session can only be present if the connection is accepted.
+		msg.SessionPresent = msg.ReturnCode == mqtt.RetCodeAccepted && randomBool(r)
+		return msg
+	case mqtt.MsgPublish:
+		msg := &mqtt.Publish{
+			Header:    RandomHeader(r),
+			TopicName: randomTopic(r),
+			Payload:   make(mqtt.BytesPayload, randomSize(r)),
+		}
+		if msg.QosLevel.HasId() {
+			msg.MessageId = RandomUint16(r)
+		}
+		if v5 {
+			msg.Properties = randomProperties(r)
+			// A topic alias may stand in for the topic name.
+			if r.Intn(4) == 0 {
+				alias := uint16(1 + r.Intn(0xffff))
+				msg.Properties = append(msg.Properties, mqtt.Property{Id: mqtt.PropTopicAlias, Value: alias})
+				if randomBool(r) {
+					msg.TopicName = ""
+				}
+			}
+		}
+		r.Read(msg.Payload.(mqtt.BytesPayload))
+		return msg
+	case mqtt.MsgPubAck:
+		msg := &mqtt.PubAck{MessageId: RandomUint16(r)}
+		if v5 {
+			msg.ReasonCode = randomReason(r, mqtt.ReasonNoMatchingSubscribers, mqtt.ReasonUnspecifiedError, mqtt.ReasonQuotaExceeded)
+			msg.Properties = randomProperties(r)
+		}
+		return msg
+	case mqtt.MsgPubRec:
+		msg := &mqtt.PubRec{MessageId: RandomUint16(r)}
+		if v5 {
+			msg.ReasonCode = randomReason(r, mqtt.ReasonNoMatchingSubscribers, mqtt.ReasonUnspecifiedError, mqtt.ReasonQuotaExceeded)
+			msg.Properties = randomProperties(r)
+		}
+		return msg
+	case mqtt.MsgPubRel:
+		msg := &mqtt.PubRel{Header: qos1, MessageId: RandomUint16(r)}
+		if v5 {
+			msg.ReasonCode = randomReason(r, mqtt.ReasonPacketIdNotFound)
+			msg.Properties = randomProperties(r)
+		}
+		return msg
+	case mqtt.MsgPubComp:
+		msg := &mqtt.PubComp{MessageId: RandomUint16(r)}
+		if v5 {
+			msg.ReasonCode = randomReason(r, mqtt.ReasonPacketIdNotFound)
+			msg.Properties = randomProperties(r)
+		}
+		return msg
+	case mqtt.MsgSubscribe:
+		msg := &mqtt.Subscribe{Header: qos1, MessageId: RandomUint16(r)}
+		for i := 1 + r.Intn(4); i > 0; i-- {
+			topic := mqtt.TopicQos{
+				Topic: randomTopicFilter(r),
+				Qos:   RandomQos(r),
+			}
+			if v5 {
+				topic.NoLocal = randomBool(r)
+				topic.RetainAsPublished = randomBool(r)
+				topic.RetainHandling = uint8(r.Intn(3))
+			}
+			msg.Topics = append(msg.Topics, topic)
+		}
+		if v5 {
+			msg.Properties = randomProperties(r)
+		}
+		return msg
+	case mqtt.MsgSubAck:
+		msg := &mqtt.SubAck{
+			MessageId: RandomUint16(r),
+			TopicsQos: []mqtt.QosLevel{},
+		}
+		for i := r.Intn(5); i > 0; i-- {
+			qos := RandomQos(r)
+			if r.Intn(4) == 0 {
+				qos = mqtt.QosRejected
+				if v5 {
+					qos = mqtt.QosLevel(randomReason(r, mqtt.ReasonUnspecifiedError,
+						mqtt.ReasonNotAuthorized, mqtt.ReasonTopicFilterInvalid, mqtt.ReasonQuotaExceeded))
+				}
+			}
+			msg.TopicsQos = append(msg.TopicsQos, qos)
+		}
+		if v5 {
+			msg.Properties = randomProperties(r)
+		}
+		return msg
+	case mqtt.MsgUnsubscribe:
+		msg := &mqtt.Unsubscribe{Header: qos1, MessageId: RandomUint16(r), Topics: []string{}}
+		for i := 1 + r.Intn(4); i > 0; i-- {
+			msg.Topics = append(msg.Topics, randomTopicFilter(r))
+		}
+		if v5 {
+			msg.Properties = randomProperties(r)
+		}
+		return msg
+	case mqtt.MsgUnsubAck:
+		msg := &mqtt.UnsubAck{MessageId: RandomUint16(r)}
+		if v5 {
+			msg.ReasonCodes = []mqtt.ReasonCode{}
+			for i := 1 + r.Intn(4); i > 0; i-- {
+				msg.ReasonCodes = append(msg.ReasonCodes, randomReason(r, mqtt.ReasonNoSubscriptionExisted, mqtt.ReasonNotAuthorized))
+			}
+			msg.Properties = randomProperties(r)
+		}
+		return msg
+	case mqtt.MsgPingReq:
+		return &mqtt.PingReq{}
+	case mqtt.MsgPingResp:
+		return &mqtt.PingResp{}
+	case mqtt.MsgDisconnect:
+		msg := &mqtt.Disconnect{}
+		if v5 {
+			msg.ReasonCode = randomReason(r, mqtt.ReasonDisconnectWithWill, mqtt.ReasonProtocolError, mqtt.ReasonServerShuttingDown)
+			msg.Properties = randomProperties(r)
+		}
+		return msg
+	case mqtt.MsgAuth:
+		if !v5 {
+			break
+		}
+		msg := &mqtt.Auth{
+			ReasonCode: randomReason(r, mqtt.ReasonContinueAuthentication, mqtt.ReasonReauthenticate),
+			Properties: randomProperties(r),
+		}
+		// Anything but a bare success must name the authentication method.
+		if msg.ReasonCode != mqtt.ReasonSuccess || randomBool(r) {
+			data := make([]byte, r.Intn(20))
+			r.Read(data)
+			msg.Properties = append(msg.Properties,
+				mqtt.Property{Id: mqtt.PropAuthMethod, Value: RandomString(r)},
+				mqtt.Property{Id: mqtt.PropAuthData, Value: data})
+		}
+		return msg
+	}
+	panic("mqtttest: invalid message type")
+}
+
+// RandomHeader returns a valid PUBLISH fixed header, with a random QoS level
+// and retain flag, and a DUP flag only for QoS 1 and 2.
+func RandomHeader(r *rand.Rand) mqtt.Header {
+	hdr := mqtt.Header{
+		Retain:   randomBool(r),
+		QosLevel: RandomQos(r),
+	}
+	hdr.DupFlag = hdr.QosLevel != mqtt.QosAtMostOnce && randomBool(r)
+	return hdr
+}
+
+// RandomQos returns QosAtMostOnce, QosAtLeastOnce or QosExactlyOnce.
+func RandomQos(r *rand.Rand) mqtt.QosLevel {
+	return mqtt.QosLevel(r.Intn(int(mqtt.QosExactlyOnce) + 1))
+}
+
+// RandomUint16 returns a random uint16, often 0, 1 or 0xffff.
+func RandomUint16(r *rand.Rand) uint16 {
+	switch r.Intn(8) {
+	case 0:
+		return 0
+	case 1:
+		return 1
+	case 2:
+		return 0xffff
+	}
+	return uint16(r.Intn(1 << 16))
+}
+
+// RandomString returns a random lower case string, often empty or long
+// enough to need a two byte remaining length on its own.
+func RandomString(r *rand.Rand) string {
+	var n int
+	switch r.Intn(8) {
+	case 0:
+		n = 0
+	case 1:
+		n = 127 + r.Intn(4)
+	default:
+		n = r.Intn(20)
+	}
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte('a' + r.Intn(26))
+	}
+	return string(b)
+}
+
+// randomTopic returns a random topic name, which is never empty and has
+// no wildcards.
+func randomTopic(r *rand.Rand) string {
+	if topic := RandomString(r); topic != "" {
+		return topic
+	}
+	return "/"
+}
+
+// randomTopicFilter returns a random topic filter, often with wildcards.
+func randomTopicFilter(r *rand.Rand) string {
+	switch r.Intn(8) {
+	case 0:
+		return "#"
+	case 1:
+		return "+/" + randomTopic(r)
+	case 2:
+		return randomTopic(r) + "/#"
+	}
+	return randomTopic(r)
+}
+
+// randomReason returns ReasonSuccess half of the time, and otherwise one of
+// codes.
+func randomReason(r *rand.Rand, codes ...mqtt.ReasonCode) mqtt.ReasonCode {
+	if randomBool(r) {
+		return mqtt.ReasonSuccess
+	}
+	return codes[r.Intn(len(codes))]
+}
+
+// randomProperties returns no properties half of the time, and otherwise a
+// few user properties, which any MQTT v5 message may carry.
+func randomProperties(r *rand.Rand) mqtt.Properties {
+	if randomBool(r) {
+		return nil
+	}
+	var props mqtt.Properties
+	for i := 1 + r.Intn(3); i > 0; i-- {
+		pair := mqtt.StringPair{Key: RandomString(r), Value: RandomString(r)}
+		props = append(props, mqtt.Property{Id: mqtt.PropUserProperty, Value: pair})
+	}
+	return props
+}
+
+// randomSize returns a random payload size, often close to one of the
+// remaining length encoding boundaries.
+func randomSize(r *rand.Rand) int {
+	switch r.Intn(8) {
+	case 0:
+		return 0
+	case 1:
+		return 120 + r.Intn(16)
+	case 2:
+		return 16370 + r.Intn(32)
+	}
+	return r.Intn(100)
+}
+
+func randomBool(r *rand.Rand) bool {
+	return r.Intn(2) == 0
+}
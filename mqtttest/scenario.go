@@ -0,0 +1,160 @@
+package mqtttest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/wolfeidau/mqtt"
+)
+
+// Scenario scripts the server side of a conversation with a client, for
+// testing client code at the protocol level. For example:
+//
+//	scenario := &mqtttest.Scenario{
+//		Version: mqtt.ProtocolV311,
+//		Steps: []mqtttest.Step{
+//			{Expect: &mqtt.Connect{ClientId: "c"}, Respond: []mqtt.Message{&mqtt.ConnAck{}}},
+//			{Expect: &mqtt.Subscribe{}, Respond: []mqtt.Message{&mqtt.SubAck{TopicsQos: []mqtt.QosLevel{1}}}},
+//			{Expect: &mqtt.Disconnect{}},
+//		},
+//	}
+//	local, remote := net.Pipe()
+//	go func() { errc <- scenario.Serve(remote) }()
+//	// Run the client on local, then check <-errc.
+type Scenario struct {
+	// Version is the protocol version spoken on the connection.
+	Version mqtt.ProtocolVersion
+	Steps   []Step
+}
+
+// Step is one step of a Scenario.
+type Step struct {
+	// Expect is matched against the next message from the client, which must
+	// be of the same type. Fields of Expect that are zero are not compared,
+	// so &mqtt.Connect{ClientId: "c"} matches any CONNECT with client id
+	// "c". If Expect is nil, Respond is sent without waiting.
+	Expect mqtt.Message
+
+	// Check, if not nil, is called with the message that matched Expect, and
+	// fails the scenario if it returns an error.
+	Check func(msg mqtt.Message) error
+
+	// Respond holds the messages that are sent once the step has matched. A
+	// response with a zero MessageId is sent with the MessageId of the
+	// matched message, so that acknowledgements can be declared without
+	// knowing the id that the client chooses.
+	Respond []mqtt.Message
+}
+
+// Serve plays the server side of the scenario on conn, and closes conn when
+// it returns. Once every step has been played, it waits for the client to
+// close the connection. An error is returned if a message does not match
+// its step, or if the client sends more messages than the steps expect.
+func (s *Scenario) Serve(conn io.ReadWriteCloser) error {
+	defer conn.Close()
+	codec := &mqtt.Codec{Version: s.Version}
+
+	// Responses are written by another goroutine, so that a client that is
+	// itself blocked writing (e.g acknowledging a PUBLISH) is still read.
+	out := make(chan mqtt.Message, 100)
+	writeErr := make(chan error, 1)
+	go func() {
+		var err error
+		for msg := range out {
+			if err == nil {
+				_, err = codec.Encode(conn, msg)
+			}
+		}
+		writeErr <- err
+	}()
+	finish := func(err error) error {
+		close(out)
+		if err != nil {
+			// Abandon any responses that the client is not reading.
+			conn.Close()
+			<-writeErr
+			return err
+		}
+		if err := <-writeErr; err != nil {
+			return fmt.Errorf("mqtttest: writing response: %v", err)
+		}
+		return nil
+	}
+
+	r := bufio.NewReader(conn)
+	for i, step := range s.Steps {
+		var got mqtt.Message
+		if step.Expect != nil {
+			var err error
+			if got, err = codec.Decode(r); err != nil {
+				return finish(fmt.Errorf("mqtttest: step %d: expecting %T, got error: %v", i, step.Expect, err))
+			}
+			if err := matchMessage(step.Expect, got); err != nil {
+				return finish(fmt.Errorf("mqtttest: step %d: %v", i, err))
+			}
+			if step.Check != nil {
+				if err := step.Check(got); err != nil {
+					return finish(fmt.Errorf("mqtttest: step %d: %v", i, err))
+				}
+			}
+		}
+		for _, reply := range step.Respond {
+			out <- withMessageId(reply, got)
+		}
+	}
+
+	if msg, err := codec.Decode(r); err == nil {
+		return finish(fmt.Errorf("mqtttest: unexpected %T after the last step: %+v", msg, msg))
+	} else if err != io.EOF && err != io.ErrClosedPipe {
+		return finish(fmt.Errorf("mqtttest: after the last step: %v", err))
+	}
+	return finish(nil)
+}
+
+// matchMessage returns an error describing how got differs from the non-zero
+// fields of expected.
+func matchMessage(expected, got mqtt.Message) error {
+	if reflect.TypeOf(expected) != reflect.TypeOf(got) {
+		return fmt.Errorf("expected %T, got %T: %+v", expected, got, got)
+	}
+	return matchFields(reflect.ValueOf(expected).Elem(), reflect.ValueOf(got).Elem(), fmt.Sprintf("%T", expected))
+}
+
+func matchFields(expected, got reflect.Value, path string) error {
+	for i := 0; i < expected.NumField(); i++ {
+		field := expected.Type().Field(i)
+		want := expected.Field(i)
+		if field.PkgPath != "" || want.IsZero() {
+			continue
+		}
+		fieldPath := path + "." + field.Name
+		if want.Kind() == reflect.Struct {
+			if err := matchFields(want, got.Field(i), fieldPath); err != nil {
+				return err
+			}
+		} else if !reflect.DeepEqual(want.Interface(), got.Field(i).Interface()) {
+			return fmt.Errorf("%s is %#v, expected %#v", fieldPath, got.Field(i).Interface(), want.Interface())
+		}
+	}
+	return nil
+}
+
+// withMessageId returns reply, or a copy of it with the MessageId of matched
+// if reply has a zero MessageId.
+func withMessageId(reply, matched mqtt.Message) mqtt.Message {
+	if matched == nil {
+		return reply
+	}
+	id := reflect.ValueOf(matched).Elem().FieldByName("MessageId")
+	v := reflect.ValueOf(reply).Elem()
+	replyId := v.FieldByName("MessageId")
+	if !id.IsValid() || !replyId.IsValid() || replyId.Uint() != 0 {
+		return reply
+	}
+	copied := reflect.New(v.Type())
+	copied.Elem().Set(v)
+	copied.Elem().FieldByName("MessageId").Set(id)
+	return copied.Interface().(mqtt.Message)
+}
@@ -0,0 +1,79 @@
+package mqtttest_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/wolfeidau/mqtt"
+	"github.com/wolfeidau/mqtt/mqtttest"
+)
+
+func TestScenario(t *testing.T) {
+	scenario := &mqtttest.Scenario{
+		Version: mqtt.ProtocolV311,
+		Steps: []mqtttest.Step{
+			{Expect: &mqtt.Connect{ClientId: "c"}, Respond: []mqtt.Message{&mqtt.ConnAck{}}},
+			{
+				Expect: &mqtt.Subscribe{Topics: []mqtt.TopicQos{{Topic: "a/#", Qos: mqtt.QosAtLeastOnce}}},
+				Respond: []mqtt.Message{
+					&mqtt.SubAck{TopicsQos: []mqtt.QosLevel{mqtt.QosAtLeastOnce}},
+					&mqtt.Publish{
+						Header:    mqtt.Header{QosLevel: mqtt.QosAtLeastOnce},
+						TopicName: "a/b",
+						MessageId: 7,
+						Payload:   mqtt.BytesPayload("hello"),
+					},
+				},
+			},
+			{Expect: &mqtt.PubAck{MessageId: 7}},
+			{Expect: &mqtt.Disconnect{}},
+		},
+	}
+	local, remote := net.Pipe()
+	errc := make(chan error, 1)
+	go func() { errc <- scenario.Serve(remote) }()
+
+	received := make(chan *mqtt.Publish, 1)
+	client := mqtt.NewClient(local, mqtt.ClientOptions{
+		Version:   mqtt.ProtocolV311,
+		ClientId:  "c",
+		OnMessage: func(msg *mqtt.Publish) { received <- msg },
+	})
+	if _, err := client.Connect(); err != nil {
+		t.Fatalf("Unexpected error connecting: %v", err)
+	}
+	if _, err := client.Subscribe(mqtt.TopicQos{Topic: "a/#", Qos: mqtt.QosAtLeastOnce}); err != nil {
+		t.Fatalf("Unexpected error subscribing: %v", err)
+	}
+	if msg := <-received; msg.TopicName != "a/b" {
+		t.Errorf("Received %+v", msg)
+	}
+	client.Disconnect()
+
+	if err := <-errc; err != nil {
+		t.Errorf("Scenario failed: %v", err)
+	}
+}
+
+func TestScenarioMismatch(t *testing.T) {
+	scenario := &mqtttest.Scenario{
+		Version: mqtt.ProtocolV311,
+		Steps: []mqtttest.Step{
+			{Expect: &mqtt.Connect{ClientId: "x"}, Respond: []mqtt.Message{&mqtt.ConnAck{}}},
+		},
+	}
+	local, remote := net.Pipe()
+	errc := make(chan error, 1)
+	go func() { errc <- scenario.Serve(remote) }()
+
+	client := mqtt.NewClient(local, mqtt.ClientOptions{Version: mqtt.ProtocolV311, ClientId: "c"})
+	if _, err := client.Connect(); err == nil {
+		t.Errorf("Connected, expected the scenario to close the connection")
+	}
+
+	err := <-errc
+	if err == nil || !strings.Contains(err.Error(), "ClientId") {
+		t.Errorf("Got error %v, expected a ClientId mismatch", err)
+	}
+}
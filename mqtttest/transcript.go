@@ -0,0 +1,194 @@
+package mqtttest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/wolfeidau/mqtt"
+)
+
+// Direction is the direction in which a recorded message travelled.
+type Direction uint8
+
+const (
+	// Sent messages were written to the connection by the recorded side.
+	Sent Direction = iota
+	// Received messages were read from the connection by the recorded side.
+	Received
+)
+
+func (d Direction) String() string {
+	if d == Sent {
+		return "sent"
+	}
+	return "received"
+}
+
+// Record is one message in a Transcript.
+type Record struct {
+	Dir Direction
+	// Msg is the decoded message, or nil if the packet failed to decode.
+	Msg mqtt.Message
+	// Err is the error from decoding the packet, if it failed.
+	Err error
+}
+
+// Transcript is the ordered list of messages of a session, in both
+// directions.
+type Transcript []Record
+
+// String returns the transcript with one message per line, for use as a
+// golden file.
+func (t Transcript) String() string {
+	var b strings.Builder
+	for _, rec := range t {
+		if rec.Msg == nil {
+			fmt.Fprintf(&b, "%v error %v\n", rec.Dir, rec.Err)
+			continue
+		}
+		fmt.Fprintf(&b, "%v %T %+v\n", rec.Dir, rec.Msg, reflect.ValueOf(rec.Msg).Elem().Interface())
+	}
+	return b.String()
+}
+
+// Normalize returns a copy of the transcript in which the parts of messages
+// that vary between otherwise identical runs are replaced: message ids are
+// renumbered from 1 in order of first use, and Metadata (such as receive
+// times) is removed. The recorded messages are not modified.
+func (t Transcript) Normalize() Transcript {
+	ids := make(map[uint16]uint16)
+	normalized := make(Transcript, len(t))
+	for i, rec := range t {
+		normalized[i] = rec
+		if rec.Msg == nil {
+			continue
+		}
+		v := reflect.New(reflect.TypeOf(rec.Msg).Elem())
+		v.Elem().Set(reflect.ValueOf(rec.Msg).Elem())
+		if hdr := v.Elem().FieldByName("Header"); hdr.IsValid() {
+			metadata := hdr.FieldByName("Metadata")
+			metadata.Set(reflect.Zero(metadata.Type()))
+		}
+		if id := v.Elem().FieldByName("MessageId"); id.IsValid() && id.Uint() != 0 {
+			old := uint16(id.Uint())
+			if _, ok := ids[old]; !ok {
+				ids[old] = uint16(len(ids) + 1)
+			}
+			id.SetUint(uint64(ids[old]))
+		}
+		normalized[i].Msg = v.Interface().(mqtt.Message)
+	}
+	return normalized
+}
+
+// MatchGolden compares the normalized transcript with the golden transcript
+// in the file at path, and returns an error describing the first line that
+// differs. If update is true, the file is written with the transcript
+// instead, e.g when a test is run with an -update flag.
+func (t Transcript) MatchGolden(path string, update bool) error {
+	got := t.Normalize().String()
+	if update {
+		return ioutil.WriteFile(path, []byte(got), 0644)
+	}
+	golden, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if got == string(golden) {
+		return nil
+	}
+	gotLines := strings.Split(got, "\n")
+	goldenLines := strings.Split(string(golden), "\n")
+	for i := 0; ; i++ {
+		var g, w string
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if i < len(goldenLines) {
+			w = goldenLines[i]
+		}
+		if g != w {
+			return fmt.Errorf("mqtttest: transcript differs from %s at line %d:\n     got: %s\n  golden: %s", path, i+1, g, w)
+		}
+	}
+}
+
+// Recorder wraps the connection of one side of a session (usually a
+// client), and records the messages that pass through it in either
+// direction. It may be read from and written to by different goroutines.
+type Recorder struct {
+	conn  io.ReadWriteCloser
+	codec *mqtt.Codec
+
+	mu         sync.Mutex
+	transcript Transcript
+	sent       bytes.Buffer
+	received   bytes.Buffer
+}
+
+// NewRecorder creates a Recorder for conn, decoding messages as version.
+func NewRecorder(conn io.ReadWriteCloser, version mqtt.ProtocolVersion) *Recorder {
+	return &Recorder{conn: conn, codec: &mqtt.Codec{Version: version}}
+}
+
+func (r *Recorder) Read(p []byte) (int, error) {
+	n, err := r.conn.Read(p)
+	r.record(Received, &r.received, p[:n])
+	return n, err
+}
+
+// Write records p before writing it, as a reply to it may otherwise be read
+// (and recorded) before the write returns.
+func (r *Recorder) Write(p []byte) (int, error) {
+	r.record(Sent, &r.sent, p)
+	return r.conn.Write(p)
+}
+
+func (r *Recorder) Close() error {
+	return r.conn.Close()
+}
+
+// Transcript returns the messages recorded so far. Bytes of a message that
+// has not been completely read or written are not included.
+func (r *Recorder) Transcript() Transcript {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append(Transcript(nil), r.transcript...)
+}
+
+// record appends data to buf, and records each message that is complete.
+func (r *Recorder) record(dir Direction, buf *bytes.Buffer, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	buf.Write(data)
+	for {
+		b := buf.Bytes()
+		if len(b) < 2 {
+			return
+		}
+		length, err := mqtt.DecodeRemainingLength(bytes.NewReader(b[1:]))
+		if err == io.EOF {
+			return // The remaining length is incomplete.
+		} else if err != nil {
+			// The packet boundary is lost, so give up on the direction.
+			r.transcript = append(r.transcript, Record{Dir: dir, Err: err})
+			buf.Reset()
+			return
+		}
+		size := 1 + mqtt.RemainingLengthSize(length) + int(length)
+		if len(b) < size {
+			return
+		}
+		msg, err := r.codec.Decode(bytes.NewReader(b[:size]))
+		if err != nil {
+			msg = nil
+		}
+		r.transcript = append(r.transcript, Record{Dir: dir, Msg: msg, Err: err})
+		buf.Next(size)
+	}
+}
@@ -0,0 +1,75 @@
+package mqtttest_test
+
+import (
+	"flag"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/wolfeidau/mqtt"
+	"github.com/wolfeidau/mqtt/mqtttest"
+)
+
+var update = flag.Bool("update", false, "update golden transcripts")
+
+func TestTranscriptGolden(t *testing.T) {
+	scenario := &mqtttest.Scenario{
+		Version: mqtt.ProtocolV311,
+		Steps: []mqtttest.Step{
+			{Expect: &mqtt.Connect{}, Respond: []mqtt.Message{&mqtt.ConnAck{}}},
+			{Expect: &mqtt.Publish{}, Respond: []mqtt.Message{&mqtt.PubAck{}}},
+			{Expect: &mqtt.Subscribe{}, Respond: []mqtt.Message{&mqtt.SubAck{TopicsQos: []mqtt.QosLevel{mqtt.QosAtMostOnce}}}},
+			{Expect: &mqtt.Disconnect{}},
+		},
+	}
+	local, remote := net.Pipe()
+	errc := make(chan error, 1)
+	go func() { errc <- scenario.Serve(remote) }()
+
+	recorder := mqtttest.NewRecorder(local, mqtt.ProtocolV311)
+	client := mqtt.NewClient(recorder, mqtt.ClientOptions{Version: mqtt.ProtocolV311, ClientId: "c", CleanSession: true})
+	if _, err := client.Connect(); err != nil {
+		t.Fatalf("Unexpected error connecting: %v", err)
+	}
+	if err := client.Publish("a/b", []byte("hello"), mqtt.QosAtLeastOnce, false); err != nil {
+		t.Fatalf("Unexpected error publishing: %v", err)
+	}
+	if _, err := client.Subscribe(mqtt.TopicQos{Topic: "a/#"}); err != nil {
+		t.Fatalf("Unexpected error subscribing: %v", err)
+	}
+	client.Disconnect()
+	if err := <-errc; err != nil {
+		t.Fatalf("Scenario failed: %v", err)
+	}
+
+	transcript := recorder.Transcript()
+	if len(transcript) != 7 {
+		t.Fatalf("Recorded %d messages:\n%v", len(transcript), transcript)
+	}
+	if err := transcript.MatchGolden(filepath.Join("testdata", "session.golden"), *update); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTranscriptNormalize(t *testing.T) {
+	publish := &mqtt.Publish{Header: mqtt.Header{QosLevel: mqtt.QosAtLeastOnce}, TopicName: "a", MessageId: 42}
+	pubAck := &mqtt.PubAck{Header: mqtt.Header{Metadata: &mqtt.Metadata{"k": 1}}, MessageId: 42}
+	transcript := mqtttest.Transcript{
+		{Dir: mqtttest.Sent, Msg: publish},
+		{Dir: mqtttest.Received, Msg: pubAck},
+		{Dir: mqtttest.Sent, Msg: &mqtt.Subscribe{MessageId: 7}},
+	}
+
+	expected := mqtttest.Transcript{
+		{Dir: mqtttest.Sent, Msg: &mqtt.Publish{Header: mqtt.Header{QosLevel: mqtt.QosAtLeastOnce}, TopicName: "a", MessageId: 1}},
+		{Dir: mqtttest.Received, Msg: &mqtt.PubAck{MessageId: 1}},
+		{Dir: mqtttest.Sent, Msg: &mqtt.Subscribe{MessageId: 2}},
+	}
+	if got := transcript.Normalize(); !reflect.DeepEqual(expected, got) {
+		t.Errorf("\n     got = %v\nexpected = %v", got, expected)
+	}
+	if publish.MessageId != 42 || pubAck.Metadata == nil {
+		t.Errorf("Normalize modified the recorded messages")
+	}
+}
@@ -0,0 +1,160 @@
+package mqtt
+
+import (
+	"sync"
+)
+
+// MessageIdPool hands out the message ids of QoS 1 and 2 PUBLISH, SUBSCRIBE
+// and UNSUBSCRIBE messages, and keeps track of them while they are in
+// flight, so that an id is not reused before the exchange that it belongs
+// to is complete. Ids are handed out in increasing order, wrapping around
+// from 65535 to 1, skipping those that are in flight.
+//
+// The zero value is ready to use, and it is safe for concurrent use.
+type MessageIdPool struct {
+	mu   sync.Mutex
+	next uint16
+	// inFlight maps each id in flight to the type of the message that
+	// completes its exchange.
+	inFlight map[uint16]MessageType
+}
+
+// Allocate returns a free message id, which stays in flight until a message
+// of type done with the same id is passed to Acknowledge, or the id is
+// released. ErrNoMessageId is returned if all 65535 ids are in flight.
+func (p *MessageIdPool) Allocate(done MessageType) (uint16, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.inFlight == nil {
+		p.inFlight = make(map[uint16]MessageType)
+	}
+	for i := 0; i < 0xffff; i++ {
+		p.next++
+		if p.next == 0 {
+			p.next = 1
+		}
+		if _, ok := p.inFlight[p.next]; !ok {
+			p.inFlight[p.next] = done
+			return p.next, nil
+		}
+	}
+	return 0, ErrNoMessageId
+}
+
+// Reserve puts id in flight, to be completed by a message of type done,
+// e.g when resuming a session whose messages are still in flight. It
+// returns false if id is 0 or already in flight.
+func (p *MessageIdPool) Reserve(id uint16, done MessageType) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.inFlight == nil {
+		p.inFlight = make(map[uint16]MessageType)
+	}
+	if _, ok := p.inFlight[id]; ok || id == 0 {
+		return false
+	}
+	p.inFlight[id] = done
+	return true
+}
+
+// SetNext makes id the first that Allocate tries.
+func (p *MessageIdPool) SetNext(id uint16) {
+	p.mu.Lock()
+	p.next = id - 1
+	p.mu.Unlock()
+}
+
+// Assign allocates a message id for msg, and sets its MessageId. The id is
+// released when Acknowledge is passed the reply that completes the
+// exchange: PUBACK for a QoS 1 PUBLISH, PUBCOMP for a QoS 2 PUBLISH, and
+// SUBACK or UNSUBACK. ErrMissingMessageId is returned for messages that do
+// not need an id.
+func (p *MessageIdPool) Assign(msg Message) error {
+	var done MessageType
+	var messageId *uint16
+	switch msg := msg.(type) {
+	case *Publish:
+		switch msg.QosLevel {
+		case QosAtLeastOnce:
+			done = MsgPubAck
+		case QosExactlyOnce:
+			done = MsgPubComp
+		default:
+			return ErrMissingMessageId
+		}
+		messageId = &msg.MessageId
+	case *Subscribe:
+		done, messageId = MsgSubAck, &msg.MessageId
+	case *Unsubscribe:
+		done, messageId = MsgUnsubAck, &msg.MessageId
+	default:
+		return ErrMissingMessageId
+	}
+
+	id, err := p.Allocate(done)
+	if err != nil {
+		return err
+	}
+	*messageId = id
+	return nil
+}
+
+// Acknowledge releases the id of reply if reply completes the exchange that
+// the id was allocated for. It returns true if the id was released. Other
+// replies, such as the PUBREC in the middle of a QoS 2 exchange, or a
+// PUBACK for an id that is not in flight, are ignored.
+func (p *MessageIdPool) Acknowledge(reply Message) bool {
+	switch reply := reply.(type) {
+	case *PubAck:
+		return p.complete(MsgPubAck, reply.MessageId)
+	case *PubComp:
+		return p.complete(MsgPubComp, reply.MessageId)
+	case *SubAck:
+		return p.complete(MsgSubAck, reply.MessageId)
+	case *UnsubAck:
+		return p.complete(MsgUnsubAck, reply.MessageId)
+	}
+	return false
+}
+
+// Release releases id, whether or not its exchange is complete, e.g when a
+// request is abandoned.
+func (p *MessageIdPool) Release(id uint16) {
+	p.mu.Lock()
+	delete(p.inFlight, id)
+	p.mu.Unlock()
+}
+
+// InFlight returns true if id has been allocated and not yet released.
+func (p *MessageIdPool) InFlight(id uint16) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.inFlight[id]
+	return ok
+}
+
+// Len returns the number of ids in flight.
+func (p *MessageIdPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.inFlight)
+}
+
+// reset releases every id, and starts handing them out from 1 again.
+func (p *MessageIdPool) reset() {
+	p.mu.Lock()
+	p.next = 0
+	p.inFlight = nil
+	p.mu.Unlock()
+}
+
+// complete releases id if it was allocated to be completed by msgType.
+func (p *MessageIdPool) complete(msgType MessageType, id uint16) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if done, ok := p.inFlight[id]; ok && done == msgType {
+		delete(p.inFlight, id)
+		return true
+	}
+	return false
+}
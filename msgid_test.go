@@ -0,0 +1,70 @@
+package mqtt
+
+import (
+	"testing"
+)
+
+func TestMessageIdPool(t *testing.T) {
+	var pool MessageIdPool
+
+	qos1 := &Publish{Header: Header{QosLevel: QosAtLeastOnce}}
+	qos2 := &Publish{Header: Header{QosLevel: QosExactlyOnce}}
+	sub := &Subscribe{Header: Header{QosLevel: QosAtLeastOnce}}
+	for i, msg := range []Message{qos1, qos2, sub} {
+		if err := pool.Assign(msg); err != nil {
+			t.Fatalf("Unexpected error assigning id: %v", err)
+		}
+		if !pool.InFlight(uint16(i + 1)) {
+			t.Errorf("Id %d is not in flight", i+1)
+		}
+	}
+	if qos1.MessageId != 1 || qos2.MessageId != 2 || sub.MessageId != 3 {
+		t.Errorf("Assigned ids %d, %d, %d", qos1.MessageId, qos2.MessageId, sub.MessageId)
+	}
+	if err := pool.Assign(&Publish{}); err != ErrMissingMessageId {
+		t.Errorf("QoS 0 PUBLISH: got %v, expected ErrMissingMessageId", err)
+	}
+
+	tests := []struct {
+		Comment  string
+		Reply    Message
+		Released bool
+	}{
+		{"PUBREC in the middle of QoS 2", &PubRec{MessageId: 2}, false},
+		{"PUBACK for the QoS 2 id", &PubAck{MessageId: 2}, false},
+		{"PUBACK for an unknown id", &PubAck{MessageId: 9}, false},
+		{"PUBACK for QoS 1", &PubAck{MessageId: 1}, true},
+		{"PUBACK repeated", &PubAck{MessageId: 1}, false},
+		{"PUBCOMP for QoS 2", &PubComp{MessageId: 2}, true},
+		{"SUBACK", &SubAck{MessageId: 3}, true},
+	}
+	for _, test := range tests {
+		if released := pool.Acknowledge(test.Reply); released != test.Released {
+			t.Errorf("%s: released %v, expected %v", test.Comment, released, test.Released)
+		}
+	}
+	if pool.Len() != 0 {
+		t.Errorf("%d ids still in flight", pool.Len())
+	}
+}
+
+func TestMessageIdPoolWraparound(t *testing.T) {
+	var pool MessageIdPool
+	for i := 0; i < 0xffff; i++ {
+		if _, err := pool.Allocate(MsgPubAck); err != nil {
+			t.Fatalf("Allocation %d: Unexpected error: %v", i, err)
+		}
+	}
+	if _, err := pool.Allocate(MsgPubAck); err != ErrNoMessageId {
+		t.Fatalf("Got %v with every id in flight, expected ErrNoMessageId", err)
+	}
+
+	// Freed ids are reused, after wrapping around and skipping 0.
+	pool.Release(7)
+	pool.Release(3)
+	for _, expected := range []uint16{3, 7} {
+		if id, err := pool.Allocate(MsgPubAck); err != nil || id != expected {
+			t.Errorf("Got id %d, error %v, expected id %d", id, err, expected)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package mqtt
 
 import (
 	"io"
+	"io/ioutil"
+	"os"
 )
 
 // Payload is the interface for Publish payloads. Typically the BytesPayload
@@ -71,3 +73,202 @@ func (p *StreamedPayload) ReadPayload(r io.Reader) error {
 	p.N = int(n)
 	return err
 }
+
+// DiscardedPayload reads and throws away payload data, recording only its
+// size. It cannot be encoded: encoding a Publish with one fails with
+// ErrDiscardedPayload before anything is written.
+type DiscardedPayload struct {
+	// N is the number of bytes that were discarded.
+	N int
+}
+
+func (p *DiscardedPayload) Size() int {
+	return p.N
+}
+
+func (p *DiscardedPayload) WritePayload(w io.Writer) (int, error) {
+	return 0, ErrDiscardedPayload
+}
+
+func (p *DiscardedPayload) ReadPayload(r io.Reader) error {
+	n, err := io.Copy(ioutil.Discard, r)
+	p.N = int(n)
+	return err
+}
+
+// checkEncodable returns ErrDiscardedPayload if p is a *DiscardedPayload.
+// It is called before the fixed header is written, as a header promising
+// a payload that never follows would corrupt the stream.
+func checkEncodable(p Payload) error {
+	if _, ok := p.(*DiscardedPayload); ok {
+		return ErrDiscardedPayload
+	}
+	return nil
+}
+
+// ReaderPayload writes N bytes read from R. It is for encoding only, e.g to
+// publish data from a pipe or network connection without buffering it. As R
+// is consumed, the message cannot be encoded again (e.g to resend it); use a
+// FilePayload for data that needs to be resent.
+type ReaderPayload struct {
+	R io.Reader
+	N int
+}
+
+func (p *ReaderPayload) Size() int {
+	return p.N
+}
+
+func (p *ReaderPayload) WritePayload(w io.Writer) (int, error) {
+	c, err := io.CopyN(w, p.R, int64(p.N))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return int(c), err
+}
+
+func (p *ReaderPayload) ReadPayload(r io.Reader) error {
+	return ErrEncodeOnlyPayload
+}
+
+// FilePayload reads or writes a payload in a region of a file, so that
+// large payloads (e.g firmware images) need not be held in memory. Encoding
+// reads the region with ReadAt, so it does not move the file offset and the
+// message can be encoded more than once.
+type FilePayload struct {
+	File *os.File
+	// Offset is where the payload starts in File.
+	Offset int64
+	// N is the size of the payload. It is set by decoding.
+	N int
+}
+
+// NewFilePayload returns a FilePayload for the whole of f.
+func NewFilePayload(f *os.File) (*FilePayload, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > MaxPayloadSize {
+		return nil, ErrMessageTooLong
+	}
+	return &FilePayload{File: f, N: int(info.Size())}, nil
+}
+
+func (p *FilePayload) Size() int {
+	return p.N
+}
+
+func (p *FilePayload) WritePayload(w io.Writer) (int, error) {
+	c, err := io.Copy(w, io.NewSectionReader(p.File, p.Offset, int64(p.N)))
+	if err == nil && c < int64(p.N) {
+		err = io.ErrUnexpectedEOF
+	}
+	return int(c), err
+}
+
+func (p *FilePayload) ReadPayload(r io.Reader) error {
+	n, err := io.Copy(&offsetWriter{p.File, p.Offset}, r)
+	p.N = int(n)
+	return err
+}
+
+// MmapPayload writes a region of a file that is mapped into memory, so that
+// a large file (e.g a map or a model published to a fleet of devices) is
+// written to connections straight from the page cache, without being copied
+// onto the heap. The message can be encoded any number of times, from any
+// number of goroutines. It is for encoding only.
+//
+// On platforms without mmap support, the region is read into memory
+// instead.
+type MmapPayload struct {
+	data   []byte
+	mapped []byte // The mapping that data is in, or nil.
+}
+
+// NewMmapPayload maps n bytes of f, starting at offset. Close the payload
+// to unmap it once it is no longer being encoded; f may be closed before
+// then.
+func NewMmapPayload(f *os.File, offset int64, n int) (*MmapPayload, error) {
+	if n < 0 || n > MaxPayloadSize {
+		return nil, ErrMessageTooLong
+	}
+	if n == 0 {
+		return &MmapPayload{}, nil
+	}
+	// Touching a mapped page beyond the end of the file is fatal.
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || offset+int64(n) > info.Size() {
+		return nil, io.ErrUnexpectedEOF
+	}
+	data, mapped, err := mmapRegion(f, offset, n)
+	if err != nil {
+		return nil, err
+	}
+	return &MmapPayload{data: data, mapped: mapped}, nil
+}
+
+func (p *MmapPayload) Size() int {
+	return len(p.data)
+}
+
+func (p *MmapPayload) WritePayload(w io.Writer) (int, error) {
+	return w.Write(p.data)
+}
+
+func (p *MmapPayload) ReadPayload(r io.Reader) error {
+	return ErrEncodeOnlyPayload
+}
+
+// Bytes returns the mapped region. It must not be modified, nor used after
+// Close.
+func (p *MmapPayload) Bytes() []byte {
+	return p.data
+}
+
+// Close unmaps the region. The payload must not be encoded afterwards.
+func (p *MmapPayload) Close() error {
+	mapped := p.mapped
+	p.data, p.mapped = nil, nil
+	if mapped == nil {
+		return nil
+	}
+	return munmap(mapped)
+}
+
+// offsetWriter writes sequentially to f from offset, with WriteAt.
+type offsetWriter struct {
+	f      *os.File
+	offset int64
+}
+
+func (w *offsetWriter) Write(b []byte) (int, error) {
+	n, err := w.f.WriteAt(b, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
+
+// FileDecoderConfig decodes payloads of at least Threshold bytes into
+// temporary files, as *FilePayload, and smaller payloads as BytesPayload.
+// The caller is responsible for closing and removing the files.
+type FileDecoderConfig struct {
+	// Dir is the directory to create files in. "" means the default
+	// directory for temporary files.
+	Dir string
+	// Threshold is the smallest payload that is written to a file.
+	Threshold int
+}
+
+func (c *FileDecoderConfig) MakePayload(msg *Publish, r io.Reader, n int) (Payload, error) {
+	if n < c.Threshold {
+		return make(BytesPayload, n), nil
+	}
+	f, err := ioutil.TempFile(c.Dir, "mqtt-payload-")
+	if err != nil {
+		return nil, err
+	}
+	return &FilePayload{File: f}, nil
+}
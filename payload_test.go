@@ -0,0 +1,123 @@
+package mqtt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFilePayload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqtt-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := bytes.Repeat([]byte{1, 2, 3, 4, 5}, 1000)
+	f, err := ioutil.TempFile(dir, "image-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := NewFilePayload(f)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The payload can be encoded more than once, e.g to resend it.
+	buf := new(bytes.Buffer)
+	msg := &Publish{TopicName: "fw", Payload: payload}
+	for i := 0; i < 2; i++ {
+		if _, err := msg.Encode(buf); err != nil {
+			t.Fatalf("Unexpected error during encoding: %v", err)
+		}
+	}
+
+	config := &FileDecoderConfig{Dir: dir, Threshold: 100}
+	for i := 0; i < 2; i++ {
+		decoded, err := DecodeOneMessage(buf, config)
+		if err != nil {
+			t.Fatalf("Unexpected error during decoding: %v", err)
+		}
+		filePayload, ok := decoded.(*Publish).Payload.(*FilePayload)
+		if !ok {
+			t.Fatalf("Expected *FilePayload, got %T", decoded.(*Publish).Payload)
+		}
+		got, err := ioutil.ReadFile(filePayload.File.Name())
+		filePayload.File.Close()
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(data, got) || filePayload.N != len(data) {
+			t.Errorf("Decoded %d bytes into file, expected %d", len(got), len(data))
+		}
+	}
+
+	// Small payloads stay in memory.
+	buf.Reset()
+	(&Publish{TopicName: "a", Payload: BytesPayload{1}}).Encode(buf)
+	if decoded, err := DecodeOneMessage(buf, config); err != nil {
+		t.Errorf("Unexpected error during decoding: %v", err)
+	} else if _, ok := decoded.(*Publish).Payload.(BytesPayload); !ok {
+		t.Errorf("Expected BytesPayload, got %T", decoded.(*Publish).Payload)
+	}
+}
+
+func TestMmapPayload(t *testing.T) {
+	f, err := ioutil.TempFile("", "mqtt-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	data := bytes.Repeat([]byte{1, 2, 3, 4, 5}, 2000)
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// The region need not start on a page boundary.
+	payload, err := NewMmapPayload(f, 4097, 5000)
+	if err != nil {
+		t.Fatalf("Unexpected error mapping: %v", err)
+	}
+	defer payload.Close()
+
+	buf := new(bytes.Buffer)
+	msg := &Publish{TopicName: "map", Payload: payload}
+	if _, err := msg.Encode(buf); err != nil {
+		t.Fatalf("Unexpected error during encoding: %v", err)
+	}
+	if decoded, err := DecodeOneMessage(buf, nil); err != nil {
+		t.Errorf("Unexpected error during decoding: %v", err)
+	} else if !bytes.Equal(data[4097:9097], decoded.(*Publish).Payload.(BytesPayload)) {
+		t.Errorf("Decoded payload differs from the file region")
+	}
+
+	if _, err := NewMmapPayload(f, 9000, 2000); err == nil {
+		t.Errorf("Expected error for region beyond the end of the file, but got nil.")
+	}
+	if empty, err := NewMmapPayload(f, 0, 0); err != nil || empty.Size() != 0 {
+		t.Errorf("Empty region: got %v, %v", empty, err)
+	}
+}
+
+func TestReaderPayload(t *testing.T) {
+	buf := new(bytes.Buffer)
+	msg := &Publish{TopicName: "a", Payload: &ReaderPayload{R: bytes.NewReader([]byte{1, 2, 3}), N: 3}}
+	if _, err := msg.Encode(buf); err != nil {
+		t.Fatalf("Unexpected error during encoding: %v", err)
+	}
+	if decoded, err := DecodeOneMessage(buf, nil); err != nil {
+		t.Errorf("Unexpected error during decoding: %v", err)
+	} else if !bytes.Equal([]byte{1, 2, 3}, decoded.(*Publish).Payload.(BytesPayload)) {
+		t.Errorf("Decoded %#v", decoded)
+	}
+
+	short := &Publish{TopicName: "a", Payload: &ReaderPayload{R: bytes.NewReader([]byte{1}), N: 3}}
+	if _, err := short.Encode(new(bytes.Buffer)); err == nil {
+		t.Errorf("Expected error for short reader, but got nil.")
+	}
+}
@@ -0,0 +1,101 @@
+package mqtt
+
+import (
+	"io"
+	"sync"
+)
+
+// MessageFactory can optionally be implemented by a DecoderConfig to supply
+// the Message values that DecodeOneMessage decodes into, instead of
+// NewMessage. It is also asked for messages of reserved types, so that new
+// packet types can be plugged in; returning ErrBadMessageType for them
+// leaves them to the ReservedTypePolicy.
+type MessageFactory interface {
+	NewMessage(msgType MessageType) (Message, error)
+}
+
+// MaxPooledPayloadSize is the capacity above which MessagePool does not keep
+// a released BytesPayload for reuse.
+const MaxPooledPayloadSize = 64 * 1024
+
+// MessagePool is a DecoderConfig that recycles decoded messages, to reduce
+// garbage when decoding many messages (e.g in a broker). Messages are
+// returned to the pool with Release once they are no longer used, and are
+// reused by later calls to DecodeOneMessage. A released Publish keeps its
+// BytesPayload, which is reused for the next payload that fits in it.
+//
+// The zero value is ready to use, and it is safe for concurrent use.
+type MessagePool struct {
+	pools [16]sync.Pool
+}
+
+func (p *MessagePool) NewMessage(msgType MessageType) (Message, error) {
+	if msg, ok := p.pools[msgType&0x0f].Get().(Message); ok {
+		debugCount(&debugCounters.poolGets)
+		return msg, nil
+	}
+	msg, err := NewMessage(msgType)
+	if err == nil {
+		debugCount(&debugCounters.poolGets)
+		debugCount(&debugCounters.poolMisses)
+	}
+	return msg, err
+}
+
+func (p *MessagePool) MakePayload(msg *Publish, r io.Reader, n int) (Payload, error) {
+	if payload, ok := msg.Payload.(BytesPayload); ok && cap(payload) >= n {
+		if len(payload) == n {
+			// Avoid allocating a new interface value.
+			return msg.Payload, nil
+		}
+		return payload[:n], nil
+	}
+	return make(BytesPayload, n), nil
+}
+
+// Release returns msg to the pool. Neither msg nor its payload may be used
+// after it has been released.
+func (p *MessagePool) Release(msg Message) {
+	var msgType MessageType
+	switch msg := msg.(type) {
+	case *Connect:
+		*msg, msgType = Connect{}, MsgConnect
+	case *ConnAck:
+		*msg, msgType = ConnAck{}, MsgConnAck
+	case *Publish:
+		// Keep the payload as an interface value, as converting it back to one
+		// would allocate.
+		payload := msg.Payload
+		if bytesPayload, ok := payload.(BytesPayload); !ok || cap(bytesPayload) > MaxPooledPayloadSize {
+			payload = nil
+		}
+		*msg, msgType = Publish{}, MsgPublish
+		msg.Payload = payload
+	case *PubAck:
+		*msg, msgType = PubAck{}, MsgPubAck
+	case *PubRec:
+		*msg, msgType = PubRec{}, MsgPubRec
+	case *PubRel:
+		*msg, msgType = PubRel{}, MsgPubRel
+	case *PubComp:
+		*msg, msgType = PubComp{}, MsgPubComp
+	case *Subscribe:
+		*msg, msgType = Subscribe{}, MsgSubscribe
+	case *SubAck:
+		*msg, msgType = SubAck{}, MsgSubAck
+	case *Unsubscribe:
+		*msg, msgType = Unsubscribe{}, MsgUnsubscribe
+	case *UnsubAck:
+		*msg, msgType = UnsubAck{}, MsgUnsubAck
+	case *PingReq:
+		*msg, msgType = PingReq{}, MsgPingReq
+	case *PingResp:
+		*msg, msgType = PingResp{}, MsgPingResp
+	case *Disconnect:
+		*msg, msgType = Disconnect{}, MsgDisconnect
+	default:
+		return
+	}
+	debugCount(&debugCounters.poolReleases)
+	p.pools[msgType].Put(msg)
+}
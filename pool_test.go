@@ -0,0 +1,64 @@
+package mqtt
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestMessagePool(t *testing.T) {
+	pool := new(MessagePool)
+
+	first := &Publish{Header: Header{QosLevel: QosAtLeastOnce}, TopicName: "a/b", MessageId: 7, Payload: BytesPayload{1, 2, 3, 4}}
+	second := &Publish{TopicName: "c", Payload: BytesPayload{5, 6}}
+	buf := new(bytes.Buffer)
+	first.Encode(buf)
+	second.Encode(buf)
+
+	msg, err := DecodeOneMessage(buf, pool)
+	if err != nil {
+		t.Fatalf("Unexpected error during decoding: %v", err)
+	}
+	if !reflect.DeepEqual(first, msg) {
+		t.Errorf("\n     got = %#v\nexpected = %#v", msg, first)
+	}
+	payload := msg.(*Publish).Payload.(BytesPayload)
+	pool.Release(msg)
+
+	// Decoding may reuse the released message and its payload, but must not
+	// leak its fields (e.g the message id of a QoS 1 message into a QoS 0
+	// message).
+	msg, err = DecodeOneMessage(buf, pool)
+	if err != nil {
+		t.Fatalf("Unexpected error during decoding: %v", err)
+	}
+	if !reflect.DeepEqual(second, msg) {
+		t.Errorf("\n     got = %#v\nexpected = %#v", msg, second)
+	}
+	// sync.Pool drops items at random in race builds.
+	if reused := msg.(*Publish).Payload.(BytesPayload); !raceEnabled && &reused[:1][0] != &payload[0] {
+		t.Errorf("Payload was not reused")
+	}
+}
+
+func TestMessagePoolAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items at random in race builds")
+	}
+	pool := new(MessagePool)
+	buf := new(bytes.Buffer)
+	(&Publish{TopicName: "a/b", Payload: BytesPayload{1, 2, 3}}).Encode(buf)
+	encoded := buf.Bytes()
+	r := bytes.NewReader(encoded)
+
+	// The topic bytes and string, and the payload reader. The Publish and its
+	// payload are reused.
+	const budget = 3
+	if allocs := testing.AllocsPerRun(100, func() {
+		r.Reset(encoded)
+		msg, _ := DecodeOneMessage(r, pool)
+		pool.Release(msg)
+	}); allocs > budget {
+		t.Errorf("Decoding with a pool made %v allocations, budget is %v", allocs, budget)
+	}
+}
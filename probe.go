@@ -0,0 +1,168 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ProbePayloadSize is the size of the payload of a probe message: an 8 byte
+// sequence number, then the 8 byte send time in Unix nanoseconds, both
+// big-endian. The send time lets subscribers in other processes measure
+// latency too, subject to the skew between the clocks.
+const ProbePayloadSize = 16
+
+// LatencyProbe measures the latency from publishing a message through a
+// server to it being delivered back, by publishing probe messages to a topic
+// that it subscribes to.
+type LatencyProbe struct {
+	client *Client
+	topic  string
+
+	mu      sync.Mutex
+	nextSeq uint64
+	sent    map[uint64]time.Time // Send times of the current run.
+	stats   *LatencyStats
+	arrived chan struct{}
+}
+
+// LatencyStats holds the latencies measured by one LatencyProbe run.
+type LatencyStats struct {
+	Qos QosLevel
+	// Sent is the number of probes that were published.
+	Sent int
+	// Samples holds the latency of each probe that was delivered, in
+	// ascending order.
+	Samples []time.Duration
+}
+
+// Lost returns the number of probes that were not delivered in time.
+func (s *LatencyStats) Lost() int {
+	return s.Sent - len(s.Samples)
+}
+
+// Percentile returns the latency that p percent of the delivered probes
+// were within, or 0 if none were delivered.
+func (s *LatencyStats) Percentile(p float64) time.Duration {
+	if len(s.Samples) == 0 {
+		return 0
+	}
+	i := int(p / 100 * float64(len(s.Samples)))
+	if i >= len(s.Samples) {
+		i = len(s.Samples) - 1
+	} else if i < 0 {
+		i = 0
+	}
+	return s.Samples[i]
+}
+
+// NewLatencyProbe creates a LatencyProbe that talks to a server over conn,
+// using topic for its probes. opts.OnMessage is replaced by the probe.
+func NewLatencyProbe(conn io.ReadWriteCloser, opts ClientOptions, topic string) *LatencyProbe {
+	p := &LatencyProbe{
+		topic:   topic,
+		arrived: make(chan struct{}, 1),
+	}
+	opts.OnMessage = p.onMessage
+	p.client = NewClient(conn, opts)
+	return p
+}
+
+// Connect connects to the server, and subscribes to the probe topic. The
+// subscription is at QoS 2, so that probes are delivered at the QoS they
+// were published with.
+func (p *LatencyProbe) Connect() error {
+	if _, err := p.client.Connect(); err != nil {
+		return err
+	}
+	_, err := p.client.Subscribe(TopicQos{Topic: p.topic, Qos: QosExactlyOnce})
+	return err
+}
+
+// Run publishes count probes at qos, interval apart, then waits up to
+// timeout after the last one for them to be delivered. Probes from earlier
+// runs that arrive late are ignored.
+func (p *LatencyProbe) Run(count int, qos QosLevel, interval, timeout time.Duration) (*LatencyStats, error) {
+	stats := &LatencyStats{Qos: qos, Samples: make([]time.Duration, 0, count)}
+	p.mu.Lock()
+	p.sent = make(map[uint64]time.Time, count)
+	p.stats = stats
+	p.mu.Unlock()
+
+	payload := make([]byte, ProbePayloadSize)
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+		now := time.Now()
+		p.mu.Lock()
+		p.nextSeq++
+		seq := p.nextSeq
+		p.sent[seq] = now
+		stats.Sent++
+		p.mu.Unlock()
+
+		binary.BigEndian.PutUint64(payload[:8], seq)
+		binary.BigEndian.PutUint64(payload[8:], uint64(now.UnixNano()))
+		if err := p.client.Publish(p.topic, payload, qos, false); err != nil {
+			return p.finish(), err
+		}
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		p.mu.Lock()
+		done := len(stats.Samples) == stats.Sent
+		p.mu.Unlock()
+		if done {
+			return p.finish(), nil
+		}
+		select {
+		case <-p.arrived:
+		case <-deadline.C:
+			return p.finish(), nil
+		case <-p.client.Done():
+			return p.finish(), p.client.Err()
+		}
+	}
+}
+
+// Close disconnects from the server.
+func (p *LatencyProbe) Close() error {
+	return p.client.Disconnect()
+}
+
+// finish ends the current run, and returns its stats.
+func (p *LatencyProbe) finish() *LatencyStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.stats
+	p.sent, p.stats = nil, nil
+	sort.Slice(stats.Samples, func(i, j int) bool {
+		return stats.Samples[i] < stats.Samples[j]
+	})
+	return stats
+}
+
+func (p *LatencyProbe) onMessage(msg *Publish) {
+	payload, ok := msg.Payload.(BytesPayload)
+	if !ok || msg.TopicName != p.topic || len(payload) != ProbePayloadSize {
+		return
+	}
+	seq := binary.BigEndian.Uint64(payload[:8])
+
+	p.mu.Lock()
+	if sentAt, ok := p.sent[seq]; ok {
+		delete(p.sent, seq)
+		p.stats.Samples = append(p.stats.Samples, time.Since(sentAt))
+	}
+	p.mu.Unlock()
+
+	select {
+	case p.arrived <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,117 @@
+package mqtt
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+// loopbackServer acknowledges a client's requests on conn, like fakeServer,
+// and delivers each PUBLISH back to the client at the same QoS. Replies are
+// written by another goroutine, as the client may itself be blocked writing
+// an acknowledgement.
+func loopbackServer(conn net.Conn) {
+	defer conn.Close()
+	codec := &Codec{Version: ProtocolV311}
+	out := make(chan Message, 100)
+	defer close(out)
+	go func() {
+		for reply := range out {
+			if _, err := codec.Encode(conn, reply); err != nil {
+				conn.Close()
+			}
+		}
+	}()
+	r := bufio.NewReader(conn)
+	var nextId uint16
+	for {
+		msg, err := codec.Decode(r)
+		if err != nil {
+			return
+		}
+
+		var replies []Message
+		switch msg := msg.(type) {
+		case *Connect:
+			replies = append(replies, &ConnAck{})
+		case *Publish:
+			switch msg.QosLevel {
+			case QosAtLeastOnce:
+				replies = append(replies, &PubAck{MessageId: msg.MessageId})
+			case QosExactlyOnce:
+				replies = append(replies, &PubRec{MessageId: msg.MessageId})
+			}
+			nextId++
+			replies = append(replies, &Publish{
+				Header:    Header{QosLevel: msg.QosLevel},
+				TopicName: msg.TopicName,
+				MessageId: nextId,
+				Payload:   msg.Payload,
+			})
+		case *PubRec:
+			replies = append(replies, &PubRel{Header: Header{QosLevel: QosAtLeastOnce}, MessageId: msg.MessageId})
+		case *PubRel:
+			replies = append(replies, &PubComp{MessageId: msg.MessageId})
+		case *Subscribe:
+			replies = append(replies, &SubAck{MessageId: msg.MessageId, TopicsQos: []QosLevel{QosExactlyOnce}})
+		}
+		for _, reply := range replies {
+			out <- reply
+		}
+	}
+}
+
+func TestLatencyProbe(t *testing.T) {
+	local, remote := net.Pipe()
+	go loopbackServer(remote)
+
+	probe := NewLatencyProbe(local, ClientOptions{Version: ProtocolV311, ClientId: "probe", CleanSession: true}, "probe/latency")
+	if err := probe.Connect(); err != nil {
+		t.Fatalf("Unexpected error connecting: %v", err)
+	}
+	defer probe.Close()
+
+	for _, qos := range []QosLevel{QosAtMostOnce, QosAtLeastOnce, QosExactlyOnce} {
+		stats, err := probe.Run(5, qos, time.Millisecond, 5*time.Second)
+		if err != nil {
+			t.Errorf("QoS %d: Unexpected error: %v", qos, err)
+			continue
+		}
+		if stats.Qos != qos || stats.Sent != 5 || stats.Lost() != 0 {
+			t.Errorf("QoS %d: got %+v", qos, stats)
+		}
+		for i := 1; i < len(stats.Samples); i++ {
+			if stats.Samples[i] < stats.Samples[i-1] {
+				t.Errorf("QoS %d: samples are not sorted: %v", qos, stats.Samples)
+			}
+		}
+		if p50, p100 := stats.Percentile(50), stats.Percentile(100); p50 <= 0 || p100 != stats.Samples[4] {
+			t.Errorf("QoS %d: got p50 %v, p100 %v", qos, p50, p100)
+		}
+	}
+}
+
+func TestLatencyStatsPercentile(t *testing.T) {
+	stats := &LatencyStats{Sent: 5, Samples: []time.Duration{1, 2, 3, 4}}
+	tests := []struct {
+		P        float64
+		Expected time.Duration
+	}{
+		{0, 1},
+		{50, 3},
+		{99, 4},
+		{100, 4},
+	}
+	for _, test := range tests {
+		if got := stats.Percentile(test.P); got != test.Expected {
+			t.Errorf("p%v: got %v, expected %v", test.P, got, test.Expected)
+		}
+	}
+	if stats.Lost() != 1 {
+		t.Errorf("Lost %d, expected 1", stats.Lost())
+	}
+	if got := new(LatencyStats).Percentile(50); got != 0 {
+		t.Errorf("Empty stats gave %v", got)
+	}
+}
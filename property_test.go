@@ -0,0 +1,219 @@
+package mqtt_test
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	"github.com/wolfeidau/mqtt"
+	"github.com/wolfeidau/mqtt/mqtttest"
+)
+
+// Iteration counts for the property tests. Building the tests with the
+// "audit" tag raises them substantially (see audit_test.go).
+var (
+	quickConfig         = &quick.Config{MaxCount: 1000}
+	roundTripIterations = 10000
+)
+
+// mustNotPanic runs f, failing the test with the offending input if f panics.
+func mustNotPanic(t *testing.T, input []byte, f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("panic on input %x: %v", input, r)
+		}
+	}()
+	f()
+}
+
+// decoderConfigs are the DecoderConfigs that the property tests decode
+// with. Each must decode a valid message as the default config does, apart
+// from refusing packets over a size limit.
+var decoderConfigs = []struct {
+	name   string
+	config mqtt.DecoderConfig
+}{
+	{"default", nil},
+	{"strict", mqtt.StrictDecoderConfig{}},
+	{"pooled", new(mqtt.MessagePool)},
+	{"size limited", &mqtt.PacketLimitConfig{MaxPacketSize: 1024}},
+}
+
+// release returns msg to config, if config is a MessagePool, so that later
+// decodes reuse it.
+func release(config mqtt.DecoderConfig, msg mqtt.Message) {
+	if pool, ok := config.(*mqtt.MessagePool); ok && msg != nil {
+		pool.Release(msg)
+	}
+}
+
+// checkRoundTrip checks that decoding the encoding of msg produces an equal
+// message, and that encoding that produces the same bytes. Decoding may
+// instead refuse a packet that is over a size limit.
+func checkRoundTrip(t *testing.T, config mqtt.DecoderConfig, msg mqtt.Message,
+	encode func(w io.Writer, msg mqtt.Message) (int, error),
+	decode func(r io.Reader) (mqtt.Message, error)) {
+
+	encoded := new(bytes.Buffer)
+	if _, err := encode(encoded, msg); err != nil {
+		t.Fatalf("%#v: Unexpected error during encoding: %v", msg, err)
+	}
+	data := append([]byte(nil), encoded.Bytes()...)
+
+	var decodedMsg mqtt.Message
+	var err error
+	mustNotPanic(t, data, func() {
+		decodedMsg, err = decode(encoded)
+	})
+	if tooLarge, ok := err.(*mqtt.PacketTooLargeError); ok && tooLarge.Size == len(data) && tooLarge.Size > tooLarge.Limit {
+		return
+	}
+	if err != nil {
+		t.Fatalf("%#v: Unexpected error during decoding %x: %v", msg, data, err)
+	}
+	defer release(config, decodedMsg)
+	if !reflect.DeepEqual(msg, decodedMsg) {
+		t.Fatalf("Decoded value mismatch\n     got = %#v\nexpected = %#v", decodedMsg, msg)
+	}
+
+	reencoded := new(bytes.Buffer)
+	if _, err := encode(reencoded, decodedMsg); err != nil {
+		t.Fatalf("%#v: Unexpected error during re-encoding: %v", decodedMsg, err)
+	}
+	if !bytes.Equal(data, reencoded.Bytes()) {
+		t.Fatalf("%#v: Re-encoded to %x, expected %x", decodedMsg, reencoded.Bytes(), data)
+	}
+}
+
+// Encoding then decoding a message must produce an equal message, and
+// encoding that must produce the same bytes.
+func TestRoundTripProperty(t *testing.T) {
+	encode := func(w io.Writer, msg mqtt.Message) (int, error) {
+		return msg.Encode(w)
+	}
+
+	for _, c := range decoderConfigs {
+		t.Run(c.name, func(t *testing.T) {
+			r := rand.New(rand.NewSource(1))
+			decode := func(r io.Reader) (mqtt.Message, error) {
+				return mqtt.DecodeOneMessage(r, c.config)
+			}
+
+			for i := 0; i < roundTripIterations; i++ {
+				msg := mqtttest.RandomMessage(r)
+				if err := mqtt.Validate(msg); err != nil {
+					t.Fatalf("%#v: Generated an invalid message: %v", msg, err)
+				}
+				checkRoundTrip(t, c.config, msg, encode, decode)
+			}
+		})
+	}
+}
+
+// As TestRoundTripProperty, but for MQTT v5 messages and a strict v5 Codec.
+func TestRoundTripPropertyV5(t *testing.T) {
+	for _, c := range decoderConfigs {
+		t.Run(c.name, func(t *testing.T) {
+			r := rand.New(rand.NewSource(1))
+			codec := &mqtt.Codec{Version: mqtt.ProtocolV5, DecoderConfig: c.config, Strict: true}
+
+			for i := 0; i < roundTripIterations; i++ {
+				checkRoundTrip(t, c.config, mqtttest.RandomMessageV5(r), codec.Encode, codec.Decode)
+			}
+		})
+	}
+}
+
+// AppendTo must produce the same bytes as Encode, and Size their length.
+func TestAppendToProperty(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	type appender interface {
+		Size() int
+		AppendTo(b []byte) ([]byte, error)
+	}
+
+	for i := 0; i < roundTripIterations; i++ {
+		msg := mqtttest.RandomMessage(r)
+
+		encoded := new(bytes.Buffer)
+		if _, err := msg.Encode(encoded); err != nil {
+			t.Fatalf("%#v: Unexpected error during encoding: %v", msg, err)
+		}
+
+		a := msg.(appender)
+		prefix := []byte{0xaa}
+		appended, err := a.AppendTo(prefix)
+		if err != nil {
+			t.Fatalf("%#v: Unexpected error during appending: %v", msg, err)
+		}
+		if !bytes.Equal(encoded.Bytes(), appended[1:]) || appended[0] != 0xaa {
+			t.Fatalf("%#v: Appended %x, expected %x", msg, appended[1:], encoded.Bytes())
+		}
+		if a.Size() != encoded.Len() {
+			t.Fatalf("%#v: Size() = %d, expected %d", msg, a.Size(), encoded.Len())
+		}
+	}
+}
+
+// Decoding arbitrary bytes must never panic.
+func TestDecodeArbitraryBytes(t *testing.T) {
+	f := func(data []byte) bool {
+		for _, c := range decoderConfigs {
+			mustNotPanic(t, data, func() {
+				msg, _ := mqtt.DecodeOneMessage(bytes.NewReader(data), c.config)
+				release(c.config, msg)
+			})
+		}
+		return true
+	}
+	if err := quick.Check(f, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+// Decoding arbitrary bytes must never panic, and anything that does decode
+// must survive an encode/decode round trip.
+func FuzzDecodeOneMessage(f *testing.F) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		buf := new(bytes.Buffer)
+		mqtttest.RandomMessage(r).Encode(buf)
+		f.Add(buf.Bytes())
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, c := range decoderConfigs {
+			fuzzDecode(t, c.config, data)
+		}
+	})
+}
+
+func fuzzDecode(t *testing.T, config mqtt.DecoderConfig, data []byte) {
+	var msg mqtt.Message
+	var err error
+	mustNotPanic(t, data, func() {
+		msg, err = mqtt.DecodeOneMessage(bytes.NewReader(data), config)
+	})
+	if err != nil {
+		return
+	}
+	defer release(config, msg)
+
+	buf := new(bytes.Buffer)
+	if _, err := msg.Encode(buf); err != nil {
+		// Some decodable values, such as QoS 3, are refused by the encoder.
+		return
+	}
+	decodedMsg, err := mqtt.DecodeOneMessage(buf, config)
+	if err != nil {
+		t.Fatalf("%#v: Unexpected error decoding re-encoded message: %v", msg, err)
+	}
+	defer release(config, decodedMsg)
+	if !reflect.DeepEqual(msg, decodedMsg) {
+		t.Fatalf("input %x: Decoded value mismatch\n     got = %#v\nexpected = %#v", data, decodedMsg, msg)
+	}
+}
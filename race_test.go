@@ -0,0 +1,7 @@
+//go:build race
+
+package mqtt
+
+// raceEnabled is true in race detector builds, in which sync.Pool drops
+// items at random, so allocation budgets cannot be held.
+const raceEnabled = true
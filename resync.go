@@ -0,0 +1,137 @@
+package mqtt
+
+import (
+	"bufio"
+)
+
+// Resync discards bytes from r until it appears to be positioned at the start
+// of a message, and returns the number of bytes that were skipped. It is
+// intended for transports that can corrupt or drop bytes (e.g serial or radio
+// links), to recover after DecodeOneMessage has returned a framing error:
+//
+//	msg, err := mqtt.DecodeOneMessage(br, nil)
+//	if err != nil {
+//	  skipped, err := mqtt.Resync(br, mqtt.ProtocolV311, 1024)
+//	  // log skipped, handle err
+//	}
+//
+// A header is considered plausible if its message type is valid, its flags
+// are valid for that type, and its remaining length is well formed and
+// possible for that type in the given protocol version. This is only a
+// heuristic: payload data can look like a header, and so messages following
+// the corruption may be lost or garbled.
+//
+// At most maxSkip bytes are discarded before giving up with an error. Errors
+// from r (including io.EOF) are returned as they occur. ErrBadProtocol is
+// returned if version is not supported.
+func Resync(r *bufio.Reader, version ProtocolVersion, maxSkip int) (skipped int, err error) {
+	rules, ok := conformance[version]
+	if !ok {
+		return 0, ErrBadProtocol
+	}
+
+	for {
+		var ok bool
+		if ok, err = plausibleHeader(r, rules.v5); err != nil || ok {
+			return
+		}
+		if skipped >= maxSkip {
+			return skipped, ErrResyncLimit
+		}
+		if _, err = r.Discard(1); err != nil {
+			return
+		}
+		skipped++
+	}
+}
+
+// plausibleHeader peeks at the bytes at the front of r, and returns true if
+// they could be the fixed header of a valid message. v5 is true for MQTT v5.
+func plausibleHeader(r *bufio.Reader, v5 bool) (bool, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return false, err
+	}
+
+	msgType := MessageType(b[0] & 0xF0 >> 4)
+	flags := b[0] & 0x0F
+	if !(msgType.IsValid() || v5 && msgType == MsgAuth) || !plausibleFlags(msgType, flags) {
+		return false, nil
+	}
+
+	var length int32
+	var shift uint
+	for i := 1; i <= 4; i++ {
+		if b, err = r.Peek(i + 1); err != nil {
+			return false, err
+		}
+		length |= int32(b[i]&0x7f) << shift
+		if b[i]&0x80 == 0 {
+			return plausibleLength(msgType, flags, length, v5), nil
+		}
+		shift += 7
+	}
+
+	return false, nil
+}
+
+func plausibleFlags(msgType MessageType, flags byte) bool {
+	switch msgType {
+	case MsgPublish:
+		return QosLevel(flags&0x06>>1) != 3
+	case MsgPubRel, MsgSubscribe, MsgUnsubscribe:
+		// These are sent with QoS 1, and may be duplicates.
+		return flags&^0x08 == byte(QosAtLeastOnce)<<1
+	}
+	return flags == 0
+}
+
+// plausibleLength returns true if length is a possible remaining length for
+// a message of msgType. MQTT v5 adds a property length to most messages, and
+// lets acknowledgements leave out their reason code and properties.
+func plausibleLength(msgType MessageType, flags byte, length int32, v5 bool) bool {
+	// The property length takes at least one byte.
+	var props int32
+	if v5 {
+		props = 1
+	}
+
+	switch msgType {
+	case MsgConnect:
+		// Protocol name, version, flags, keep alive and client id length.
+		return length >= 2+1+1+2+props+2
+	case MsgPublish:
+		if QosLevel(flags & 0x06 >> 1).HasId() {
+			return length >= 2+2+props
+		}
+		return length >= 2+props
+	case MsgConnAck:
+		// Flags and return code.
+		if v5 {
+			return length >= 2+props
+		}
+		return length == 2
+	case MsgPubAck, MsgPubRec, MsgPubRel, MsgPubComp:
+		if v5 {
+			return length >= 2
+		}
+		return length == 2
+	case MsgUnsubAck:
+		// MQTT v5 adds a reason code for each topic.
+		if v5 {
+			return length >= 2+props+1
+		}
+		return length == 2
+	case MsgSubscribe:
+		// MessageId and at least one topic with its QoS.
+		return length >= 2+props+2+1
+	case MsgSubAck:
+		return length >= 2+props+1
+	case MsgUnsubscribe:
+		return length >= 2+props+2
+	case MsgDisconnect, MsgAuth:
+		// An MQTT v5 reason code and properties may follow.
+		return length == 0 || v5
+	}
+	return length == 0
+}
@@ -0,0 +1,203 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"time"
+)
+
+// DefaultSerialMaxPacketSize is the packet size limit used by SerialTransport
+// when SerialConfig.MaxPacketSize is zero. Serial links are slow, and the
+// devices on them tend to be small, so this is far below MaxPayloadSize.
+const DefaultSerialMaxPacketSize = 1024
+
+// SLIP special characters (RFC 1055).
+const (
+	slipEnd    = 0xC0
+	slipEsc    = 0xDB
+	slipEscEnd = 0xDC
+	slipEscEsc = 0xDD
+)
+
+// SerialConfig configures a SerialTransport.
+type SerialConfig struct {
+	// InterByteTimeout is the longest gap allowed between bytes once a message
+	// has started arriving. Zero means no limit. It is only enforced if the
+	// underlying connection has a SetReadDeadline(time.Time) error method.
+	InterByteTimeout time.Duration
+
+	// SLIP enables SLIP framing (RFC 1055) of each message. Framing lets a
+	// corrupt or truncated message be dropped without losing track of where
+	// the next one starts.
+	SLIP bool
+
+	// MaxPacketSize is the largest packet, in bytes, that will be accepted.
+	// Zero means DefaultSerialMaxPacketSize. With SLIP framing, larger frames
+	// are dropped with an error. Without it, Publish payloads larger than this
+	// are read and discarded (see PayloadLimitConfig).
+	MaxPacketSize int
+}
+
+// SerialTransport reads and writes messages over a serial link, such as an
+// RS-485 bus or a LoRa modem's UART. It is not safe for concurrent reads, or
+// concurrent writes.
+type SerialTransport struct {
+	rw          io.ReadWriter
+	br          *bufio.Reader
+	config      SerialConfig
+	midMessage  bool
+	writeBuffer bytes.Buffer
+}
+
+// NewSerialTransport creates a SerialTransport on rw. A nil config uses the
+// defaults of the zero SerialConfig.
+func NewSerialTransport(rw io.ReadWriter, config *SerialConfig) *SerialTransport {
+	t := &SerialTransport{rw: rw}
+	if config != nil {
+		t.config = *config
+	}
+	if t.config.MaxPacketSize == 0 {
+		t.config.MaxPacketSize = DefaultSerialMaxPacketSize
+	}
+	t.br = bufio.NewReader(&deadlineReader{t})
+	return t
+}
+
+// ReadMessage reads one message. config is used as for DecodeOneMessage.
+func (t *SerialTransport) ReadMessage(config DecoderConfig) (Message, error) {
+	if t.config.SLIP {
+		frame, err := t.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		r := bytes.NewReader(frame)
+		msg, err := DecodeOneMessage(r, config)
+		if err == nil && r.Len() != 0 {
+			err = ErrMessageTooLong
+		}
+		return msg, err
+	}
+
+	t.midMessage = false
+	return DecodeOneMessage(&messageStartReader{t}, &PayloadLimitConfig{
+		DecoderConfig:  config,
+		MaxPayloadSize: t.config.MaxPacketSize,
+	})
+}
+
+// WriteMessage writes one message.
+func (t *SerialTransport) WriteMessage(msg Message) error {
+	if !t.config.SLIP {
+		_, err := msg.Encode(t.rw)
+		return err
+	}
+
+	t.writeBuffer.Reset()
+	if _, err := msg.Encode(&t.writeBuffer); err != nil {
+		return err
+	}
+	if t.writeBuffer.Len() > t.config.MaxPacketSize {
+		return ErrMessageTooLong
+	}
+
+	frame := make([]byte, 0, 2+2*t.writeBuffer.Len())
+	frame = append(frame, slipEnd)
+	for _, b := range t.writeBuffer.Bytes() {
+		switch b {
+		case slipEnd:
+			frame = append(frame, slipEsc, slipEscEnd)
+		case slipEsc:
+			frame = append(frame, slipEsc, slipEscEsc)
+		default:
+			frame = append(frame, b)
+		}
+	}
+	frame = append(frame, slipEnd)
+
+	_, err := t.rw.Write(frame)
+	return err
+}
+
+// readFrame reads the next non-empty SLIP frame. Frames that are too long or
+// badly escaped are consumed up to their end and reported as an error.
+func (t *SerialTransport) readFrame() ([]byte, error) {
+	t.midMessage = false
+	var frame []byte
+	var frameErr error
+	for {
+		b, err := t.br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		if b == slipEnd {
+			t.midMessage = false
+			if frameErr != nil {
+				return nil, frameErr
+			}
+			if len(frame) > 0 {
+				return frame, nil
+			}
+			continue
+		}
+		t.midMessage = true
+
+		if b == slipEsc {
+			if b, err = t.br.ReadByte(); err != nil {
+				return nil, err
+			}
+			switch b {
+			case slipEscEnd:
+				b = slipEnd
+			case slipEscEsc:
+				b = slipEsc
+			default:
+				frameErr = ErrBadFrame
+			}
+		}
+
+		if len(frame) >= t.config.MaxPacketSize {
+			frameErr = ErrMessageTooLong
+		}
+		if frameErr == nil {
+			frame = append(frame, b)
+		}
+	}
+}
+
+// messageStartReader marks the transport as being mid-message once the first
+// byte of a message has been read.
+type messageStartReader struct {
+	t *SerialTransport
+}
+
+func (r *messageStartReader) Read(p []byte) (int, error) {
+	n, err := r.t.br.Read(p)
+	if n > 0 {
+		r.t.midMessage = true
+	}
+	return n, err
+}
+
+// deadlineReader applies the inter-byte timeout to reads from the underlying
+// connection while a message is arriving.
+type deadlineReader struct {
+	t *SerialTransport
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	t := r.t
+	if d, ok := t.rw.(interface {
+		SetReadDeadline(time.Time) error
+	}); ok && t.config.InterByteTimeout > 0 {
+		var deadline time.Time
+		if t.midMessage {
+			deadline = time.Now().Add(t.config.InterByteTimeout)
+		}
+		if err := d.SetReadDeadline(deadline); err != nil {
+			return 0, err
+		}
+	}
+	return t.rw.Read(p)
+}
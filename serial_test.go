@@ -0,0 +1,88 @@
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSerialTransportRoundTrip(t *testing.T) {
+	msgs := []Message{
+		&Publish{TopicName: "a/b", Payload: BytesPayload{slipEnd, slipEsc, slipEscEnd, 1}},
+		&PubAck{MessageId: 0x1234},
+	}
+
+	for _, slip := range []bool{false, true} {
+		buf := new(bytes.Buffer)
+		transport := NewSerialTransport(buf, &SerialConfig{SLIP: slip})
+
+		for _, msg := range msgs {
+			if err := transport.WriteMessage(msg); err != nil {
+				t.Fatalf("SLIP=%t: Unexpected error during writing: %v", slip, err)
+			}
+		}
+		for _, expectedMsg := range msgs {
+			if msg, err := transport.ReadMessage(nil); err != nil {
+				t.Errorf("SLIP=%t: Unexpected error during reading: %v", slip, err)
+			} else if !reflect.DeepEqual(expectedMsg, msg) {
+				t.Errorf("SLIP=%t:\n     got = %#v\nexpected = %#v", slip, msg, expectedMsg)
+			}
+		}
+	}
+}
+
+func TestSerialTransportDropsBadFrames(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{
+		slipEnd, 0x40, 0x02, 0x12, 0x34, 0x56, 0x78, slipEnd, // Too long.
+		slipEnd, 0x40, 0x02, slipEsc, 0x00, 0x34, slipEnd, // Bad escape.
+		slipEnd, 0x40, 0x02, 0x12, slipEnd, // Truncated.
+		slipEnd, 0x40, 0x02, 0x12, 0x34, slipEnd,
+	})
+	transport := NewSerialTransport(buf, &SerialConfig{SLIP: true, MaxPacketSize: 4})
+
+	for i := 0; i < 3; i++ {
+		if _, err := transport.ReadMessage(nil); err == nil {
+			t.Errorf("Frame %d: Expected error, but got nil.", i)
+		}
+	}
+	if msg, err := transport.ReadMessage(nil); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	} else if !reflect.DeepEqual(&PubAck{MessageId: 0x1234}, msg) {
+		t.Errorf("Got %#v", msg)
+	}
+}
+
+func TestSerialTransportInterByteTimeout(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	go func() {
+		// Send the start of a PUBACK, then stall.
+		remote.Write([]byte{0x40, 0x02, 0x12})
+	}()
+
+	transport := NewSerialTransport(local, &SerialConfig{InterByteTimeout: 10 * time.Millisecond})
+	_, err := transport.ReadMessage(nil)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("Expected timeout error, got %v", err)
+	}
+}
+
+func TestSerialTransportKeepsConfig(t *testing.T) {
+	// A QoS 0 PUBLISH with DUP set.
+	transport := NewSerialTransport(bytes.NewBuffer([]byte{0x38, 0x03, 0x00, 0x01, 'a'}), nil)
+	if _, err := transport.ReadMessage(StrictDecoderConfig{}); !errors.Is(err, ErrBadDupFlag) {
+		t.Errorf("Got %v, expected ErrBadDupFlag", err)
+	}
+
+	transport = NewSerialTransport(bytes.NewBuffer([]byte{0x30, 0x08, 0x00, 0x01, 'a', 1, 2, 3, 4, 5}), nil)
+	var tooLarge *PacketTooLargeError
+	if _, err := transport.ReadMessage(&PacketLimitConfig{MaxPacketSize: 8}); !errors.As(err, &tooLarge) {
+		t.Errorf("Got %v, expected a *PacketTooLargeError", err)
+	}
+}
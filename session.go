@@ -0,0 +1,188 @@
+package mqtt
+
+import (
+	"sync"
+)
+
+// Session is the state that outlives a connection when a client connects
+// with CleanSession false, so that messages in flight are completed and
+// subscriptions kept across connections.
+type Session struct {
+	// Outbound holds the QoS 1 and 2 messages sent but not yet completed,
+	// by message id: a *Publish until it is acknowledged (or, at QoS 2,
+	// received), then the *PubRel that follows until PUBCOMP.
+	Outbound map[uint16]Message
+	// Received holds the ids of QoS 2 messages received but not yet
+	// released, so that they are not delivered again if resent.
+	Received map[uint16]bool
+	// Subscriptions maps each topic filter subscribed to to its QoS.
+	Subscriptions map[string]QosLevel
+	// NextMessageId is the message id to try next when sending.
+	NextMessageId uint16
+}
+
+func newSession() *Session {
+	return &Session{
+		Outbound:      make(map[uint16]Message),
+		Received:      make(map[uint16]bool),
+		Subscriptions: make(map[string]QosLevel),
+	}
+}
+
+// SessionStore stores sessions by client id. The Client (given one in its
+// options) records its session as it changes, and resumes it when it
+// connects with CleanSession false; a server can store the sessions of its
+// clients in the same way. Each change is stored as it happens, so that a
+// store can write it out before the message it concerns is sent.
+// Implementations must be safe for concurrent use.
+type SessionStore interface {
+	// Get returns the session of clientId, or nil if there is none. The
+	// session returned is not changed by later calls.
+	Get(clientId string) (*Session, error)
+	// Delete removes the session of clientId, if it has one.
+	Delete(clientId string) error
+
+	// PutMessage stores an outbound message in flight, which is a *Publish
+	// or *PubRel, replacing any with the same message id.
+	PutMessage(clientId string, msg Message) error
+	// DeleteMessage removes the outbound message in flight with messageId.
+	DeleteMessage(clientId string, messageId uint16) error
+	// PutReceived stores the id of a QoS 2 message received.
+	PutReceived(clientId string, messageId uint16) error
+	// DeleteReceived removes the id of a QoS 2 message once it is released.
+	DeleteReceived(clientId string, messageId uint16) error
+	// PutSubscription stores a subscription, replacing any to the same
+	// topic filter.
+	PutSubscription(clientId string, sub TopicQos) error
+	// DeleteSubscription removes the subscription to filter.
+	DeleteSubscription(clientId string, filter string) error
+	// PutNextMessageId stores the message id to try next when sending.
+	PutNextMessageId(clientId string, id uint16) error
+}
+
+// MemorySessionStore is a SessionStore that keeps sessions in memory, so
+// they last as long as the process. The zero value is ready to use.
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func (s *MemorySessionStore) Get(clientId string) (*Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[clientId]
+	if !ok {
+		return nil, nil
+	}
+	return session.copy(), nil
+}
+
+func (s *MemorySessionStore) Delete(clientId string) error {
+	s.mu.Lock()
+	if _, ok := s.sessions[clientId]; ok {
+		delete(s.sessions, clientId)
+		debugGauge(&debugCounters.storedSessions, -1)
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *MemorySessionStore) PutMessage(clientId string, msg Message) error {
+	id, err := sessionMessageId(msg)
+	if err != nil {
+		return err
+	}
+	msg = copyMessage(msg)
+	s.update(clientId, func(session *Session) { session.Outbound[id] = msg })
+	return nil
+}
+
+func (s *MemorySessionStore) DeleteMessage(clientId string, messageId uint16) error {
+	s.update(clientId, func(session *Session) { delete(session.Outbound, messageId) })
+	return nil
+}
+
+func (s *MemorySessionStore) PutReceived(clientId string, messageId uint16) error {
+	s.update(clientId, func(session *Session) { session.Received[messageId] = true })
+	return nil
+}
+
+func (s *MemorySessionStore) DeleteReceived(clientId string, messageId uint16) error {
+	s.update(clientId, func(session *Session) { delete(session.Received, messageId) })
+	return nil
+}
+
+func (s *MemorySessionStore) PutSubscription(clientId string, sub TopicQos) error {
+	s.update(clientId, func(session *Session) { session.Subscriptions[sub.Topic] = sub.Qos })
+	return nil
+}
+
+func (s *MemorySessionStore) DeleteSubscription(clientId string, filter string) error {
+	s.update(clientId, func(session *Session) { delete(session.Subscriptions, filter) })
+	return nil
+}
+
+func (s *MemorySessionStore) PutNextMessageId(clientId string, id uint16) error {
+	s.update(clientId, func(session *Session) { session.NextMessageId = id })
+	return nil
+}
+
+// update calls fn with the session of clientId, creating it if need be.
+func (s *MemorySessionStore) update(clientId string, fn func(*Session)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions == nil {
+		s.sessions = make(map[string]*Session)
+	}
+	session, ok := s.sessions[clientId]
+	if !ok {
+		session = newSession()
+		s.sessions[clientId] = session
+		debugGauge(&debugCounters.storedSessions, 1)
+	}
+	fn(session)
+}
+
+// copy returns a copy of the session that shares none of its maps.
+func (s *Session) copy() *Session {
+	c := newSession()
+	for id, msg := range s.Outbound {
+		c.Outbound[id] = copyMessage(msg)
+	}
+	for id := range s.Received {
+		c.Received[id] = true
+	}
+	for filter, qos := range s.Subscriptions {
+		c.Subscriptions[filter] = qos
+	}
+	c.NextMessageId = s.NextMessageId
+	return c
+}
+
+// sessionMessageId returns the message id of an outbound message that a
+// session can hold. ErrNotInFlight is returned for other messages.
+func sessionMessageId(msg Message) (uint16, error) {
+	switch msg := msg.(type) {
+	case *Publish:
+		if msg.QosLevel == QosAtLeastOnce || msg.QosLevel == QosExactlyOnce {
+			return msg.MessageId, nil
+		}
+	case *PubRel:
+		return msg.MessageId, nil
+	}
+	return 0, ErrNotInFlight
+}
+
+// copyMessage returns a shallow copy of a *Publish or *PubRel, so that the
+// copy's header can be changed (e.g to set DupFlag) without affecting msg.
+func copyMessage(msg Message) Message {
+	switch msg := msg.(type) {
+	case *Publish:
+		c := *msg
+		return &c
+	case *PubRel:
+		c := *msg
+		return &c
+	}
+	return msg
+}
@@ -0,0 +1,68 @@
+package mqtt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMemorySessionStore(t *testing.T) {
+	var store MemorySessionStore
+	if session, err := store.Get("c"); session != nil || err != nil {
+		t.Fatalf("Got %+v, %v before storing anything", session, err)
+	}
+
+	pub := &Publish{Header: Header{QosLevel: QosExactlyOnce}, TopicName: "a", MessageId: 1}
+	steps := []error{
+		store.PutMessage("c", pub),
+		store.PutMessage("c", &Publish{Header: Header{QosLevel: QosAtLeastOnce}, TopicName: "b", MessageId: 2}),
+		store.PutMessage("c", &PubRel{MessageId: 2}),
+		store.PutReceived("c", 7),
+		store.PutReceived("c", 8),
+		store.DeleteReceived("c", 8),
+		store.PutSubscription("c", TopicQos{Topic: "a/#", Qos: QosAtMostOnce}),
+		store.PutSubscription("c", TopicQos{Topic: "a/#", Qos: QosAtLeastOnce}),
+		store.PutSubscription("c", TopicQos{Topic: "b", Qos: QosAtLeastOnce}),
+		store.DeleteSubscription("c", "b"),
+		store.PutNextMessageId("c", 3),
+		store.PutNextMessageId("other", 9),
+	}
+	for i, err := range steps {
+		if err != nil {
+			t.Fatalf("Step %d: Unexpected error: %v", i, err)
+		}
+	}
+	if err := store.PutMessage("c", &Publish{TopicName: "qos0"}); err != ErrNotInFlight {
+		t.Errorf("Storing a QoS 0 PUBLISH: got %v, expected ErrNotInFlight", err)
+	}
+
+	expected := &Session{
+		Outbound:      map[uint16]Message{1: pub, 2: &PubRel{MessageId: 2}},
+		Received:      map[uint16]bool{7: true},
+		Subscriptions: map[string]QosLevel{"a/#": QosAtLeastOnce},
+		NextMessageId: 3,
+	}
+	session, err := store.Get("c")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(session, expected) {
+		t.Errorf("\n     got = %+v\nexpected = %+v", session, expected)
+	}
+
+	// The session returned is a copy.
+	session.Outbound[1].(*Publish).DupFlag = true
+	delete(session.Received, 7)
+	if again, _ := store.Get("c"); !reflect.DeepEqual(again, expected) {
+		t.Errorf("Changing a session changed the store: %+v", again)
+	}
+
+	if err := store.Delete("c"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if session, _ := store.Get("c"); session != nil {
+		t.Errorf("Got %+v after deleting", session)
+	}
+	if session, _ := store.Get("other"); session == nil || session.NextMessageId != 9 {
+		t.Errorf("Deleting one session changed another: %+v", session)
+	}
+}
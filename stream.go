@@ -0,0 +1,103 @@
+package mqtt
+
+import (
+	"bytes"
+)
+
+// StreamDecoder is a push-style decoder, for use where blocking io.Reader
+// semantics don't fit, such as event loops that receive data as it arrives
+// or transports that reassemble packets from several datagrams. Bytes are
+// accumulated across calls to Feed, and messages are decoded once all of
+// their bytes have arrived.
+type StreamDecoder struct {
+	// Config is passed to DecodeOneMessage for each complete packet. It may
+	// be nil.
+	Config DecoderConfig
+
+	buf []byte
+}
+
+// NewStreamDecoder creates a StreamDecoder using config.
+func NewStreamDecoder(config DecoderConfig) *StreamDecoder {
+	return &StreamDecoder{Config: config}
+}
+
+// Feed appends data to the bytes held by the decoder, and returns the
+// messages that are now complete, in the order in which they were received.
+// Bytes of an incomplete message are kept until the rest of it is fed.
+//
+// If a complete packet fails to decode, the messages before it are returned
+// along with the error. The bad packet is discarded, and bytes following it
+// are kept, so that the caller may continue by calling Feed again (with nil
+// data if there is nothing new). If the remaining length field of a packet
+// is malformed, the packet boundary cannot be found, so all held bytes are
+// discarded. The same goes for a packet over the limit of a
+// PacketSizeLimiter, which is refused as soon as its fixed header arrives
+// rather than being held until it is complete.
+func (d *StreamDecoder) Feed(data []byte) (msgs []Message, err error) {
+	d.buf = append(d.buf, data...)
+
+	var consumed int
+	defer func() {
+		// Keep the unconsumed bytes at the front of the buffer.
+		n := copy(d.buf, d.buf[consumed:])
+		d.buf = d.buf[:n]
+	}()
+
+	for {
+		var size int
+		if size, err = packetSize(d.buf[consumed:]); err != nil {
+			consumed = len(d.buf)
+			return
+		}
+		if size == 0 {
+			return
+		}
+		if err = checkPacketSize(d.Config, MessageType(d.buf[consumed]>>4), size); err != nil {
+			consumed = len(d.buf)
+			return
+		}
+		if len(d.buf)-consumed < size {
+			return
+		}
+
+		packet := d.buf[consumed : consumed+size]
+		consumed += size
+
+		var msg Message
+		if msg, err = DecodeOneMessage(bytes.NewReader(packet), d.Config); err != nil {
+			return
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+// Buffered returns the number of bytes held by the decoder that are not yet
+// part of a complete message.
+func (d *StreamDecoder) Buffered() int {
+	return len(d.buf)
+}
+
+// Reset discards all bytes held by the decoder.
+func (d *StreamDecoder) Reset() {
+	d.buf = d.buf[:0]
+}
+
+// packetSize returns the total size of the packet at the start of b,
+// including its fixed header, or 0 if b does not yet hold the whole fixed
+// header.
+func packetSize(b []byte) (int, error) {
+	var length int32
+	var shift uint
+	for i := 1; i <= 4; i++ {
+		if i >= len(b) {
+			return 0, nil
+		}
+		length |= int32(b[i]&0x7f) << shift
+		if b[i]&0x80 == 0 {
+			return 1 + i + int(length), nil
+		}
+		shift += 7
+	}
+	return 0, ErrBadLengthEncoding
+}
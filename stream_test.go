@@ -0,0 +1,88 @@
+package mqtt
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestStreamDecoder(t *testing.T) {
+	msgs := []Message{
+		&Publish{TopicName: "a/b", Payload: BytesPayload{1, 2, 3}},
+		&PubAck{MessageId: 0x1234},
+		&Publish{TopicName: "c", Payload: BytesPayload(bytes.Repeat([]byte{4}, 200))},
+		&PingReq{},
+	}
+	buf := new(bytes.Buffer)
+	for _, msg := range msgs {
+		if _, err := msg.Encode(buf); err != nil {
+			t.Fatalf("Unexpected error during encoding: %v", err)
+		}
+	}
+	data := buf.Bytes()
+
+	// Feed the same stream in chunks of every size.
+	for chunk := 1; chunk <= len(data); chunk++ {
+		d := NewStreamDecoder(nil)
+		var got []Message
+		for i := 0; i < len(data); i += chunk {
+			end := i + chunk
+			if end > len(data) {
+				end = len(data)
+			}
+			decoded, err := d.Feed(data[i:end])
+			if err != nil {
+				t.Fatalf("chunk=%d: Unexpected error: %v", chunk, err)
+			}
+			got = append(got, decoded...)
+		}
+		if !reflect.DeepEqual(msgs, got) {
+			t.Errorf("chunk=%d:\n     got = %#v\nexpected = %#v", chunk, got, msgs)
+		}
+		if d.Buffered() != 0 {
+			t.Errorf("chunk=%d: %d bytes left buffered", chunk, d.Buffered())
+		}
+	}
+}
+
+func TestStreamDecoderErrors(t *testing.T) {
+	d := NewStreamDecoder(nil)
+
+	// A bad return code in a complete CONNACK, followed by a partial PUBACK.
+	msgs, err := d.Feed([]byte{0x40, 0x02, 0x00, 0x01, 0x20, 0x02, 0x00, 0x09, 0x40, 0x02})
+	if err == nil {
+		t.Errorf("Expected error, but got nil.")
+	}
+	if expected := []Message{&PubAck{MessageId: 1}}; !reflect.DeepEqual(expected, msgs) {
+		t.Errorf("Got %#v", msgs)
+	}
+	if d.Buffered() != 2 {
+		t.Errorf("Expected partial PUBACK to be kept, got %d bytes", d.Buffered())
+	}
+
+	msgs, err = d.Feed([]byte{0x00, 0x02})
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	} else if expected := []Message{&PubAck{MessageId: 2}}; !reflect.DeepEqual(expected, msgs) {
+		t.Errorf("Got %#v", msgs)
+	}
+
+	// A malformed remaining length discards everything held.
+	if _, err = d.Feed([]byte{0x40, 0xff, 0xff, 0xff, 0xff, 0x01}); err == nil {
+		t.Errorf("Expected error, but got nil.")
+	}
+	if d.Buffered() != 0 {
+		t.Errorf("Expected buffer to be discarded, got %d bytes", d.Buffered())
+	}
+
+	// An oversized packet is refused from its fixed header alone.
+	d.Config = &PacketLimitConfig{MaxPacketSize: 100}
+	if _, err = d.Feed([]byte{0x30, 0xff, 0x01, 0x00}); err == nil {
+		t.Errorf("Expected error, but got nil.")
+	} else if _, ok := err.(*PacketTooLargeError); !ok {
+		t.Errorf("Expected *PacketTooLargeError, got %v", err)
+	}
+	if d.Buffered() != 0 {
+		t.Errorf("Expected buffer to be discarded, got %d bytes", d.Buffered())
+	}
+}
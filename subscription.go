@@ -0,0 +1,118 @@
+package mqtt
+
+import (
+	"strings"
+	"sync"
+)
+
+// SubscriptionTree stores subscribers by topic filter, and finds those
+// whose filters match a topic without scanning every filter. It is safe for
+// concurrent use, and Match calls can run concurrently with each other.
+// The zero value is an empty tree, ready to use.
+type SubscriptionTree struct {
+	mu   sync.RWMutex
+	root subscriptionNode
+}
+
+type subscriptionNode struct {
+	children    map[string]*subscriptionNode
+	subscribers []interface{}
+}
+
+// Insert adds subscriber under filter. subscriber must be comparable (with
+// ==) so that it can later be removed. An error is returned if filter is
+// not a valid topic filter.
+func (t *SubscriptionTree) Insert(filter string, subscriber interface{}) error {
+	if err := ValidateTopicFilter(filter); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	node := &t.root
+	for _, level := range strings.Split(filter, "/") {
+		child, ok := node.children[level]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[string]*subscriptionNode)
+			}
+			child = new(subscriptionNode)
+			node.children[level] = child
+		}
+		node = child
+	}
+	node.subscribers = append(node.subscribers, subscriber)
+	return nil
+}
+
+// Remove removes subscriber from under filter, and returns whether it was
+// there.
+func (t *SubscriptionTree) Remove(filter string, subscriber interface{}) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.root.remove(strings.Split(filter, "/"), subscriber)
+}
+
+func (n *subscriptionNode) remove(levels []string, subscriber interface{}) bool {
+	if len(levels) == 0 {
+		for i, s := range n.subscribers {
+			if s == subscriber {
+				n.subscribers = append(n.subscribers[:i], n.subscribers[i+1:]...)
+				return true
+			}
+		}
+		return false
+	}
+
+	child, ok := n.children[levels[0]]
+	if !ok || !child.remove(levels[1:], subscriber) {
+		return false
+	}
+	// Prune nodes that no longer lead to any subscribers.
+	if len(child.subscribers) == 0 && len(child.children) == 0 {
+		delete(n.children, levels[0])
+	}
+	return true
+}
+
+// Match returns the subscribers whose filters match topic, following the
+// rules of TopicFilter.Matches. A subscriber is returned once for each of
+// its matching filters.
+func (t *SubscriptionTree) Match(topic string) []interface{} {
+	if ValidateTopicName(topic) != nil {
+		return nil
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var matches []interface{}
+	levels := strings.Split(topic, "/")
+	t.root.match(levels, !strings.HasPrefix(topic, "$"), &matches)
+	return matches
+}
+
+// match adds the subscribers under n that match levels. wildcards is false
+// if wildcards cannot match the next level.
+func (n *subscriptionNode) match(levels []string, wildcards bool, matches *[]interface{}) {
+	if wildcards {
+		if child, ok := n.children["#"]; ok {
+			*matches = append(*matches, child.subscribers...)
+		}
+	}
+	if len(levels) == 0 {
+		*matches = append(*matches, n.subscribers...)
+		return
+	}
+
+	if child, ok := n.children[levels[0]]; ok {
+		child.match(levels[1:], true, matches)
+	}
+	if wildcards {
+		if child, ok := n.children["+"]; ok {
+			child.match(levels[1:], true, matches)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package mqtt
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestSubscriptionTree(t *testing.T) {
+	var tree SubscriptionTree
+	filters := map[string]string{
+		"exact":    "a/b/c",
+		"plus":     "a/+/c",
+		"hash":     "a/#",
+		"all":      "#",
+		"sys":      "$SYS/#",
+		"trailing": "a/b/+",
+	}
+	for sub, filter := range filters {
+		if err := tree.Insert(filter, sub); err != nil {
+			t.Fatalf("Unexpected error inserting %q: %v", filter, err)
+		}
+	}
+	if err := tree.Insert("a/#/b", "bad"); err == nil {
+		t.Errorf("Expected error inserting invalid filter, but got nil.")
+	}
+
+	tests := []struct {
+		Topic    string
+		Expected []string
+	}{
+		{"a/b/c", []string{"all", "exact", "hash", "plus", "trailing"}},
+		{"a", []string{"all", "hash"}},
+		{"a/x/c", []string{"all", "hash", "plus"}},
+		{"b", []string{"all"}},
+		{"$SYS/uptime", []string{"sys"}},
+		{"a/+", nil},
+	}
+	for _, test := range tests {
+		if got := matchNames(tree.Match(test.Topic)); !reflect.DeepEqual(test.Expected, got) {
+			t.Errorf("Match(%q) = %v, expected %v", test.Topic, got, test.Expected)
+		}
+		// The tree agrees with TopicMatches.
+		var expected []string
+		for sub, filter := range filters {
+			if TopicMatches(filter, test.Topic) {
+				expected = append(expected, sub)
+			}
+		}
+		sort.Strings(expected)
+		if got := matchNames(tree.Match(test.Topic)); !reflect.DeepEqual(expected, got) {
+			t.Errorf("Match(%q) = %v, but TopicMatches gives %v", test.Topic, got, expected)
+		}
+	}
+
+	if !tree.Remove("a/+/c", "plus") {
+		t.Errorf("Expected to remove subscriber")
+	}
+	if tree.Remove("a/+/c", "plus") {
+		t.Errorf("Removed subscriber twice")
+	}
+	if got := matchNames(tree.Match("a/x/c")); !reflect.DeepEqual([]string{"all", "hash"}, got) {
+		t.Errorf("After Remove, Match = %v", got)
+	}
+	if _, ok := tree.root.children["a"].children["+"]; ok {
+		t.Errorf("Empty node was not pruned")
+	}
+}
+
+func matchNames(matches []interface{}) []string {
+	var names []string
+	for _, m := range matches {
+		names = append(names, m.(string))
+	}
+	sort.Strings(names)
+	return names
+}
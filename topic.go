@@ -0,0 +1,64 @@
+package mqtt
+
+import (
+	"strings"
+)
+
+// TopicFilter is a topic filter that has been checked and split into its
+// levels, for matching against many topic names.
+type TopicFilter struct {
+	filter string
+	levels []string
+}
+
+// NewTopicFilter compiles filter. An error is returned if it is not a valid
+// topic filter.
+func NewTopicFilter(filter string) (*TopicFilter, error) {
+	if err := ValidateTopicFilter(filter); err != nil {
+		return nil, err
+	}
+	return &TopicFilter{filter, strings.Split(filter, "/")}, nil
+}
+
+// Matches returns true if topic matches the filter. "+" matches any single
+// level, and "#" matches any number of levels (including none) at the end
+// of the topic. Topics starting with "$" are not matched by a wildcard in
+// the first level, as they are reserved for server use (e.g "$SYS"). Topics
+// that are empty or contain wildcards never match.
+func (f *TopicFilter) Matches(topic string) bool {
+	if ValidateTopicName(topic) != nil {
+		return false
+	}
+	if strings.HasPrefix(topic, "$") && (f.levels[0] == "+" || f.levels[0] == "#") {
+		return false
+	}
+
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range f.levels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(topicLevels) == len(f.levels)
+}
+
+// String returns the filter as it was given to NewTopicFilter.
+func (f *TopicFilter) String() string {
+	return f.filter
+}
+
+// TopicMatches returns true if topic matches filter, as for
+// TopicFilter.Matches. It returns false if filter is not valid.
+func TopicMatches(filter, topic string) bool {
+	f, err := NewTopicFilter(filter)
+	if err != nil {
+		return false
+	}
+	return f.Matches(topic)
+}
@@ -0,0 +1,53 @@
+package mqtt
+
+import (
+	"testing"
+)
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		Filter, Topic string
+		Expected      bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/b", "a/b/c", false},
+		{"a/b/c", "a/b", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/", true},
+		{"a/+", "a", false},
+		{"a/+", "a/b/c", false},
+		{"+/+", "/b", true},
+		{"+", "/b", false},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"a/#", "b/c", false},
+		{"#", "a/b", true},
+		{"#", "/", true},
+		{"a/+/c/#", "a/b/c", true},
+		{"a/+/c/#", "a/b/d", false},
+		{"#", "$SYS/x", false},
+		{"+/x", "$SYS/x", false},
+		{"$SYS/#", "$SYS/x", true},
+		{"$SYS/+", "$SYS/x", true},
+		{"a/+", "a/+", false},
+		{"#", "", false},
+		{"a/b#", "a/b#", false},
+		{"a/#/c", "a/b/c", false},
+	}
+
+	for _, test := range tests {
+		if got := TopicMatches(test.Filter, test.Topic); got != test.Expected {
+			t.Errorf("TopicMatches(%q, %q) = %t, expected %t", test.Filter, test.Topic, got, test.Expected)
+		}
+	}
+
+	if _, err := NewTopicFilter("a/b+"); err == nil {
+		t.Errorf("Expected error compiling invalid filter, but got nil.")
+	}
+	if f, err := NewTopicFilter("a/+"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	} else if f.String() != "a/+" {
+		t.Errorf("String() = %q", f.String())
+	}
+}
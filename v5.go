@@ -0,0 +1,752 @@
+package mqtt
+
+import (
+	"bytes"
+	"io"
+)
+
+// ReasonCode is the result of an operation in MQTT v5, sent in acknowledgements,
+// DISCONNECT and AUTH. Values below 0x80 indicate success.
+type ReasonCode uint8
+
+const (
+	ReasonSuccess                     = ReasonCode(0x00)
+	ReasonNormalDisconnection         = ReasonCode(0x00)
+	ReasonGrantedQos0                 = ReasonCode(0x00)
+	ReasonGrantedQos1                 = ReasonCode(0x01)
+	ReasonGrantedQos2                 = ReasonCode(0x02)
+	ReasonDisconnectWithWill          = ReasonCode(0x04)
+	ReasonNoMatchingSubscribers       = ReasonCode(0x10)
+	ReasonNoSubscriptionExisted       = ReasonCode(0x11)
+	ReasonContinueAuthentication      = ReasonCode(0x18)
+	ReasonReauthenticate              = ReasonCode(0x19)
+	ReasonUnspecifiedError            = ReasonCode(0x80)
+	ReasonMalformedPacket             = ReasonCode(0x81)
+	ReasonProtocolError               = ReasonCode(0x82)
+	ReasonImplementationError         = ReasonCode(0x83)
+	ReasonUnsupportedProtocolVersion  = ReasonCode(0x84)
+	ReasonClientIdNotValid            = ReasonCode(0x85)
+	ReasonBadUsernameOrPassword       = ReasonCode(0x86)
+	ReasonNotAuthorized               = ReasonCode(0x87)
+	ReasonServerUnavailable           = ReasonCode(0x88)
+	ReasonServerBusy                  = ReasonCode(0x89)
+	ReasonBanned                      = ReasonCode(0x8A)
+	ReasonServerShuttingDown          = ReasonCode(0x8B)
+	ReasonBadAuthenticationMethod     = ReasonCode(0x8C)
+	ReasonKeepAliveTimeout            = ReasonCode(0x8D)
+	ReasonSessionTakenOver            = ReasonCode(0x8E)
+	ReasonTopicFilterInvalid          = ReasonCode(0x8F)
+	ReasonTopicNameInvalid            = ReasonCode(0x90)
+	ReasonPacketIdInUse               = ReasonCode(0x91)
+	ReasonPacketIdNotFound            = ReasonCode(0x92)
+	ReasonReceiveMaximumExceeded      = ReasonCode(0x93)
+	ReasonTopicAliasInvalid           = ReasonCode(0x94)
+	ReasonPacketTooLarge              = ReasonCode(0x95)
+	ReasonMessageRateTooHigh          = ReasonCode(0x96)
+	ReasonQuotaExceeded               = ReasonCode(0x97)
+	ReasonAdministrativeAction        = ReasonCode(0x98)
+	ReasonPayloadFormatInvalid        = ReasonCode(0x99)
+	ReasonRetainNotSupported          = ReasonCode(0x9A)
+	ReasonQosNotSupported             = ReasonCode(0x9B)
+	ReasonUseAnotherServer            = ReasonCode(0x9C)
+	ReasonServerMoved                 = ReasonCode(0x9D)
+	ReasonSharedSubsNotSupported      = ReasonCode(0x9E)
+	ReasonConnectionRateExceeded      = ReasonCode(0x9F)
+	ReasonMaximumConnectTime          = ReasonCode(0xA0)
+	ReasonSubscriptionIdsNotSupported = ReasonCode(0xA1)
+	ReasonWildcardSubsNotSupported    = ReasonCode(0xA2)
+)
+
+// IsError returns true if the ReasonCode indicates failure.
+func (rc ReasonCode) IsError() bool {
+	return rc >= 0x80
+}
+
+// PropertyId identifies an MQTT v5 property.
+type PropertyId uint8
+
+const (
+	PropPayloadFormat           = PropertyId(0x01)
+	PropMessageExpiry           = PropertyId(0x02)
+	PropContentType             = PropertyId(0x03)
+	PropResponseTopic           = PropertyId(0x08)
+	PropCorrelationData         = PropertyId(0x09)
+	PropSubscriptionId          = PropertyId(0x0B)
+	PropSessionExpiry           = PropertyId(0x11)
+	PropAssignedClientId        = PropertyId(0x12)
+	PropServerKeepAlive         = PropertyId(0x13)
+	PropAuthMethod              = PropertyId(0x15)
+	PropAuthData                = PropertyId(0x16)
+	PropRequestProblemInfo      = PropertyId(0x17)
+	PropWillDelay               = PropertyId(0x18)
+	PropRequestResponseInfo     = PropertyId(0x19)
+	PropResponseInfo            = PropertyId(0x1A)
+	PropServerReference         = PropertyId(0x1C)
+	PropReasonString            = PropertyId(0x1F)
+	PropReceiveMaximum          = PropertyId(0x21)
+	PropTopicAliasMaximum       = PropertyId(0x22)
+	PropTopicAlias              = PropertyId(0x23)
+	PropMaximumQos              = PropertyId(0x24)
+	PropRetainAvailable         = PropertyId(0x25)
+	PropUserProperty            = PropertyId(0x26)
+	PropMaximumPacketSize       = PropertyId(0x27)
+	PropWildcardSubAvailable    = PropertyId(0x28)
+	PropSubscriptionIdAvailable = PropertyId(0x29)
+	PropSharedSubAvailable      = PropertyId(0x2A)
+)
+
+// propertyType is the wire format of a property's value.
+type propertyType int
+
+const (
+	propByte = propertyType(iota)
+	propUint16
+	propUint32
+	propVarInt
+	propString
+	propBinary
+	propStringPair
+)
+
+var propertyTypes = map[PropertyId]propertyType{
+	PropPayloadFormat:           propByte,
+	PropMessageExpiry:           propUint32,
+	PropContentType:             propString,
+	PropResponseTopic:           propString,
+	PropCorrelationData:         propBinary,
+	PropSubscriptionId:          propVarInt,
+	PropSessionExpiry:           propUint32,
+	PropAssignedClientId:        propString,
+	PropServerKeepAlive:         propUint16,
+	PropAuthMethod:              propString,
+	PropAuthData:                propBinary,
+	PropRequestProblemInfo:      propByte,
+	PropWillDelay:               propUint32,
+	PropRequestResponseInfo:     propByte,
+	PropResponseInfo:            propString,
+	PropServerReference:         propString,
+	PropReasonString:            propString,
+	PropReceiveMaximum:          propUint16,
+	PropTopicAliasMaximum:       propUint16,
+	PropTopicAlias:              propUint16,
+	PropMaximumQos:              propByte,
+	PropRetainAvailable:         propByte,
+	PropUserProperty:            propStringPair,
+	PropMaximumPacketSize:       propUint32,
+	PropWildcardSubAvailable:    propByte,
+	PropSubscriptionIdAvailable: propByte,
+	PropSharedSubAvailable:      propByte,
+}
+
+// Property is a single MQTT v5 property. The type of Value depends on Id:
+// uint8, uint16 or uint32 for integer properties (uint32 for
+// PropSubscriptionId), string for strings, []byte for binary data, and
+// StringPair for PropUserProperty.
+type Property struct {
+	Id    PropertyId
+	Value interface{}
+}
+
+// StringPair is the value of a PropUserProperty.
+type StringPair struct {
+	Key, Value string
+}
+
+// Properties is a list of MQTT v5 properties, in the order in which they are
+// sent. Some properties (e.g PropUserProperty) may appear more than once.
+type Properties []Property
+
+// Get returns the value of the first property with the given id, and whether
+// there was one.
+func (props Properties) Get(id PropertyId) (interface{}, bool) {
+	for _, prop := range props {
+		if prop.Id == id {
+			return prop.Value, true
+		}
+	}
+	return nil, false
+}
+
+// UserProperties returns the values of all PropUserProperty properties.
+func (props Properties) UserProperties() []StringPair {
+	var pairs []StringPair
+	for _, prop := range props {
+		if pair, ok := prop.Value.(StringPair); ok && prop.Id == PropUserProperty {
+			pairs = append(pairs, pair)
+		}
+	}
+	return pairs
+}
+
+// Auth represents an MQTT v5 AUTH message.
+type Auth struct {
+	Header
+	ReasonCode ReasonCode
+	Properties Properties
+}
+
+func (msg *Auth) Encode(w io.Writer) (int, error) {
+	return encodeReasonOnly(w, &msg.Header, msg.ReasonCode, msg.Properties, MsgAuth)
+}
+
+func (msg *Auth) Decode(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) error {
+	msg.Header = hdr
+	return decodeReasonOnly(r, packetRemaining, &msg.ReasonCode, &msg.Properties)
+}
+
+// v5Encoder is implemented by messages whose MQTT v5 encoding differs from
+// that of earlier versions.
+type v5Encoder interface {
+	encodeV5(w io.Writer) (int, error)
+}
+
+// v5Decoder is implemented by messages whose MQTT v5 encoding differs from
+// that of earlier versions.
+type v5Decoder interface {
+	decodeV5(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) error
+}
+
+func (msg *Connect) encodeV5(w io.Writer) (n int, err error) {
+	defer func() {
+		err = recoverError(err, recover())
+	}()
+
+	if !msg.WillQos.IsValid() {
+		return 0, ErrBadWillQos
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	flags := boolToByte(msg.UsernameFlag) << 7
+	flags |= boolToByte(msg.PasswordFlag) << 6
+	flags |= boolToByte(msg.WillRetain) << 5
+	flags |= byte(msg.WillQos) << 3
+	flags |= boolToByte(msg.WillFlag) << 2
+	flags |= boolToByte(msg.CleanSession) << 1
+
+	setString(msg.ProtocolName, buf)
+	setUint8(msg.ProtocolVersion, buf)
+	buf.WriteByte(flags)
+	setUint16(msg.KeepAliveTimer, buf)
+	if err := setProperties(msg.Properties, buf); err != nil {
+		return 0, err
+	}
+	setStringOrBytes(msg.ClientId, msg.ClientIdBytes, buf)
+	if msg.WillFlag {
+		if err := setProperties(msg.WillProperties, buf); err != nil {
+			return 0, err
+		}
+		setString(msg.WillTopic, buf)
+		setString(msg.WillMessage, buf)
+	}
+	if msg.UsernameFlag {
+		setString(msg.Username, buf)
+	}
+	if msg.PasswordFlag {
+		setString(msg.Password, buf)
+	}
+
+	return writeMessage(w, MsgConnect, &msg.Header, buf, 0)
+}
+
+func (msg *ConnAck) encodeV5(w io.Writer) (int, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	setUint8(boolToByte(msg.SessionPresent), buf)
+	setUint8(uint8(msg.ReturnCode), buf)
+	if err := setProperties(msg.Properties, buf); err != nil {
+		return 0, err
+	}
+
+	return writeMessage(w, MsgConnAck, &msg.Header, buf, 0)
+}
+
+func (msg *ConnAck) decodeV5(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) (err error) {
+	defer func() {
+		err = recoverError(err, recover())
+	}()
+
+	msg.Header = hdr
+
+	flags := getUint8(r, &packetRemaining)
+	if flags&0xfe != 0 && isStrict(config) {
+		return ErrReservedBits
+	}
+	msg.SessionPresent = flags&0x01 > 0
+	msg.ReturnCode = ReturnCode(getUint8(r, &packetRemaining))
+	msg.Properties = getProperties(r, &packetRemaining)
+
+	if packetRemaining != 0 {
+		return ErrMessageTooLong
+	}
+
+	return nil
+}
+
+func (msg *Publish) encodeV5(w io.Writer) (n int, err error) {
+	defer func() {
+		err = recoverError(err, recover())
+		countEncode(MsgPublish, n, err)
+	}()
+
+	if err := checkEncodable(msg.Payload); err != nil {
+		return 0, err
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	setStringOrBytes(msg.TopicName, msg.TopicBytes, buf)
+	if msg.Header.QosLevel.HasId() {
+		setUint16(msg.MessageId, buf)
+	}
+	if err := setProperties(msg.Properties, buf); err != nil {
+		return 0, err
+	}
+
+	n, err = writeMessage(w, MsgPublish, &msg.Header, buf, int32(msg.Payload.Size()))
+	if err != nil {
+		return 0, err
+	}
+
+	p, err := msg.Payload.WritePayload(w)
+
+	return (n + p), err
+}
+
+func (msg *Publish) decodeV5(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) (err error) {
+	defer func() {
+		err = recoverError(err, recover())
+	}()
+
+	msg.Header = hdr
+
+	msg.TopicName, msg.TopicBytes = getStringOrBytes(r, &packetRemaining, config)
+	if msg.Header.QosLevel.HasId() {
+		msg.MessageId = getUint16(r, &packetRemaining)
+	}
+	msg.Properties = getProperties(r, &packetRemaining)
+
+	payloadReader := &io.LimitedReader{r, int64(packetRemaining)}
+
+	if msg.Payload, err = config.MakePayload(msg, payloadReader, int(packetRemaining)); err != nil {
+		return
+	}
+
+	return msg.Payload.ReadPayload(payloadReader)
+}
+
+func (msg *PubAck) encodeV5(w io.Writer) (int, error) {
+	return encodeAckV5(w, &msg.Header, msg.MessageId, msg.ReasonCode, msg.Properties, MsgPubAck)
+}
+
+func (msg *PubAck) decodeV5(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) error {
+	msg.Header = hdr
+	return decodeAckV5(r, packetRemaining, &msg.MessageId, &msg.ReasonCode, &msg.Properties)
+}
+
+func (msg *PubRec) encodeV5(w io.Writer) (int, error) {
+	return encodeAckV5(w, &msg.Header, msg.MessageId, msg.ReasonCode, msg.Properties, MsgPubRec)
+}
+
+func (msg *PubRec) decodeV5(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) error {
+	msg.Header = hdr
+	return decodeAckV5(r, packetRemaining, &msg.MessageId, &msg.ReasonCode, &msg.Properties)
+}
+
+func (msg *PubRel) encodeV5(w io.Writer) (int, error) {
+	return encodeAckV5(w, &msg.Header, msg.MessageId, msg.ReasonCode, msg.Properties, MsgPubRel)
+}
+
+func (msg *PubRel) decodeV5(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) error {
+	msg.Header = hdr
+	return decodeAckV5(r, packetRemaining, &msg.MessageId, &msg.ReasonCode, &msg.Properties)
+}
+
+func (msg *PubComp) encodeV5(w io.Writer) (int, error) {
+	return encodeAckV5(w, &msg.Header, msg.MessageId, msg.ReasonCode, msg.Properties, MsgPubComp)
+}
+
+func (msg *PubComp) decodeV5(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) error {
+	msg.Header = hdr
+	return decodeAckV5(r, packetRemaining, &msg.MessageId, &msg.ReasonCode, &msg.Properties)
+}
+
+func (msg *Subscribe) encodeV5(w io.Writer) (n int, err error) {
+	defer func() {
+		err = recoverError(err, recover())
+	}()
+
+	if len(msg.Topics) == 0 {
+		return 0, ErrNoTopics
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if msg.Header.QosLevel.HasId() {
+		setUint16(msg.MessageId, buf)
+	}
+	if err := setProperties(msg.Properties, buf); err != nil {
+		return 0, err
+	}
+	for _, topicSub := range msg.Topics {
+		options := byte(topicSub.Qos)
+		options |= boolToByte(topicSub.NoLocal) << 2
+		options |= boolToByte(topicSub.RetainAsPublished) << 3
+		options |= (topicSub.RetainHandling & 0x03) << 4
+		setString(topicSub.Topic, buf)
+		setUint8(options, buf)
+	}
+
+	return writeMessage(w, MsgSubscribe, &msg.Header, buf, 0)
+}
+
+func (msg *Subscribe) decodeV5(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) (err error) {
+	defer func() {
+		err = recoverError(err, recover())
+	}()
+
+	msg.Header = hdr
+
+	if msg.Header.QosLevel.HasId() {
+		msg.MessageId = getUint16(r, &packetRemaining)
+	}
+	msg.Properties = getProperties(r, &packetRemaining)
+	var topics []TopicQos
+	for packetRemaining > 0 {
+		topic := getString(r, &packetRemaining)
+		options := getUint8(r, &packetRemaining)
+		if options&0xc0 != 0 && isStrict(config) {
+			return ErrReservedBits
+		}
+		topics = append(topics, TopicQos{
+			Topic:             topic,
+			Qos:               QosLevel(options & 0x03),
+			NoLocal:           options&0x04 > 0,
+			RetainAsPublished: options&0x08 > 0,
+			RetainHandling:    options & 0x30 >> 4,
+		})
+	}
+	msg.Topics = topics
+
+	return nil
+}
+
+func (msg *SubAck) encodeV5(w io.Writer) (int, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	setUint16(msg.MessageId, buf)
+	if err := setProperties(msg.Properties, buf); err != nil {
+		return 0, err
+	}
+	for _, qos := range msg.TopicsQos {
+		setUint8(uint8(qos), buf)
+	}
+
+	return writeMessage(w, MsgSubAck, &msg.Header, buf, 0)
+}
+
+func (msg *SubAck) decodeV5(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) (err error) {
+	defer func() {
+		err = recoverError(err, recover())
+	}()
+
+	msg.Header = hdr
+
+	msg.MessageId = getUint16(r, &packetRemaining)
+	msg.Properties = getProperties(r, &packetRemaining)
+	topicsQos := make([]QosLevel, 0)
+	for packetRemaining > 0 {
+		topicsQos = append(topicsQos, QosLevel(getUint8(r, &packetRemaining)))
+	}
+	msg.TopicsQos = topicsQos
+
+	return nil
+}
+
+func (msg *Unsubscribe) encodeV5(w io.Writer) (n int, err error) {
+	defer func() {
+		err = recoverError(err, recover())
+	}()
+
+	if len(msg.Topics) == 0 {
+		return 0, ErrNoTopics
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if msg.Header.QosLevel.HasId() {
+		setUint16(msg.MessageId, buf)
+	}
+	if err := setProperties(msg.Properties, buf); err != nil {
+		return 0, err
+	}
+	for _, topic := range msg.Topics {
+		setString(topic, buf)
+	}
+
+	return writeMessage(w, MsgUnsubscribe, &msg.Header, buf, 0)
+}
+
+func (msg *Unsubscribe) decodeV5(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) (err error) {
+	defer func() {
+		err = recoverError(err, recover())
+	}()
+
+	msg.Header = hdr
+
+	if msg.Header.QosLevel.HasId() {
+		msg.MessageId = getUint16(r, &packetRemaining)
+	}
+	msg.Properties = getProperties(r, &packetRemaining)
+	topics := make([]string, 0)
+	for packetRemaining > 0 {
+		topics = append(topics, getString(r, &packetRemaining))
+	}
+	msg.Topics = topics
+
+	return nil
+}
+
+func (msg *UnsubAck) encodeV5(w io.Writer) (int, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	setUint16(msg.MessageId, buf)
+	if err := setProperties(msg.Properties, buf); err != nil {
+		return 0, err
+	}
+	for _, code := range msg.ReasonCodes {
+		setUint8(uint8(code), buf)
+	}
+
+	return writeMessage(w, MsgUnsubAck, &msg.Header, buf, 0)
+}
+
+func (msg *UnsubAck) decodeV5(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) (err error) {
+	defer func() {
+		err = recoverError(err, recover())
+	}()
+
+	msg.Header = hdr
+
+	msg.MessageId = getUint16(r, &packetRemaining)
+	msg.Properties = getProperties(r, &packetRemaining)
+	codes := make([]ReasonCode, 0)
+	for packetRemaining > 0 {
+		codes = append(codes, ReasonCode(getUint8(r, &packetRemaining)))
+	}
+	msg.ReasonCodes = codes
+
+	return nil
+}
+
+func (msg *Disconnect) encodeV5(w io.Writer) (int, error) {
+	return encodeReasonOnly(w, &msg.Header, msg.ReasonCode, msg.Properties, MsgDisconnect)
+}
+
+func (msg *Disconnect) decodeV5(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) error {
+	msg.Header = hdr
+	return decodeReasonOnly(r, packetRemaining, &msg.ReasonCode, &msg.Properties)
+}
+
+// encodeAckV5 encodes the MQTT v5 PUBACK, PUBREC, PUBREL and PUBCOMP
+// messages. The reason code and properties are left out when they have
+// their default values.
+func encodeAckV5(w io.Writer, hdr *Header, messageId uint16, code ReasonCode, props Properties, msgType MessageType) (int, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	setUint16(messageId, buf)
+	if code != ReasonSuccess || len(props) > 0 {
+		setUint8(uint8(code), buf)
+		if err := setProperties(props, buf); err != nil {
+			return 0, err
+		}
+	}
+	return writeMessage(w, msgType, hdr, buf, 0)
+}
+
+func decodeAckV5(r io.Reader, packetRemaining int32, messageId *uint16, code *ReasonCode, props *Properties) (err error) {
+	defer func() {
+		err = recoverError(err, recover())
+	}()
+
+	*messageId = getUint16(r, &packetRemaining)
+	*code = ReasonSuccess
+	*props = nil
+	if packetRemaining > 0 {
+		*code = ReasonCode(getUint8(r, &packetRemaining))
+	}
+	if packetRemaining > 0 {
+		*props = getProperties(r, &packetRemaining)
+	}
+
+	if packetRemaining != 0 {
+		return ErrMessageTooLong
+	}
+
+	return nil
+}
+
+// encodeReasonOnly encodes the MQTT v5 DISCONNECT and AUTH messages. The
+// reason code and properties are left out when they have their default
+// values.
+func encodeReasonOnly(w io.Writer, hdr *Header, code ReasonCode, props Properties, msgType MessageType) (int, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if code != ReasonSuccess || len(props) > 0 {
+		setUint8(uint8(code), buf)
+		if err := setProperties(props, buf); err != nil {
+			return 0, err
+		}
+	}
+	return writeMessage(w, msgType, hdr, buf, 0)
+}
+
+func decodeReasonOnly(r io.Reader, packetRemaining int32, code *ReasonCode, props *Properties) (err error) {
+	defer func() {
+		err = recoverError(err, recover())
+	}()
+
+	*code = ReasonSuccess
+	*props = nil
+	if packetRemaining > 0 {
+		*code = ReasonCode(getUint8(r, &packetRemaining))
+	}
+	if packetRemaining > 0 {
+		*props = getProperties(r, &packetRemaining)
+	}
+
+	if packetRemaining != 0 {
+		return ErrMessageTooLong
+	}
+
+	return nil
+}
+
+// setProperties writes props to buf, preceded by their length.
+func setProperties(props Properties, buf *bytes.Buffer) error {
+	propBuf := getBuffer()
+	defer putBuffer(propBuf)
+
+	for _, prop := range props {
+		typ, ok := propertyTypes[prop.Id]
+		if !ok {
+			return ErrBadProperty
+		}
+		encodeLength(int32(prop.Id), propBuf)
+
+		switch value := prop.Value.(type) {
+		case uint8:
+			if typ != propByte {
+				return ErrBadProperty
+			}
+			setUint8(value, propBuf)
+		case uint16:
+			if typ != propUint16 {
+				return ErrBadProperty
+			}
+			setUint16(value, propBuf)
+		case uint32:
+			switch typ {
+			case propUint32:
+				setUint16(uint16(value>>16), propBuf)
+				setUint16(uint16(value), propBuf)
+			case propVarInt:
+				if value > MaxRemainingLength {
+					return ErrBadProperty
+				}
+				encodeLength(int32(value), propBuf)
+			default:
+				return ErrBadProperty
+			}
+		case string:
+			if typ != propString || len(value) > 0xffff {
+				return ErrBadProperty
+			}
+			setString(value, propBuf)
+		case []byte:
+			if typ != propBinary || len(value) > 0xffff {
+				return ErrBadProperty
+			}
+			setUint16(uint16(len(value)), propBuf)
+			propBuf.Write(value)
+		case StringPair:
+			if typ != propStringPair || len(value.Key) > 0xffff || len(value.Value) > 0xffff {
+				return ErrBadProperty
+			}
+			setString(value.Key, propBuf)
+			setString(value.Value, propBuf)
+		default:
+			return ErrBadProperty
+		}
+	}
+
+	if propBuf.Len() > MaxRemainingLength {
+		return ErrMessageTooLong
+	}
+	encodeLength(int32(propBuf.Len()), buf)
+	buf.Write(propBuf.Bytes())
+	return nil
+}
+
+// getProperties reads a property length and the properties that follow it.
+func getProperties(r io.Reader, packetRemaining *int32) Properties {
+	length := getVarInt(r, packetRemaining)
+	if length > uint32(*packetRemaining) {
+		raiseError(ErrDataExceedsPacket)
+	}
+	propsRemaining := int32(length)
+	*packetRemaining -= propsRemaining
+
+	var props Properties
+	for propsRemaining > 0 {
+		id := PropertyId(getVarInt(r, &propsRemaining))
+		typ, ok := propertyTypes[id]
+		if !ok {
+			raiseError(ErrBadProperty)
+		}
+
+		var value interface{}
+		switch typ {
+		case propByte:
+			value = getUint8(r, &propsRemaining)
+		case propUint16:
+			value = getUint16(r, &propsRemaining)
+		case propUint32:
+			hi := getUint16(r, &propsRemaining)
+			lo := getUint16(r, &propsRemaining)
+			value = uint32(hi)<<16 | uint32(lo)
+		case propVarInt:
+			value = getVarInt(r, &propsRemaining)
+		case propString:
+			value = getString(r, &propsRemaining)
+		case propBinary:
+			value = []byte(getString(r, &propsRemaining))
+		case propStringPair:
+			key := getString(r, &propsRemaining)
+			value = StringPair{key, getString(r, &propsRemaining)}
+		}
+		props = append(props, Property{id, value})
+	}
+	return props
+}
+
+// getVarInt reads a value in the variable length encoding used for the
+// remaining length field.
+func getVarInt(r io.Reader, packetRemaining *int32) uint32 {
+	var v uint32
+	var shift uint
+	for i := 0; i < 4; i++ {
+		b := getUint8(r, packetRemaining)
+		v |= uint32(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return v
+		}
+		shift += 7
+	}
+
+	raiseError(ErrBadLengthEncoding)
+	panic("unreachable")
+}
@@ -0,0 +1,144 @@
+package mqtt
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestV5RoundTrip(t *testing.T) {
+	props := Properties{
+		{PropUserProperty, StringPair{"k", "v"}},
+		{PropReasonString, "why"},
+	}
+	msgs := []Message{
+		&Connect{
+			ProtocolName:    "MQTT",
+			ProtocolVersion: 5,
+			ClientId:        "c",
+			WillFlag:        true,
+			WillTopic:       "will",
+			WillMessage:     "bye",
+			PasswordFlag:    true,
+			Password:        "pwd",
+			Properties:      Properties{{PropSessionExpiry, uint32(3600)}, {PropReceiveMaximum, uint16(10)}},
+			WillProperties:  Properties{{PropWillDelay, uint32(5)}, {PropCorrelationData, []byte{1, 2}}},
+		},
+		&ConnAck{SessionPresent: true, ReturnCode: ReturnCode(ReasonBanned), Properties: props},
+		&Publish{
+			Header:     Header{QosLevel: QosAtLeastOnce},
+			TopicName:  "a/b",
+			MessageId:  7,
+			Payload:    BytesPayload{1, 2, 3},
+			Properties: Properties{{PropTopicAlias, uint16(1)}, {PropSubscriptionId, uint32(300)}},
+		},
+		&PubAck{MessageId: 1},
+		&PubRec{MessageId: 2, ReasonCode: ReasonNoMatchingSubscribers},
+		&PubRel{Header: Header{QosLevel: QosAtLeastOnce}, MessageId: 3, ReasonCode: ReasonPacketIdNotFound, Properties: props},
+		&PubComp{MessageId: 4, Properties: props},
+		&Subscribe{
+			Header:    Header{QosLevel: QosAtLeastOnce},
+			MessageId: 5,
+			Topics: []TopicQos{
+				{Topic: "a/#", Qos: QosExactlyOnce, NoLocal: true, RetainAsPublished: true, RetainHandling: 2},
+				{Topic: "b", Qos: QosAtMostOnce},
+			},
+			Properties: Properties{{PropSubscriptionId, uint32(1)}},
+		},
+		&SubAck{MessageId: 5, TopicsQos: []QosLevel{QosExactlyOnce, QosLevel(ReasonNotAuthorized)}, Properties: props},
+		&Unsubscribe{Header: Header{QosLevel: QosAtLeastOnce}, MessageId: 6, Topics: []string{"a/#"}, Properties: props},
+		&UnsubAck{MessageId: 6, ReasonCodes: []ReasonCode{ReasonNoSubscriptionExisted}},
+		&PingReq{},
+		&Disconnect{},
+		&Disconnect{ReasonCode: ReasonDisconnectWithWill, Properties: props},
+		&Auth{ReasonCode: ReasonContinueAuthentication, Properties: Properties{{PropAuthMethod, "SCRAM"}}},
+	}
+
+	codec, err := NewCodec(ProtocolV5, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error creating codec: %v", err)
+	}
+	for _, expected := range msgs {
+		buf := new(bytes.Buffer)
+		if _, err := codec.Encode(buf, expected); err != nil {
+			t.Errorf("%T: Unexpected error during encoding: %v", expected, err)
+			continue
+		}
+		if msg, err := codec.Decode(buf); err != nil {
+			t.Errorf("%T: Unexpected error during decoding: %v", expected, err)
+		} else if !reflect.DeepEqual(expected, msg) {
+			t.Errorf("%T:\n     got = %#v\nexpected = %#v", expected, msg, expected)
+		}
+	}
+}
+
+func TestV5Encoding(t *testing.T) {
+	codec := &Codec{Version: ProtocolV5}
+	tests := []struct {
+		Comment  string
+		Msg      Message
+		Expected []byte
+	}{
+		{
+			Comment:  "PUBACK with default reason code",
+			Msg:      &PubAck{MessageId: 0x1234},
+			Expected: []byte{0x40, 0x02, 0x12, 0x34},
+		},
+		{
+			Comment:  "PUBACK with reason code",
+			Msg:      &PubAck{MessageId: 0x1234, ReasonCode: ReasonQuotaExceeded},
+			Expected: []byte{0x40, 0x04, 0x12, 0x34, 0x97, 0x00},
+		},
+		{
+			Comment:  "CONNACK with property",
+			Msg:      &ConnAck{Properties: Properties{{PropTopicAliasMaximum, uint16(0x0102)}}},
+			Expected: []byte{0x20, 0x06, 0x00, 0x00, 0x03, 0x22, 0x01, 0x02},
+		},
+		{
+			Comment:  "DISCONNECT with reason code",
+			Msg:      &Disconnect{ReasonCode: ReasonServerShuttingDown},
+			Expected: []byte{0xe0, 0x02, 0x8b, 0x00},
+		},
+	}
+
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		if _, err := codec.Encode(buf, test.Msg); err != nil {
+			t.Errorf("%s: Unexpected error during encoding: %v", test.Comment, err)
+		} else if !bytes.Equal(test.Expected, buf.Bytes()) {
+			t.Errorf("%s: got % x, expected % x", test.Comment, buf.Bytes(), test.Expected)
+		}
+	}
+
+	badProps := []Properties{
+		{{PropertyId(0x7f), uint8(1)}},     // Unknown property.
+		{{PropTopicAlias, uint32(1)}},      // Wrong value type.
+		{{PropUserProperty, "not a pair"}}, // Wrong value type.
+	}
+	for _, props := range badProps {
+		if _, err := codec.Encode(new(bytes.Buffer), &ConnAck{Properties: props}); err == nil {
+			t.Errorf("%#v: Expected error, but got nil.", props)
+		}
+	}
+}
+
+func TestV5FieldsRefusedBeforeV5(t *testing.T) {
+	msgs := []Message{
+		&PubAck{MessageId: 1, ReasonCode: ReasonQuotaExceeded},
+		&Publish{TopicName: "a", Payload: BytesPayload{}, Properties: Properties{{PropContentType, "text/plain"}}},
+		&Subscribe{Header: Header{QosLevel: QosAtLeastOnce}, MessageId: 1, Topics: []TopicQos{{Topic: "a", NoLocal: true}}},
+		&Auth{},
+	}
+	codec := &Codec{Version: ProtocolV311}
+	for _, msg := range msgs {
+		if _, err := codec.Encode(new(bytes.Buffer), msg); err == nil {
+			t.Errorf("%#v: Expected error, but got nil.", msg)
+		}
+	}
+
+	// AUTH is a reserved message type before v5.
+	buf := bytes.NewBuffer([]byte{0xf0, 0x00})
+	if _, err := codec.Decode(buf); err == nil {
+		t.Errorf("Expected error decoding AUTH, but got nil.")
+	}
+}
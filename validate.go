@@ -0,0 +1,196 @@
+package mqtt
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf8"
+)
+
+// Validate checks msg against the rules of the protocol that are enforced
+// by strict encoding and decoding (see StrictConfig and Codec.Strict):
+//
+//   - fixed header flags must not use QoS 3, must not set DUP on a QoS 0
+//     PUBLISH, and must be 0010 for PUBREL, SUBSCRIBE and UNSUBSCRIBE
+//   - strings must be valid UTF-8, must not contain U+0000, and must fit in
+//     65535 bytes, as must a CONNECT's will message and password
+//   - topic names in PUBLISH and will topics must not contain wildcards
+//   - a PUBLISH must have a topic name, unless it has an MQTT v5 topic alias
+//   - SUBSCRIBE and UNSUBSCRIBE must have at least one valid topic filter,
+//     and SUBSCRIBE must not ask for QoS 3
+//   - a CONNECT must not use will QoS 3, nor set a will QoS without a will
+//   - a CONNECT with an empty client id must ask for a clean session
+//   - a CONNECT with a password must have a username (before MQTT v5)
+//
+// Rules that differ between protocol versions are checked by a strict
+// Codec.
+func Validate(msg Message) error {
+	if err := validateHeader(msg); err != nil {
+		return err
+	}
+
+	switch msg := msg.(type) {
+	case *Connect:
+		if err := validateStrings(msg.ProtocolName, msg.ClientId, msg.Username); err != nil {
+			return err
+		}
+		if err := validateByteString(msg.ClientIdBytes); err != nil {
+			return err
+		}
+		if msg.WillQos > QosExactlyOnce || (!msg.WillFlag && msg.WillQos != QosAtMostOnce) {
+			return ErrBadWillQos
+		}
+		// The will message and password are binary data, so only their
+		// lengths are checked.
+		if len(msg.WillMessage) > 0xffff || len(msg.Password) > 0xffff {
+			return ErrStringTooLong
+		}
+		if msg.ClientId == "" && len(msg.ClientIdBytes) == 0 && !msg.CleanSession {
+			return ErrBadClientId
+		}
+		if msg.WillFlag {
+			if err := validateStrings(msg.WillTopic); err != nil {
+				return err
+			}
+			if strings.ContainsAny(msg.WillTopic, "+#") {
+				return ErrWildcardTopic
+			}
+		}
+		// MQTT v5 allows a password without a username.
+		if msg.PasswordFlag && !msg.UsernameFlag && msg.ProtocolVersion != uint8(ProtocolV5) {
+			return ErrPasswordNoUser
+		}
+	case *Publish:
+		if msg.TopicName == "" && len(msg.TopicBytes) == 0 {
+			if _, ok := msg.Properties.Get(PropTopicAlias); !ok {
+				return ErrEmptyTopic
+			}
+			break
+		}
+		if msg.TopicName == "" {
+			if err := validateByteString(msg.TopicBytes); err != nil {
+				return err
+			}
+			if bytes.ContainsAny(msg.TopicBytes, "+#") {
+				return ErrWildcardTopic
+			}
+			break
+		}
+		if err := validateStrings(msg.TopicName); err != nil {
+			return err
+		}
+		if strings.ContainsAny(msg.TopicName, "+#") {
+			return ErrWildcardTopic
+		}
+	case *Subscribe:
+		if len(msg.Topics) == 0 {
+			return ErrNoTopics
+		}
+		for _, topic := range msg.Topics {
+			if err := ValidateTopicFilter(topic.Topic); err != nil {
+				return err
+			}
+			if topic.Qos > QosExactlyOnce {
+				return ErrBadQos
+			}
+		}
+	case *Unsubscribe:
+		if len(msg.Topics) == 0 {
+			return ErrNoTopics
+		}
+		for _, topic := range msg.Topics {
+			if err := ValidateTopicFilter(topic); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateHeader checks the fixed header flags of msg against the values
+// that the protocol allows for its type.
+func validateHeader(msg Message) error {
+	h, ok := msg.(interface {
+		header() *Header
+	})
+	if !ok {
+		return nil
+	}
+	hdr := h.header()
+
+	switch msg.(type) {
+	case *Publish:
+		if hdr.QosLevel > QosExactlyOnce {
+			return ErrBadQos
+		}
+		if hdr.QosLevel == QosAtMostOnce && hdr.DupFlag {
+			return ErrBadDupFlag
+		}
+	case *PubRel, *Subscribe, *Unsubscribe:
+		if hdr.DupFlag || hdr.Retain || hdr.QosLevel != QosAtLeastOnce {
+			return ErrReservedBits
+		}
+	}
+	return nil
+}
+
+// ValidateTopicName checks that topic can be published to: it must be a
+// valid string, not empty, and without wildcards.
+func ValidateTopicName(topic string) error {
+	if topic == "" {
+		return ErrEmptyTopic
+	}
+	if err := validateStrings(topic); err != nil {
+		return err
+	}
+	if strings.ContainsAny(topic, "+#") {
+		return ErrWildcardTopic
+	}
+	return nil
+}
+
+// ValidateTopicFilter checks that filter can be subscribed to: it must be a
+// valid string and not empty, wildcards must occupy a whole level, and "#"
+// may only be the last level.
+func ValidateTopicFilter(filter string) error {
+	if filter == "" {
+		return ErrEmptyTopic
+	}
+	if err := validateStrings(filter); err != nil {
+		return err
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.ContainsAny(level, "+#") && len(level) != 1 {
+			return ErrBadTopicFilter
+		}
+		if level == "#" && i != len(levels)-1 {
+			return ErrBadTopicFilter
+		}
+	}
+	return nil
+}
+
+// validateStrings checks that each string can be encoded as an MQTT string.
+func validateStrings(strs ...string) error {
+	for _, s := range strs {
+		if len(s) > 0xffff {
+			return ErrStringTooLong
+		}
+		if !utf8.ValidString(s) || strings.IndexByte(s, 0) >= 0 {
+			return ErrBadString
+		}
+	}
+	return nil
+}
+
+// validateByteString checks that b can be encoded as an MQTT string, as
+// validateStrings does for strings.
+func validateByteString(b ByteString) error {
+	if len(b) > 0xffff {
+		return ErrStringTooLong
+	}
+	if !utf8.Valid(b) || bytes.IndexByte(b, 0) >= 0 {
+		return ErrBadString
+	}
+	return nil
+}
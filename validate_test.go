@@ -0,0 +1,88 @@
+package mqtt
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		Comment     string
+		Msg         Message
+		ExpectError bool
+	}{
+		{"valid PUBLISH", &Publish{TopicName: "a/b"}, false},
+		{"PUBLISH with wildcard", &Publish{TopicName: "a/#"}, true},
+		{"PUBLISH with invalid UTF-8", &Publish{TopicName: "a/\xff"}, true},
+		{"PUBLISH with U+0000", &Publish{TopicName: "a/\x00"}, true},
+		{"PUBLISH with long topic", &Publish{TopicName: strings.Repeat("a", 0x10000)}, true},
+		{"PUBLISH with QoS 3", &Publish{Header: Header{QosLevel: 3}, TopicName: "a/b"}, true},
+		{"QoS 0 PUBLISH with DUP", &Publish{Header: Header{DupFlag: true}, TopicName: "a/b"}, true},
+		{"PUBLISH with empty topic", &Publish{}, true},
+		{"PUBLISH with empty topic bytes", &Publish{TopicBytes: ByteString{}}, true},
+		{"PUBLISH with topic alias", &Publish{Properties: Properties{{PropTopicAlias, uint16(1)}}}, false},
+		{"valid SUBSCRIBE", &Subscribe{Header: Header{QosLevel: QosAtLeastOnce}, Topics: []TopicQos{{Topic: "a/+/#"}}}, false},
+		{"SUBSCRIBE with QoS 0 header", &Subscribe{Topics: []TopicQos{{Topic: "a/+/#"}}}, true},
+		{"SUBSCRIBE asking for QoS 3", &Subscribe{Header: Header{QosLevel: QosAtLeastOnce}, Topics: []TopicQos{{Topic: "a", Qos: 3}}}, true},
+		{"SUBSCRIBE with bad filter", &Subscribe{Topics: []TopicQos{{Topic: "a/#/b"}}}, true},
+		{"SUBSCRIBE with empty filter", &Subscribe{Topics: []TopicQos{{Topic: ""}}}, true},
+		{"UNSUBSCRIBE with bad filter", &Unsubscribe{Topics: []string{"a+"}}, true},
+		{"CONNECT with empty client id", &Connect{CleanSession: true}, false},
+		{"CONNECT with empty client id, keeping session", &Connect{}, true},
+		{"CONNECT with U+0000 in username", &Connect{ClientId: "c", UsernameFlag: true, Username: "a\x00"}, true},
+		{"CONNECT with wildcard will topic", &Connect{ClientId: "c", WillFlag: true, WillTopic: "+"}, true},
+		{"CONNECT with will QoS 3", &Connect{ClientId: "c", WillFlag: true, WillTopic: "w", WillQos: 3}, true},
+		{"CONNECT with will QoS but no will", &Connect{ClientId: "c", WillQos: QosAtLeastOnce}, true},
+		{"CONNECT with long will message", &Connect{ClientId: "c", WillFlag: true, WillTopic: "w", WillMessage: strings.Repeat("a", 0x10000)}, true},
+		{"CONNECT with long password", &Connect{ClientId: "c", UsernameFlag: true, PasswordFlag: true, Password: strings.Repeat("a", 0x10000)}, true},
+	}
+
+	for _, test := range tests {
+		err := Validate(test.Msg)
+		if test.ExpectError && err == nil {
+			t.Errorf("%s: Expected error, but got nil.", test.Comment)
+		} else if !test.ExpectError && err != nil {
+			t.Errorf("%s: Unexpected error: %v", test.Comment, err)
+		}
+	}
+
+	if err := ValidateTopicName("a/\xc3\x28"); err == nil {
+		t.Errorf("Expected error for invalid UTF-8 topic name, but got nil.")
+	}
+	if err := ValidateTopicFilter("a/\x00"); err == nil {
+		t.Errorf("Expected error for topic filter with U+0000, but got nil.")
+	}
+}
+
+// A string too long for its length to be encoded is refused whether or not
+// the encoding is strict, rather than framed wrongly.
+func TestEncodeStringTooLong(t *testing.T) {
+	long := strings.Repeat("a", 0x10000)
+	tests := []struct {
+		Comment string
+		Msg     Message
+	}{
+		{"PUBLISH topic", &Publish{TopicName: long, Payload: BytesPayload{}}},
+		{"PUBLISH topic bytes", &Publish{TopicBytes: ByteString(long), Payload: BytesPayload{}}},
+		{"CONNECT password", &Connect{ClientId: "c", UsernameFlag: true, PasswordFlag: true, Password: long}},
+		{"CONNECT will message", &Connect{ClientId: "c", WillFlag: true, WillTopic: "w", WillMessage: long}},
+		{"SUBSCRIBE topic", &Subscribe{Header: Header{QosLevel: QosAtLeastOnce}, Topics: []TopicQos{{Topic: long}}}},
+		{"UNSUBSCRIBE topic", &Unsubscribe{Header: Header{QosLevel: QosAtLeastOnce}, Topics: []string{long}}},
+	}
+
+	for _, test := range tests {
+		if _, err := test.Msg.Encode(new(bytes.Buffer)); err != ErrStringTooLong {
+			t.Errorf("%s: Got %v, expected ErrStringTooLong", test.Comment, err)
+		}
+		if _, err := (&Codec{Version: ProtocolV5}).Encode(new(bytes.Buffer), test.Msg); err != ErrStringTooLong {
+			t.Errorf("%s: Got %v from a v5 Codec, expected ErrStringTooLong", test.Comment, err)
+		}
+		appender := test.Msg.(interface {
+			AppendTo(b []byte) ([]byte, error)
+		})
+		if b, err := appender.AppendTo([]byte{0xaa}); err != ErrStringTooLong || len(b) != 1 {
+			t.Errorf("%s: AppendTo appended %d bytes and returned %v, expected ErrStringTooLong", test.Comment, len(b)-1, err)
+		}
+	}
+}